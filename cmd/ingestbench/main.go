@@ -0,0 +1,138 @@
+// Command ingestbench compares writing readings to PostgreSQL one row per
+// statement, as the per-message consumer did, with the batched multi-row
+// inserts used by the ingestion worker.
+//
+// It uses the same configuration as the server (environment, .env or
+// CONFIG_FILE) and removes the rows it writes when it finishes:
+//
+//	go run ./cmd/ingestbench -readings 20000 -batch 100,500,1000
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/internal/database"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/repository"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func main() {
+	readings := flag.Int("readings", 10000, "readings to write per run")
+	devices := flag.Int("devices", 500, "distinct devices the readings are spread over")
+	batches := flag.String("batch", "100,500,1000", "comma-separated batch sizes to compare against single-row inserts")
+	migrations := flag.String("migrations", "./migrations", "migrations directory")
+	flag.Parse()
+
+	batchSizes, err := parseBatchSizes(*batches)
+	if err != nil {
+		fatal("Invalid -batch", err)
+	}
+
+	cfg, err := config.LoadArgs(nil)
+	if err != nil {
+		fatal("Failed to load config", err)
+	}
+
+	db, err := database.NewPostgresDB(cfg)
+	if err != nil {
+		fatal("Failed to connect to PostgreSQL", err)
+	}
+	defer db.Close()
+
+	if err := database.RunMigrations(db, *migrations); err != nil {
+		fatal("Failed to run migrations", err)
+	}
+
+	repo := repository.NewReadingRepository(db)
+	ctx := context.Background()
+	runID := uuid.NewString()[:8]
+	defer func() {
+		if _, err := db.ExecContext(ctx, `DELETE FROM device_readings WHERE message_id LIKE $1`, "bench-"+runID+"-%"); err != nil {
+			slog.Error("Failed to remove benchmark readings", "error", err)
+		}
+	}()
+
+	deviceIDs := make([]uuid.UUID, *devices)
+	for i := range deviceIDs {
+		deviceIDs[i] = uuid.New()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "mode\treadings\tseconds\treadings/s\tspeedup\t")
+
+	baseline := 0.0
+	for i, batchSize := range append([]int{1}, batchSizes...) {
+		data := generateReadings(fmt.Sprintf("bench-%s-%d", runID, i), *readings, deviceIDs)
+
+		elapsed, err := insertAll(ctx, repo, data, batchSize)
+		if err != nil {
+			fatal("Insert failed", err)
+		}
+
+		rate := float64(len(data)) / elapsed.Seconds()
+		mode := "single-row"
+		if batchSize > 1 {
+			mode = fmt.Sprintf("batch=%d", batchSize)
+		} else {
+			baseline = rate
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.2f\t%.0f\t%.1fx\t\n", mode, len(data), elapsed.Seconds(), rate, rate/baseline)
+	}
+	w.Flush()
+}
+
+func insertAll(ctx context.Context, repo repository.ReadingRepository, readings []*domain.DeviceReading, batchSize int) (time.Duration, error) {
+	start := time.Now()
+	for offset := 0; offset < len(readings); offset += batchSize {
+		end := min(offset+batchSize, len(readings))
+		if _, err := repo.InsertBatch(ctx, readings[offset:end]); err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start), nil
+}
+
+func generateReadings(prefix string, n int, deviceIDs []uuid.UUID) []*domain.DeviceReading {
+	now := time.Now()
+	readings := make([]*domain.DeviceReading, n)
+	for i := range readings {
+		count := i % 100
+		readings[i] = &domain.DeviceReading{
+			DeviceID:         deviceIDs[i%len(deviceIDs)],
+			MessageID:        prefix + "-" + strconv.Itoa(i),
+			CurrentWeight:    float64(count) * 0.5,
+			CurrentItemCount: count,
+			ItemWeight:       0.5,
+			ReadingAt:        now.Add(time.Duration(i) * time.Millisecond),
+			ReceivedAt:       now,
+		}
+	}
+	return readings
+}
+
+func parseBatchSizes(raw string) ([]int, error) {
+	var sizes []int
+	for _, part := range strings.Split(raw, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || size < 2 || size > repository.MaxReadingBatchSize {
+			return nil, fmt.Errorf("batch size %q must be between 2 and %d", part, repository.MaxReadingBatchSize)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"github.com/google/uuid"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,76 +15,177 @@ import (
 	"smat/iot/simulation/iot-inventory-management/internal/database"
 	"smat/iot/simulation/iot-inventory-management/internal/domain"
 	"smat/iot/simulation/iot-inventory-management/internal/handler"
+	"smat/iot/simulation/iot-inventory-management/internal/logger"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"smat/iot/simulation/iot-inventory-management/internal/middleware"
 	"smat/iot/simulation/iot-inventory-management/internal/repository"
 	"smat/iot/simulation/iot-inventory-management/internal/router"
 	"smat/iot/simulation/iot-inventory-management/internal/service"
+	"smat/iot/simulation/iot-inventory-management/internal/settings"
+	"smat/iot/simulation/iot-inventory-management/internal/spool"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
 	"sync"
 	"syscall"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func main() {
 	cfg, err := config.Load()
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
-		log.Fatal("Failed to load config:", err)
+		fatal("Failed to load config", err)
+	}
+
+	if err := logger.Setup(cfg.LogLevel, cfg.LogFormat); err != nil {
+		fatal("Failed to configure logging", err)
 	}
 
+	settingsStore := settings.NewStore(cfg, config.Load)
+	settingsStore.Subscribe(settings.SubscriberFunc(func(cfg *config.Config) {
+		if err := logger.SetLevel(cfg.LogLevel); err != nil {
+			slog.Error("Failed to change log level", "error", err)
+		}
+	}))
+
+	shutdownTracing, err := telemetry.InitTracing(context.Background(), cfg)
+	if err != nil {
+		fatal("Failed to initialize tracing", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("Failed to shut down tracing", "error", err)
+		}
+	}()
+
 	db, err := database.NewPostgresDB(cfg)
 	if err != nil {
-		log.Fatal("Failed to connect to PostgreSQL:", err)
+		fatal("Failed to connect to PostgreSQL", err)
 	}
 	defer db.Close()
 
+	metrics.RegisterDBStats(db)
+
 	if err = database.RunMigrations(db, "./migrations"); err != nil {
-		log.Fatal("Failed to run migrations:", err)
+		fatal("Failed to run migrations", err)
 	}
 
-	log.Println("Database initialized successfully")
+	slog.Info("Database initialized successfully")
 
 	redisClient, err := database.NewRedisClient(cfg)
 	if err != nil {
-		log.Fatal("Failed to connect to Redis:", err)
+		fatal("Failed to connect to Redis", err)
 	}
 	defer redisClient.Close()
 
 	deviceRepo := repository.NewDeviceRepository(db)
+	if cfg.CacheEnabled {
+		deviceRepo = repository.NewCachedDeviceRepository(deviceRepo, redisClient, cfg.CacheDeviceTTL, cfg.CacheClientDevicesTTL)
+	}
+	liveStateRepo := repository.NewLiveStateRepository(redisClient, cfg.LiveStateTTL)
+	presenceRepo := repository.NewPresenceRepository(redisClient)
+	readingRepo := repository.NewReadingRepository(db)
+	auditRepo := repository.NewAuditRepository(db)
+	auditService := service.NewAuditService(auditRepo)
 
 	wsHub := service.NewWebSocketHub()
+	settingsStore.Subscribe(wsHub)
 	go wsHub.Run()
 
-	rabbitMQ := service.NewRabbitMQService(cfg)
-	log.Println("Connecting to RabbitMQ at", cfg.RabbitMQURL)
-	if err := rabbitMQ.Connect(); err != nil {
-		log.Printf("Warning: Initial connection to RabbitMQ failed: %v", err)
-		log.Println("Application will continue and retry connecting to RabbitMQ in the background")
+	var outbox *spool.Spool
+	var bus service.MessageBus
+	switch cfg.MessageBus {
+	case config.MessageBusMemory:
+		slog.Warn("Using the in-memory message bus; queued messages are lost on restart")
+		bus = service.NewMemoryBus(cfg)
+	case config.MessageBusNATS:
+		bus = service.NewNATSBus(cfg)
+	case config.MessageBusRedis:
+		bus = service.NewRedisStreamBus(cfg, redisClient)
+	default:
+		if cfg.SpoolEnabled {
+			outbox, err = spool.Open(spool.Options{
+				Dir:           cfg.SpoolDir,
+				SegmentBytes:  int64(cfg.SpoolSegmentSizeMB) << 20,
+				MaxBytes:      int64(cfg.SpoolMaxSizeMB) << 20,
+				Fsync:         cfg.SpoolFsync,
+				FsyncInterval: cfg.SpoolFsyncInterval,
+			})
+			if err != nil {
+				fatal("Failed to open message spool", err)
+			}
+			defer outbox.Close()
+			if pending := outbox.Pending(); pending > 0 {
+				slog.Info("Found spooled messages from a previous run", "pending", pending)
+			}
+		}
+		bus = service.NewRabbitMQService(cfg, outbox)
+	}
+	settingsStore.Subscribe(bus)
+	slog.Info("Connecting to the message bus", "bus", cfg.MessageBus)
+	if err := bus.Connect(); err != nil {
+		slog.Warn("Initial connection to the message bus failed, retrying in the background", "error", err)
 		// Start a goroutine to keep trying to connect in the background
 		go func() {
 			for {
 				time.Sleep(10 * time.Second)
-				if err := rabbitMQ.Connect(); err == nil {
-					log.Println("Successfully connected to RabbitMQ in background")
+				if err := bus.Connect(); err == nil {
+					slog.Info("Successfully connected to the message bus in background")
 					break
 				} else {
-					log.Printf("Background connection attempt to RabbitMQ failed: %v", err)
+					slog.Warn("Background connection attempt to the message bus failed", "error", err)
 				}
 			}
 		}()
 	} else {
-		log.Println("Successfully connected to RabbitMQ")
+		slog.Info("Successfully connected to the message bus")
 	}
-	defer rabbitMQ.Close()
+	defer bus.Close()
+
+	alertService := service.NewAlertService(wsHub, bus)
+	settingsStore.Subscribe(alertService)
 
-	deviceService := service.NewDeviceService(deviceRepo)
-	mqttService := service.NewMQTTService(cfg, rabbitMQ)
-	simulationService := service.NewSimulationService(deviceRepo)
+	presenceService := service.NewPresenceService(presenceRepo, deviceRepo, wsHub, alertService, cfg.PresenceTimeout)
+	commandService := service.NewCommandService(repository.NewCommandRepository(db), deviceRepo, auditService, cfg.CommandTimeout)
+	twinService := service.NewTwinService(repository.NewTwinRepository(db), deviceRepo, auditService)
+
+	deviceService := service.NewDeviceService(deviceRepo, auditService)
+	credentialService := service.NewDeviceCredentialService(repository.NewDeviceCredentialRepository(db), deviceRepo, auditService)
+	provisioningService := service.NewProvisioningService(repository.NewDeviceClaimRepository(db), repository.NewPendingDeviceRepository(db), deviceService, deviceRepo, credentialService, auditService)
+	var mqttService service.MQTTService
+	if cfg.MQTTVersion == config.MQTTVersion5 {
+		mqttService = service.NewMQTTV5Service(cfg, bus, deviceRepo, presenceService, commandService, twinService, provisioningService)
+	} else {
+		mqttService = service.NewMQTTService(cfg, bus, deviceRepo, presenceService, commandService, twinService, provisioningService)
+	}
+	commandService.SetPublisher(mqttService)
+	twinService.SetPublisher(mqttService)
+	provisioningService.SetPublisher(mqttService)
+	simulationService := service.NewSimulationService(deviceRepo, auditService)
+	liveStateService := service.NewLiveStateService(liveStateRepo, deviceRepo, cfg.LiveStateFlushBatch)
+	settingsStore.Subscribe(simulationService)
+
+	if cfg.MQTTBrokerEmbedded {
+		broker := service.NewMQTTBroker(cfg, credentialService)
+		if err := broker.Start(); err != nil {
+			fatal("Failed to start embedded MQTT broker", err)
+		}
+		defer broker.Close()
+	}
 
 	if err := mqttService.Connect(); err != nil {
-		log.Fatal("Failed to connect to MQTT:", err)
+		fatal("Failed to connect to MQTT", err)
 	}
 	defer mqttService.Disconnect()
 
-	if err := mqttService.Subscribe(cfg.MQTTTopic); err != nil {
-		log.Fatal("Failed to subscribe to MQTT topic:", err)
+	for _, topic := range cfg.MQTTSubscriptions() {
+		if err := mqttService.Subscribe(topic); err != nil {
+			fatal("Failed to subscribe to MQTT topic", err)
+		}
 	}
 
 	// Start consuming messages with better error handling
@@ -89,24 +193,109 @@ func main() {
 	defer cancel()
 
 	var wg sync.WaitGroup
+	ingestionService := service.NewIngestionService(readingRepo, cfg.IngestionBatchSize, cfg.IngestionFlushInterval)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ingestionService.Run(ctx)
+	}()
+
+	consumer := &queueConsumer{
+		system:    cfg.MessageBus,
+		wsHub:     wsHub,
+		alerts:    alertService,
+		liveState: liveStateService,
+		presence:  presenceService,
+		ingestion: ingestionService,
+	}
+	consumerPool := service.NewConsumerPool(cfg.ConsumerWorkers, cfg.RabbitMQPrefetch/cfg.ConsumerWorkers+1, consumer.handle)
+	consumerPool.Start(ctx)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		consumeMessages(ctx, bus, consumerPool)
+		consumerPool.Wait()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		liveStateService.RunFlusher(ctx, cfg.LiveStateFlushInterval)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		presenceService.RunSweeper(ctx, cfg.PresenceSweepInterval)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		commandService.RunExpirer(ctx, cfg.CommandSweepInterval)
+	}()
+
+	// Retained desired twin state does not survive a broker restart without
+	// persistence, such as the embedded broker's, so publish it again.
+	if cfg.MQTTEnabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			published, err := twinService.PublishAll(ctx)
+			if err != nil {
+				slog.Warn("Failed to publish desired device twins", "published", published, "error", err)
+			} else if published > 0 {
+				slog.Info("Published desired device twins", "devices", published)
+			}
+		}()
+	}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		consumeRabbitMQMessages(ctx, rabbitMQ, wsHub)
+		settingsStore.Watch(ctx)
 	}()
 
 	ctx = context.Background()
 	if err := deviceService.InitializeDevices(ctx); err != nil {
-		log.Printf("Warning: Failed to initialize devices: %v", err)
+		slog.Warn("Failed to initialize devices", "error", err)
 	}
 
-	deviceHandler := handler.NewDeviceHandler(deviceService)
+	deviceHandler := handler.NewDeviceHandler(deviceService, liveStateService)
+	credentialHandler := handler.NewDeviceCredentialHandler(credentialService)
+	commandHandler := handler.NewCommandHandler(commandService)
+	twinHandler := handler.NewTwinHandler(twinService)
+	provisioningHandler := handler.NewProvisioningHandler(provisioningService)
 	wsHandler := handler.NewWebSocketHandler(wsHub)
-	healthHandler := handler.NewHealthHandler(rabbitMQ)
+	healthChecks := []service.DependencyCheck{
+		service.NewPostgresCheck(db),
+		service.NewRedisCheck(redisClient),
+		service.NewMessageBusCheck(cfg.MessageBus, bus),
+	}
+	if cfg.MQTTEnabled {
+		healthChecks = append(healthChecks, service.NewMQTTCheck(mqttService))
+	}
+	if outbox != nil {
+		healthChecks = append(healthChecks, service.NewSpoolCheck(outbox))
+	}
+	healthService := service.NewHealthService(
+		cfg.HealthCheckTimeout,
+		cfg.HealthCacheTTL,
+		func(ctx context.Context) (int64, error) { return database.MigrationVersion(ctx, db) },
+		healthChecks...,
+	)
+
+	healthHandler := handler.NewHealthHandler(healthService, bus)
 	simulationHandler := handler.NewSimulationHandler(mqttService, deviceService, simulationService)
-	uiHandler := handler.NewUIHandler(deviceService)
+	uiHandler := handler.NewUIHandler(deviceService, auditService, liveStateService, provisioningService)
+	auditHandler := handler.NewAuditHandler(auditService)
+	adminHandler := handler.NewAdminHandler(settingsStore)
+	deadLetterHandler := handler.NewDeadLetterHandler(bus)
 
-	r := router.SetupRouter(deviceHandler, wsHandler, healthHandler, simulationHandler, uiHandler)
+	rateLimiter := middleware.NewRateLimiter()
+	settingsStore.Subscribe(rateLimiter)
+
+	r := router.SetupRouter(deviceHandler, credentialHandler, commandHandler, twinHandler, provisioningHandler, wsHandler, healthHandler, simulationHandler, uiHandler, auditHandler, adminHandler, deadLetterHandler, rateLimiter)
 
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%s", cfg.ServerPort),
@@ -118,23 +307,23 @@ func main() {
 
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatal("Failed to start server:", err)
+			fatal("Failed to start server", err)
 		}
 	}()
 
-	log.Printf("Server started on port %s", cfg.ServerPort)
+	slog.Info("Server started", "port", cfg.ServerPort)
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server")
 
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer shutdownCancel()
 
 	if err := srv.Shutdown(shutdownCtx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+		fatal("Server forced to shutdown", err)
 	}
 
 	cancel()
@@ -147,56 +336,123 @@ func main() {
 
 	select {
 	case <-done:
-		log.Println("All goroutines finished gracefully")
+		slog.Info("All goroutines finished gracefully")
 	case <-time.After(5 * time.Second):
-		log.Println("Timeout waiting for goroutines")
+		slog.Warn("Timeout waiting for goroutines")
 	}
 
-	log.Println("Server shutdown complete")
+	slog.Info("Server shutdown complete")
 }
 
-func consumeRabbitMQMessages(ctx context.Context, rabbitMQ service.RabbitMQService, wsHub *service.WebSocketHub) {
+// consumeMessages feeds deliveries into pool, subscribing again whenever the
+// delivery channel closes (e.g. after a reconnect).
+func consumeMessages(ctx context.Context, bus service.MessageBus, pool *service.ConsumerPool) {
 	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Stopping RabbitMQ consumer")
-			return
-		default:
-			messages, err := rabbitMQ.ConsumeMessages()
-			if err != nil {
-				log.Printf("Failed to start consuming messages: %v", err)
-
-				if healthErr := rabbitMQ.HealthCheck(); healthErr != nil {
-					log.Printf("RabbitMQ unhealthy: %v, retrying in 5 seconds", healthErr)
-					time.Sleep(5 * time.Second)
-					continue
-				}
+		messages, err := bus.Subscribe()
+		if err != nil {
+			slog.Warn("Failed to start consuming messages, retrying in 5 seconds", "error", err)
+			select {
+			case <-ctx.Done():
+				slog.Info("Stopping message consumer")
+				return
+			case <-time.After(5 * time.Second):
+				continue
 			}
+		}
 
-			log.Println("Started consuming messages from RabbitMQ")
-
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case msg, ok := <-messages:
-					if !ok {
-						log.Println("Message channel closed, reconnecting...")
-						break
-					}
-
-					var deviceMsg domain.DeviceMessage
-					if err := json.Unmarshal(msg, &deviceMsg); err != nil {
-						log.Printf("Failed to unmarshal message: %v", err)
-						continue
-					}
-
-					// Broadcast to websocket client
-					log.Printf("Broadcasting message to websocket clients: %v", deviceMsg)
-					log.Println("message: ", string(msg))
-					wsHub.Broadcast(msg)
+		slog.Info("Started consuming messages from the message bus")
+
+	deliveries:
+		for {
+			select {
+			case <-ctx.Done():
+				slog.Info("Stopping message consumer")
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					slog.Warn("Message channel closed, reconnecting")
+					break deliveries
 				}
+				pool.Dispatch(ctx, msg)
 			}
 		}
 	}
 }
+
+// queueConsumer processes device messages consumed from the message bus. Messages
+// that can never be processed are dead-lettered; valid readings are handed to
+// the ingestion worker, which acks them after their batch commits.
+type queueConsumer struct {
+	// system names the message bus in traces.
+	system    string
+	wsHub     *service.WebSocketHub
+	alerts    service.AlertService
+	liveState service.LiveStateService
+	presence  service.PresenceService
+	ingestion service.IngestionService
+}
+
+func (c *queueConsumer) handle(ctx context.Context, msg service.QueueMessage) error {
+	ctx, span := telemetry.Tracer().Start(telemetry.Extract(ctx, msg.Headers), c.system+".consume",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("messaging.system", c.system)),
+	)
+	defer span.End()
+
+	var deviceMsg domain.DeviceMessage
+	if err := json.Unmarshal(msg.Body, &deviceMsg); err != nil {
+		slog.ErrorContext(ctx, "Failed to unmarshal message", "error", err)
+		slog.DebugContext(ctx, "Malformed message payload", "payload", string(msg.Body))
+		telemetry.RecordError(span, err)
+		return service.Permanent(domain.DeadLetterReasonMalformed, err)
+	}
+	span.SetAttributes(attribute.String("device.id", deviceMsg.DeviceID))
+	ctx = logger.With(ctx, "device_id", deviceMsg.DeviceID, "message_id", deviceMsg.MessageID)
+
+	deviceID, err := uuid.Parse(deviceMsg.DeviceID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Message has an invalid device ID", "error", err)
+		telemetry.RecordError(span, err)
+		return service.Permanent(domain.DeadLetterReasonInvalid, err)
+	}
+
+	if err := c.liveState.Record(ctx, &deviceMsg); err != nil {
+		slog.ErrorContext(ctx, "Failed to record live device state", "error", err)
+		telemetry.RecordError(span, err)
+	}
+	if err := c.presence.Seen(ctx, deviceID, deviceMsg.ClientID); err != nil {
+		slog.ErrorContext(ctx, "Failed to record device presence", "error", err)
+		telemetry.RecordError(span, err)
+	}
+
+	// Broadcast to websocket client
+	slog.DebugContext(ctx, "Broadcasting message to websocket clients", "payload", string(msg.Body))
+	c.wsHub.Broadcast(ctx, msg.Body)
+
+	c.alerts.Evaluate(ctx, &deviceMsg)
+
+	receivedAt := time.Now()
+	readingAt := deviceMsg.Timestamp
+	if readingAt.IsZero() {
+		readingAt = receivedAt
+	}
+	reading := &domain.DeviceReading{
+		DeviceID:         deviceID,
+		MessageID:        deviceMsg.MessageID,
+		CurrentWeight:    deviceMsg.CurrentWeight,
+		CurrentItemCount: deviceMsg.DerivedItemCount(),
+		ItemWeight:       deviceMsg.ItemWeight,
+		ReadingAt:        readingAt,
+		ReceivedAt:       receivedAt,
+	}
+	if err := c.ingestion.Submit(ctx, reading, msg); err != nil {
+		telemetry.RecordError(span, err)
+		return err
+	}
+	return service.ErrAckDeferred
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -1,14 +1,56 @@
 package config
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"github.com/joho/godotenv"
+	"math"
 	"os"
-	"strconv"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// maxIngestionBatchSize keeps a batch insert of readings (seven columns each)
+// under PostgreSQL's limit of 65535 bind parameters.
+const maxIngestionBatchSize = 65535 / 7
+
+// Message buses that can be selected with MESSAGE_BUS.
+const (
+	MessageBusRabbitMQ = "rabbitmq"
+	MessageBusMemory   = "memory"
+	MessageBusNATS     = "nats"
+	MessageBusRedis    = "redis"
+)
+
+// MQTT protocol versions that can be selected with MQTT_VERSION.
+const (
+	MQTTVersion311 = "3.1.1"
+	MQTTVersion5   = "5"
 )
 
+// MQTTBrokerProvisioningUsername is the user devices without a credential
+// log in to the embedded broker as, with MQTT_BROKER_PROVISIONING_PASSWORD.
+const MQTTBrokerProvisioningUsername = "provisioning"
+
+// QueueBinding is a queue declared on the RabbitMQ exchange and the routing
+// key patterns bound to it.
+type QueueBinding struct {
+	Queue    string
+	Patterns []string
+}
+
 type Config struct {
 	ServerPort string
 
+	LogLevel  string
+	LogFormat string
+
 	DBHost     string
 	DBPort     string
 	DBUser     string
@@ -21,63 +63,551 @@ type Config struct {
 	RedisPassword string
 	RedisDB       int
 
-	RabbitMQURL   string
-	RabbitMQQueue string
+	CacheEnabled          bool
+	CacheDeviceTTL        time.Duration
+	CacheClientDevicesTTL time.Duration
+
+	PresenceTimeout       time.Duration
+	PresenceSweepInterval time.Duration
+
+	CommandTimeout       time.Duration
+	CommandSweepInterval time.Duration
+
+	LiveStateTTL           time.Duration
+	LiveStateFlushInterval time.Duration
+	LiveStateFlushBatch    int
+
+	IngestionBatchSize     int
+	IngestionFlushInterval time.Duration
+
+	MessageBus        string
+	MemoryBusCapacity int
+
+	SpoolEnabled       bool
+	SpoolDir           string
+	SpoolMaxSizeMB     int
+	SpoolSegmentSizeMB int
+	SpoolFsync         string
+	SpoolFsyncInterval time.Duration
+
+	RabbitMQURL            string
+	RabbitMQExchange       string
+	RabbitMQQueue          string
+	RabbitMQBindings       []QueueBinding
+	RabbitMQPublishTimeout time.Duration
+	RabbitMQConfirmTimeout time.Duration
+	RabbitMQPublishRetries int
+	RabbitMQMaxDeliveries  int
+	RabbitMQPrefetch       int
+	ConsumerWorkers        int
+
+	RedisStreamPrefix        string
+	RedisStreamMaxLen        int
+	RedisStreamClaimIdle     time.Duration
+	RedisStreamClaimInterval time.Duration
+
+	NATSURL           string
+	NATSStream        string
+	NATSSubjectPrefix string
+	NATSAckWait       time.Duration
 
-	MQTTBroker     string
-	MQTTClientID   string
-	MQTTUsername   string
-	MQTTPassword   string
-	MQTTTopic      string
-	MQTTUseTLS     bool
-	MQTTCACertPath string
+	MQTTEnabled           bool
+	MQTTBroker            string
+	MQTTClientID          string
+	MQTTUniqueClientID    bool
+	MQTTUsername          string
+	MQTTPassword          string
+	MQTTTopic             string
+	MQTTStatusTopic       string
+	MQTTCommandAckTopic   string
+	MQTTTwinReportedTopic string
+	MQTTProvisioningTopic string
+	MQTTSharedGroup       string
+	MQTTUseTLS            bool
+	MQTTCACertPath        string
+
+	MQTTVersion           string
+	MQTTMessageExpiry     time.Duration
+	MQTTTopicAliasMaximum int
+
+	MQTTBrokerEmbedded       bool
+	MQTTBrokerListen         string
+	MQTTBrokerWSListen       string
+	MQTTBrokerAllowAnonymous bool
+	// MQTTBrokerProvisioningPassword lets devices without a credential log
+	// in as MQTTBrokerProvisioningUsername to publish their birth message.
+	MQTTBrokerProvisioningPassword string
 
 	SimulationDevicesPerClient int
 	SimulationClients          int
+	SimulationMaxItemsPerSale  int
+
+	LowStockThreshold int
+
+	RateLimitRPS   float64
+	RateLimitBurst int
+
+	WebSocketMaxClients int
+	WebSocketSendBuffer int
+
+	// ConfigFile is the config file the settings were loaded from, if any.
+	ConfigFile          string
+	ConfigWatchInterval time.Duration
+
+	HealthCheckTimeout time.Duration
+	HealthCacheTTL     time.Duration
+
+	TracingServiceName  string
+	TracingExporters    string
+	TracingOTLPEndpoint string
+	TracingOTLPInsecure bool
+	TracingSampleRatio  float64
+
+	// raw holds the effective string value of every setting.
+	raw map[string]string
 }
 
+// Load builds the configuration from, in increasing order of precedence:
+// built-in defaults, a YAML or TOML config file, environment variables (and
+// the .env file), and command-line flags.
+//
+// The config file is chosen with --config or CONFIG_FILE. Any setting can
+// also be read from a file by setting <KEY>_FILE, which is how secrets are
+// mounted in containers. All problems are reported together in one error.
 func Load() (*Config, error) {
+	return LoadArgs(os.Args[1:])
+}
+
+func LoadArgs(args []string) (*Config, error) {
 	_ = godotenv.Load()
 
-	redisDB, _ := strconv.Atoi(getEnv("REDIS_DB", ""))
-	devicesPerClient, _ := strconv.Atoi(getEnv("SIMULATION_DEVICES_PER_CLIENT", ""))
-	clients, _ := strconv.Atoi(getEnv("SIMULATION_CLIENTS", ""))
-	useTLS, _ := strconv.ParseBool(getEnv("MQTT_USE_TLS", ""))
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	flagValues := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flagValues[s.Key] = fs.String(s.flagName(), "", fmt.Sprintf("%s (env %s)", s.Usage, s.Key))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(settings))
+	for _, s := range settings {
+		values[s.Key] = s.Default
+	}
+
+	var errs []error
+
+	if *configFile != "" {
+		fileValues, err := readConfigFile(*configFile)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		keys := make([]string, 0, len(fileValues))
+		for key := range fileValues {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if _, ok := settingsByKey[key]; !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown setting %q", *configFile, strings.ToLower(key)))
+				continue
+			}
+			values[key] = fileValues[key]
+		}
+	}
+
+	for _, s := range settings {
+		value, ok, err := lookupEnv(s.Key)
+		if err != nil {
+			errs = append(errs, err)
+		} else if ok {
+			values[s.Key] = value
+		}
+	}
 
-	return &Config{
-		ServerPort: getEnv("SERVER_PORT", ""),
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flagName() == f.Name {
+				values[s.Key] = *flagValues[s.Key]
+			}
+		}
+	})
+
+	cfg := &Config{ConfigFile: *configFile, raw: values}
+	for _, s := range settings {
+		value := values[s.Key]
+		if value == "" {
+			if s.Required {
+				errs = append(errs, fmt.Errorf("%s is required", s.Key))
+			}
+			continue
+		}
+		if err := s.apply(cfg, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.Key, err))
+		}
+	}
 
-		DBHost:     getEnv("DB_HOST", ""),
-		DBPort:     getEnv("DB_PORT", ""),
-		DBUser:     getEnv("DB_USER", ""),
-		DBPassword: getEnv("DB_PASSWORD", ""),
-		DBName:     getEnv("DB_NAME", ""),
-		DBSSLMode:  getEnv("DB_SSLMODE", ""),
+	errs = append(errs, cfg.validate()...)
 
-		RedisHost:     getEnv("REDIS_HOST", ""),
-		RedisPort:     getEnv("REDIS_PORT", ""),
-		RedisPassword: getEnv("REDIS_PASSWORD", ""),
-		RedisDB:       redisDB,
+	if len(errs) > 0 {
+		return nil, &ValidationError{Errors: errs}
+	}
 
-		RabbitMQURL:   getEnv("RABBITMQ_URL", ""),
-		RabbitMQQueue: getEnv("RABBITMQ_QUEUE", ""),
+	return cfg, nil
+}
 
-		MQTTBroker:     getEnv("MQTT_BROKER", ""),
-		MQTTClientID:   getEnv("MQTT_CLIENT_ID", ""),
-		MQTTUsername:   getEnv("MQTT_USERNAME", ""),
-		MQTTPassword:   getEnv("MQTT_PASSWORD", ""),
-		MQTTTopic:      getEnv("MQTT_TOPIC", ""),
-		MQTTUseTLS:     useTLS,
-		MQTTCACertPath: getEnv("MQTT_CA_CERT_PATH", ""),
+// ValidationError lists every invalid or missing setting found by Load.
+type ValidationError struct {
+	Errors []error
+}
 
-		SimulationDevicesPerClient: devicesPerClient,
-		SimulationClients:          clients,
-	}, nil
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	b.WriteString("invalid configuration:")
+	for _, err := range e.Errors {
+		b.WriteString("\n  - ")
+		b.WriteString(err.Error())
+	}
+	return b.String()
 }
 
-func getEnv(key, defaultValue string) string {
+func (e *ValidationError) Unwrap() []error {
+	return e.Errors
+}
+
+// lookupEnv returns the value of key, falling back to the contents of the
+// file named by key_FILE.
+func lookupEnv(key string) (string, bool, error) {
 	if value := os.Getenv(key); value != "" {
-		return value
+		return value, true, nil
+	}
+
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		return "", false, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %w", key, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// readConfigFile reads a YAML or TOML file into a map keyed like the
+// environment variables. Nested sections are flattened, so
+// `db: {host: x}` and `db_host: x` both set DB_HOST.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("config file %s: unsupported format, expected .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	flatten("", raw, values)
+	return values, nil
+}
+
+func flatten(prefix string, raw map[string]interface{}, out map[string]string) {
+	for key, value := range raw {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flatten(name, v, out)
+		case nil:
+			out[name] = ""
+		default:
+			out[name] = fmt.Sprint(v)
+		}
+	}
+}
+
+func (c *Config) validate() []error {
+	var errs []error
+
+	ports := []struct{ key, value string }{
+		{"SERVER_PORT", c.ServerPort},
+		{"DB_PORT", c.DBPort},
+		{"REDIS_PORT", c.RedisPort},
+	}
+	for _, port := range ports {
+		if port.value != "" {
+			if err := validatePort(port.value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", port.key, err))
+			}
+		}
+	}
+
+	if c.MQTTUseTLS && c.MQTTCACertPath == "" {
+		errs = append(errs, errors.New("MQTT_CA_CERT_PATH is required when MQTT_USE_TLS is true"))
+	}
+
+	if strings.ContainsAny(c.MQTTSharedGroup, "/+#") {
+		errs = append(errs, errors.New("MQTT_SHARED_GROUP must not contain /, + or #"))
+	}
+
+	for _, topic := range []string{c.MQTTTopic, c.MQTTStatusTopic, c.MQTTCommandAckTopic, c.MQTTTwinReportedTopic, c.MQTTProvisioningTopic} {
+		if strings.HasPrefix(topic, "$share/") {
+			errs = append(errs, errors.New("MQTT_TOPIC, MQTT_STATUS_TOPIC, MQTT_COMMAND_ACK_TOPIC, MQTT_TWIN_REPORTED_TOPIC and MQTT_PROVISIONING_TOPIC must not be shared subscriptions; set MQTT_SHARED_GROUP instead"))
+			break
+		}
+	}
+
+	if c.PresenceTimeout <= 0 || c.PresenceSweepInterval <= 0 {
+		errs = append(errs, errors.New("PRESENCE_TIMEOUT and PRESENCE_SWEEP_INTERVAL must be positive"))
+	}
+
+	if c.CommandTimeout <= 0 || c.CommandSweepInterval <= 0 {
+		errs = append(errs, errors.New("COMMAND_TIMEOUT and COMMAND_SWEEP_INTERVAL must be positive"))
+	}
+
+	if c.MQTTMessageExpiry < 0 {
+		errs = append(errs, errors.New("MQTT_MESSAGE_EXPIRY must not be negative"))
+	}
+
+	if c.MQTTTopicAliasMaximum < 0 || c.MQTTTopicAliasMaximum > math.MaxUint16 {
+		errs = append(errs, fmt.Errorf("MQTT_TOPIC_ALIAS_MAXIMUM must be between 0 and %d", math.MaxUint16))
+	}
+
+	if c.MQTTBrokerEmbedded {
+		if c.MQTTBrokerListen == "" {
+			errs = append(errs, errors.New("MQTT_BROKER_LISTEN is required when MQTT_BROKER_EMBEDDED is true"))
+		}
+		// The server authenticates to its own broker with MQTT_USERNAME and
+		// MQTT_PASSWORD, which grant access to every device's topics.
+		if c.MQTTEnabled && !c.MQTTBrokerAllowAnonymous && (c.MQTTUsername == "" || c.MQTTPassword == "") {
+			errs = append(errs, errors.New("MQTT_USERNAME and MQTT_PASSWORD are required with MQTT_BROKER_EMBEDDED unless MQTT_BROKER_ALLOW_ANONYMOUS is true"))
+		}
+		if c.MQTTBrokerProvisioningPassword != "" && c.MQTTUsername == MQTTBrokerProvisioningUsername {
+			errs = append(errs, fmt.Errorf("MQTT_USERNAME must not be %q, which devices use for provisioning", MQTTBrokerProvisioningUsername))
+		}
+	}
+
+	if c.RedisDB < 0 {
+		errs = append(errs, errors.New("REDIS_DB must not be negative"))
+	}
+
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		errs = append(errs, errors.New("OTEL_TRACES_SAMPLE_RATIO must be between 0 and 1"))
+	}
+
+	for _, exporter := range strings.Split(c.TracingExporters, ",") {
+		switch strings.TrimSpace(strings.ToLower(exporter)) {
+		case "", "none", "otlp", "stdout":
+		default:
+			errs = append(errs, fmt.Errorf("OTEL_TRACES_EXPORTER: unknown exporter %q", exporter))
+		}
+	}
+
+	if c.RateLimitRPS < 0 {
+		errs = append(errs, errors.New("RATE_LIMIT_RPS must not be negative"))
+	}
+
+	if c.LowStockThreshold < 0 {
+		errs = append(errs, errors.New("LOW_STOCK_THRESHOLD must not be negative"))
+	}
+
+	if c.CacheEnabled && (c.CacheDeviceTTL <= 0 || c.CacheClientDevicesTTL <= 0) {
+		errs = append(errs, errors.New("CACHE_DEVICE_TTL and CACHE_CLIENT_DEVICES_TTL must be positive when caching is enabled"))
+	}
+
+	if c.LiveStateFlushInterval <= 0 {
+		errs = append(errs, errors.New("LIVE_STATE_FLUSH_INTERVAL must be positive"))
+	} else if c.LiveStateTTL <= c.LiveStateFlushInterval {
+		errs = append(errs, errors.New("LIVE_STATE_TTL must be longer than LIVE_STATE_FLUSH_INTERVAL"))
+	}
+
+	if c.IngestionBatchSize > maxIngestionBatchSize {
+		errs = append(errs, fmt.Errorf("INGESTION_BATCH_SIZE must be at most %d", maxIngestionBatchSize))
+	}
+
+	if c.RabbitMQPrefetch < c.IngestionBatchSize {
+		errs = append(errs, errors.New("RABBITMQ_PREFETCH must be at least INGESTION_BATCH_SIZE, or batches can never fill"))
+	}
+
+	if c.IngestionFlushInterval <= 0 {
+		errs = append(errs, errors.New("INGESTION_FLUSH_INTERVAL must be positive"))
+	}
+
+	consumerBound := false
+	for _, binding := range c.RabbitMQBindings {
+		if binding.Queue == c.RabbitMQQueue {
+			consumerBound = true
+		}
+	}
+	if !consumerBound {
+		errs = append(errs, fmt.Errorf("RABBITMQ_BINDINGS must bind the consumer queue %q", c.RabbitMQQueue))
+	}
+
+	if c.SpoolEnabled {
+		if c.SpoolSegmentSizeMB > c.SpoolMaxSizeMB {
+			errs = append(errs, errors.New("SPOOL_SEGMENT_SIZE_MB must not exceed SPOOL_MAX_SIZE_MB"))
+		}
+		if c.SpoolFsync == "interval" && c.SpoolFsyncInterval <= 0 {
+			errs = append(errs, errors.New("SPOOL_FSYNC_INTERVAL must be positive when SPOOL_FSYNC is interval"))
+		}
+	}
+
+	if c.MessageBus == MessageBusRedis && (c.RedisStreamClaimIdle <= 0 || c.RedisStreamClaimInterval <= 0) {
+		errs = append(errs, errors.New("REDIS_STREAM_CLAIM_IDLE and REDIS_STREAM_CLAIM_INTERVAL must be positive"))
+	}
+	if c.MessageBus == MessageBusRedis && c.RedisStreamClaimInterval >= c.RedisStreamClaimIdle {
+		// Entries in progress are refreshed on every reclaim; with a longer
+		// interval other servers would take them over in between.
+		errs = append(errs, errors.New("REDIS_STREAM_CLAIM_INTERVAL must be shorter than REDIS_STREAM_CLAIM_IDLE"))
+	}
+
+	if c.MessageBus == MessageBusNATS {
+		errs = append(errs, c.validateNATS()...)
+	}
+
+	if c.RabbitMQConfirmTimeout <= 0 {
+		errs = append(errs, errors.New("RABBITMQ_CONFIRM_TIMEOUT must be positive"))
+	}
+
+	if c.HealthCheckTimeout <= 0 {
+		errs = append(errs, errors.New("HEALTH_CHECK_TIMEOUT must be positive"))
+	}
+
+	return errs
+}
+
+// Redacted returns the effective value of every setting keyed by its
+// environment variable name, with secrets masked.
+func (c *Config) Redacted() map[string]string {
+	redacted := make(map[string]string, len(settings))
+	for _, s := range settings {
+		value := c.raw[s.Key]
+		if s.Secret && value != "" {
+			value = "[REDACTED]"
+		}
+		redacted[s.Key] = value
+	}
+	return redacted
+}
+
+// ChangedKeys compares c with next and returns the changed settings, split
+// into those that can be applied at runtime and those that need a restart.
+func (c *Config) ChangedKeys(next *Config) (reloadable, static []string) {
+	for _, s := range settings {
+		if c.raw[s.Key] == next.raw[s.Key] {
+			continue
+		}
+		if s.Reloadable {
+			reloadable = append(reloadable, s.Key)
+		} else {
+			static = append(static, s.Key)
+		}
+	}
+	return reloadable, static
+}
+
+// WithReloadable returns a copy of c with the reloadable settings taken from
+// next. Settings that need a restart keep their current values, so the result
+// always describes what the running process is actually using.
+func (c *Config) WithReloadable(next *Config) *Config {
+	merged := *c
+	merged.raw = make(map[string]string, len(c.raw))
+	for key, value := range c.raw {
+		merged.raw[key] = value
+	}
+
+	for _, s := range settings {
+		if !s.Reloadable {
+			continue
+		}
+		value := next.raw[s.Key]
+		merged.raw[s.Key] = value
+		if value != "" {
+			// next has already been validated, so apply cannot fail.
+			_ = s.apply(&merged, value)
+		}
+	}
+	return &merged
+}
+
+// ReloadableKeys lists the settings that can change without a restart.
+func ReloadableKeys() []string {
+	var keys []string
+	for _, s := range settings {
+		if s.Reloadable {
+			keys = append(keys, s.Key)
+		}
+	}
+	return keys
+}
+
+// validateNATS checks the names that become JetStream streams, consumers and
+// subjects. NATS subject wildcards only allow a multi-word wildcard at the
+// end, so "#" may only be the last word of a binding pattern.
+func (c *Config) validateNATS() []error {
+	var errs []error
+
+	if !validNATSName(c.NATSStream) {
+		errs = append(errs, fmt.Errorf("NATS_STREAM %q must not contain spaces, dots or wildcards", c.NATSStream))
+	}
+	if !validNATSName(c.NATSSubjectPrefix) {
+		errs = append(errs, fmt.Errorf("NATS_SUBJECT_PREFIX %q must not contain spaces, dots or wildcards", c.NATSSubjectPrefix))
+	}
+	if c.NATSAckWait <= 0 {
+		errs = append(errs, errors.New("NATS_ACK_WAIT must be positive"))
+	}
+
+	for _, binding := range c.RabbitMQBindings {
+		if !validNATSName(binding.Queue) {
+			errs = append(errs, fmt.Errorf("RABBITMQ_BINDINGS: queue %q cannot be a NATS consumer name", binding.Queue))
+		}
+		for _, pattern := range binding.Patterns {
+			words := strings.Split(pattern, ".")
+			for i, word := range words {
+				if word == "#" && i != len(words)-1 {
+					errs = append(errs, fmt.Errorf("RABBITMQ_BINDINGS: pattern %q can only use # as its last word with NATS", pattern))
+					break
+				}
+			}
+		}
+	}
+	return errs
+}
+
+func validNATSName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t.*>")
+}
+
+// MQTTSubscriptions returns the topic filters device messages are received
+// on: MQTT_TOPIC, MQTT_STATUS_TOPIC, MQTT_COMMAND_ACK_TOPIC,
+// MQTT_TWIN_REPORTED_TOPIC and MQTT_PROVISIONING_TOPIC, as shared
+// subscriptions when MQTT_SHARED_GROUP is set.
+func (c *Config) MQTTSubscriptions() []string {
+	topics := []string{c.MQTTTopic}
+	for _, topic := range []string{c.MQTTStatusTopic, c.MQTTCommandAckTopic, c.MQTTTwinReportedTopic, c.MQTTProvisioningTopic} {
+		if topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+	if c.MQTTSharedGroup != "" {
+		for i, topic := range topics {
+			topics[i] = "$share/" + c.MQTTSharedGroup + "/" + topic
+		}
 	}
-	return defaultValue
+	return topics
 }
@@ -1,9 +1,10 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"path/filepath"
 
 	_ "github.com/lib/pq"
@@ -41,7 +42,7 @@ func RunMigrations(db *sql.DB, migrationsDir string) error {
 		return fmt.Errorf("failed to get absolute path: %w", err)
 	}
 
-	log.Printf("Running migrations from directory: %s", absPath)
+	slog.Info("Running migrations", "dir", absPath)
 
 	if err := goose.Up(db, absPath); err != nil {
 		return fmt.Errorf("failed to run migrations: %w", err)
@@ -52,6 +53,11 @@ func RunMigrations(db *sql.DB, migrationsDir string) error {
 		return fmt.Errorf("failed to get version after migration: %w", err)
 	}
 
-	log.Printf("Migrations completed successfully. Current version: %d", newVersion)
+	slog.Info("Migrations completed successfully", "version", newVersion)
 	return nil
 }
+
+// MigrationVersion returns the current goose schema version.
+func MigrationVersion(ctx context.Context, db *sql.DB) (int64, error) {
+	return goose.GetDBVersionContext(ctx, db)
+}
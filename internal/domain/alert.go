@@ -0,0 +1,26 @@
+package domain
+
+import "time"
+
+const (
+	// AlertMessageType marks alert messages on the WebSocket stream, which
+	// otherwise carries plain device updates.
+	AlertMessageType = "alert"
+
+	AlertKindLowStock      = "low_stock"
+	AlertKindDeviceOffline = "device_offline"
+	AlertKindDeviceOnline  = "device_online"
+)
+
+type Alert struct {
+	Type             string  `json:"type"`
+	Kind             string  `json:"kind"`
+	DeviceID         string  `json:"device_id"`
+	ClientID         string  `json:"client_id,omitempty"`
+	Message          string  `json:"message"`
+	CurrentTotalItem float64 `json:"current_total_item"`
+	Threshold        int     `json:"threshold"`
+	// LastSeenAt is set on presence alerts.
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	RaisedAt   time.Time  `json:"raised_at"`
+}
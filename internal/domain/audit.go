@@ -0,0 +1,114 @@
+package domain
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	AuditActionDeviceCreate = "device.create"
+	AuditActionDeviceUpdate = "device.update"
+	AuditActionDeviceDelete = "device.delete"
+	AuditActionSale         = "inventory.sale"
+	AuditActionLogin        = "auth.login"
+	AuditActionLogout       = "auth.logout"
+
+	AuditActionDeviceCredentialIssue  = "device_credential.issue"
+	AuditActionDeviceCredentialRevoke = "device_credential.revoke"
+	AuditActionDeviceCredentialEnroll = "device_credential.enroll"
+
+	AuditActionDeviceCommandSend = "device_command.send"
+	AuditActionDeviceTwinUpdate  = "device_twin.update"
+
+	AuditActionDeviceClaimCreate    = "device_claim.create"
+	AuditActionDeviceClaimDelete    = "device_claim.delete"
+	AuditActionPendingDeviceDismiss = "pending_device.dismiss"
+)
+
+const (
+	AuditResourceDevice  = "device"
+	AuditResourceSession = "session"
+
+	AuditResourceDeviceCredential = "device_credential"
+	AuditResourceDeviceCommand    = "device_command"
+	AuditResourceDeviceTwin       = "device_twin"
+	AuditResourceDeviceClaim      = "device_claim"
+	AuditResourcePendingDevice    = "pending_device"
+)
+
+const (
+	AuditActorSystem    = "system"
+	AuditActorAnonymous = "anonymous"
+)
+
+const defaultAuditQueryLimit = 100
+
+const auditActorContextKey = auditContextKey("audit_actor")
+
+type auditContextKey string
+
+// AuditEntry is a single immutable record in the audit log.
+type AuditEntry struct {
+	ID           int64                  `json:"id"`
+	OccurredAt   time.Time              `json:"occurred_at"`
+	Actor        string                 `json:"actor"`
+	ClientID     *uuid.UUID             `json:"client_id,omitempty"`
+	Action       string                 `json:"action"`
+	ResourceType string                 `json:"resource_type"`
+	ResourceID   string                 `json:"resource_id,omitempty"`
+	IPAddress    string                 `json:"ip_address,omitempty"`
+	RequestID    string                 `json:"request_id,omitempty"`
+	Before       json.RawMessage        `json:"before,omitempty"`
+	After        json.RawMessage        `json:"after,omitempty"`
+	Changes      map[string]AuditChange `json:"changes,omitempty"`
+}
+
+// AuditChange describes how a single top-level field changed.
+type AuditChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// AuditFilter narrows down audit log queries. Zero values are ignored.
+type AuditFilter struct {
+	Actor        string
+	ClientID     *uuid.UUID
+	Action       string
+	ResourceType string
+	ResourceID   string
+	From         time.Time
+	To           time.Time
+	Limit        int
+	Offset       int
+}
+
+// EffectiveLimit returns the page size to use for the filter.
+func (f AuditFilter) EffectiveLimit() int {
+	if f.Limit <= 0 {
+		return defaultAuditQueryLimit
+	}
+	return f.Limit
+}
+
+// AuditActor identifies who triggered a request and where it came from.
+type AuditActor struct {
+	Actor     string
+	ClientID  *uuid.UUID
+	IPAddress string
+	RequestID string
+}
+
+func ContextWithAuditActor(ctx context.Context, actor AuditActor) context.Context {
+	return context.WithValue(ctx, auditActorContextKey, actor)
+}
+
+// AuditActorFromContext returns the actor stored in ctx, falling back to the
+// system actor for background work that did not originate from a request.
+func AuditActorFromContext(ctx context.Context) AuditActor {
+	if actor, ok := ctx.Value(auditActorContextKey).(AuditActor); ok {
+		return actor
+	}
+	return AuditActor{Actor: AuditActorSystem}
+}
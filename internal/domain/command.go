@@ -0,0 +1,104 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+)
+
+// Commands a device accepts on devices/<id>/commands.
+const (
+	CommandTare                 = "tare"
+	CommandRecalibrate          = "recalibrate"
+	CommandReboot               = "reboot"
+	CommandSetReportingInterval = "set_reporting_interval"
+)
+
+// Command statuses. A command is pending once it has been published, is
+// delivered when the device confirms it received it, and ends acked, failed
+// or timed out.
+const (
+	CommandStatusPending   = "pending"
+	CommandStatusDelivered = "delivered"
+	CommandStatusAcked     = "acked"
+	CommandStatusFailed    = "failed"
+	CommandStatusTimedOut  = "timed_out"
+)
+
+// MaxReportingIntervalSeconds bounds set_reporting_interval.
+const MaxReportingIntervalSeconds = 86400
+
+var ErrInvalidCommand = errors.New("invalid command")
+
+// DeviceCommand is a command sent to a device and its outcome. Its ID is
+// the correlation ID the device echoes in its acknowledgements.
+type DeviceCommand struct {
+	ID          uuid.UUID       `json:"id"`
+	DeviceID    uuid.UUID       `json:"device_id"`
+	ClientID    uuid.UUID       `json:"client_id"`
+	Command     string          `json:"command"`
+	Params      json.RawMessage `json:"params,omitempty"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	ExpiresAt   time.Time       `json:"expires_at"`
+	DeliveredAt *time.Time      `json:"delivered_at,omitempty"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+}
+
+// Done reports whether the command has reached a final status.
+func (c *DeviceCommand) Done() bool {
+	switch c.Status {
+	case CommandStatusAcked, CommandStatusFailed, CommandStatusTimedOut:
+		return true
+	}
+	return false
+}
+
+// DeviceCommandMessage is what the device receives on devices/<id>/commands.
+// Devices should ignore commands received after ExpiresAt.
+type DeviceCommandMessage struct {
+	CommandID uuid.UUID       `json:"command_id"`
+	Command   string          `json:"command"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// DeviceCommandAck is what the device publishes on
+// devices/<id>/commands/ack: delivered when it has received the command,
+// then acked or failed once it has carried it out.
+type DeviceCommandAck struct {
+	CommandID uuid.UUID       `json:"command_id"`
+	Status    string          `json:"status"`
+	Error     string          `json:"error,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+}
+
+// ValidateCommandParams checks the params of a command, which may be empty
+// except for set_reporting_interval.
+func ValidateCommandParams(command string, params json.RawMessage) error {
+	switch command {
+	case CommandTare, CommandRecalibrate, CommandReboot:
+		if len(params) == 0 || string(params) == "null" {
+			return nil
+		}
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(params, &object); err != nil {
+			return fmt.Errorf("%w: params must be an object", ErrInvalidCommand)
+		}
+		return nil
+	case CommandSetReportingInterval:
+		var p struct {
+			IntervalSeconds int `json:"interval_seconds"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil || p.IntervalSeconds < 1 || p.IntervalSeconds > MaxReportingIntervalSeconds {
+			return fmt.Errorf("%w: %s needs params.interval_seconds between 1 and %d", ErrInvalidCommand, command, MaxReportingIntervalSeconds)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown command %q", ErrInvalidCommand, command)
+	}
+}
@@ -0,0 +1,36 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Reasons a message ends up in the dead-letter queue.
+const (
+	// DeadLetterReasonMalformed: the payload could not be decoded.
+	DeadLetterReasonMalformed = "malformed"
+	// DeadLetterReasonInvalid: the payload decoded but cannot be processed,
+	// e.g. an invalid device ID.
+	DeadLetterReasonInvalid = "invalid"
+	// DeadLetterReasonMaxDeliveries: processing kept failing.
+	DeadLetterReasonMaxDeliveries = "max_deliveries_exceeded"
+	// DeadLetterReasonExpired and DeadLetterReasonRejected are set by the
+	// broker for messages that outlived the queue TTL or were rejected
+	// without the application recording a reason.
+	DeadLetterReasonExpired  = "expired"
+	DeadLetterReasonRejected = "rejected"
+)
+
+type DeadLetter struct {
+	ID            string    `json:"id"`
+	MessageID     string    `json:"message_id,omitempty"`
+	Reason        string    `json:"reason"`
+	Error         string    `json:"error,omitempty"`
+	Source        string    `json:"source,omitempty"`
+	DeliveryCount int       `json:"delivery_count"`
+	FailedAt      time.Time `json:"failed_at"`
+	// Payload holds the message body when it is valid JSON; otherwise the
+	// body is returned as text in RawPayload.
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	RawPayload string          `json:"raw_payload,omitempty"`
+}
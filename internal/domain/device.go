@@ -2,25 +2,60 @@ package domain
 
 import (
 	"github.com/google/uuid"
+	"math"
 	"time"
 )
 
 type Device struct {
-	ID                 uuid.UUID `json:"id"`
-	ClientID           uuid.UUID `json:"client_id"`
-	CurrentItemCount   int       `json:"current_item_count"`
-	CurrentWeight      float64   `json:"current_weight"`
-	ItemWeight         float64   `json:"item_weight"`
-	MaxCapacity        float64   `json:"max_capacity"`
-	TotalItemSoldCount int       `json:"total_item_sold_count"`
-	CreatedAt          time.Time `json:"created_at"`
-	UpdatedAt          time.Time `json:"updated_at"`
+	ID                 uuid.UUID  `json:"id"`
+	ClientID           uuid.UUID  `json:"client_id"`
+	CurrentItemCount   int        `json:"current_item_count"`
+	CurrentWeight      float64    `json:"current_weight"`
+	ItemWeight         float64    `json:"item_weight"`
+	MaxCapacity        float64    `json:"max_capacity"`
+	TotalItemSoldCount int        `json:"total_item_sold_count"`
+	LastSeenAt         *time.Time `json:"last_seen_at,omitempty"`
+	Online             bool       `json:"online"`
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
 }
 
+// Device event types. The event is the last segment of the routing key a
+// message is published with.
+const (
+	DeviceEventSale      = "sale"
+	DeviceEventRestock   = "restock"
+	DeviceEventTelemetry = "telemetry"
+	DeviceEventAlert     = "alert"
+)
+
+// DeviceMessageSchemaVersion is the version of the DeviceMessage layout.
+// MQTT 5 clients send it as the schema_version user property; messages
+// with another version are dead-lettered.
+const DeviceMessageSchemaVersion = "1"
+
 type DeviceMessage struct {
+	MessageID        string    `json:"message_id,omitempty"`
 	DeviceID         string    `json:"device_id"`
+	ClientID         string    `json:"client_id,omitempty"`
+	Event            string    `json:"event,omitempty"`
 	CurrentTotalItem float64   `json:"current_total_item"`
 	CurrentWeight    float64   `json:"current_weight"`
 	ItemWeight       float64   `json:"item_weight"`
 	Timestamp        time.Time `json:"timestamp"`
+
+	// TraceContext carries W3C trace headers across MQTT, which has no
+	// message headers in v3.1.1. With MQTT 5 they are also sent as user
+	// properties.
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+}
+
+// DerivedItemCount computes the item count from the measured weight when the
+// item weight is known, which is what a real scale reports. Otherwise the
+// count sent by the device is used.
+func (m *DeviceMessage) DerivedItemCount() int {
+	if m.ItemWeight > 0 {
+		return int(math.Max(0, math.Round(m.CurrentWeight/m.ItemWeight)))
+	}
+	return int(m.CurrentTotalItem)
 }
@@ -0,0 +1,25 @@
+package domain
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// DeviceCredential is the secret a device authenticates to the embedded
+// MQTT broker with, using its device ID as the username. Only a hash of the
+// secret is stored.
+type DeviceCredential struct {
+	DeviceID   uuid.UUID  `json:"device_id"`
+	SecretHash []byte     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// IssuedDeviceCredential is returned once, when a credential is issued. The
+// password cannot be retrieved again.
+type IssuedDeviceCredential struct {
+	DeviceID  uuid.UUID `json:"device_id"`
+	Username  string    `json:"username"`
+	Password  string    `json:"password"`
+	CreatedAt time.Time `json:"created_at"`
+}
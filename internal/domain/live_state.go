@@ -0,0 +1,25 @@
+package domain
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	LiveStateSourceCache    = "live"
+	LiveStateSourceDatabase = "database"
+)
+
+// DeviceLiveState is the latest reading reported by a device. It is kept in
+// Redis and written back to the devices table periodically.
+type DeviceLiveState struct {
+	DeviceID         uuid.UUID `json:"device_id"`
+	CurrentWeight    float64   `json:"current_weight"`
+	CurrentItemCount int       `json:"current_item_count"`
+	ItemWeight       float64   `json:"item_weight"`
+	// ReadingAt is the timestamp reported by the device; LastSeenAt is when
+	// the server received the reading.
+	ReadingAt  time.Time `json:"reading_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Source     string    `json:"source"`
+}
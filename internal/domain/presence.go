@@ -0,0 +1,29 @@
+package domain
+
+import "time"
+
+const (
+	// PresenceMessageType marks online/offline transitions on the WebSocket
+	// stream.
+	PresenceMessageType = "presence"
+
+	// Device statuses published on devices/<id>/status.
+	DeviceStatusOnline  = "online"
+	DeviceStatusOffline = "offline"
+
+	// Why a device came online or went offline.
+	PresenceReasonTelemetry = "telemetry"
+	PresenceReasonStatus    = "status"
+	PresenceReasonTimeout   = "timeout"
+)
+
+// DevicePresence is a device coming online or going offline.
+type DevicePresence struct {
+	Type       string     `json:"type"`
+	DeviceID   string     `json:"device_id"`
+	ClientID   string     `json:"client_id,omitempty"`
+	Online     bool       `json:"online"`
+	Reason     string     `json:"reason"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	ChangedAt  time.Time  `json:"changed_at"`
+}
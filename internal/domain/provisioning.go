@@ -0,0 +1,138 @@
+package domain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"regexp"
+	"time"
+)
+
+// Outcomes of a birth message, sent back to the device as the status of
+// its ProvisioningResponse.
+const (
+	ProvisioningStatusProvisioned = "provisioned"
+	ProvisioningStatusPending     = "pending"
+	ProvisioningStatusRejected    = "rejected"
+)
+
+// MinClaimTokenLength is the shortest claim token accepted when a claim is
+// registered with a token of its own, such as one printed on the device.
+const MinClaimTokenLength = 16
+
+var (
+	ErrInvalidSerialNumber   = errors.New("invalid serial number")
+	ErrInvalidClaimToken     = errors.New("invalid claim token")
+	ErrInvalidCredentialHash = errors.New("invalid credential hash")
+)
+
+// serialNumberPattern keeps serial numbers usable as an MQTT topic level
+// and client ID.
+var serialNumberPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// DeviceClaim pre-registers a device for a client: a device that publishes
+// a birth message with the serial number and claim token is created for
+// the client. Only a hash of the token is stored. A claim is used up once
+// its device is created (ClaimedAt is set); the token alone does not
+// provision another device or replace the device's credential.
+type DeviceClaim struct {
+	SerialNumber string     `json:"serial_number"`
+	ClientID     uuid.UUID  `json:"client_id"`
+	TokenHash    []byte     `json:"-"`
+	DeviceID     *uuid.UUID `json:"device_id,omitempty"`
+	ClaimedAt    *time.Time `json:"claimed_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// IssuedDeviceClaim is returned once, when a claim is registered. The
+// claim token cannot be retrieved again.
+type IssuedDeviceClaim struct {
+	DeviceClaim
+	ClaimToken string `json:"claim_token"`
+}
+
+// PendingDevice is a device that announced itself without a claim. It
+// waits for an operator to approve it for a client, or to dismiss it.
+//
+// The claim token and client of the first birth message are kept. Birth
+// messages with another token are not applied but counted as conflicts: a
+// second device is using the serial number, and the operator should
+// compare TokenFingerprint with the device before approving it.
+type PendingDevice struct {
+	SerialNumber string `json:"serial_number"`
+	// ClientID is the client the device said it belongs to, if any.
+	ClientID         *uuid.UUID `json:"client_id,omitempty"`
+	TokenHash        []byte     `json:"-"`
+	TokenFingerprint string     `json:"token_fingerprint"`
+	// CredentialHash is the credential hash of the latest birth message
+	// with the device's token, enrolled when the device is approved.
+	CredentialHash  []byte     `json:"-"`
+	FirmwareVersion string     `json:"firmware_version,omitempty"`
+	Model           string     `json:"model,omitempty"`
+	BirthCount      int        `json:"birth_count"`
+	ConflictCount   int        `json:"conflict_count"`
+	FirstSeenAt     time.Time  `json:"first_seen_at"`
+	LastSeenAt      time.Time  `json:"last_seen_at"`
+	LastConflictAt  *time.Time `json:"last_conflict_at,omitempty"`
+}
+
+// BirthMessage is what a device without credentials publishes on
+// provisioning/<serial number>/birth. The device chooses its own MQTT
+// secret and sends only its SHA-256, as credential_hash, so the secret
+// never travels over a topic. DeviceSecret is only needed to replace the
+// credential of a device that is already provisioned: it is the current
+// secret, proving the birth message comes from that device.
+type BirthMessage struct {
+	SerialNumber    string     `json:"serial_number"`
+	ClaimToken      string     `json:"claim_token"`
+	CredentialHash  string     `json:"credential_hash"`
+	DeviceSecret    string     `json:"device_secret,omitempty"`
+	ClientID        *uuid.UUID `json:"client_id,omitempty"`
+	FirmwareVersion string     `json:"firmware_version,omitempty"`
+	Model           string     `json:"model,omitempty"`
+}
+
+// ProvisioningResponse is published to the device on
+// provisioning/<serial number>/response. It never carries a secret: once
+// provisioned, the device connects with DeviceID as the username and the
+// secret whose hash it sent as the password.
+type ProvisioningResponse struct {
+	Status   string     `json:"status"`
+	DeviceID *uuid.UUID `json:"device_id,omitempty"`
+	ClientID *uuid.UUID `json:"client_id,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// TokenFingerprint identifies a claim token by its SHA-256 without
+// revealing it: the first 16 hex digits of the hash, in groups of four.
+func TokenFingerprint(tokenHash []byte) string {
+	if len(tokenHash) < 8 {
+		return ""
+	}
+	digits := hex.EncodeToString(tokenHash[:8])
+	return digits[0:4] + "-" + digits[4:8] + "-" + digits[8:12] + "-" + digits[12:16]
+}
+
+// HashClaimToken returns the SHA-256 a claim token is stored as.
+func HashClaimToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// ParseCredentialHash decodes the hex SHA-256 of a device secret.
+func ParseCredentialHash(value string) ([]byte, error) {
+	hash, err := hex.DecodeString(value)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("%w: expected the hex SHA-256 of the device secret", ErrInvalidCredentialHash)
+	}
+	return hash, nil
+}
+
+func ValidateSerialNumber(serial string) error {
+	if !serialNumberPattern.MatchString(serial) {
+		return fmt.Errorf("%w: expected 1-64 letters, digits, '.', '_' or '-'", ErrInvalidSerialNumber)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package domain
+
+// QueueStats describes the queue this server consumes device updates from.
+type QueueStats struct {
+	Queue string `json:"queue_name"`
+	// Messages are waiting to be delivered to a consumer.
+	Messages  int `json:"messages"`
+	Consumers int `json:"consumers"`
+	// Pending (delivered, not yet acked) and StreamLength are only reported
+	// by Redis Streams.
+	Pending      int `json:"pending,omitempty"`
+	StreamLength int `json:"stream_length,omitempty"`
+}
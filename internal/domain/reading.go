@@ -0,0 +1,17 @@
+package domain
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// DeviceReading is one row of reading history.
+type DeviceReading struct {
+	DeviceID         uuid.UUID `json:"device_id"`
+	MessageID        string    `json:"message_id,omitempty"`
+	CurrentWeight    float64   `json:"current_weight"`
+	CurrentItemCount int       `json:"current_item_count"`
+	ItemWeight       float64   `json:"item_weight"`
+	ReadingAt        time.Time `json:"reading_at"`
+	ReceivedAt       time.Time `json:"received_at"`
+}
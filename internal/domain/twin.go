@@ -0,0 +1,142 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Desired properties a device twin accepts.
+const (
+	TwinReportingIntervalSeconds = "reporting_interval_seconds"
+	TwinUnits                    = "units"
+	TwinThresholds               = "thresholds"
+	TwinFirmwareVersion          = "firmware_version"
+)
+
+var ErrInvalidTwin = errors.New("invalid twin")
+
+// twinUnits are the weight units a device can report in.
+var twinUnits = map[string]bool{"kg": true, "g": true, "lb": true}
+
+// DeviceTwin is the configuration the fleet operator wants a device to have
+// (desired) next to the configuration the device says it has (reported).
+// Each section has its own version, incremented on every change.
+type DeviceTwin struct {
+	DeviceID          uuid.UUID              `json:"device_id"`
+	Desired           map[string]interface{} `json:"desired"`
+	DesiredVersion    int64                  `json:"desired_version"`
+	DesiredUpdatedAt  *time.Time             `json:"desired_updated_at,omitempty"`
+	Reported          map[string]interface{} `json:"reported"`
+	ReportedVersion   int64                  `json:"reported_version"`
+	ReportedUpdatedAt *time.Time             `json:"reported_updated_at,omitempty"`
+	// Drift lists the desired properties the device has not reported yet.
+	Drift []TwinDrift `json:"drift"`
+}
+
+// TwinDrift is a desired property whose reported value differs. Path is
+// dotted for nested properties, e.g. thresholds.low_stock.
+type TwinDrift struct {
+	Path     string      `json:"path"`
+	Desired  interface{} `json:"desired"`
+	Reported interface{} `json:"reported"`
+}
+
+// TwinDesiredMessage is the retained message on devices/<id>/twin/desired.
+type TwinDesiredMessage struct {
+	Version   int64                  `json:"version"`
+	Desired   map[string]interface{} `json:"desired"`
+	UpdatedAt time.Time              `json:"updated_at"`
+}
+
+// UpdateDrift recomputes Drift from the desired and reported sections.
+func (t *DeviceTwin) UpdateDrift() {
+	t.Drift = twinDrift("", t.Desired, t.Reported)
+	if t.Drift == nil {
+		t.Drift = []TwinDrift{}
+	}
+}
+
+func twinDrift(prefix string, desired, reported map[string]interface{}) []TwinDrift {
+	keys := make([]string, 0, len(desired))
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var drift []TwinDrift
+	for _, key := range keys {
+		want := desired[key]
+		have := reported[key]
+		path := prefix + key
+		if wantObject, ok := want.(map[string]interface{}); ok {
+			haveObject, _ := have.(map[string]interface{})
+			drift = append(drift, twinDrift(path+".", wantObject, haveObject)...)
+			continue
+		}
+		if !reflect.DeepEqual(want, have) {
+			drift = append(drift, TwinDrift{Path: path, Desired: want, Reported: have})
+		}
+	}
+	return drift
+}
+
+// MergeTwinPatch applies a JSON merge patch (RFC 7396) to target: objects
+// are merged recursively and null removes a property. target is not
+// modified.
+func MergeTwinPatch(target, patch map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(target)+len(patch))
+	for key, value := range target {
+		merged[key] = value
+	}
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(merged, key)
+		case map[string]interface{}:
+			existing, _ := merged[key].(map[string]interface{})
+			merged[key] = MergeTwinPatch(existing, value)
+		default:
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// ValidateTwinDesired checks a desired section against the properties
+// devices support.
+func ValidateTwinDesired(desired map[string]interface{}) error {
+	for key, value := range desired {
+		switch key {
+		case TwinReportingIntervalSeconds:
+			interval, ok := value.(float64)
+			if !ok || interval != float64(int64(interval)) || interval < 1 || interval > MaxReportingIntervalSeconds {
+				return fmt.Errorf("%w: %s must be a whole number of seconds between 1 and %d", ErrInvalidTwin, key, MaxReportingIntervalSeconds)
+			}
+		case TwinUnits:
+			if units, ok := value.(string); !ok || !twinUnits[units] {
+				return fmt.Errorf("%w: %s must be kg, g or lb", ErrInvalidTwin, key)
+			}
+		case TwinThresholds:
+			thresholds, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%w: %s must be an object", ErrInvalidTwin, key)
+			}
+			for name, threshold := range thresholds {
+				if number, ok := threshold.(float64); !ok || number < 0 {
+					return fmt.Errorf("%w: %s.%s must be a non-negative number", ErrInvalidTwin, key, name)
+				}
+			}
+		case TwinFirmwareVersion:
+			if version, ok := value.(string); !ok || version == "" {
+				return fmt.Errorf("%w: %s must be a non-empty string", ErrInvalidTwin, key)
+			}
+		default:
+			return fmt.Errorf("%w: unknown desired property %q", ErrInvalidTwin, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/internal/settings"
+	"smat/iot/simulation/iot-inventory-management/pkg/utils"
+)
+
+type AdminHandler struct {
+	settings *settings.Store
+}
+
+func NewAdminHandler(settings *settings.Store) *AdminHandler {
+	return &AdminHandler{settings: settings}
+}
+
+// GetConfig returns the effective configuration with secrets redacted,
+// together with which settings can be reloaded without a restart.
+func (h *AdminHandler) GetConfig(c *gin.Context) {
+	cfg := h.settings.Current()
+
+	utils.SuccessResponse(c, "Effective configuration", gin.H{
+		"settings":         cfg.Redacted(),
+		"reloadable":       config.ReloadableKeys(),
+		"config_file":      cfg.ConfigFile,
+		"last_reloaded_at": h.settings.LoadedAt(),
+	})
+}
+
+// ReloadConfig reloads the configuration, the same as sending SIGHUP.
+func (h *AdminHandler) ReloadConfig(c *gin.Context) {
+	if err := h.settings.Reload(); err != nil {
+		slog.WarnContext(c.Request.Context(), "Configuration reload rejected", "error", err)
+		utils.ErrorResponse(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	h.GetConfig(c)
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log/slog"
+	"net/http"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/service"
+	"smat/iot/simulation/iot-inventory-management/pkg/utils"
+	"strconv"
+	"time"
+)
+
+const maxAuditPageSize = 1000
+
+type AuditHandler struct {
+	auditService service.AuditService
+}
+
+func NewAuditHandler(auditService service.AuditService) *AuditHandler {
+	return &AuditHandler{auditService: auditService}
+}
+
+// ListAuditEntries returns the logged-in client's audit entries matching the
+// query filters. Passing format=csv streams the same result set as a CSV
+// attachment.
+func (h *AuditHandler) ListAuditEntries(c *gin.Context) {
+	actor := domain.AuditActorFromContext(c.Request.Context())
+	if actor.ClientID == nil {
+		utils.ErrorResponse(c, http.StatusUnauthorized, "Login required")
+		return
+	}
+
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.ClientID != nil && *filter.ClientID != *actor.ClientID {
+		utils.ErrorResponse(c, http.StatusForbidden, "Cannot list another client's audit entries")
+		return
+	}
+	filter.ClientID = actor.ClientID
+
+	entries, err := h.auditService.List(c.Request.Context(), filter)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to list audit entries", "error", err)
+		utils.ErrorResponse(c, http.StatusInternalServerError, "Failed to fetch audit entries")
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		writeAuditCSV(c, entries)
+		return
+	}
+
+	utils.SuccessResponse(c, "Audit entries fetched successfully", entries)
+}
+
+func parseAuditFilter(c *gin.Context) (domain.AuditFilter, error) {
+	filter := domain.AuditFilter{
+		Actor:        c.Query("actor"),
+		Action:       c.Query("action"),
+		ResourceType: c.Query("resource_type"),
+		ResourceID:   c.Query("resource_id"),
+	}
+
+	if clientID := c.Query("client_id"); clientID != "" {
+		parsed, err := uuid.Parse(clientID)
+		if err != nil {
+			return filter, errors.New("Invalid client ID")
+		}
+		filter.ClientID = &parsed
+	}
+
+	if from := c.Query("from"); from != "" {
+		parsed, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return filter, errors.New("Invalid from timestamp, expected RFC3339")
+		}
+		filter.From = parsed
+	}
+
+	if to := c.Query("to"); to != "" {
+		parsed, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return filter, errors.New("Invalid to timestamp, expected RFC3339")
+		}
+		filter.To = parsed
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > maxAuditPageSize {
+			return filter, fmt.Errorf("Invalid limit, expected 1-%d", maxAuditPageSize)
+		}
+		filter.Limit = parsed
+	}
+
+	if offset := c.Query("offset"); offset != "" {
+		parsed, err := strconv.Atoi(offset)
+		if err != nil || parsed < 0 {
+			return filter, errors.New("Invalid offset")
+		}
+		filter.Offset = parsed
+	}
+
+	return filter, nil
+}
+
+func writeAuditCSV(c *gin.Context, entries []*domain.AuditEntry) {
+	filename := fmt.Sprintf("audit-%s.csv", time.Now().UTC().Format("20060102-150405"))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write([]string{
+		"id", "occurred_at", "actor", "client_id", "action", "resource_type", "resource_id",
+		"ip_address", "request_id", "before", "after", "changes",
+	})
+
+	for _, entry := range entries {
+		clientID := ""
+		if entry.ClientID != nil {
+			clientID = entry.ClientID.String()
+		}
+
+		changes := ""
+		if len(entry.Changes) > 0 {
+			if data, err := json.Marshal(entry.Changes); err == nil {
+				changes = string(data)
+			}
+		}
+
+		_ = w.Write([]string{
+			strconv.FormatInt(entry.ID, 10),
+			entry.OccurredAt.UTC().Format(time.RFC3339),
+			entry.Actor,
+			clientID,
+			entry.Action,
+			entry.ResourceType,
+			entry.ResourceID,
+			entry.IPAddress,
+			entry.RequestID,
+			string(entry.Before),
+			string(entry.After),
+			changes,
+		})
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to write audit CSV", "error", err)
+	}
+}
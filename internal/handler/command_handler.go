@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log/slog"
+	"net/http"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/service"
+	"smat/iot/simulation/iot-inventory-management/pkg/utils"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultCommandPageSize = 50
+	maxCommandPageSize     = 500
+	maxCommandTimeout      = time.Hour
+	maxCommandWait         = 5 * time.Minute
+)
+
+type CommandHandler struct {
+	commands service.CommandService
+}
+
+func NewCommandHandler(commands service.CommandService) *CommandHandler {
+	return &CommandHandler{commands: commands}
+}
+
+// SendCommand publishes a command to the device. With wait (e.g. wait=10s)
+// the response is delayed until the device has acknowledged the command or
+// wait has passed; otherwise it returns the pending command at once, to be
+// polled with GetCommand.
+func (h *CommandHandler) SendCommand(c *gin.Context) {
+	deviceID, err := uuid.Parse(c.Param("deviceId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid device ID format")
+		return
+	}
+	wait, ok := parseCommandWait(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Command        string          `json:"command" binding:"required"`
+		Params         json.RawMessage `json:"params"`
+		TimeoutSeconds int             `json:"timeout_seconds"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	timeout := time.Duration(req.TimeoutSeconds) * time.Second
+	if timeout < 0 || timeout > maxCommandTimeout {
+		utils.ErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("Invalid timeout_seconds, expected 1-%d", int(maxCommandTimeout/time.Second)))
+		return
+	}
+
+	ctx := c.Request.Context()
+	command, err := h.commands.Send(ctx, deviceID, req.Command, req.Params, timeout)
+	if err != nil {
+		h.respondError(c, "Failed to send command", err)
+		return
+	}
+
+	if wait > 0 {
+		if command, err = h.commands.Wait(ctx, deviceID, command.ID, wait); err != nil {
+			h.respondError(c, "Failed to read command", err)
+			return
+		}
+	}
+
+	utils.SuccessResponse(c, "Command sent successfully", command)
+}
+
+// ListCommands returns the device's most recent commands, newest first.
+func (h *CommandHandler) ListCommands(c *gin.Context) {
+	deviceID, err := uuid.Parse(c.Param("deviceId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid device ID format")
+		return
+	}
+
+	limit := defaultCommandPageSize
+	if raw := c.Query("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 || parsed > maxCommandPageSize {
+			utils.ErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("Invalid limit, expected 1-%d", maxCommandPageSize))
+			return
+		}
+		limit = parsed
+	}
+
+	commands, err := h.commands.List(c.Request.Context(), deviceID, limit)
+	if err != nil {
+		h.respondError(c, "Failed to fetch commands", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Commands fetched successfully", commands)
+}
+
+// GetCommand returns a command and its status. With wait it long-polls
+// like SendCommand.
+func (h *CommandHandler) GetCommand(c *gin.Context) {
+	deviceID, err := uuid.Parse(c.Param("deviceId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid device ID format")
+		return
+	}
+	commandID, err := uuid.Parse(c.Param("commandId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid command ID format")
+		return
+	}
+	wait, ok := parseCommandWait(c)
+	if !ok {
+		return
+	}
+
+	var command *domain.DeviceCommand
+	if wait > 0 {
+		command, err = h.commands.Wait(c.Request.Context(), deviceID, commandID, wait)
+	} else {
+		command, err = h.commands.Get(c.Request.Context(), deviceID, commandID)
+	}
+	if err != nil {
+		h.respondError(c, "Failed to read command", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Command fetched successfully", command)
+}
+
+func parseCommandWait(c *gin.Context) (time.Duration, bool) {
+	raw := c.Query("wait")
+	if raw == "" {
+		return 0, true
+	}
+	wait, err := time.ParseDuration(raw)
+	if err != nil || wait < 0 || wait > maxCommandWait {
+		utils.ErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("Invalid wait, expected a duration up to %s", maxCommandWait))
+		return 0, false
+	}
+	return wait, true
+}
+
+func (h *CommandHandler) respondError(c *gin.Context, message string, err error) {
+	switch {
+	case errors.Is(err, domain.ErrInvalidCommand):
+		utils.ErrorResponse(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrCommandDeviceNotFound):
+		utils.ErrorResponse(c, http.StatusNotFound, "Device not found")
+	case errors.Is(err, service.ErrCommandNotFound):
+		utils.ErrorResponse(c, http.StatusNotFound, "Command not found")
+	case errors.Is(err, service.ErrCommandNotSent):
+		slog.WarnContext(c.Request.Context(), message, "device_id", c.Param("deviceId"), "error", err)
+		utils.ErrorResponse(c, http.StatusServiceUnavailable, "Command could not be sent to the device")
+	default:
+		slog.ErrorContext(c.Request.Context(), message, "device_id", c.Param("deviceId"), "error", err)
+		utils.ErrorResponse(c, http.StatusInternalServerError, message)
+	}
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"smat/iot/simulation/iot-inventory-management/internal/service"
+	"smat/iot/simulation/iot-inventory-management/pkg/utils"
+	"strconv"
+)
+
+const (
+	defaultDeadLetterPageSize = 50
+	maxDeadLetterPageSize     = 500
+)
+
+type DeadLetterHandler struct {
+	deadLetters service.DeadLetterQueue
+}
+
+func NewDeadLetterHandler(deadLetters service.DeadLetterQueue) *DeadLetterHandler {
+	return &DeadLetterHandler{deadLetters: deadLetters}
+}
+
+// ListDeadLetters returns the oldest dead letters without removing them.
+func (h *DeadLetterHandler) ListDeadLetters(c *gin.Context) {
+	limit := defaultDeadLetterPageSize
+	if raw := c.Query("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 || parsed > maxDeadLetterPageSize {
+			utils.ErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("Invalid limit, expected 1-%d", maxDeadLetterPageSize))
+			return
+		}
+		limit = parsed
+	}
+
+	letters, total, err := h.deadLetters.ListDeadLetters(limit)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to list dead letters", "error", err)
+		utils.ErrorResponse(c, http.StatusServiceUnavailable, "Failed to read the dead-letter queue")
+		return
+	}
+
+	utils.SuccessResponse(c, "Dead letters fetched successfully", gin.H{
+		"total":        total,
+		"dead_letters": letters,
+	})
+}
+
+func (h *DeadLetterHandler) GetDeadLetter(c *gin.Context) {
+	letter, err := h.deadLetters.GetDeadLetter(c.Param("id"))
+	if err != nil {
+		h.respondError(c, "Failed to read dead letter", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Dead letter fetched successfully", letter)
+}
+
+// ReplayDeadLetter publishes a dead letter back onto the main queue. The
+// request body may carry an edited payload as {"payload": {...}}.
+func (h *DeadLetterHandler) ReplayDeadLetter(c *gin.Context) {
+	var req struct {
+		Payload json.RawMessage `json:"payload"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	var payload []byte
+	if len(req.Payload) > 0 && string(req.Payload) != "null" {
+		payload = req.Payload
+	}
+
+	if err := h.deadLetters.ReplayDeadLetter(c.Request.Context(), c.Param("id"), payload); err != nil {
+		h.respondError(c, "Failed to replay dead letter", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Dead letter replayed successfully", gin.H{"id": c.Param("id"), "edited": payload != nil})
+}
+
+func (h *DeadLetterHandler) ReplayDeadLetters(c *gin.Context) {
+	replayed, err := h.deadLetters.ReplayDeadLetters(c.Request.Context())
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to replay dead letters", "replayed", replayed, "error", err)
+		utils.ErrorResponse(c, http.StatusServiceUnavailable, fmt.Sprintf("Replay stopped after %d dead letters", replayed))
+		return
+	}
+
+	utils.SuccessResponse(c, "Dead letters replayed successfully", gin.H{"replayed": replayed})
+}
+
+func (h *DeadLetterHandler) DeleteDeadLetter(c *gin.Context) {
+	if err := h.deadLetters.DeleteDeadLetter(c.Param("id")); err != nil {
+		h.respondError(c, "Failed to delete dead letter", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Dead letter deleted successfully", gin.H{"id": c.Param("id")})
+}
+
+func (h *DeadLetterHandler) PurgeDeadLetters(c *gin.Context) {
+	purged, err := h.deadLetters.PurgeDeadLetters()
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to purge dead letters", "error", err)
+		utils.ErrorResponse(c, http.StatusServiceUnavailable, "Failed to purge the dead-letter queue")
+		return
+	}
+
+	utils.SuccessResponse(c, "Dead letters purged successfully", gin.H{"purged": purged})
+}
+
+func (h *DeadLetterHandler) respondError(c *gin.Context, msg string, err error) {
+	if errors.Is(err, service.ErrDeadLetterNotFound) {
+		utils.ErrorResponse(c, http.StatusNotFound, "Dead letter not found")
+		return
+	}
+	slog.ErrorContext(c.Request.Context(), msg, "id", c.Param("id"), "error", err)
+	utils.ErrorResponse(c, http.StatusServiceUnavailable, msg)
+}
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log/slog"
+	"net/http"
+	"smat/iot/simulation/iot-inventory-management/internal/service"
+	"smat/iot/simulation/iot-inventory-management/pkg/utils"
+)
+
+type DeviceCredentialHandler struct {
+	credentials service.DeviceCredentialService
+}
+
+func NewDeviceCredentialHandler(credentials service.DeviceCredentialService) *DeviceCredentialHandler {
+	return &DeviceCredentialHandler{credentials: credentials}
+}
+
+// IssueCredential creates the MQTT credential of a device, replacing its
+// previous one. The password is only returned in this response.
+func (h *DeviceCredentialHandler) IssueCredential(c *gin.Context) {
+	deviceID, err := uuid.Parse(c.Param("deviceId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid device ID format")
+		return
+	}
+
+	credential, err := h.credentials.Issue(c.Request.Context(), deviceID)
+	if err != nil {
+		h.respondError(c, "Failed to issue device credential", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Device credential issued successfully", credential)
+}
+
+// RevokeCredential deletes the MQTT credential of a device. Connections
+// already open are not closed.
+func (h *DeviceCredentialHandler) RevokeCredential(c *gin.Context) {
+	deviceID, err := uuid.Parse(c.Param("deviceId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid device ID format")
+		return
+	}
+
+	if err := h.credentials.Revoke(c.Request.Context(), deviceID); err != nil {
+		h.respondError(c, "Failed to revoke device credential", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Device credential revoked successfully", nil)
+}
+
+func (h *DeviceCredentialHandler) respondError(c *gin.Context, message string, err error) {
+	switch {
+	case errors.Is(err, service.ErrCredentialDeviceNotFound):
+		utils.ErrorResponse(c, http.StatusNotFound, "Device not found")
+	case errors.Is(err, service.ErrDeviceCredentialNotFound):
+		utils.ErrorResponse(c, http.StatusNotFound, "Device has no credential")
+	default:
+		slog.ErrorContext(c.Request.Context(), message, "device_id", c.Param("deviceId"), "error", err)
+		utils.ErrorResponse(c, http.StatusInternalServerError, message)
+	}
+}
@@ -12,11 +12,15 @@ import (
 var ErrDeviceNotFound = errors.New("device not found")
 
 type DeviceHandler struct {
-	deviceService service.DeviceService
+	deviceService    service.DeviceService
+	liveStateService service.LiveStateService
 }
 
-func NewDeviceHandler(deviceService service.DeviceService) *DeviceHandler {
-	return &DeviceHandler{deviceService: deviceService}
+func NewDeviceHandler(deviceService service.DeviceService, liveStateService service.LiveStateService) *DeviceHandler {
+	return &DeviceHandler{
+		deviceService:    deviceService,
+		liveStateService: liveStateService,
+	}
 }
 
 func (h *DeviceHandler) GetAllDevices(c *gin.Context) {
@@ -51,6 +55,29 @@ func (h *DeviceHandler) GetDevice(c *gin.Context) {
 	utils.SuccessResponse(c, "Device fetched successfully", device)
 }
 
+// GetLiveState returns the latest reading of a device from the live state
+// store. The source field is "database" when the device has not reported
+// recently and the last flushed values are returned instead.
+func (h *DeviceHandler) GetLiveState(c *gin.Context) {
+	deviceID, err := uuid.Parse(c.Param("deviceId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid device ID format")
+		return
+	}
+
+	state, err := h.liveStateService.Get(c.Request.Context(), deviceID)
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusInternalServerError, "Failed to fetch device state")
+		return
+	}
+	if state == nil {
+		utils.ErrorResponse(c, http.StatusNotFound, "Device not found")
+		return
+	}
+
+	utils.SuccessResponse(c, "Device state fetched successfully", state)
+}
+
 func (h *DeviceHandler) GetDevicesByClient(c *gin.Context) {
 	clientIDStr := c.Param("clientId")
 	clientID, err := uuid.Parse(clientIDStr)
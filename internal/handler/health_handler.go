@@ -7,46 +7,42 @@ import (
 )
 
 type HealthHandler struct {
-	rabbitMQ service.RabbitMQService
+	healthService service.HealthService
+	bus           service.MessageBus
 }
 
-func NewHealthHandler(rabbitMQ service.RabbitMQService) *HealthHandler {
+func NewHealthHandler(healthService service.HealthService, bus service.MessageBus) *HealthHandler {
 	return &HealthHandler{
-		rabbitMQ: rabbitMQ,
+		healthService: healthService,
+		bus:           bus,
 	}
 }
 
-func (h *HealthHandler) HealthCheck(c *gin.Context) {
-	health := gin.H{
-		"status":   "healthy",
-		"services": gin.H{},
-	}
+// Liveness only reports that the process is up and serving requests. It
+// deliberately does not touch any dependency, so a broker or database outage
+// never gets the process restarted.
+func (h *HealthHandler) Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":         "alive",
+		"uptime_seconds": int64(h.healthService.Uptime().Seconds()),
+	})
+}
 
-	statusCode := http.StatusOK
+// Readiness reports per-dependency status. Degraded dependencies still count
+// as ready; only a failing critical dependency returns 503.
+func (h *HealthHandler) Readiness(c *gin.Context) {
+	report := h.healthService.Readiness(c.Request.Context())
 
-	if err := h.rabbitMQ.HealthCheck(); err != nil {
-		health["services"].(gin.H)["rabbitmq"] = gin.H{
-			"status": "unhealthy",
-			"error":  err.Error(),
-		}
-		health["status"] = "unhealthy"
+	statusCode := http.StatusOK
+	if report.Status == service.HealthStatusUnhealthy {
 		statusCode = http.StatusServiceUnavailable
-	} else {
-		health["services"].(gin.H)["rabbitmq"] = gin.H{
-			"status": "healthy",
-		}
-
-		if queueInfo, err := h.rabbitMQ.GetQueueInfo(); err == nil {
-			health["services"].(gin.H)["rabbitmq"].(gin.H)["queue_messages"] = queueInfo.Messages
-			health["services"].(gin.H)["rabbitmq"].(gin.H)["queue_consumers"] = queueInfo.Consumers
-		}
 	}
 
-	c.JSON(statusCode, health)
+	c.JSON(statusCode, report)
 }
 
 func (h *HealthHandler) QueueStats(c *gin.Context) {
-	queueInfo, err := h.rabbitMQ.GetQueueInfo()
+	stats, err := h.bus.QueueStats()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "Failed to get queue statistics",
@@ -55,9 +51,5 @@ func (h *HealthHandler) QueueStats(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"queue_name": queueInfo.Name,
-		"messages":   queueInfo.Messages,
-		"consumers":  queueInfo.Consumers,
-	})
+	c.JSON(http.StatusOK, stats)
 }
@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log/slog"
+	"net/http"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/service"
+	"smat/iot/simulation/iot-inventory-management/pkg/utils"
+)
+
+type ProvisioningHandler struct {
+	provisioning service.ProvisioningService
+}
+
+func NewProvisioningHandler(provisioning service.ProvisioningService) *ProvisioningHandler {
+	return &ProvisioningHandler{provisioning: provisioning}
+}
+
+// RegisterClaim pre-registers a device for the client by serial number.
+// Without claim_token one is generated; the token is only returned in this
+// response.
+func (h *ProvisioningHandler) RegisterClaim(c *gin.Context) {
+	clientID, err := uuid.Parse(c.Param("clientId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid client ID format")
+		return
+	}
+
+	var req struct {
+		SerialNumber string `json:"serial_number" binding:"required"`
+		ClaimToken   string `json:"claim_token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	claim, err := h.provisioning.RegisterClaim(c.Request.Context(), clientID, req.SerialNumber, req.ClaimToken)
+	if err != nil {
+		h.respondError(c, "Failed to register device claim", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Device claim registered successfully", claim)
+}
+
+func (h *ProvisioningHandler) ListClaims(c *gin.Context) {
+	clientID, err := uuid.Parse(c.Param("clientId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid client ID format")
+		return
+	}
+
+	claims, err := h.provisioning.ListClaims(c.Request.Context(), clientID)
+	if err != nil {
+		h.respondError(c, "Failed to fetch device claims", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Device claims fetched successfully", claims)
+}
+
+// DeleteClaim removes a claim. A device already provisioned with it is
+// kept.
+func (h *ProvisioningHandler) DeleteClaim(c *gin.Context) {
+	clientID, err := uuid.Parse(c.Param("clientId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid client ID format")
+		return
+	}
+
+	if err := h.provisioning.DeleteClaim(c.Request.Context(), clientID, c.Param("serialNumber")); err != nil {
+		h.respondError(c, "Failed to delete device claim", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Device claim deleted successfully", nil)
+}
+
+// ListClientPending returns the devices waiting for approval that named
+// the client in their birth message.
+func (h *ProvisioningHandler) ListClientPending(c *gin.Context) {
+	clientID, err := uuid.Parse(c.Param("clientId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid client ID format")
+		return
+	}
+
+	devices, err := h.provisioning.ListPending(c.Request.Context(), &clientID)
+	if err != nil {
+		h.respondError(c, "Failed to fetch pending devices", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Pending devices fetched successfully", devices)
+}
+
+// ApproveClientPending provisions a pending device that named the client
+// and notifies it.
+func (h *ProvisioningHandler) ApproveClientPending(c *gin.Context) {
+	clientID, err := uuid.Parse(c.Param("clientId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid client ID format")
+		return
+	}
+
+	device, err := h.provisioning.Approve(c.Request.Context(), c.Param("serialNumber"), clientID)
+	if err != nil {
+		h.respondError(c, "Failed to approve pending device", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Pending device approved successfully", device)
+}
+
+func (h *ProvisioningHandler) DismissClientPending(c *gin.Context) {
+	clientID, err := uuid.Parse(c.Param("clientId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid client ID format")
+		return
+	}
+
+	if err := h.provisioning.Dismiss(c.Request.Context(), c.Param("serialNumber"), &clientID); err != nil {
+		h.respondError(c, "Failed to dismiss pending device", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Pending device dismissed successfully", nil)
+}
+
+// ListPending returns all devices waiting for approval, optionally only
+// those that named client_id.
+func (h *ProvisioningHandler) ListPending(c *gin.Context) {
+	var clientID *uuid.UUID
+	if raw := c.Query("client_id"); raw != "" {
+		parsed, err := uuid.Parse(raw)
+		if err != nil {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Invalid client ID format")
+			return
+		}
+		clientID = &parsed
+	}
+
+	devices, err := h.provisioning.ListPending(c.Request.Context(), clientID)
+	if err != nil {
+		h.respondError(c, "Failed to fetch pending devices", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Pending devices fetched successfully", devices)
+}
+
+// AssignPending provisions any pending device for the client in the body,
+// whichever client the device named, and notifies it.
+func (h *ProvisioningHandler) AssignPending(c *gin.Context) {
+	var req struct {
+		ClientID uuid.UUID `json:"client_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.ClientID == uuid.Nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	device, err := h.provisioning.Assign(c.Request.Context(), c.Param("serialNumber"), req.ClientID)
+	if err != nil {
+		h.respondError(c, "Failed to assign pending device", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Pending device assigned successfully", device)
+}
+
+func (h *ProvisioningHandler) DismissPending(c *gin.Context) {
+	if err := h.provisioning.Dismiss(c.Request.Context(), c.Param("serialNumber"), nil); err != nil {
+		h.respondError(c, "Failed to dismiss pending device", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Pending device dismissed successfully", nil)
+}
+
+func (h *ProvisioningHandler) respondError(c *gin.Context, message string, err error) {
+	switch {
+	case errors.Is(err, domain.ErrInvalidSerialNumber), errors.Is(err, domain.ErrInvalidClaimToken):
+		utils.ErrorResponse(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrClaimExists):
+		utils.ErrorResponse(c, http.StatusConflict, "Serial number is already registered")
+	case errors.Is(err, service.ErrClaimNotFound):
+		utils.ErrorResponse(c, http.StatusNotFound, "Device claim not found")
+	case errors.Is(err, service.ErrPendingDeviceNotFound):
+		utils.ErrorResponse(c, http.StatusNotFound, "Pending device not found")
+	default:
+		slog.ErrorContext(c.Request.Context(), message, "serial_number", c.Param("serialNumber"), "error", err)
+		utils.ErrorResponse(c, http.StatusInternalServerError, message)
+	}
+}
@@ -48,6 +48,10 @@ func (h *SimulationHandler) SimulateSale(c *gin.Context) {
 			utils.ErrorResponse(c, http.StatusBadRequest, "Invalid device ID format")
 			return
 		}
+		if err.Error() == "items sold exceeds the maximum per sale" {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Items sold exceeds the maximum per sale")
+			return
+		}
 		if err.Error() == "insufficient stock for requested sale" {
 			utils.ErrorResponse(c, http.StatusBadRequest, "Insufficient stock for requested sale")
 			return
@@ -61,7 +65,7 @@ func (h *SimulationHandler) SimulateSale(c *gin.Context) {
 	}
 
 	// once you the get the message publish that message to mqtt service
-	if err := h.mqttService.PublishDeviceMessage(message); err != nil {
+	if err := h.mqttService.PublishDeviceMessage(c.Request.Context(), message); err != nil {
 		utils.ErrorResponse(c, http.StatusInternalServerError, "Failed to publish sale event")
 		return
 	}
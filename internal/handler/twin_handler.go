@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log/slog"
+	"net/http"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/service"
+	"smat/iot/simulation/iot-inventory-management/pkg/utils"
+)
+
+type TwinHandler struct {
+	twins service.TwinService
+}
+
+func NewTwinHandler(twins service.TwinService) *TwinHandler {
+	return &TwinHandler{twins: twins}
+}
+
+// GetTwin returns the desired and reported configuration of a device and
+// the desired properties it has not reported yet.
+func (h *TwinHandler) GetTwin(c *gin.Context) {
+	deviceID, err := uuid.Parse(c.Param("deviceId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid device ID format")
+		return
+	}
+
+	twin, err := h.twins.Get(c.Request.Context(), deviceID)
+	if err != nil {
+		h.respondError(c, "Failed to fetch device twin", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Device twin fetched successfully", twin)
+}
+
+// PatchDesired merges a JSON merge patch into the desired configuration and
+// publishes the result to the device. Passing version makes the update
+// fail with 409 if the desired configuration changed since it was read.
+func (h *TwinHandler) PatchDesired(c *gin.Context) {
+	deviceID, err := uuid.Parse(c.Param("deviceId"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid device ID format")
+		return
+	}
+
+	var req struct {
+		Desired map[string]interface{} `json:"desired" binding:"required"`
+		Version int64                  `json:"version" binding:"min=0"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	twin, err := h.twins.PatchDesired(c.Request.Context(), deviceID, req.Desired, req.Version)
+	if err != nil {
+		h.respondError(c, "Failed to update device twin", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Desired configuration updated successfully", twin)
+}
+
+// ListDrifted returns the twins of devices that do not report their desired
+// configuration.
+func (h *TwinHandler) ListDrifted(c *gin.Context) {
+	twins, err := h.twins.ListDrifted(c.Request.Context())
+	if err != nil {
+		h.respondError(c, "Failed to fetch device twins", err)
+		return
+	}
+
+	utils.SuccessResponse(c, "Drifted device twins fetched successfully", twins)
+}
+
+func (h *TwinHandler) respondError(c *gin.Context, message string, err error) {
+	switch {
+	case errors.Is(err, domain.ErrInvalidTwin):
+		utils.ErrorResponse(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrTwinDeviceNotFound):
+		utils.ErrorResponse(c, http.StatusNotFound, "Device not found")
+	case errors.Is(err, service.ErrTwinVersionConflict):
+		utils.ErrorResponse(c, http.StatusConflict, "Desired configuration was changed concurrently; read it again and retry")
+	case errors.Is(err, service.ErrTwinNotPublished):
+		slog.WarnContext(c.Request.Context(), message, "device_id", c.Param("deviceId"), "error", err)
+		utils.ErrorResponse(c, http.StatusServiceUnavailable, "Desired configuration was saved but could not be published; it is published again when the server restarts or on the next change")
+	default:
+		slog.ErrorContext(c.Request.Context(), message, "device_id", c.Param("deviceId"), "error", err)
+		utils.ErrorResponse(c, http.StatusInternalServerError, message)
+	}
+}
@@ -2,9 +2,10 @@ package handler
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -16,11 +17,14 @@ import (
 )
 
 type UIHandler struct {
-	deviceService service.DeviceService
-	templates     *template.Template
+	deviceService    service.DeviceService
+	auditService     service.AuditService
+	liveStateService service.LiveStateService
+	provisioning     service.ProvisioningService
+	templates        *template.Template
 }
 
-func NewUIHandler(deviceService service.DeviceService) *UIHandler {
+func NewUIHandler(deviceService service.DeviceService, auditService service.AuditService, liveStateService service.LiveStateService, provisioning service.ProvisioningService) *UIHandler {
 	// Create function map
 	funcMap := template.FuncMap{
 		"mul": func(a, b float64) float64 {
@@ -58,7 +62,7 @@ func NewUIHandler(deviceService service.DeviceService) *UIHandler {
 		}
 	}
 
-	log.Printf("Using template directory: %s", templateDir)
+	slog.Info("Using template directory", "dir", templateDir)
 
 	// Parse all template files
 	templateFiles := []string{}
@@ -70,13 +74,13 @@ func NewUIHandler(deviceService service.DeviceService) *UIHandler {
 		}
 		if !info.IsDir() && filepath.Ext(path) == ".html" {
 			templateFiles = append(templateFiles, path)
-			log.Printf("Found template file: %s", path)
+			slog.Debug("Found template file", "path", path)
 		}
 		return nil
 	})
 
 	if err != nil {
-		log.Printf("Error walking template directory: %v", err)
+		slog.Error("Error walking template directory", "error", err)
 		// Try using glob patterns as fallback
 		patterns := []string{
 			filepath.Join(templateDir, "pages", "*.html"),
@@ -87,7 +91,7 @@ func NewUIHandler(deviceService service.DeviceService) *UIHandler {
 		for _, pattern := range patterns {
 			files, err := filepath.Glob(pattern)
 			if err != nil {
-				log.Printf("Error with glob pattern %s: %v", pattern, err)
+				slog.Error("Error with glob pattern", "pattern", pattern, "error", err)
 				continue
 			}
 			templateFiles = append(templateFiles, files...)
@@ -98,28 +102,34 @@ func NewUIHandler(deviceService service.DeviceService) *UIHandler {
 	if len(templateFiles) > 0 {
 		templates, err = templates.ParseFiles(templateFiles...)
 		if err != nil {
-			log.Fatalf("Failed to parse template files: %v", err)
+			slog.Error("Failed to parse template files", "error", err)
+			os.Exit(1)
 		}
 	} else {
-		log.Fatal("No template files found!")
+		slog.Error("No template files found", "dir", templateDir)
+		os.Exit(1)
 	}
 
 	// Log loaded templates for debugging
-	log.Println("Successfully loaded templates:")
+	var templateNames []string
 	for _, tmpl := range templates.Templates() {
-		log.Printf("  - %s", tmpl.Name())
+		templateNames = append(templateNames, tmpl.Name())
 	}
+	slog.Info("Successfully loaded templates", "templates", templateNames)
 
 	return &UIHandler{
-		deviceService: deviceService,
-		templates:     templates,
+		deviceService:    deviceService,
+		auditService:     auditService,
+		liveStateService: liveStateService,
+		provisioning:     provisioning,
+		templates:        templates,
 	}
 }
 
 func (h *UIHandler) LoginPage(c *gin.Context) {
 	// Check if templates are loaded
 	if h.templates == nil {
-		log.Printf("Templates not loaded!")
+		slog.ErrorContext(c.Request.Context(), "Templates not loaded")
 		c.String(http.StatusInternalServerError, "Templates not loaded")
 		return
 	}
@@ -141,7 +151,7 @@ func (h *UIHandler) LoginPage(c *gin.Context) {
 	var buf bytes.Buffer
 	err = h.templates.ExecuteTemplate(&buf, "login", data)
 	if err != nil {
-		log.Printf("Error rendering login template: %v", err)
+		slog.ErrorContext(c.Request.Context(), "Error rendering login template", "error", err)
 		c.String(http.StatusInternalServerError, "Error rendering template: %v", err)
 		return
 	}
@@ -188,16 +198,18 @@ func (h *UIHandler) HandleLogin(c *gin.Context) {
 	clientUUID, _ := uuid.Parse(clientID)
 	devices, err := h.deviceService.GetDevicesByClient(c.Request.Context(), clientUUID)
 	if err != nil {
-		log.Printf("Error fetching devices for client %s: %v", clientID, err)
+		slog.ErrorContext(c.Request.Context(), "Error fetching devices", "client_id", clientID, "error", err)
 	}
 
 	if len(devices) == 0 {
-		log.Printf("No devices found for client %s, but allowing login", clientID)
+		slog.InfoContext(c.Request.Context(), "No devices found for client, but allowing login", "client_id", clientID)
 	}
 
 	// Set session cookie
 	c.SetCookie("client_id", clientID, 3600, "/", "", false, true)
 
+	h.recordSessionAudit(c, domain.AuditActionLogin, clientUUID)
+
 	// Use HX-Redirect header for HTMX
 	c.Header("HX-Redirect", "/ui/dashboard")
 	c.Status(http.StatusOK)
@@ -206,7 +218,7 @@ func (h *UIHandler) HandleLogin(c *gin.Context) {
 func (h *UIHandler) Dashboard(c *gin.Context) {
 	// Check if templates are loaded
 	if h.templates == nil {
-		log.Printf("Templates not loaded!")
+		slog.ErrorContext(c.Request.Context(), "Templates not loaded")
 		c.String(http.StatusInternalServerError, "Templates not loaded")
 		return
 	}
@@ -229,7 +241,7 @@ func (h *UIHandler) Dashboard(c *gin.Context) {
 
 	devices, err := h.deviceService.GetDevicesByClient(c.Request.Context(), clientUUID)
 	if err != nil {
-		log.Printf("Error fetching devices: %v", err)
+		slog.ErrorContext(c.Request.Context(), "Error fetching devices", "client_id", clientUUID, "error", err)
 		devices = []*domain.Device{}
 	}
 
@@ -248,7 +260,7 @@ func (h *UIHandler) Dashboard(c *gin.Context) {
 	var buf bytes.Buffer
 	err = h.templates.ExecuteTemplate(&buf, "dashboard", data)
 	if err != nil {
-		log.Printf("Error rendering dashboard template: %v", err)
+		slog.ErrorContext(c.Request.Context(), "Error rendering dashboard template", "error", err)
 		c.String(http.StatusInternalServerError, "Error rendering template: %v", err)
 		return
 	}
@@ -272,11 +284,14 @@ func (h *UIHandler) GetDevices(c *gin.Context) {
 
 	devices, err := h.deviceService.GetDevicesByClient(c.Request.Context(), clientUUID)
 	if err != nil {
-		log.Printf("Error fetching devices: %v", err)
+		slog.ErrorContext(c.Request.Context(), "Error fetching devices", "client_id", clientUUID, "error", err)
 		c.String(http.StatusInternalServerError, "Error fetching devices")
 		return
 	}
 
+	// Show the latest readings rather than the last flushed values.
+	h.liveStateService.Overlay(c.Request.Context(), devices)
+
 	if len(devices) == 0 {
 		emptyHTML := `<div class="col-span-full text-center py-12">
             <svg class="mx-auto h-12 w-12 text-gray-400" fill="none" stroke="currentColor" viewBox="0 0 24 24">
@@ -293,7 +308,7 @@ func (h *UIHandler) GetDevices(c *gin.Context) {
 		var cardBuf bytes.Buffer
 		err := h.templates.ExecuteTemplate(&cardBuf, "device-card", device)
 		if err != nil {
-			log.Printf("Error rendering device card: %v", err)
+			slog.ErrorContext(c.Request.Context(), "Error rendering device card", "device_id", device.ID, "error", err)
 			continue
 		}
 		html.Write(cardBuf.Bytes())
@@ -321,11 +336,14 @@ func (h *UIHandler) GetDeviceModal(c *gin.Context) {
 		c.String(http.StatusInternalServerError, "Error fetching device")
 		return
 	}
+	if device != nil {
+		h.liveStateService.Overlay(c.Request.Context(), []*domain.Device{device})
+	}
 
 	var buf bytes.Buffer
 	err = h.templates.ExecuteTemplate(&buf, "device-modal", device)
 	if err != nil {
-		log.Printf("Error rendering modal: %v", err)
+		slog.ErrorContext(c.Request.Context(), "Error rendering modal", "device_id", deviceUUID, "error", err)
 		c.String(http.StatusInternalServerError, "Error rendering modal: %v", err)
 		return
 	}
@@ -334,7 +352,109 @@ func (h *UIHandler) GetDeviceModal(c *gin.Context) {
 	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(modalHTML))
 }
 
+// PendingDevices renders the devices waiting for approval that named the
+// logged-in client in their birth message.
+func (h *UIHandler) PendingDevices(c *gin.Context) {
+	clientID, ok := h.sessionClient(c)
+	if !ok {
+		return
+	}
+	h.renderPendingDevices(c, clientID)
+}
+
+// ApprovePendingDevice provisions a pending device for the logged-in client
+// and renders the remaining pending devices.
+func (h *UIHandler) ApprovePendingDevice(c *gin.Context) {
+	clientID, ok := h.sessionClient(c)
+	if !ok {
+		return
+	}
+
+	serialNumber := c.Param("serialNumber")
+	device, err := h.provisioning.Approve(c.Request.Context(), serialNumber, clientID)
+	if errors.Is(err, service.ErrPendingDeviceNotFound) {
+		c.String(http.StatusNotFound, "Pending device not found")
+		return
+	}
+	if errors.Is(err, service.ErrClaimExists) {
+		c.String(http.StatusConflict, "Serial number is already registered")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error approving pending device", "serial_number", serialNumber, "client_id", clientID, "error", err)
+		c.String(http.StatusInternalServerError, "Error approving device")
+		return
+	}
+	slog.InfoContext(c.Request.Context(), "Approved pending device", "serial_number", serialNumber, "device_id", device.ID, "client_id", clientID)
+
+	// Reloads the device grid.
+	c.Header("HX-Trigger", "device-provisioned")
+	h.renderPendingDevices(c, clientID)
+}
+
+func (h *UIHandler) DismissPendingDevice(c *gin.Context) {
+	clientID, ok := h.sessionClient(c)
+	if !ok {
+		return
+	}
+
+	serialNumber := c.Param("serialNumber")
+	err := h.provisioning.Dismiss(c.Request.Context(), serialNumber, &clientID)
+	if errors.Is(err, service.ErrPendingDeviceNotFound) {
+		c.String(http.StatusNotFound, "Pending device not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error dismissing pending device", "serial_number", serialNumber, "error", err)
+		c.String(http.StatusInternalServerError, "Error dismissing device")
+		return
+	}
+	h.renderPendingDevices(c, clientID)
+}
+
+func (h *UIHandler) renderPendingDevices(c *gin.Context, clientID uuid.UUID) {
+	if h.templates == nil {
+		c.String(http.StatusInternalServerError, "Templates not loaded")
+		return
+	}
+
+	devices, err := h.provisioning.ListPending(c.Request.Context(), &clientID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error fetching pending devices", "client_id", clientID, "error", err)
+		c.String(http.StatusInternalServerError, "Error fetching pending devices")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := h.templates.ExecuteTemplate(&buf, "pending-devices", devices); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error rendering pending devices", "client_id", clientID, "error", err)
+		c.String(http.StatusInternalServerError, "Error rendering template: %v", err)
+		return
+	}
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+}
+
+// sessionClient returns the client of the session cookie, or responds with
+// 401 if there is none.
+func (h *UIHandler) sessionClient(c *gin.Context) (uuid.UUID, bool) {
+	clientID, err := c.Cookie("client_id")
+	if err == nil {
+		if clientUUID, err := uuid.Parse(clientID); err == nil {
+			return clientUUID, true
+		}
+	}
+	c.String(http.StatusUnauthorized, "Not logged in")
+	return uuid.Nil, false
+}
+
 func (h *UIHandler) Logout(c *gin.Context) {
+	if clientID, err := c.Cookie("client_id"); err == nil {
+		if clientUUID, err := uuid.Parse(clientID); err == nil {
+			h.recordSessionAudit(c, domain.AuditActionLogout, clientUUID)
+		}
+	}
+
 	// Clear the cookie
 	c.SetCookie("client_id", "", -1, "/", "", false, true)
 	c.Redirect(http.StatusFound, "/ui/login")
@@ -353,7 +473,7 @@ func (h *UIHandler) HelloWorldPage(c *gin.Context) {
 	var buf bytes.Buffer
 	err := h.templates.ExecuteTemplate(&buf, "hello_world", data)
 	if err != nil {
-		log.Printf("Error rendering hello_world template: %v", err)
+		slog.ErrorContext(c.Request.Context(), "Error rendering hello_world template", "error", err)
 		c.String(http.StatusInternalServerError, "Error rendering template: %v", err)
 		return
 	}
@@ -374,10 +494,28 @@ func (h *UIHandler) GoToHelloWorldPage(c *gin.Context) {
 	var buf bytes.Buffer
 	err := h.templates.ExecuteTemplate(&buf, "go_to_hello_world", data)
 	if err != nil {
-		log.Printf("Error rendering go_to_hello_world template: %v", err)
+		slog.ErrorContext(c.Request.Context(), "Error rendering go_to_hello_world template", "error", err)
 		c.String(http.StatusInternalServerError, "Error rendering template: %v", err)
 		return
 	}
 
 	c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
 }
+
+func (h *UIHandler) recordSessionAudit(c *gin.Context, action string, clientID uuid.UUID) {
+	// The session cookie is not part of the request yet on login, so the
+	// actor is set explicitly rather than taken from the audit middleware.
+	actor := domain.AuditActorFromContext(c.Request.Context())
+	actor.Actor = "client:" + clientID.String()
+	actor.ClientID = &clientID
+	ctx := domain.ContextWithAuditActor(c.Request.Context(), actor)
+
+	entry := &domain.AuditEntry{
+		Action:       action,
+		ResourceType: domain.AuditResourceSession,
+		ResourceID:   clientID.String(),
+	}
+	if err := h.auditService.Record(ctx, entry, nil, nil); err != nil {
+		slog.ErrorContext(ctx, "Failed to record audit entry", "action", action, "client_id", clientID, "error", err)
+	}
+}
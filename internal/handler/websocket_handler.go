@@ -3,7 +3,7 @@ package handler
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	"log"
+	"log/slog"
 	"net/http"
 	"smat/iot/simulation/iot-inventory-management/internal/service"
 )
@@ -27,15 +27,11 @@ func NewWebSocketHandler(hub *service.WebSocketHub) *WebSocketHandler {
 func (h *WebSocketHandler) HandleWebSocket(c *gin.Context) {
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		log.Printf("Failed to upgrade connection: %v", err)
+		slog.ErrorContext(c.Request.Context(), "Failed to upgrade connection", "error", err)
 		return
 	}
 
-	client := &service.WebSocketClient{
-		Hub:  h.hub,
-		Conn: conn,
-		Send: make(chan []byte, 256),
-	}
+	client := h.hub.NewClient(conn)
 
 	h.hub.Register <- client
 
@@ -0,0 +1,144 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type contextKey string
+
+const (
+	attrsContextKey     = contextKey("log_attrs")
+	requestIDContextKey = contextKey("request_id")
+)
+
+var level = new(slog.LevelVar)
+
+// Setup installs the process-wide slog logger. format is "json" or "text";
+// levelName is one of debug, info, warn or error.
+func Setup(levelName, format string) error {
+	if err := SetLevel(levelName); err != nil {
+		return err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "json":
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	slog.SetDefault(slog.New(&contextHandler{Handler: handler}))
+	return nil
+}
+
+// SetLevel changes the minimum log level at runtime.
+func SetLevel(levelName string) error {
+	parsed, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	level.Set(parsed)
+	return nil
+}
+
+func ParseLevel(levelName string) (slog.Level, error) {
+	var parsed slog.Level
+	if levelName == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := parsed.UnmarshalText([]byte(levelName)); err != nil {
+		return parsed, fmt.Errorf("unknown log level %q", levelName)
+	}
+	return parsed, nil
+}
+
+// With returns a copy of ctx whose log records will carry args in addition to
+// any attributes already attached further up the call chain.
+func With(ctx context.Context, args ...any) context.Context {
+	existing, _ := ctx.Value(attrsContextKey).([]slog.Attr)
+	record := slog.Record{}
+	record.Add(args...)
+
+	attrs := make([]slog.Attr, 0, len(existing)+record.NumAttrs())
+	attrs = append(attrs, existing...)
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, attr)
+		return true
+	})
+
+	return context.WithValue(ctx, attrsContextKey, attrs)
+}
+
+// WithRequestID attaches the request ID to ctx for logging and auditing.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	ctx = context.WithValue(ctx, requestIDContextKey, requestID)
+	return With(ctx, "request_id", requestID)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey).(string)
+	return requestID
+}
+
+// contextHandler adds the attributes stored with With and the current trace
+// and span IDs to every record logged with a context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs, ok := ctx.Value(attrsContextKey).([]slog.Attr); ok {
+		record.AddAttrs(attrs...)
+	}
+
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		record.AddAttrs(
+			slog.String("trace_id", spanContext.TraceID().String()),
+			slog.String("span_id", spanContext.SpanID().String()),
+		)
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// AtLeast returns a logger that drops the records of l below minimum, for
+// libraries that log more than the rest of the server should.
+func AtLeast(l *slog.Logger, minimum slog.Level) *slog.Logger {
+	return slog.New(&minimumLevelHandler{Handler: l.Handler(), minimum: minimum})
+}
+
+type minimumLevelHandler struct {
+	slog.Handler
+	minimum slog.Level
+}
+
+func (h *minimumLevelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.minimum && h.Handler.Enabled(ctx, level)
+}
+
+func (h *minimumLevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &minimumLevelHandler{Handler: h.Handler.WithAttrs(attrs), minimum: h.minimum}
+}
+
+func (h *minimumLevelHandler) WithGroup(name string) slog.Handler {
+	return &minimumLevelHandler{Handler: h.Handler.WithGroup(name), minimum: h.minimum}
+}
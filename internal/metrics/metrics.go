@@ -0,0 +1,461 @@
+package metrics
+
+import (
+	"database/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "iot_inventory"
+
+var (
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	MQTTMessagesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "messages_received_total",
+		Help:      "MQTT messages received from devices.",
+	})
+
+	MQTTMessagesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "messages_failed_total",
+		Help:      "MQTT messages that could not be processed, by reason.",
+	}, []string{"reason"})
+
+	MQTTReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "reconnects_total",
+		Help:      "MQTT reconnect attempts.",
+	})
+
+	MQTTConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "connected",
+		Help:      "Whether the MQTT client is connected (1) or not (0).",
+	})
+
+	MQTTBrokerClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt_broker",
+		Name:      "clients",
+		Help:      "Clients connected to the embedded MQTT broker.",
+	})
+
+	MQTTBrokerAuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt_broker",
+		Name:      "auth_failures_total",
+		Help:      "Connections and topic accesses the embedded MQTT broker refused, by reason.",
+	}, []string{"reason"})
+
+	RabbitMQPublishDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "rabbitmq",
+		Name:      "publish_duration_seconds",
+		Help:      "Time taken to publish a message to RabbitMQ, including retries.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	})
+
+	RabbitMQPublishRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "rabbitmq",
+		Name:      "publish_retries_total",
+		Help:      "RabbitMQ publish attempts that were retried.",
+	})
+
+	RabbitMQPublishFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "rabbitmq",
+		Name:      "publish_failures_total",
+		Help:      "RabbitMQ publishes that failed after all retries.",
+	})
+
+	RabbitMQConfirmDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "rabbitmq",
+		Name:      "confirm_duration_seconds",
+		Help:      "Time from publishing a message to the broker confirming it.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	})
+
+	RabbitMQPublishUnconfirmed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "rabbitmq",
+		Name:      "publish_unconfirmed_total",
+		Help:      "Publish attempts the broker did not accept, by reason (nack, returned, timeout).",
+	}, []string{"reason"})
+
+	RabbitMQMessagesConsumed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "rabbitmq",
+		Name:      "messages_consumed_total",
+		Help:      "Messages delivered by the RabbitMQ consumer.",
+	})
+
+	RabbitMQReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "rabbitmq",
+		Name:      "reconnects_total",
+		Help:      "RabbitMQ connection losses that triggered a reconnect.",
+	})
+
+	RabbitMQDeadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "rabbitmq",
+		Name:      "dead_lettered_total",
+		Help:      "Messages moved to the dead-letter queue, by reason.",
+	}, []string{"reason"})
+
+	RabbitMQDeadLettersReplayed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "rabbitmq",
+		Name:      "dead_letters_replayed_total",
+		Help:      "Dead letters published back onto the main queue.",
+	})
+
+	NATSPublishDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "nats",
+		Name:      "publish_duration_seconds",
+		Help:      "Time taken to publish a message to JetStream until it is stored.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	})
+
+	NATSPublishFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "nats",
+		Name:      "publish_failures_total",
+		Help:      "JetStream publishes that failed.",
+	})
+
+	NATSMessagesConsumed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "nats",
+		Name:      "messages_consumed_total",
+		Help:      "Messages delivered by the JetStream consumer.",
+	})
+
+	NATSDeadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "nats",
+		Name:      "dead_lettered_total",
+		Help:      "Messages moved to the dead-letter stream, by reason.",
+	}, []string{"reason"})
+
+	NATSDeadLettersReplayed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "nats",
+		Name:      "dead_letters_replayed_total",
+		Help:      "Dead letters published back to the consumer.",
+	})
+
+	RedisStreamMessagesConsumed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "redis_stream",
+		Name:      "messages_consumed_total",
+		Help:      "Entries read from the Redis stream by this server's consumer.",
+	})
+
+	RedisStreamReclaimed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "redis_stream",
+		Name:      "reclaimed_total",
+		Help:      "Pending entries reclaimed with XAUTOCLAIM from consumers that stopped acking them.",
+	})
+
+	RedisStreamDeadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "redis_stream",
+		Name:      "dead_lettered_total",
+		Help:      "Entries moved to the dead-letter stream, by reason.",
+	}, []string{"reason"})
+
+	RedisStreamDeadLettersReplayed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "redis_stream",
+		Name:      "dead_letters_replayed_total",
+		Help:      "Dead letters added back to the consumer stream.",
+	})
+
+	RedisStreamLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "redis_stream",
+		Name:      "lag",
+		Help:      "Entries in the consumer stream not yet delivered to the consumer group.",
+	})
+
+	RedisStreamPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "redis_stream",
+		Name:      "pending",
+		Help:      "Entries delivered to the consumer group but not acked yet.",
+	})
+
+	RedisStreamLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "redis_stream",
+		Name:      "length",
+		Help:      "Entries kept in the consumer stream.",
+	})
+
+	SpoolPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "spool",
+		Name:      "pending_messages",
+		Help:      "Messages buffered on disk waiting to be published to RabbitMQ.",
+	})
+
+	SpoolBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "spool",
+		Name:      "size_bytes",
+		Help:      "Disk space taken by the spool.",
+	})
+
+	SpoolAppended = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "spool",
+		Name:      "appended_total",
+		Help:      "Messages written to the spool while RabbitMQ was unavailable.",
+	})
+
+	SpoolReplayed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "spool",
+		Name:      "replayed_total",
+		Help:      "Spooled messages published to RabbitMQ after it came back.",
+	})
+
+	SpoolDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "spool",
+		Name:      "dropped_total",
+		Help:      "Messages rejected because the spool was full.",
+	})
+
+	WebSocketClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "clients",
+		Help:      "Currently connected WebSocket clients.",
+	})
+
+	WebSocketBroadcasts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "broadcasts_total",
+		Help:      "Messages broadcast to WebSocket clients.",
+	})
+
+	WebSocketDroppedSends = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "dropped_sends_total",
+		Help:      "Sends dropped because a client's buffer was full; the client is disconnected.",
+	})
+
+	WebSocketRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "rejected_clients_total",
+		Help:      "WebSocket connections rejected because the client limit was reached.",
+	})
+
+	AlertsRaised = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "alerts",
+		Name:      "raised_total",
+		Help:      "Alerts raised, by kind.",
+	}, []string{"kind"})
+
+	PresenceTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "presence",
+		Name:      "transitions_total",
+		Help:      "Devices coming online or going offline, by new state and reason.",
+	}, []string{"state", "reason"})
+
+	DevicesOnline = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "presence",
+		Name:      "online_devices",
+		Help:      "Devices currently online, as of the last sweep.",
+	})
+
+	CommandsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "commands",
+		Name:      "sent_total",
+		Help:      "Commands published to devices, by command.",
+	}, []string{"command"})
+
+	CommandsCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "commands",
+		Name:      "completed_total",
+		Help:      "Commands that reached a final status, by command and status.",
+	}, []string{"command", "status"})
+
+	CommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "commands",
+		Name:      "duration_seconds",
+		Help:      "Time from sending a command to the device acknowledging it.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"command"})
+
+	TwinUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "twins",
+		Name:      "updates_total",
+		Help:      "Device twin changes, by section (desired or reported).",
+	}, []string{"section"})
+
+	TwinsDrifted = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "twins",
+		Name:      "drifted_devices",
+		Help:      "Devices whose reported configuration differs from the desired one, as of the last drift listing.",
+	})
+
+	ProvisioningBirths = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "provisioning",
+		Name:      "births_total",
+		Help:      "Birth messages from devices asking to be provisioned, by result (provisioned, pending, rejected, invalid).",
+	}, []string{"result"})
+
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "requests_total",
+		Help:      "Cache lookups by cache and result (hit, miss, error).",
+	}, []string{"cache", "result"})
+
+	CacheInvalidations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "invalidations_total",
+		Help:      "Cache keys invalidated after writes.",
+	})
+
+	LiveStateStaleReadings = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "live_state",
+		Name:      "stale_readings_total",
+		Help:      "Device readings ignored because a newer reading was already stored.",
+	})
+
+	LiveStateFlushedDevices = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "live_state",
+		Name:      "flushed_devices_total",
+		Help:      "Device states written back to PostgreSQL.",
+	})
+
+	LiveStateFlushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "live_state",
+		Name:      "flush_duration_seconds",
+		Help:      "Time taken to flush live device state to PostgreSQL.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	ConsumerMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "consumer",
+		Name:      "messages_total",
+		Help:      "Consumed messages by outcome (acked, requeued, dead_lettered, deferred).",
+	}, []string{"outcome"})
+
+	ConsumerHandleDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "consumer",
+		Name:      "handle_duration_seconds",
+		Help:      "Time a worker spent handling one message.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"worker"})
+
+	IngestionReadings = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ingestion",
+		Name:      "readings_total",
+		Help:      "Readings written to PostgreSQL by the ingestion worker.",
+	})
+
+	IngestionDuplicates = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ingestion",
+		Name:      "duplicate_readings_total",
+		Help:      "Redelivered readings skipped because they were already stored.",
+	})
+
+	IngestionFailedBatches = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ingestion",
+		Name:      "failed_batches_total",
+		Help:      "Batches that failed to commit; their messages are requeued.",
+	})
+
+	IngestionBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "ingestion",
+		Name:      "batch_size",
+		Help:      "Readings per written batch.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+	IngestionFlushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "ingestion",
+		Name:      "flush_duration_seconds",
+		Help:      "Time taken to write one batch.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	IngestionLag = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "ingestion",
+		Name:      "lag_seconds",
+		Help:      "Time from a device reading to its commit in PostgreSQL.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	})
+
+	IngestionPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "ingestion",
+		Name:      "pending_readings",
+		Help:      "Readings buffered and waiting for the next batch.",
+	})
+
+	SalesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "inventory",
+		Name:      "sales_total",
+		Help:      "Sales recorded per tenant.",
+	}, []string{"client_id"})
+
+	ItemsSoldTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "inventory",
+		Name:      "items_sold_total",
+		Help:      "Items sold per tenant.",
+	}, []string{"client_id"})
+)
+
+// RegisterDBStats exposes the connection pool statistics of db.
+func RegisterDBStats(db *sql.DB) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "postgres"))
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/logger"
+)
+
+// AuditContext attaches the request's actor, tenant, client IP and request ID
+// to the request context so services can record audit entries. Requests
+// without a session are recorded as AuditActorAnonymous with the address of
+// the connection, which unlike a forwarding header the caller cannot choose,
+// and have no tenant of their own.
+func AuditContext() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		actor := domain.AuditActor{
+			Actor:     domain.AuditActorAnonymous,
+			IPAddress: c.RemoteIP(),
+			RequestID: logger.RequestIDFromContext(c.Request.Context()),
+		}
+
+		if clientID, err := c.Cookie("client_id"); err == nil {
+			if clientUUID, err := uuid.Parse(clientID); err == nil {
+				actor.Actor = "client:" + clientUUID.String()
+				actor.ClientID = &clientUUID
+				actor.IPAddress = c.ClientIP()
+			}
+		}
+
+		c.Request = c.Request.WithContext(domain.ContextWithAuditActor(c.Request.Context(), actor))
+		c.Next()
+	}
+}
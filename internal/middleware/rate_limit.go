@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+	"net/http"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/pkg/utils"
+	"sync"
+	"time"
+)
+
+// rateLimiterIdleTTL is how long a client's limiter is kept after its last
+// request.
+const rateLimiterIdleTTL = 10 * time.Minute
+
+// RateLimiter limits requests per client IP. Its limits can be changed at
+// runtime with ApplySettings; existing clients keep their accumulated tokens.
+type RateLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		limit:     rate.Inf,
+		clients:   make(map[string]*clientLimiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// ApplySettings sets the per-client rate and burst. A rate of 0 disables
+// limiting.
+func (l *RateLimiter) ApplySettings(cfg *config.Config) {
+	limit := rate.Limit(cfg.RateLimitRPS)
+	if cfg.RateLimitRPS == 0 {
+		limit = rate.Inf
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = limit
+	l.burst = cfg.RateLimitBurst
+
+	now := time.Now()
+	for _, client := range l.clients {
+		client.limiter.SetLimitAt(now, limit)
+		client.limiter.SetBurstAt(now, cfg.RateLimitBurst)
+	}
+}
+
+func (l *RateLimiter) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !l.allow(c.ClientIP()) {
+			c.Header("Retry-After", "1")
+			utils.ErrorResponse(c, http.StatusTooManyRequests, "Rate limit exceeded")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func (l *RateLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit == rate.Inf {
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > rateLimiterIdleTTL {
+		for key, client := range l.clients {
+			if now.Sub(client.lastSeen) > rateLimiterIdleTTL {
+				delete(l.clients, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = now
+
+	return client.limiter.AllowN(now, 1)
+}
@@ -0,0 +1,134 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"strings"
+)
+
+type auditRepository struct {
+	db *sql.DB
+}
+
+func NewAuditRepository(db *sql.DB) AuditRepository {
+	return &auditRepository{db: db}
+}
+
+func (r *auditRepository) Append(ctx context.Context, entry *domain.AuditEntry) error {
+	var changes []byte
+	if len(entry.Changes) > 0 {
+		var err error
+		changes, err = json.Marshal(entry.Changes)
+		if err != nil {
+			return fmt.Errorf("failed to marshal audit changes: %w", err)
+		}
+	}
+
+	query := `
+        INSERT INTO audit_log (actor, client_id, action, resource_type, resource_id, ip_address, request_id, before_state, after_state, changes)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+        RETURNING id, occurred_at`
+
+	return r.db.QueryRowContext(ctx, query,
+		entry.Actor, entry.ClientID, entry.Action, entry.ResourceType, nullString(entry.ResourceID),
+		nullString(entry.IPAddress), nullString(entry.RequestID),
+		nullJSON(entry.Before), nullJSON(entry.After), nullJSON(changes),
+	).Scan(&entry.ID, &entry.OccurredAt)
+}
+
+func (r *auditRepository) List(ctx context.Context, filter domain.AuditFilter) ([]*domain.AuditEntry, error) {
+	var conditions []string
+	var args []interface{}
+
+	addCondition := func(clause string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(clause, len(args)))
+	}
+
+	if filter.Actor != "" {
+		addCondition("actor = $%d", filter.Actor)
+	}
+	if filter.ClientID != nil {
+		addCondition("client_id = $%d", *filter.ClientID)
+	}
+	if filter.Action != "" {
+		addCondition("action = $%d", filter.Action)
+	}
+	if filter.ResourceType != "" {
+		addCondition("resource_type = $%d", filter.ResourceType)
+	}
+	if filter.ResourceID != "" {
+		addCondition("resource_id = $%d", filter.ResourceID)
+	}
+	if !filter.From.IsZero() {
+		addCondition("occurred_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addCondition("occurred_at < $%d", filter.To)
+	}
+
+	query := `
+        SELECT id, occurred_at, actor, client_id, action, resource_type, resource_id, ip_address, request_id, before_state, after_state, changes
+        FROM audit_log`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	args = append(args, filter.EffectiveLimit(), filter.Offset)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*domain.AuditEntry
+	for rows.Next() {
+		entry := &domain.AuditEntry{}
+		var clientID uuid.NullUUID
+		var resourceID, ipAddress, requestID sql.NullString
+		var before, after, changes []byte
+
+		err := rows.Scan(
+			&entry.ID, &entry.OccurredAt, &entry.Actor, &clientID, &entry.Action, &entry.ResourceType,
+			&resourceID, &ipAddress, &requestID, &before, &after, &changes,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if clientID.Valid {
+			entry.ClientID = &clientID.UUID
+		}
+		entry.ResourceID = resourceID.String
+		entry.IPAddress = ipAddress.String
+		entry.RequestID = requestID.String
+		entry.Before = before
+		entry.After = after
+		if len(changes) > 0 {
+			if err := json.Unmarshal(changes, &entry.Changes); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal audit changes: %w", err)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullJSON(b []byte) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	return string(b)
+}
@@ -0,0 +1,210 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"time"
+)
+
+const (
+	deviceCacheName        = "device"
+	clientDevicesCacheName = "client_devices"
+)
+
+// cachedDeviceRepository is a read-through Redis cache in front of another
+// DeviceRepository. Single devices and per-client device lists are cached;
+// writes go to the wrapped repository first and then invalidate the affected
+// keys.
+//
+// Redis is treated as best effort: any cache error is logged and the call
+// falls through to the wrapped repository. A read that races with a write
+// can repopulate a stale entry, which the TTL bounds.
+type cachedDeviceRepository struct {
+	next            DeviceRepository
+	client          *redis.Client
+	deviceTTL       time.Duration
+	clientDeviceTTL time.Duration
+}
+
+func NewCachedDeviceRepository(next DeviceRepository, client *redis.Client, deviceTTL, clientDeviceTTL time.Duration) DeviceRepository {
+	return &cachedDeviceRepository{
+		next:            next,
+		client:          client,
+		deviceTTL:       deviceTTL,
+		clientDeviceTTL: clientDeviceTTL,
+	}
+}
+
+func deviceCacheKey(id uuid.UUID) string {
+	return "cache:device:" + id.String()
+}
+
+func clientDevicesCacheKey(clientID uuid.UUID) string {
+	return "cache:client_devices:" + clientID.String()
+}
+
+func (r *cachedDeviceRepository) Create(ctx context.Context, device *domain.Device) error {
+	if err := r.next.Create(ctx, device); err != nil {
+		return err
+	}
+	r.invalidate(ctx, clientDevicesCacheKey(device.ClientID))
+	return nil
+}
+
+func (r *cachedDeviceRepository) GetByDeviceID(ctx context.Context, id uuid.UUID) (*domain.Device, error) {
+	key := deviceCacheKey(id)
+
+	var device *domain.Device
+	if r.get(ctx, deviceCacheName, key, &device) {
+		return device, nil
+	}
+
+	device, err := r.next.GetByDeviceID(ctx, id)
+	if err != nil || device == nil {
+		return device, err
+	}
+
+	r.set(ctx, key, device, r.deviceTTL)
+	return device, nil
+}
+
+func (r *cachedDeviceRepository) GetByClientID(ctx context.Context, clientID uuid.UUID) ([]*domain.Device, error) {
+	key := clientDevicesCacheKey(clientID)
+
+	var devices []*domain.Device
+	if r.get(ctx, clientDevicesCacheName, key, &devices) {
+		return devices, nil
+	}
+
+	devices, err := r.next.GetByClientID(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	r.set(ctx, key, devices, r.clientDeviceTTL)
+	return devices, nil
+}
+
+// GetAll is not cached; it is only used by admin listings.
+func (r *cachedDeviceRepository) GetAll(ctx context.Context) ([]*domain.Device, error) {
+	return r.next.GetAll(ctx)
+}
+
+func (r *cachedDeviceRepository) Update(ctx context.Context, device *domain.Device) error {
+	if err := r.next.Update(ctx, device); err != nil {
+		return err
+	}
+	r.invalidate(ctx, deviceCacheKey(device.ID), clientDevicesCacheKey(device.ClientID))
+	return nil
+}
+
+func (r *cachedDeviceRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	// Look the device up first so its client's device list can be
+	// invalidated too.
+	device, err := r.next.GetByDeviceID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := r.next.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	keys := []string{deviceCacheKey(id)}
+	if device != nil {
+		keys = append(keys, clientDevicesCacheKey(device.ClientID))
+	}
+	r.invalidate(ctx, keys...)
+	return nil
+}
+
+// UpdateLiveState invalidates the updated devices but not the client lists;
+// those expire on their own shortly and flushes happen often.
+func (r *cachedDeviceRepository) UpdateLiveState(ctx context.Context, states []*domain.DeviceLiveState) error {
+	if err := r.next.UpdateLiveState(ctx, states); err != nil {
+		return err
+	}
+	if len(states) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(states))
+	for i, state := range states {
+		keys[i] = deviceCacheKey(state.DeviceID)
+	}
+	r.invalidate(ctx, keys...)
+	return nil
+}
+
+// SetOnline invalidates the device but, as with UpdateLiveState, not its
+// client's list.
+func (r *cachedDeviceRepository) SetOnline(ctx context.Context, id uuid.UUID, online bool, seenAt time.Time) error {
+	if err := r.next.SetOnline(ctx, id, online, seenAt); err != nil {
+		return err
+	}
+	r.invalidate(ctx, deviceCacheKey(id))
+	return nil
+}
+
+func (r *cachedDeviceRepository) MarkStaleOffline(ctx context.Context, keep []uuid.UUID, seenBefore time.Time) ([]uuid.UUID, error) {
+	stale, err := r.next.MarkStaleOffline(ctx, keep, seenBefore)
+	if err != nil || len(stale) == 0 {
+		return stale, err
+	}
+
+	keys := make([]string, len(stale))
+	for i, id := range stale {
+		keys[i] = deviceCacheKey(id)
+	}
+	r.invalidate(ctx, keys...)
+	return stale, nil
+}
+
+// get loads key into dest and reports whether it was a cache hit.
+func (r *cachedDeviceRepository) get(ctx context.Context, cache, key string, dest interface{}) bool {
+	data, err := r.client.Get(ctx, key).Bytes()
+	switch {
+	case errors.Is(err, redis.Nil):
+		metrics.CacheRequests.WithLabelValues(cache, "miss").Inc()
+		return false
+	case err != nil:
+		metrics.CacheRequests.WithLabelValues(cache, "error").Inc()
+		slog.WarnContext(ctx, "Device cache read failed", "key", key, "error", err)
+		return false
+	}
+
+	if err := json.Unmarshal(data, dest); err != nil {
+		metrics.CacheRequests.WithLabelValues(cache, "error").Inc()
+		slog.WarnContext(ctx, "Discarding undecodable device cache entry", "key", key, "error", err)
+		r.invalidate(ctx, key)
+		return false
+	}
+
+	metrics.CacheRequests.WithLabelValues(cache, "hit").Inc()
+	return true
+}
+
+func (r *cachedDeviceRepository) set(ctx context.Context, key string, value interface{}, ttl time.Duration) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to encode device cache entry", "key", key, "error", err)
+		return
+	}
+	if err := r.client.Set(ctx, key, data, ttl).Err(); err != nil {
+		slog.WarnContext(ctx, "Device cache write failed", "key", key, "error", err)
+	}
+}
+
+func (r *cachedDeviceRepository) invalidate(ctx context.Context, keys ...string) {
+	if err := r.client.Del(ctx, keys...).Err(); err != nil {
+		slog.WarnContext(ctx, "Device cache invalidation failed", "keys", keys, "error", err)
+		return
+	}
+	metrics.CacheInvalidations.Add(float64(len(keys)))
+}
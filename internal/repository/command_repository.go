@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
+	"time"
+)
+
+const commandColumns = `id, device_id, client_id, command, params, status, error, result, created_at, expires_at, delivered_at, completed_at`
+
+type commandRepository struct {
+	db *sql.DB
+}
+
+func NewCommandRepository(db *sql.DB) CommandRepository {
+	return &commandRepository{db: db}
+}
+
+func (r *commandRepository) Create(ctx context.Context, command *domain.DeviceCommand) error {
+	query := `
+        INSERT INTO device_commands (id, device_id, client_id, command, params, status, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING created_at`
+
+	ctx, span := startDBSpan(ctx, "INSERT", "device_commands", query)
+	err := r.db.QueryRowContext(ctx, query,
+		command.ID, command.DeviceID, command.ClientID, command.Command, nullJSON(command.Params), command.Status, command.ExpiresAt,
+	).Scan(&command.CreatedAt)
+	endDBSpan(span, err)
+	return err
+}
+
+func (r *commandRepository) Get(ctx context.Context, id uuid.UUID) (*domain.DeviceCommand, error) {
+	query := `SELECT ` + commandColumns + ` FROM device_commands WHERE id = $1`
+
+	ctx, span := startDBSpan(ctx, "SELECT", "device_commands", query)
+	command, err := scanCommand(r.db.QueryRowContext(ctx, query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		endDBSpan(span, nil)
+		return nil, nil
+	}
+	endDBSpan(span, err)
+	return command, err
+}
+
+func (r *commandRepository) ListByDevice(ctx context.Context, deviceID uuid.UUID, limit int) ([]*domain.DeviceCommand, error) {
+	query := `SELECT ` + commandColumns + ` FROM device_commands WHERE device_id = $1 ORDER BY created_at DESC LIMIT $2`
+	return r.query(ctx, "SELECT", query, deviceID, limit)
+}
+
+func (r *commandRepository) Transition(ctx context.Context, id uuid.UUID, from []string, update *domain.DeviceCommand) (*domain.DeviceCommand, error) {
+	query := `
+        UPDATE device_commands
+        SET status = $3,
+            error = COALESCE($4, error),
+            result = COALESCE($5, result),
+            delivered_at = COALESCE(delivered_at, $6),
+            completed_at = COALESCE(completed_at, $7)
+        WHERE id = $1 AND status = ANY($2)
+        RETURNING ` + commandColumns
+
+	ctx, span := startDBSpan(ctx, "UPDATE", "device_commands", query)
+	command, err := scanCommand(r.db.QueryRowContext(ctx, query,
+		id, pq.Array(from), update.Status, nullString(update.Error), nullJSON(update.Result), update.DeliveredAt, update.CompletedAt,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		endDBSpan(span, nil)
+		return nil, nil
+	}
+	endDBSpan(span, err)
+	return command, err
+}
+
+func (r *commandRepository) ExpireOverdue(ctx context.Context, now time.Time) ([]*domain.DeviceCommand, error) {
+	query := `
+        UPDATE device_commands
+        SET status = $1, completed_at = $2
+        WHERE status IN ($3, $4) AND expires_at <= $2
+        RETURNING ` + commandColumns
+	return r.query(ctx, "UPDATE", query,
+		domain.CommandStatusTimedOut, now, domain.CommandStatusPending, domain.CommandStatusDelivered,
+	)
+}
+
+func (r *commandRepository) query(ctx context.Context, operation, query string, args ...interface{}) ([]*domain.DeviceCommand, error) {
+	ctx, span := startDBSpan(ctx, operation, "device_commands", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		telemetry.RecordError(span, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var commands []*domain.DeviceCommand
+	for rows.Next() {
+		command, err := scanCommand(rows)
+		if err != nil {
+			telemetry.RecordError(span, err)
+			return nil, err
+		}
+		commands = append(commands, command)
+	}
+	if err := rows.Err(); err != nil {
+		telemetry.RecordError(span, err)
+		return nil, err
+	}
+	return commands, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCommand(row rowScanner) (*domain.DeviceCommand, error) {
+	command := &domain.DeviceCommand{}
+	var params, result []byte
+	var errorText sql.NullString
+	err := row.Scan(
+		&command.ID, &command.DeviceID, &command.ClientID, &command.Command, &params, &command.Status,
+		&errorText, &result, &command.CreatedAt, &command.ExpiresAt, &command.DeliveredAt, &command.CompletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	command.Params = params
+	command.Result = result
+	command.Error = errorText.String
+	return command, nil
+}
@@ -0,0 +1,121 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
+	"time"
+)
+
+const claimColumns = `serial_number, client_id, token_hash, device_id, claimed_at, created_at`
+
+type deviceClaimRepository struct {
+	db *sql.DB
+}
+
+func NewDeviceClaimRepository(db *sql.DB) DeviceClaimRepository {
+	return &deviceClaimRepository{db: db}
+}
+
+func (r *deviceClaimRepository) Create(ctx context.Context, claim *domain.DeviceClaim) (bool, error) {
+	query := `
+        INSERT INTO device_claims (serial_number, client_id, token_hash)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (serial_number) DO NOTHING
+        RETURNING created_at`
+
+	ctx, span := startDBSpan(ctx, "INSERT", "device_claims", query)
+	err := r.db.QueryRowContext(ctx, query, claim.SerialNumber, claim.ClientID, claim.TokenHash).Scan(&claim.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		endDBSpan(span, nil)
+		return false, nil
+	}
+	endDBSpan(span, err)
+	return err == nil, err
+}
+
+func (r *deviceClaimRepository) Get(ctx context.Context, serialNumber string) (*domain.DeviceClaim, error) {
+	query := `SELECT ` + claimColumns + ` FROM device_claims WHERE serial_number = $1`
+
+	ctx, span := startDBSpan(ctx, "SELECT", "device_claims", query)
+	claim, err := scanClaim(r.db.QueryRowContext(ctx, query, serialNumber))
+	if errors.Is(err, sql.ErrNoRows) {
+		endDBSpan(span, nil)
+		return nil, nil
+	}
+	endDBSpan(span, err)
+	return claim, err
+}
+
+func (r *deviceClaimRepository) ListByClient(ctx context.Context, clientID uuid.UUID) ([]*domain.DeviceClaim, error) {
+	query := `SELECT ` + claimColumns + ` FROM device_claims WHERE client_id = $1 ORDER BY created_at DESC`
+
+	ctx, span := startDBSpan(ctx, "SELECT", "device_claims", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, clientID)
+	if err != nil {
+		telemetry.RecordError(span, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	claims := make([]*domain.DeviceClaim, 0)
+	for rows.Next() {
+		claim, err := scanClaim(rows)
+		if err != nil {
+			telemetry.RecordError(span, err)
+			return nil, err
+		}
+		claims = append(claims, claim)
+	}
+	if err := rows.Err(); err != nil {
+		telemetry.RecordError(span, err)
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (r *deviceClaimRepository) Delete(ctx context.Context, clientID uuid.UUID, serialNumber string) (bool, error) {
+	query := `DELETE FROM device_claims WHERE serial_number = $1 AND client_id = $2`
+	ctx, span := startDBSpan(ctx, "DELETE", "device_claims", query)
+	result, err := r.db.ExecContext(ctx, query, serialNumber, clientID)
+	endDBSpan(span, err)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (r *deviceClaimRepository) Bind(ctx context.Context, serialNumber string, deviceID uuid.UUID, at time.Time) (bool, error) {
+	query := `
+        UPDATE device_claims SET device_id = $2, claimed_at = $3
+        WHERE serial_number = $1 AND device_id IS NULL AND claimed_at IS NULL`
+
+	ctx, span := startDBSpan(ctx, "UPDATE", "device_claims", query)
+	result, err := r.db.ExecContext(ctx, query, serialNumber, deviceID, at)
+	endDBSpan(span, err)
+	if err != nil {
+		return false, err
+	}
+
+	bound, err := result.RowsAffected()
+	return bound > 0, err
+}
+
+func scanClaim(row rowScanner) (*domain.DeviceClaim, error) {
+	claim := &domain.DeviceClaim{}
+	var deviceID uuid.NullUUID
+	if err := row.Scan(&claim.SerialNumber, &claim.ClientID, &claim.TokenHash, &deviceID, &claim.ClaimedAt, &claim.CreatedAt); err != nil {
+		return nil, err
+	}
+	if deviceID.Valid {
+		claim.DeviceID = &deviceID.UUID
+	}
+	return claim, nil
+}
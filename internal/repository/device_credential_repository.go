@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"time"
+)
+
+type deviceCredentialRepository struct {
+	db *sql.DB
+}
+
+func NewDeviceCredentialRepository(db *sql.DB) DeviceCredentialRepository {
+	return &deviceCredentialRepository{db: db}
+}
+
+func (r *deviceCredentialRepository) Upsert(ctx context.Context, credential *domain.DeviceCredential) error {
+	query := `
+        INSERT INTO device_credentials (device_id, secret_hash)
+        VALUES ($1, $2)
+        ON CONFLICT (device_id) DO UPDATE
+        SET secret_hash = EXCLUDED.secret_hash, created_at = CURRENT_TIMESTAMP, last_used_at = NULL
+        RETURNING created_at`
+
+	ctx, span := startDBSpan(ctx, "INSERT", "device_credentials", query)
+	err := r.db.QueryRowContext(ctx, query, credential.DeviceID, credential.SecretHash).Scan(&credential.CreatedAt)
+	endDBSpan(span, err)
+	credential.LastUsedAt = nil
+	return err
+}
+
+func (r *deviceCredentialRepository) Get(ctx context.Context, deviceID uuid.UUID) (*domain.DeviceCredential, error) {
+	credential := &domain.DeviceCredential{}
+	query := `
+        SELECT device_id, secret_hash, created_at, last_used_at
+        FROM device_credentials WHERE device_id = $1`
+
+	ctx, span := startDBSpan(ctx, "SELECT", "device_credentials", query)
+	err := r.db.QueryRowContext(ctx, query, deviceID).Scan(
+		&credential.DeviceID, &credential.SecretHash, &credential.CreatedAt, &credential.LastUsedAt,
+	)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		endDBSpan(span, nil)
+		return nil, nil
+	}
+	endDBSpan(span, err)
+	return credential, err
+}
+
+func (r *deviceCredentialRepository) Delete(ctx context.Context, deviceID uuid.UUID) (bool, error) {
+	query := `DELETE FROM device_credentials WHERE device_id = $1`
+	ctx, span := startDBSpan(ctx, "DELETE", "device_credentials", query)
+	result, err := r.db.ExecContext(ctx, query, deviceID)
+	endDBSpan(span, err)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (r *deviceCredentialRepository) TouchLastUsed(ctx context.Context, deviceID uuid.UUID, at time.Time) error {
+	query := `UPDATE device_credentials SET last_used_at = $1 WHERE device_id = $2`
+	ctx, span := startDBSpan(ctx, "UPDATE", "device_credentials", query)
+	_, err := r.db.ExecContext(ctx, query, at, deviceID)
+	endDBSpan(span, err)
+	return err
+}
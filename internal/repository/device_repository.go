@@ -5,7 +5,10 @@ import (
 	"database/sql"
 	"errors"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
+	"time"
 )
 
 type deviceRepository struct {
@@ -22,8 +25,10 @@ func (r *deviceRepository) Create(ctx context.Context, device *domain.Device) er
         VALUES ($1, $2)
         RETURNING id, created_at, updated_at`
 
+	ctx, span := startDBSpan(ctx, "INSERT", "devices", query)
 	err := r.db.QueryRowContext(ctx, query,
 		device.ClientID, device.ItemWeight).Scan(&device.ID, &device.CreatedAt, &device.UpdatedAt)
+	endDBSpan(span, err)
 
 	return err
 }
@@ -31,27 +36,34 @@ func (r *deviceRepository) Create(ctx context.Context, device *domain.Device) er
 func (r *deviceRepository) GetByDeviceID(ctx context.Context, id uuid.UUID) (*domain.Device, error) {
 	device := &domain.Device{}
 	query := `
-        SELECT id, client_id, current_item_count, max_capacity, total_item_sold_count, item_weight, created_at, updated_at
+        SELECT id, client_id, current_item_count, max_capacity, total_item_sold_count, item_weight, current_weight, last_seen_at, online, created_at, updated_at
         FROM devices WHERE id = $1`
 
+	ctx, span := startDBSpan(ctx, "SELECT", "devices", query)
 	err := r.db.QueryRowContext(ctx, query, id).Scan(
 		&device.ID, &device.ClientID, &device.CurrentItemCount,
-		&device.MaxCapacity, &device.TotalItemSoldCount, &device.ItemWeight, &device.CreatedAt, &device.UpdatedAt,
+		&device.MaxCapacity, &device.TotalItemSoldCount, &device.ItemWeight, &device.CurrentWeight, &device.LastSeenAt, &device.Online, &device.CreatedAt, &device.UpdatedAt,
 	)
 
 	if errors.Is(err, sql.ErrNoRows) {
+		endDBSpan(span, nil)
 		return nil, nil
 	}
+	endDBSpan(span, err)
 	return device, err
 }
 
 func (r *deviceRepository) GetByClientID(ctx context.Context, clientID uuid.UUID) ([]*domain.Device, error) {
 	query := `
-        SELECT id, client_id, current_item_count, max_capacity, total_item_sold_count, item_weight, current_weight, created_at, updated_at
+        SELECT id, client_id, current_item_count, max_capacity, total_item_sold_count, item_weight, current_weight, last_seen_at, online, created_at, updated_at
         FROM devices WHERE client_id = $1`
 
+	ctx, span := startDBSpan(ctx, "SELECT", "devices", query)
+	defer span.End()
+
 	rows, err := r.db.QueryContext(ctx, query, clientID)
 	if err != nil {
+		telemetry.RecordError(span, err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -61,9 +73,10 @@ func (r *deviceRepository) GetByClientID(ctx context.Context, clientID uuid.UUID
 		device := &domain.Device{}
 		err := rows.Scan(
 			&device.ID, &device.ClientID, &device.CurrentItemCount,
-			&device.MaxCapacity, &device.TotalItemSoldCount, &device.ItemWeight, &device.CurrentWeight, &device.CreatedAt, &device.UpdatedAt,
+			&device.MaxCapacity, &device.TotalItemSoldCount, &device.ItemWeight, &device.CurrentWeight, &device.LastSeenAt, &device.Online, &device.CreatedAt, &device.UpdatedAt,
 		)
 		if err != nil {
+			telemetry.RecordError(span, err)
 			return nil, err
 		}
 		devices = append(devices, device)
@@ -74,11 +87,15 @@ func (r *deviceRepository) GetByClientID(ctx context.Context, clientID uuid.UUID
 
 func (r *deviceRepository) GetAll(ctx context.Context) ([]*domain.Device, error) {
 	query := `
-        SELECT id, client_id, current_item_count, max_capacity, total_item_sold_count, item_weight, current_weight, created_at, updated_at
+        SELECT id, client_id, current_item_count, max_capacity, total_item_sold_count, item_weight, current_weight, last_seen_at, online, created_at, updated_at
         FROM devices ORDER BY created_at DESC`
 
+	ctx, span := startDBSpan(ctx, "SELECT", "devices", query)
+	defer span.End()
+
 	rows, err := r.db.QueryContext(ctx, query)
 	if err != nil {
+		telemetry.RecordError(span, err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -88,9 +105,10 @@ func (r *deviceRepository) GetAll(ctx context.Context) ([]*domain.Device, error)
 		device := &domain.Device{}
 		err := rows.Scan(
 			&device.ID, &device.ClientID, &device.CurrentItemCount,
-			&device.MaxCapacity, &device.TotalItemSoldCount, &device.ItemWeight, &device.CurrentWeight, &device.CreatedAt, &device.UpdatedAt,
+			&device.MaxCapacity, &device.TotalItemSoldCount, &device.ItemWeight, &device.CurrentWeight, &device.LastSeenAt, &device.Online, &device.CreatedAt, &device.UpdatedAt,
 		)
 		if err != nil {
+			telemetry.RecordError(span, err)
 			return nil, err
 		}
 		devices = append(devices, device)
@@ -105,14 +123,106 @@ func (r *deviceRepository) Update(ctx context.Context, device *domain.Device) er
         SET current_item_count = $1, max_capacity = $2, total_item_sold_count = $3, item_weight = $4, current_weight = $5, updated_at = CURRENT_TIMESTAMP
         WHERE id = $6`
 
+	ctx, span := startDBSpan(ctx, "UPDATE", "devices", query)
 	_, err := r.db.ExecContext(ctx, query,
 		device.CurrentItemCount, device.MaxCapacity, device.TotalItemSoldCount, device.ItemWeight, device.CurrentWeight, device.ID,
 	)
+	endDBSpan(span, err)
 	return err
 }
 
 func (r *deviceRepository) Delete(ctx context.Context, id uuid.UUID) error {
 	query := `DELETE FROM devices WHERE id = $1`
+	ctx, span := startDBSpan(ctx, "DELETE", "devices", query)
 	_, err := r.db.ExecContext(ctx, query, id)
+	endDBSpan(span, err)
+	return err
+}
+
+// UpdateLiveState writes the latest readings back to the devices table in a
+// single statement. A row is only updated if the reading is newer than the
+// one already stored.
+func (r *deviceRepository) UpdateLiveState(ctx context.Context, states []*domain.DeviceLiveState) error {
+	if len(states) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(states))
+	weights := make([]float64, len(states))
+	counts := make([]int64, len(states))
+	lastSeen := make([]string, len(states))
+	for i, state := range states {
+		ids[i] = state.DeviceID.String()
+		weights[i] = state.CurrentWeight
+		counts[i] = int64(state.CurrentItemCount)
+		lastSeen[i] = state.LastSeenAt.UTC().Format(time.RFC3339Nano)
+	}
+
+	query := `
+        UPDATE devices AS d
+        SET current_weight = v.current_weight, current_item_count = v.current_item_count,
+            last_seen_at = v.last_seen_at, updated_at = CURRENT_TIMESTAMP
+        FROM unnest($1::uuid[], $2::numeric[], $3::int[], $4::timestamptz[])
+            AS v(id, current_weight, current_item_count, last_seen_at)
+        WHERE d.id = v.id AND (d.last_seen_at IS NULL OR d.last_seen_at < v.last_seen_at)`
+
+	ctx, span := startDBSpan(ctx, "UPDATE", "devices", query)
+	_, err := r.db.ExecContext(ctx, query, pq.Array(ids), pq.Array(weights), pq.Array(counts), pq.Array(lastSeen))
+	endDBSpan(span, err)
+	return err
+}
+
+// SetOnline records a presence transition. seenAt moves last_seen_at
+// forward when set and is ignored when zero.
+func (r *deviceRepository) SetOnline(ctx context.Context, id uuid.UUID, online bool, seenAt time.Time) error {
+	var lastSeen sql.NullTime
+	if !seenAt.IsZero() {
+		lastSeen = sql.NullTime{Time: seenAt, Valid: true}
+	}
+
+	query := `
+        UPDATE devices
+        SET online = $1, last_seen_at = GREATEST(last_seen_at, $2), updated_at = CURRENT_TIMESTAMP
+        WHERE id = $3`
+
+	ctx, span := startDBSpan(ctx, "UPDATE", "devices", query)
+	_, err := r.db.ExecContext(ctx, query, online, lastSeen, id)
+	endDBSpan(span, err)
 	return err
 }
+
+// MarkStaleOffline marks devices offline that are online in the database
+// but not in keep and were last seen before seenBefore, and returns them.
+func (r *deviceRepository) MarkStaleOffline(ctx context.Context, keep []uuid.UUID, seenBefore time.Time) ([]uuid.UUID, error) {
+	ids := make([]string, len(keep))
+	for i, id := range keep {
+		ids[i] = id.String()
+	}
+
+	query := `
+        UPDATE devices
+        SET online = FALSE, updated_at = CURRENT_TIMESTAMP
+        WHERE online AND NOT (id = ANY($1::uuid[])) AND (last_seen_at IS NULL OR last_seen_at < $2)
+        RETURNING id`
+
+	ctx, span := startDBSpan(ctx, "UPDATE", "devices", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(ids), seenBefore)
+	if err != nil {
+		telemetry.RecordError(span, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stale []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			telemetry.RecordError(span, err)
+			return nil, err
+		}
+		stale = append(stale, id)
+	}
+	return stale, rows.Err()
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/google/uuid"
 	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"time"
 )
 
 type DeviceRepository interface {
@@ -13,4 +14,115 @@ type DeviceRepository interface {
 	GetAll(ctx context.Context) ([]*domain.Device, error)
 	Update(ctx context.Context, device *domain.Device) error
 	Delete(ctx context.Context, id uuid.UUID) error
+	UpdateLiveState(ctx context.Context, states []*domain.DeviceLiveState) error
+	// SetOnline stores the device's presence; a non-zero seenAt also moves
+	// last_seen_at forward.
+	SetOnline(ctx context.Context, id uuid.UUID, online bool, seenAt time.Time) error
+	// MarkStaleOffline marks devices offline that are online in the
+	// database but not in keep and were last seen before seenBefore.
+	MarkStaleOffline(ctx context.Context, keep []uuid.UUID, seenBefore time.Time) ([]uuid.UUID, error)
+}
+
+// DeviceCredentialRepository stores the credentials devices authenticate
+// to the embedded MQTT broker with.
+type DeviceCredentialRepository interface {
+	// Upsert stores credential, replacing the device's previous one.
+	Upsert(ctx context.Context, credential *domain.DeviceCredential) error
+	Get(ctx context.Context, deviceID uuid.UUID) (*domain.DeviceCredential, error)
+	// Delete removes the device's credential and reports whether it had one.
+	Delete(ctx context.Context, deviceID uuid.UUID) (bool, error)
+	TouchLastUsed(ctx context.Context, deviceID uuid.UUID, at time.Time) error
+}
+
+type AuditRepository interface {
+	Append(ctx context.Context, entry *domain.AuditEntry) error
+	List(ctx context.Context, filter domain.AuditFilter) ([]*domain.AuditEntry, error)
+}
+
+// LiveStateRepository stores the latest reading per device and tracks which
+// devices changed since the last flush to the database.
+type LiveStateRepository interface {
+	Save(ctx context.Context, state *domain.DeviceLiveState) (bool, error)
+	Get(ctx context.Context, deviceID uuid.UUID) (*domain.DeviceLiveState, error)
+	GetMany(ctx context.Context, deviceIDs []uuid.UUID) (map[uuid.UUID]*domain.DeviceLiveState, error)
+	TakeDirty(ctx context.Context, max int) ([]*domain.DeviceLiveState, error)
+	MarkDirty(ctx context.Context, deviceIDs []uuid.UUID) error
+}
+
+// PresenceRepository tracks which devices are online and when they were
+// last seen. Its updates are atomic, so of several servers only one sees a
+// device come online or go offline.
+type PresenceRepository interface {
+	// MarkOnline records that the device was seen at at and reports whether
+	// it was offline before.
+	MarkOnline(ctx context.Context, deviceID uuid.UUID, at time.Time) (bool, error)
+	// MarkOffline reports whether the device was online before.
+	MarkOffline(ctx context.Context, deviceID uuid.UUID) (bool, error)
+	// Expire marks up to max devices offline that were last seen before
+	// before and returns them with their last-seen time.
+	Expire(ctx context.Context, before time.Time, max int) (map[uuid.UUID]time.Time, error)
+	Online(ctx context.Context) ([]uuid.UUID, error)
+}
+
+type ReadingRepository interface {
+	InsertBatch(ctx context.Context, readings []*domain.DeviceReading) (int64, error)
+}
+
+// CommandRepository stores the commands sent to devices and their outcome.
+type CommandRepository interface {
+	Create(ctx context.Context, command *domain.DeviceCommand) error
+	Get(ctx context.Context, id uuid.UUID) (*domain.DeviceCommand, error)
+	// ListByDevice returns the device's most recent commands, newest first.
+	ListByDevice(ctx context.Context, deviceID uuid.UUID, limit int) ([]*domain.DeviceCommand, error)
+	// Transition applies update's status, error, result and timestamps if
+	// the command is in one of the from statuses, and returns the updated
+	// command, or nil if it was not.
+	Transition(ctx context.Context, id uuid.UUID, from []string, update *domain.DeviceCommand) (*domain.DeviceCommand, error)
+	// ExpireOverdue marks commands past their expiry that are still waiting
+	// on the device timed out, and returns them.
+	ExpireOverdue(ctx context.Context, now time.Time) ([]*domain.DeviceCommand, error)
+}
+
+// TwinRepository stores device twins. Sections are saved with optimistic
+// concurrency: a save only succeeds if the section is still at the version
+// it was read at.
+type TwinRepository interface {
+	// Get returns nil if the device has no twin yet.
+	Get(ctx context.Context, deviceID uuid.UUID) (*domain.DeviceTwin, error)
+	List(ctx context.Context) ([]*domain.DeviceTwin, error)
+	// SaveDesired stores twin.Desired if the desired version is still
+	// version (0 for a device without a twin), and reports whether it did.
+	// On success twin holds the stored twin with its new version.
+	SaveDesired(ctx context.Context, twin *domain.DeviceTwin, version int64) (bool, error)
+	// SaveReported is SaveDesired for the reported section.
+	SaveReported(ctx context.Context, twin *domain.DeviceTwin, version int64) (bool, error)
+}
+
+// DeviceClaimRepository stores the devices pre-registered for zero-touch
+// provisioning.
+type DeviceClaimRepository interface {
+	// Create stores claim and reports whether it did; it does not if the
+	// serial number is already registered.
+	Create(ctx context.Context, claim *domain.DeviceClaim) (bool, error)
+	Get(ctx context.Context, serialNumber string) (*domain.DeviceClaim, error)
+	ListByClient(ctx context.Context, clientID uuid.UUID) ([]*domain.DeviceClaim, error)
+	// Delete removes the client's claim and reports whether it had one.
+	Delete(ctx context.Context, clientID uuid.UUID, serialNumber string) (bool, error)
+	// Bind records the device created for a claim and marks the claim as
+	// used, if it was not used before, and reports whether it did.
+	Bind(ctx context.Context, serialNumber string, deviceID uuid.UUID, at time.Time) (bool, error)
+}
+
+// PendingDeviceRepository stores the devices that announced themselves
+// without a claim.
+type PendingDeviceRepository interface {
+	// Upsert records a birth message and reads back the stored device. The
+	// token and client of the first birth message are kept: Upsert reports
+	// false and only counts a conflict if device has another token.
+	Upsert(ctx context.Context, device *domain.PendingDevice) (bool, error)
+	Get(ctx context.Context, serialNumber string) (*domain.PendingDevice, error)
+	// List returns the pending devices, oldest first; with a client only
+	// those that named it.
+	List(ctx context.Context, clientID *uuid.UUID) ([]*domain.PendingDevice, error)
+	Delete(ctx context.Context, serialNumber string) (bool, error)
 }
@@ -0,0 +1,180 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"strconv"
+	"time"
+)
+
+const liveStateDirtyKey = "live:dirty"
+
+// saveLiveStateScript stores a reading unless a newer one is already stored,
+// so readings delivered out of order never move the state backwards. The
+// device is added to the dirty set for the next flush.
+//
+// KEYS[1] state hash, KEYS[2] dirty set
+// ARGV: reading_at (unix ms), last_seen_at (unix ms), current_weight,
+// current_item_count, item_weight, ttl (ms), device ID
+var saveLiveStateScript = redis.NewScript(`
+local stored = redis.call('HGET', KEYS[1], 'reading_at')
+if stored and tonumber(stored) > tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('HSET', KEYS[1],
+	'reading_at', ARGV[1],
+	'last_seen_at', ARGV[2],
+	'current_weight', ARGV[3],
+	'current_item_count', ARGV[4],
+	'item_weight', ARGV[5])
+redis.call('PEXPIRE', KEYS[1], ARGV[6])
+redis.call('SADD', KEYS[2], ARGV[7])
+return 1
+`)
+
+type liveStateRepository struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewLiveStateRepository stores device state in Redis hashes. State for a
+// device that stops reporting expires after ttl.
+func NewLiveStateRepository(client *redis.Client, ttl time.Duration) LiveStateRepository {
+	return &liveStateRepository{client: client, ttl: ttl}
+}
+
+func liveStateKey(deviceID uuid.UUID) string {
+	return "live:device:" + deviceID.String()
+}
+
+// Save stores state and reports whether it was applied; false means a newer
+// reading was already stored.
+func (r *liveStateRepository) Save(ctx context.Context, state *domain.DeviceLiveState) (bool, error) {
+	applied, err := saveLiveStateScript.Run(ctx, r.client,
+		[]string{liveStateKey(state.DeviceID), liveStateDirtyKey},
+		state.ReadingAt.UnixMilli(),
+		state.LastSeenAt.UnixMilli(),
+		strconv.FormatFloat(state.CurrentWeight, 'f', -1, 64),
+		state.CurrentItemCount,
+		strconv.FormatFloat(state.ItemWeight, 'f', -1, 64),
+		r.ttl.Milliseconds(),
+		state.DeviceID.String(),
+	).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to save live state: %w", err)
+	}
+	return applied == 1, nil
+}
+
+func (r *liveStateRepository) Get(ctx context.Context, deviceID uuid.UUID) (*domain.DeviceLiveState, error) {
+	fields, err := r.client.HGetAll(ctx, liveStateKey(deviceID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read live state: %w", err)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return parseLiveState(deviceID, fields)
+}
+
+// GetMany returns the stored state for each device that has one.
+func (r *liveStateRepository) GetMany(ctx context.Context, deviceIDs []uuid.UUID) (map[uuid.UUID]*domain.DeviceLiveState, error) {
+	states := make(map[uuid.UUID]*domain.DeviceLiveState, len(deviceIDs))
+	if len(deviceIDs) == 0 {
+		return states, nil
+	}
+
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(deviceIDs))
+	for i, deviceID := range deviceIDs {
+		cmds[i] = pipe.HGetAll(ctx, liveStateKey(deviceID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to read live state: %w", err)
+	}
+
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+		if len(fields) == 0 {
+			continue
+		}
+		state, err := parseLiveState(deviceIDs[i], fields)
+		if err != nil {
+			return nil, err
+		}
+		states[deviceIDs[i]] = state
+	}
+	return states, nil
+}
+
+// TakeDirty removes up to max devices from the dirty set and returns their
+// current state. Callers that fail to persist the state must hand the IDs
+// back with MarkDirty.
+func (r *liveStateRepository) TakeDirty(ctx context.Context, max int) ([]*domain.DeviceLiveState, error) {
+	members, err := r.client.SPopN(ctx, liveStateDirtyKey, int64(max)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dirty devices: %w", err)
+	}
+
+	deviceIDs := make([]uuid.UUID, 0, len(members))
+	for _, member := range members {
+		if deviceID, err := uuid.Parse(member); err == nil {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+
+	byID, err := r.GetMany(ctx, deviceIDs)
+	if err != nil {
+		// Put the IDs back so the next flush retries them.
+		_ = r.MarkDirty(ctx, deviceIDs)
+		return nil, err
+	}
+
+	states := make([]*domain.DeviceLiveState, 0, len(byID))
+	for _, deviceID := range deviceIDs {
+		if state, ok := byID[deviceID]; ok {
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
+
+func (r *liveStateRepository) MarkDirty(ctx context.Context, deviceIDs []uuid.UUID) error {
+	if len(deviceIDs) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(deviceIDs))
+	for i, deviceID := range deviceIDs {
+		members[i] = deviceID.String()
+	}
+	return r.client.SAdd(ctx, liveStateDirtyKey, members...).Err()
+}
+
+func parseLiveState(deviceID uuid.UUID, fields map[string]string) (*domain.DeviceLiveState, error) {
+	state := &domain.DeviceLiveState{DeviceID: deviceID, Source: domain.LiveStateSourceCache}
+
+	readingAt, err := strconv.ParseInt(fields["reading_at"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid live state for device %s: reading_at: %w", deviceID, err)
+	}
+	lastSeenAt, err := strconv.ParseInt(fields["last_seen_at"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid live state for device %s: last_seen_at: %w", deviceID, err)
+	}
+	if state.CurrentWeight, err = strconv.ParseFloat(fields["current_weight"], 64); err != nil {
+		return nil, fmt.Errorf("invalid live state for device %s: current_weight: %w", deviceID, err)
+	}
+	if state.CurrentItemCount, err = strconv.Atoi(fields["current_item_count"]); err != nil {
+		return nil, fmt.Errorf("invalid live state for device %s: current_item_count: %w", deviceID, err)
+	}
+	if state.ItemWeight, err = strconv.ParseFloat(fields["item_weight"], 64); err != nil {
+		return nil, fmt.Errorf("invalid live state for device %s: item_weight: %w", deviceID, err)
+	}
+
+	state.ReadingAt = time.UnixMilli(readingAt)
+	state.LastSeenAt = time.UnixMilli(lastSeenAt)
+	return state, nil
+}
@@ -0,0 +1,129 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
+)
+
+const pendingDeviceColumns = `serial_number, client_id, token_hash, credential_hash, firmware_version, model, birth_count, conflict_count, first_seen_at, last_seen_at, last_conflict_at`
+
+type pendingDeviceRepository struct {
+	db *sql.DB
+}
+
+func NewPendingDeviceRepository(db *sql.DB) PendingDeviceRepository {
+	return &pendingDeviceRepository{db: db}
+}
+
+func (r *pendingDeviceRepository) Upsert(ctx context.Context, device *domain.PendingDevice) (bool, error) {
+	// The token and client of the first birth message stay; a birth message
+	// with another token only counts as a conflict.
+	query := `
+        INSERT INTO pending_devices AS p (serial_number, client_id, token_hash, credential_hash, firmware_version, model)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        ON CONFLICT (serial_number) DO UPDATE
+        SET credential_hash = CASE WHEN p.token_hash = EXCLUDED.token_hash THEN EXCLUDED.credential_hash ELSE p.credential_hash END,
+            firmware_version = CASE WHEN p.token_hash = EXCLUDED.token_hash THEN EXCLUDED.firmware_version ELSE p.firmware_version END,
+            model = CASE WHEN p.token_hash = EXCLUDED.token_hash THEN EXCLUDED.model ELSE p.model END,
+            birth_count = p.birth_count + CASE WHEN p.token_hash = EXCLUDED.token_hash THEN 1 ELSE 0 END,
+            conflict_count = p.conflict_count + CASE WHEN p.token_hash = EXCLUDED.token_hash THEN 0 ELSE 1 END,
+            last_seen_at = CASE WHEN p.token_hash = EXCLUDED.token_hash THEN CURRENT_TIMESTAMP ELSE p.last_seen_at END,
+            last_conflict_at = CASE WHEN p.token_hash = EXCLUDED.token_hash THEN p.last_conflict_at ELSE CURRENT_TIMESTAMP END
+        RETURNING ` + pendingDeviceColumns + `, token_hash = $3`
+
+	ctx, span := startDBSpan(ctx, "INSERT", "pending_devices", query)
+	var accepted bool
+	stored, err := scanPendingDevice(r.db.QueryRowContext(ctx, query,
+		device.SerialNumber, device.ClientID, device.TokenHash, device.CredentialHash, nullString(device.FirmwareVersion), nullString(device.Model),
+	), &accepted)
+	endDBSpan(span, err)
+	if err != nil {
+		return false, err
+	}
+	*device = *stored
+	return accepted, nil
+}
+
+func (r *pendingDeviceRepository) Get(ctx context.Context, serialNumber string) (*domain.PendingDevice, error) {
+	query := `SELECT ` + pendingDeviceColumns + ` FROM pending_devices WHERE serial_number = $1`
+
+	ctx, span := startDBSpan(ctx, "SELECT", "pending_devices", query)
+	device, err := scanPendingDevice(r.db.QueryRowContext(ctx, query, serialNumber))
+	if errors.Is(err, sql.ErrNoRows) {
+		endDBSpan(span, nil)
+		return nil, nil
+	}
+	endDBSpan(span, err)
+	return device, err
+}
+
+func (r *pendingDeviceRepository) List(ctx context.Context, clientID *uuid.UUID) ([]*domain.PendingDevice, error) {
+	query := `SELECT ` + pendingDeviceColumns + ` FROM pending_devices`
+	var args []interface{}
+	if clientID != nil {
+		query += ` WHERE client_id = $1`
+		args = append(args, *clientID)
+	}
+	query += ` ORDER BY first_seen_at`
+
+	ctx, span := startDBSpan(ctx, "SELECT", "pending_devices", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		telemetry.RecordError(span, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := make([]*domain.PendingDevice, 0)
+	for rows.Next() {
+		device, err := scanPendingDevice(rows)
+		if err != nil {
+			telemetry.RecordError(span, err)
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	if err := rows.Err(); err != nil {
+		telemetry.RecordError(span, err)
+		return nil, err
+	}
+	return devices, nil
+}
+
+func (r *pendingDeviceRepository) Delete(ctx context.Context, serialNumber string) (bool, error) {
+	query := `DELETE FROM pending_devices WHERE serial_number = $1`
+	ctx, span := startDBSpan(ctx, "DELETE", "pending_devices", query)
+	result, err := r.db.ExecContext(ctx, query, serialNumber)
+	endDBSpan(span, err)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// scanPendingDevice scans the pendingDeviceColumns, followed by extra.
+func scanPendingDevice(row rowScanner, extra ...interface{}) (*domain.PendingDevice, error) {
+	device := &domain.PendingDevice{}
+	var clientID uuid.NullUUID
+	var firmwareVersion, model sql.NullString
+	dest := []interface{}{&device.SerialNumber, &clientID, &device.TokenHash, &device.CredentialHash, &firmwareVersion, &model,
+		&device.BirthCount, &device.ConflictCount, &device.FirstSeenAt, &device.LastSeenAt, &device.LastConflictAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	if clientID.Valid {
+		device.ClientID = &clientID.UUID
+	}
+	device.FirmwareVersion = firmwareVersion.String
+	device.Model = model.String
+	device.TokenFingerprint = domain.TokenFingerprint(device.TokenHash)
+	return device, nil
+}
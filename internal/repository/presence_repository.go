@@ -0,0 +1,89 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"math"
+	"strconv"
+	"time"
+)
+
+// presenceKey is a sorted set of the online devices, scored by when they
+// were last seen in unix milliseconds.
+const presenceKey = "presence:online"
+
+// expirePresenceScript removes devices last seen before ARGV[1] in one step,
+// so a device seen again meanwhile is not marked offline.
+//
+// KEYS[1] presence set
+// ARGV: last seen before (unix ms, exclusive), max devices
+var expirePresenceScript = redis.NewScript(`
+local expired = redis.call('ZRANGE', KEYS[1], '-inf', '(' .. ARGV[1], 'BYSCORE', 'LIMIT', 0, ARGV[2], 'WITHSCORES')
+for i = 1, #expired, 2 do
+	redis.call('ZREM', KEYS[1], expired[i])
+end
+return expired
+`)
+
+type presenceRepository struct {
+	client *redis.Client
+}
+
+func NewPresenceRepository(client *redis.Client) PresenceRepository {
+	return &presenceRepository{client: client}
+}
+
+func (r *presenceRepository) MarkOnline(ctx context.Context, deviceID uuid.UUID, at time.Time) (bool, error) {
+	// GT keeps the score of a device seen later by another server.
+	added, err := r.client.ZAddGT(ctx, presenceKey, redis.Z{Score: float64(at.UnixMilli()), Member: deviceID.String()}).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to record presence: %w", err)
+	}
+	return added == 1, nil
+}
+
+func (r *presenceRepository) MarkOffline(ctx context.Context, deviceID uuid.UUID) (bool, error) {
+	removed, err := r.client.ZRem(ctx, presenceKey, deviceID.String()).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to record presence: %w", err)
+	}
+	return removed == 1, nil
+}
+
+func (r *presenceRepository) Expire(ctx context.Context, before time.Time, max int) (map[uuid.UUID]time.Time, error) {
+	values, err := expirePresenceScript.Run(ctx, r.client, []string{presenceKey}, before.UnixMilli(), max).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire presence: %w", err)
+	}
+
+	expired := make(map[uuid.UUID]time.Time, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		deviceID, err := uuid.Parse(values[i])
+		if err != nil {
+			continue
+		}
+		score, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid presence score for device %s: %w", deviceID, err)
+		}
+		expired[deviceID] = time.UnixMilli(int64(math.Round(score)))
+	}
+	return expired, nil
+}
+
+func (r *presenceRepository) Online(ctx context.Context) ([]uuid.UUID, error) {
+	members, err := r.client.ZRange(ctx, presenceKey, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read presence: %w", err)
+	}
+
+	online := make([]uuid.UUID, 0, len(members))
+	for _, member := range members {
+		if deviceID, err := uuid.Parse(member); err == nil {
+			online = append(online, deviceID)
+		}
+	}
+	return online, nil
+}
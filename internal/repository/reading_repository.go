@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"strings"
+)
+
+// readingColumns is the number of parameters per row in InsertBatch.
+const readingColumns = 7
+
+// MaxReadingBatchSize keeps a batch insert under PostgreSQL's limit of 65535
+// bind parameters.
+const MaxReadingBatchSize = 65535 / readingColumns
+
+type readingRepository struct {
+	db *sql.DB
+}
+
+func NewReadingRepository(db *sql.DB) ReadingRepository {
+	return &readingRepository{db: db}
+}
+
+// InsertBatch writes readings with a single multi-row INSERT and returns the
+// number of rows inserted. Readings whose message ID is already stored are
+// skipped, so a redelivered batch is harmless.
+func (r *readingRepository) InsertBatch(ctx context.Context, readings []*domain.DeviceReading) (int64, error) {
+	if len(readings) == 0 {
+		return 0, nil
+	}
+	if len(readings) > MaxReadingBatchSize {
+		return 0, fmt.Errorf("batch of %d readings exceeds the maximum of %d", len(readings), MaxReadingBatchSize)
+	}
+
+	var b strings.Builder
+	b.WriteString(`
+        INSERT INTO device_readings (device_id, message_id, current_weight, current_item_count, item_weight, reading_at, received_at)
+        VALUES `)
+
+	args := make([]interface{}, 0, len(readings)*readingColumns)
+	for i, reading := range readings {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		n := len(args)
+		fmt.Fprintf(&b, "($%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7)
+		args = append(args,
+			reading.DeviceID, nullString(reading.MessageID), reading.CurrentWeight, reading.CurrentItemCount,
+			reading.ItemWeight, reading.ReadingAt, reading.ReceivedAt,
+		)
+	}
+	b.WriteString(" ON CONFLICT (message_id) DO NOTHING")
+	query := b.String()
+
+	ctx, span := startDBSpan(ctx, "INSERT", "device_readings", "INSERT INTO device_readings ... (batch)")
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		endDBSpan(span, err)
+		return 0, err
+	}
+	endDBSpan(span, nil)
+
+	return result.RowsAffected()
+}
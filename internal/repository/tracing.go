@@ -0,0 +1,29 @@
+package repository
+
+import (
+	"context"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
+	"strings"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startDBSpan starts a client span for a single database call.
+func startDBSpan(ctx context.Context, operation, table, query string) (context.Context, trace.Span) {
+	return telemetry.Tracer().Start(ctx, operation+" "+table,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBOperationName(operation),
+			semconv.DBCollectionName(table),
+			semconv.DBQueryText(strings.TrimSpace(query)),
+		),
+	)
+}
+
+// endDBSpan records err (if any) on span and ends it.
+func endDBSpan(span trace.Span, err error) {
+	telemetry.RecordError(span, err)
+	span.End()
+}
@@ -0,0 +1,121 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
+)
+
+const twinColumns = `device_id, desired, desired_version, desired_updated_at, reported, reported_version, reported_updated_at`
+
+type twinRepository struct {
+	db *sql.DB
+}
+
+func NewTwinRepository(db *sql.DB) TwinRepository {
+	return &twinRepository{db: db}
+}
+
+func (r *twinRepository) Get(ctx context.Context, deviceID uuid.UUID) (*domain.DeviceTwin, error) {
+	query := `SELECT ` + twinColumns + ` FROM device_twins WHERE device_id = $1`
+
+	ctx, span := startDBSpan(ctx, "SELECT", "device_twins", query)
+	twin, err := scanTwin(r.db.QueryRowContext(ctx, query, deviceID))
+	if errors.Is(err, sql.ErrNoRows) {
+		endDBSpan(span, nil)
+		return nil, nil
+	}
+	endDBSpan(span, err)
+	return twin, err
+}
+
+func (r *twinRepository) List(ctx context.Context) ([]*domain.DeviceTwin, error) {
+	query := `SELECT ` + twinColumns + ` FROM device_twins ORDER BY device_id`
+
+	ctx, span := startDBSpan(ctx, "SELECT", "device_twins", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		telemetry.RecordError(span, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var twins []*domain.DeviceTwin
+	for rows.Next() {
+		twin, err := scanTwin(rows)
+		if err != nil {
+			telemetry.RecordError(span, err)
+			return nil, err
+		}
+		twins = append(twins, twin)
+	}
+	if err := rows.Err(); err != nil {
+		telemetry.RecordError(span, err)
+		return nil, err
+	}
+	return twins, nil
+}
+
+func (r *twinRepository) SaveDesired(ctx context.Context, twin *domain.DeviceTwin, version int64) (bool, error) {
+	return r.save(ctx, "desired", twin.DeviceID, twin.Desired, version, twin)
+}
+
+func (r *twinRepository) SaveReported(ctx context.Context, twin *domain.DeviceTwin, version int64) (bool, error) {
+	return r.save(ctx, "reported", twin.DeviceID, twin.Reported, version, twin)
+}
+
+// save replaces one section of the twin if its version is still version,
+// incrementing the version, and reads the stored twin back into twin.
+func (r *twinRepository) save(ctx context.Context, section string, deviceID uuid.UUID, value map[string]interface{}, version int64, twin *domain.DeviceTwin) (bool, error) {
+	document, err := json.Marshal(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal twin %s: %w", section, err)
+	}
+
+	query := fmt.Sprintf(`
+        INSERT INTO device_twins (device_id, %[1]s, %[1]s_version, %[1]s_updated_at)
+        VALUES ($1, $2, 1, CURRENT_TIMESTAMP)
+        ON CONFLICT (device_id) DO UPDATE
+        SET %[1]s = EXCLUDED.%[1]s, %[1]s_version = device_twins.%[1]s_version + 1, %[1]s_updated_at = CURRENT_TIMESTAMP
+        WHERE device_twins.%[1]s_version = $3
+        RETURNING `+twinColumns, section)
+
+	ctx, span := startDBSpan(ctx, "INSERT", "device_twins", query)
+	saved, err := scanTwin(r.db.QueryRowContext(ctx, query, deviceID, string(document), version))
+	if errors.Is(err, sql.ErrNoRows) {
+		endDBSpan(span, nil)
+		return false, nil
+	}
+	endDBSpan(span, err)
+	if err != nil {
+		return false, err
+	}
+	*twin = *saved
+	return true, nil
+}
+
+func scanTwin(row rowScanner) (*domain.DeviceTwin, error) {
+	twin := &domain.DeviceTwin{}
+	var desired, reported []byte
+	err := row.Scan(
+		&twin.DeviceID, &desired, &twin.DesiredVersion, &twin.DesiredUpdatedAt,
+		&reported, &twin.ReportedVersion, &twin.ReportedUpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(desired, &twin.Desired); err != nil {
+		return nil, fmt.Errorf("invalid desired state for device %s: %w", twin.DeviceID, err)
+	}
+	if err := json.Unmarshal(reported, &twin.Reported); err != nil {
+		return nil, fmt.Errorf("invalid reported state for device %s: %w", twin.DeviceID, err)
+	}
+	return twin, nil
+}
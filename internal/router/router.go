@@ -2,23 +2,38 @@ package router
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"smat/iot/simulation/iot-inventory-management/internal/handler"
 	"smat/iot/simulation/iot-inventory-management/internal/middleware"
 )
 
 func SetupRouter(
 	deviceHandler *handler.DeviceHandler,
+	credentialHandler *handler.DeviceCredentialHandler,
+	commandHandler *handler.CommandHandler,
+	twinHandler *handler.TwinHandler,
+	provisioningHandler *handler.ProvisioningHandler,
 	wsHandler *handler.WebSocketHandler,
 	healthHandler *handler.HealthHandler,
 	simulationHandler *handler.SimulationHandler,
 	uiHandler *handler.UIHandler,
+	auditHandler *handler.AuditHandler,
+	adminHandler *handler.AdminHandler,
+	deadLetterHandler *handler.DeadLetterHandler,
+	rateLimiter *middleware.RateLimiter,
 ) *gin.Engine {
-	router := gin.Default()
+	router := gin.New()
+	router.Use(gin.Recovery())
 
 	// Static files
 	router.Static("/static", "./web/static")
 
+	router.Use(middleware.RequestID())
+	router.Use(middleware.Tracing())
+	router.Use(middleware.RequestLogger())
+	router.Use(middleware.Metrics())
 	router.Use(middleware.CORS())
+	router.Use(middleware.AuditContext())
 
 	// UI Routes
 	ui := router.Group("/ui")
@@ -28,6 +43,9 @@ func SetupRouter(
 		ui.GET("/dashboard", uiHandler.Dashboard)
 		ui.GET("/devices/:clientId", uiHandler.GetDevices)
 		ui.GET("/device/:deviceId", uiHandler.GetDeviceModal)
+		ui.GET("/pending-devices", uiHandler.PendingDevices)
+		ui.POST("/pending-devices/:serialNumber/approve", uiHandler.ApprovePendingDevice)
+		ui.POST("/pending-devices/:serialNumber/dismiss", uiHandler.DismissPendingDevice)
 		ui.GET("/logout", uiHandler.Logout)
 		ui.GET("/hello-world", uiHandler.HelloWorldPage)
 		ui.GET("/go-to-hello-world", uiHandler.GoToHelloWorldPage)
@@ -39,17 +57,34 @@ func SetupRouter(
 	})
 
 	api := router.Group("/server/v1")
+	api.Use(rateLimiter.Handler())
 	{
 		devices := api.Group("/devices")
 		{
 			devices.GET("", deviceHandler.GetAllDevices)
 			devices.GET("/:deviceId", deviceHandler.GetDevice)
+			devices.GET("/:deviceId/live", deviceHandler.GetLiveState)
+			devices.POST("/:deviceId/credentials", credentialHandler.IssueCredential)
+			devices.DELETE("/:deviceId/credentials", credentialHandler.RevokeCredential)
+			devices.POST("/:deviceId/commands", commandHandler.SendCommand)
+			devices.GET("/:deviceId/commands", commandHandler.ListCommands)
+			devices.GET("/:deviceId/commands/:commandId", commandHandler.GetCommand)
+			devices.GET("/:deviceId/twin", twinHandler.GetTwin)
+			devices.PATCH("/:deviceId/twin/desired", twinHandler.PatchDesired)
 			devices.POST("/initialize", deviceHandler.InitializeDevices)
 		}
 
+		api.GET("/twins/drifted", twinHandler.ListDrifted)
+
 		clients := api.Group("/clients")
 		{
 			clients.GET("/:clientId/devices", deviceHandler.GetAllDevices)
+			clients.POST("/:clientId/claims", provisioningHandler.RegisterClaim)
+			clients.GET("/:clientId/claims", provisioningHandler.ListClaims)
+			clients.DELETE("/:clientId/claims/:serialNumber", provisioningHandler.DeleteClaim)
+			clients.GET("/:clientId/pending-devices", provisioningHandler.ListClientPending)
+			clients.POST("/:clientId/pending-devices/:serialNumber/approve", provisioningHandler.ApproveClientPending)
+			clients.DELETE("/:clientId/pending-devices/:serialNumber", provisioningHandler.DismissClientPending)
 		}
 
 		simulation := api.Group("/simulation")
@@ -58,10 +93,31 @@ func SetupRouter(
 		}
 
 		api.GET("/queue/stats", healthHandler.QueueStats)
+		api.GET("/audit", auditHandler.ListAuditEntries)
+
+		admin := api.Group("/admin")
+		{
+			admin.GET("/config", adminHandler.GetConfig)
+			admin.POST("/config/reload", adminHandler.ReloadConfig)
+
+			admin.GET("/dead-letters", deadLetterHandler.ListDeadLetters)
+			admin.POST("/dead-letters/replay", deadLetterHandler.ReplayDeadLetters)
+			admin.DELETE("/dead-letters", deadLetterHandler.PurgeDeadLetters)
+			admin.GET("/dead-letters/:id", deadLetterHandler.GetDeadLetter)
+			admin.POST("/dead-letters/:id/replay", deadLetterHandler.ReplayDeadLetter)
+			admin.DELETE("/dead-letters/:id", deadLetterHandler.DeleteDeadLetter)
+
+			admin.GET("/provisioning/pending", provisioningHandler.ListPending)
+			admin.POST("/provisioning/pending/:serialNumber/assign", provisioningHandler.AssignPending)
+			admin.DELETE("/provisioning/pending/:serialNumber", provisioningHandler.DismissPending)
+		}
 	}
 
 	router.GET("/ws", wsHandler.HandleWebSocket)
-	router.GET("/health", healthHandler.HealthCheck)
+	router.GET("/health", healthHandler.Readiness)
+	router.GET("/health/live", healthHandler.Liveness)
+	router.GET("/health/ready", healthHandler.Readiness)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
 	return router
 }
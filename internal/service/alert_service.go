@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"sync"
+	"time"
+)
+
+type alertService struct {
+	hub       *WebSocketHub
+	publisher MessageBus
+
+	mu        sync.Mutex
+	threshold int
+	// lowStock records devices already alerted on, so an alert is raised
+	// once when stock crosses the threshold rather than on every update.
+	lowStock map[string]bool
+}
+
+// NewAlertService pushes alerts to the dashboard and publishes them to the
+// message bus with the alert routing key for other consumers.
+func NewAlertService(hub *WebSocketHub, publisher MessageBus) AlertService {
+	return &alertService{
+		hub:       hub,
+		publisher: publisher,
+		lowStock:  make(map[string]bool),
+	}
+}
+
+// ApplySettings updates the low-stock threshold. Alert state is cleared when
+// the threshold changes so every device is re-evaluated against it.
+func (s *alertService) ApplySettings(cfg *config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.threshold != cfg.LowStockThreshold {
+		s.threshold = cfg.LowStockThreshold
+		s.lowStock = make(map[string]bool)
+	}
+}
+
+func (s *alertService) Evaluate(ctx context.Context, message *domain.DeviceMessage) {
+	s.mu.Lock()
+	threshold := s.threshold
+	isLow := message.CurrentTotalItem <= float64(threshold)
+	wasLow := s.lowStock[message.DeviceID]
+	if isLow {
+		s.lowStock[message.DeviceID] = true
+	} else {
+		delete(s.lowStock, message.DeviceID)
+	}
+	s.mu.Unlock()
+
+	if !isLow || wasLow {
+		return
+	}
+
+	s.raise(ctx, &domain.Alert{
+		Type:             domain.AlertMessageType,
+		Kind:             domain.AlertKindLowStock,
+		DeviceID:         message.DeviceID,
+		ClientID:         message.ClientID,
+		Message:          fmt.Sprintf("Low stock: %d items left", int(message.CurrentTotalItem)),
+		CurrentTotalItem: message.CurrentTotalItem,
+		Threshold:        threshold,
+		RaisedAt:         time.Now(),
+	})
+}
+
+func (s *alertService) PresenceChanged(ctx context.Context, presence *domain.DevicePresence) {
+	alert := &domain.Alert{
+		Type:       domain.AlertMessageType,
+		Kind:       domain.AlertKindDeviceOnline,
+		DeviceID:   presence.DeviceID,
+		ClientID:   presence.ClientID,
+		Message:    "Device back online",
+		LastSeenAt: presence.LastSeenAt,
+		RaisedAt:   presence.ChangedAt,
+	}
+	if !presence.Online {
+		alert.Kind = domain.AlertKindDeviceOffline
+		alert.Message = "Device offline"
+		if presence.LastSeenAt != nil {
+			alert.Message = fmt.Sprintf("Device offline, last seen %s", presence.LastSeenAt.Format(time.RFC3339))
+		}
+	}
+	s.raise(ctx, alert)
+}
+
+// raise pushes alert to the dashboard and publishes it to the message bus.
+func (s *alertService) raise(ctx context.Context, alert *domain.Alert) {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to marshal alert", "error", err)
+		return
+	}
+
+	metrics.AlertsRaised.WithLabelValues(alert.Kind).Inc()
+	slog.InfoContext(ctx, "Alert raised", "kind", alert.Kind, "message", alert.Message)
+	s.hub.Broadcast(ctx, payload)
+
+	routingKey := RoutingKey(alert.ClientID, alert.DeviceID, domain.DeviceEventAlert)
+	if err := s.publisher.Publish(ctx, routingKey, payload); err != nil {
+		slog.ErrorContext(ctx, "Failed to publish alert", "routing_key", routingKey, "error", err)
+	}
+}
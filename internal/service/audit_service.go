@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/repository"
+)
+
+type auditService struct {
+	repo repository.AuditRepository
+}
+
+func NewAuditService(repo repository.AuditRepository) AuditService {
+	return &auditService{repo: repo}
+}
+
+// Record appends an entry to the audit log. Actor, IP address and request ID
+// are taken from the context; before and after are snapshots of the affected
+// resource (either may be nil) and are diffed field by field.
+func (s *auditService) Record(ctx context.Context, entry *domain.AuditEntry, before, after interface{}) error {
+	actor := domain.AuditActorFromContext(ctx)
+	entry.Actor = actor.Actor
+	entry.IPAddress = actor.IPAddress
+	entry.RequestID = actor.RequestID
+	if entry.ClientID == nil {
+		entry.ClientID = actor.ClientID
+	}
+
+	var err error
+	if entry.Before, err = marshalSnapshot(before); err != nil {
+		return err
+	}
+	if entry.After, err = marshalSnapshot(after); err != nil {
+		return err
+	}
+
+	entry.Changes = diffSnapshots(entry.Before, entry.After)
+
+	if err := s.repo.Append(ctx, entry); err != nil {
+		return fmt.Errorf("failed to append audit entry: %w", err)
+	}
+
+	return nil
+}
+
+func (s *auditService) List(ctx context.Context, filter domain.AuditFilter) ([]*domain.AuditEntry, error) {
+	return s.repo.List(ctx, filter)
+}
+
+func marshalSnapshot(v interface{}) (json.RawMessage, error) {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal audit snapshot: %w", err)
+	}
+	return data, nil
+}
+
+// diffSnapshots compares the top-level fields of two JSON objects and returns
+// the fields whose values differ. Snapshots that are not JSON objects are not
+// diffed.
+func diffSnapshots(before, after json.RawMessage) map[string]domain.AuditChange {
+	beforeFields := map[string]interface{}{}
+	afterFields := map[string]interface{}{}
+
+	if len(before) > 0 {
+		if err := json.Unmarshal(before, &beforeFields); err != nil {
+			return nil
+		}
+	}
+	if len(after) > 0 {
+		if err := json.Unmarshal(after, &afterFields); err != nil {
+			return nil
+		}
+	}
+
+	changes := map[string]domain.AuditChange{}
+	for key, from := range beforeFields {
+		to, ok := afterFields[key]
+		if !ok || !reflect.DeepEqual(from, to) {
+			changes[key] = domain.AuditChange{From: from, To: to}
+		}
+	}
+	for key, to := range afterFields {
+		if _, ok := beforeFields[key]; !ok {
+			changes[key] = domain.AuditChange{From: nil, To: to}
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
@@ -0,0 +1,309 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"smat/iot/simulation/iot-inventory-management/internal/repository"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrCommandDeviceNotFound = errors.New("device not found")
+	ErrCommandNotFound       = errors.New("command not found")
+	ErrCommandNotSent        = errors.New("command could not be sent")
+	ErrInvalidCommandAck     = errors.New("invalid command acknowledgement")
+)
+
+// commandPollInterval is how often Wait re-reads a command. Acknowledgements
+// handled by this server wake waiters at once; with MQTT_SHARED_GROUP the
+// acknowledgement may reach another server, and only the database tells.
+const commandPollInterval = time.Second
+
+type commandService struct {
+	repo       repository.CommandRepository
+	deviceRepo repository.DeviceRepository
+	audit      AuditService
+	publisher  MQTTService
+	timeout    time.Duration
+
+	mu      sync.Mutex
+	waiters map[uuid.UUID][]chan struct{}
+}
+
+func NewCommandService(repo repository.CommandRepository, deviceRepo repository.DeviceRepository, audit AuditService, timeout time.Duration) CommandService {
+	return &commandService{
+		repo:       repo,
+		deviceRepo: deviceRepo,
+		audit:      audit,
+		timeout:    timeout,
+		waiters:    make(map[uuid.UUID][]chan struct{}),
+	}
+}
+
+func (s *commandService) SetPublisher(publisher MQTTService) {
+	s.publisher = publisher
+}
+
+func (s *commandService) Send(ctx context.Context, deviceID uuid.UUID, command string, params json.RawMessage, timeout time.Duration) (*domain.DeviceCommand, error) {
+	if err := domain.ValidateCommandParams(command, params); err != nil {
+		return nil, err
+	}
+
+	device, err := s.deviceRepo.GetByDeviceID(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, ErrCommandDeviceNotFound
+	}
+
+	if timeout <= 0 {
+		timeout = s.timeout
+	}
+	if string(params) == "null" {
+		params = nil
+	}
+	now := time.Now().UTC()
+	cmd := &domain.DeviceCommand{
+		ID:        uuid.New(),
+		DeviceID:  deviceID,
+		ClientID:  device.ClientID,
+		Command:   command,
+		Params:    params,
+		Status:    domain.CommandStatusPending,
+		ExpiresAt: now.Add(timeout),
+	}
+	if err := s.repo.Create(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(&domain.DeviceCommandMessage{
+		CommandID: cmd.ID,
+		Command:   cmd.Command,
+		Params:    cmd.Params,
+		ExpiresAt: cmd.ExpiresAt,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal command: %w", err)
+	}
+
+	// The command ID is in the payload for MQTT 3.1.1 devices, and the
+	// correlation data for MQTT 5 ones.
+	topic := fmt.Sprintf("devices/%s/commands", deviceID)
+	if err := s.publisher.PublishRequest(ctx, topic, topic+"/ack", []byte(cmd.ID.String()), payload); err != nil {
+		failedAt := time.Now().UTC()
+		if failed, terr := s.repo.Transition(ctx, cmd.ID, []string{domain.CommandStatusPending}, &domain.DeviceCommand{
+			Status:      domain.CommandStatusFailed,
+			Error:       err.Error(),
+			CompletedAt: &failedAt,
+		}); terr != nil {
+			slog.ErrorContext(ctx, "Failed to record command failure", "command_id", cmd.ID, "error", terr)
+		} else if failed != nil {
+			cmd = failed
+		}
+		metrics.CommandsCompleted.WithLabelValues(cmd.Command, domain.CommandStatusFailed).Inc()
+		s.recordAudit(ctx, device, cmd)
+		return nil, fmt.Errorf("%w: %w", ErrCommandNotSent, err)
+	}
+
+	metrics.CommandsSent.WithLabelValues(cmd.Command).Inc()
+	slog.InfoContext(ctx, "Command sent", "device_id", deviceID, "command_id", cmd.ID, "command", cmd.Command)
+	s.recordAudit(ctx, device, cmd)
+	return cmd, nil
+}
+
+func (s *commandService) Get(ctx context.Context, deviceID, commandID uuid.UUID) (*domain.DeviceCommand, error) {
+	cmd, err := s.repo.Get(ctx, commandID)
+	if err != nil {
+		return nil, err
+	}
+	if cmd == nil || cmd.DeviceID != deviceID {
+		return nil, ErrCommandNotFound
+	}
+	return cmd, nil
+}
+
+func (s *commandService) Wait(ctx context.Context, deviceID, commandID uuid.UUID, wait time.Duration) (*domain.DeviceCommand, error) {
+	notify := s.watch(commandID)
+	defer s.unwatch(commandID, notify)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	ticker := time.NewTicker(commandPollInterval)
+	defer ticker.Stop()
+
+	for {
+		cmd, err := s.Get(ctx, deviceID, commandID)
+		if err != nil || cmd.Done() {
+			return cmd, err
+		}
+
+		select {
+		case <-notify:
+		case <-ticker.C:
+		case <-timer.C:
+			return cmd, nil
+		case <-ctx.Done():
+			return cmd, nil
+		}
+	}
+}
+
+func (s *commandService) List(ctx context.Context, deviceID uuid.UUID, limit int) ([]*domain.DeviceCommand, error) {
+	return s.repo.ListByDevice(ctx, deviceID, limit)
+}
+
+func (s *commandService) HandleAck(ctx context.Context, deviceID uuid.UUID, payload, correlationData []byte) error {
+	var ack domain.DeviceCommandAck
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidCommandAck, err)
+	}
+	if len(correlationData) > 0 {
+		commandID, err := uuid.ParseBytes(correlationData)
+		if err != nil {
+			return fmt.Errorf("%w: correlation data is not a command ID", ErrInvalidCommandAck)
+		}
+		if ack.CommandID != uuid.Nil && ack.CommandID != commandID {
+			return fmt.Errorf("%w: command_id does not match the correlation data", ErrInvalidCommandAck)
+		}
+		ack.CommandID = commandID
+	}
+	if ack.CommandID == uuid.Nil {
+		return fmt.Errorf("%w: missing command_id", ErrInvalidCommandAck)
+	}
+	if string(ack.Result) == "null" {
+		ack.Result = nil
+	}
+
+	now := time.Now().UTC()
+	update := &domain.DeviceCommand{Status: ack.Status, DeliveredAt: &now}
+	var from []string
+	switch ack.Status {
+	case domain.CommandStatusDelivered:
+		from = []string{domain.CommandStatusPending}
+	case domain.CommandStatusAcked, domain.CommandStatusFailed:
+		from = []string{domain.CommandStatusPending, domain.CommandStatusDelivered}
+		update.Error = ack.Error
+		update.Result = ack.Result
+		update.CompletedAt = &now
+	default:
+		return fmt.Errorf("%w: unknown status %q", ErrInvalidCommandAck, ack.Status)
+	}
+
+	// Check the device before changing anything, so a device cannot settle
+	// another device's commands.
+	cmd, err := s.repo.Get(ctx, ack.CommandID)
+	if err != nil {
+		return err
+	}
+	if cmd == nil || cmd.DeviceID != deviceID {
+		slog.WarnContext(ctx, "Ignoring acknowledgement for an unknown command", "device_id", deviceID, "command_id", ack.CommandID)
+		return nil
+	}
+
+	updated, err := s.repo.Transition(ctx, ack.CommandID, from, update)
+	if err != nil {
+		return err
+	}
+	if updated == nil {
+		// Duplicate, out of order or after the command timed out.
+		slog.DebugContext(ctx, "Ignoring late command acknowledgement", "command_id", ack.CommandID, "status", ack.Status, "current_status", cmd.Status)
+		return nil
+	}
+
+	if updated.Done() {
+		metrics.CommandsCompleted.WithLabelValues(updated.Command, updated.Status).Inc()
+		metrics.CommandDuration.WithLabelValues(updated.Command).Observe(now.Sub(updated.CreatedAt).Seconds())
+	}
+	slog.InfoContext(ctx, "Command acknowledged", "device_id", deviceID, "command_id", updated.ID, "command", updated.Command, "status", updated.Status)
+	s.notify(updated.ID)
+	return nil
+}
+
+func (s *commandService) Expire(ctx context.Context) (int, error) {
+	expired, err := s.repo.ExpireOverdue(ctx, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	for _, cmd := range expired {
+		metrics.CommandsCompleted.WithLabelValues(cmd.Command, cmd.Status).Inc()
+		slog.WarnContext(ctx, "Command timed out", "device_id", cmd.DeviceID, "command_id", cmd.ID, "command", cmd.Command)
+		s.notify(cmd.ID)
+	}
+	return len(expired), nil
+}
+
+// RunExpirer expires overdue commands on every interval until ctx is done.
+func (s *commandService) RunExpirer(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Expire(ctx); err != nil {
+				slog.ErrorContext(ctx, "Failed to expire commands", "error", err)
+			}
+		}
+	}
+}
+
+func (s *commandService) watch(commandID uuid.UUID) chan struct{} {
+	ch := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.waiters[commandID] = append(s.waiters[commandID], ch)
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *commandService) unwatch(commandID uuid.UUID, ch chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	waiters := s.waiters[commandID]
+	for i, waiter := range waiters {
+		if waiter == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(s.waiters, commandID)
+	} else {
+		s.waiters[commandID] = waiters
+	}
+}
+
+func (s *commandService) notify(commandID uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.waiters[commandID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *commandService) recordAudit(ctx context.Context, device *domain.Device, cmd *domain.DeviceCommand) {
+	clientID := device.ClientID
+	entry := &domain.AuditEntry{
+		Action:       domain.AuditActionDeviceCommandSend,
+		ResourceType: domain.AuditResourceDeviceCommand,
+		ResourceID:   cmd.ID.String(),
+		ClientID:     &clientID,
+	}
+
+	if err := s.audit.Record(ctx, entry, nil, cmd); err != nil {
+		slog.ErrorContext(ctx, "Failed to record audit entry", "action", entry.Action, "device_id", device.ID, "client_id", device.ClientID, "error", err)
+	}
+}
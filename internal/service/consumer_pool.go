@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrAckDeferred is returned by a MessageHandler that has handed the message
+// to a later stage which settles it itself, such as the ingestion worker
+// acking after its batch commits.
+var ErrAckDeferred = errors.New("acknowledgement deferred")
+
+// MessageHandler processes one queue message. A nil error acks the message.
+// Errors wrapped with Permanent dead-letter it; any other error retries it
+// until it reaches the maximum number of deliveries, after which it is
+// dead-lettered as well.
+type MessageHandler func(ctx context.Context, msg QueueMessage) error
+
+type permanentError struct {
+	reason string
+	err    error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as a failure that retrying cannot fix, such as a
+// malformed payload. reason is recorded on the dead letter; see the
+// domain.DeadLetterReason constants.
+func Permanent(reason string, err error) error {
+	return &permanentError{reason: reason, err: err}
+}
+
+// PermanentReason returns the dead-letter reason of an error wrapped with
+// Permanent.
+func PermanentReason(err error) (string, bool) {
+	var permanent *permanentError
+	if !errors.As(err, &permanent) {
+		return "", false
+	}
+	return permanent.reason, true
+}
+
+// ConsumerPool runs a MessageHandler on a fixed number of workers. Messages
+// are assigned to workers by a hash of their device ID, so messages from one
+// device are always handled in order while different devices are handled in
+// parallel.
+type ConsumerPool struct {
+	handler MessageHandler
+	queues  []chan QueueMessage
+	wg      sync.WaitGroup
+}
+
+// NewConsumerPool creates a pool of workers, each buffering up to
+// queueSize messages.
+func NewConsumerPool(workers, queueSize int, handler MessageHandler) *ConsumerPool {
+	queues := make([]chan QueueMessage, workers)
+	for i := range queues {
+		queues[i] = make(chan QueueMessage, queueSize)
+	}
+	return &ConsumerPool{handler: handler, queues: queues}
+}
+
+// Start launches the workers. They stop when ctx is done; messages still
+// buffered are left unsettled and redelivered by the broker.
+func (p *ConsumerPool) Start(ctx context.Context) {
+	for i, queue := range p.queues {
+		p.wg.Add(1)
+		go p.work(ctx, strconv.Itoa(i), queue)
+	}
+}
+
+// Wait blocks until all workers have stopped.
+func (p *ConsumerPool) Wait() {
+	p.wg.Wait()
+}
+
+// Dispatch hands msg to the worker owning its device, blocking while that
+// worker's buffer is full.
+func (p *ConsumerPool) Dispatch(ctx context.Context, msg QueueMessage) {
+	queue := p.queues[p.workerFor(msg)]
+	select {
+	case queue <- msg:
+	case <-ctx.Done():
+	}
+}
+
+func (p *ConsumerPool) workerFor(msg QueueMessage) int {
+	var envelope struct {
+		DeviceID string `json:"device_id"`
+	}
+	// Messages that cannot be decoded all go to worker 0, where the handler
+	// rejects them.
+	if err := json.Unmarshal(msg.Body, &envelope); err != nil || envelope.DeviceID == "" {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(envelope.DeviceID))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+func (p *ConsumerPool) work(ctx context.Context, worker string, queue <-chan QueueMessage) {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-queue:
+			start := time.Now()
+			err := p.handler(ctx, msg)
+			metrics.ConsumerHandleDuration.WithLabelValues(worker).Observe(time.Since(start).Seconds())
+			SettleMessage(ctx, msg, err)
+		}
+	}
+}
+
+// SettleMessage acks, retries or dead-letters msg according to the outcome
+// of handling it; see MessageHandler.
+func SettleMessage(ctx context.Context, msg QueueMessage, err error) {
+	var outcome string
+	var settleErr error
+
+	reason, permanent := PermanentReason(err)
+	switch {
+	case err == nil:
+		outcome = "acked"
+		settleErr = msg.Ack()
+	case errors.Is(err, ErrAckDeferred):
+		metrics.ConsumerMessages.WithLabelValues("deferred").Inc()
+		return
+	case permanent:
+		outcome = "dead_lettered"
+		slog.WarnContext(ctx, "Message failed permanently, dead-lettering", "reason", reason, "error", err)
+		settleErr = msg.DeadLetter(ctx, reason, err)
+	default:
+		var requeued bool
+		requeued, settleErr = msg.Retry(ctx, err)
+		if requeued {
+			outcome = "requeued"
+			slog.WarnContext(ctx, "Message failed, requeueing", "deliveries", msg.DeliveryCount, "error", err)
+		} else {
+			outcome = "dead_lettered"
+			slog.WarnContext(ctx, "Message failed too many times, dead-lettering", "deliveries", msg.DeliveryCount, "error", err)
+		}
+	}
+
+	metrics.ConsumerMessages.WithLabelValues(outcome).Inc()
+	if settleErr != nil {
+		// The channel is gone; the broker redelivers the message.
+		slog.WarnContext(ctx, "Failed to settle message", "outcome", outcome, "error", settleErr)
+	}
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/repository"
+	"time"
+)
+
+var (
+	ErrCredentialDeviceNotFound = errors.New("device not found")
+	ErrDeviceCredentialNotFound = errors.New("device has no credential")
+)
+
+// deviceSecretBytes is the entropy of an issued secret. Secrets are random,
+// so a plain SHA-256 is enough to store them.
+const deviceSecretBytes = 32
+
+type deviceCredentialService struct {
+	repo       repository.DeviceCredentialRepository
+	deviceRepo repository.DeviceRepository
+	audit      AuditService
+}
+
+func NewDeviceCredentialService(repo repository.DeviceCredentialRepository, deviceRepo repository.DeviceRepository, audit AuditService) DeviceCredentialService {
+	return &deviceCredentialService{repo: repo, deviceRepo: deviceRepo, audit: audit}
+}
+
+func (s *deviceCredentialService) Issue(ctx context.Context, deviceID uuid.UUID) (*domain.IssuedDeviceCredential, error) {
+	device, err := s.deviceRepo.GetByDeviceID(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, ErrCredentialDeviceNotFound
+	}
+
+	raw := make([]byte, deviceSecretBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+
+	hash := sha256.Sum256([]byte(secret))
+	credential := &domain.DeviceCredential{DeviceID: deviceID, SecretHash: hash[:]}
+	if err := s.repo.Upsert(ctx, credential); err != nil {
+		return nil, err
+	}
+
+	s.recordAudit(ctx, domain.AuditActionDeviceCredentialIssue, device, nil, credential)
+	return &domain.IssuedDeviceCredential{
+		DeviceID:  deviceID,
+		Username:  deviceID.String(),
+		Password:  secret,
+		CreatedAt: credential.CreatedAt,
+	}, nil
+}
+
+func (s *deviceCredentialService) Revoke(ctx context.Context, deviceID uuid.UUID) error {
+	device, err := s.deviceRepo.GetByDeviceID(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if device == nil {
+		return ErrCredentialDeviceNotFound
+	}
+
+	credential, err := s.repo.Get(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	deleted, err := s.repo.Delete(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrDeviceCredentialNotFound
+	}
+
+	s.recordAudit(ctx, domain.AuditActionDeviceCredentialRevoke, device, credential, nil)
+	return nil
+}
+
+func (s *deviceCredentialService) Authenticate(ctx context.Context, deviceID uuid.UUID, secret string) (bool, error) {
+	credential, err := s.repo.Get(ctx, deviceID)
+	if err != nil {
+		return false, err
+	}
+	if credential == nil {
+		return false, nil
+	}
+
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(hash[:], credential.SecretHash) != 1 {
+		return false, nil
+	}
+
+	if err := s.repo.TouchLastUsed(ctx, deviceID, time.Now().UTC()); err != nil {
+		slog.WarnContext(ctx, "Failed to record credential use", "device_id", deviceID, "error", err)
+	}
+	return true, nil
+}
+
+func (s *deviceCredentialService) Enroll(ctx context.Context, deviceID uuid.UUID, secretHash []byte) error {
+	device, err := s.deviceRepo.GetByDeviceID(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if device == nil {
+		return ErrCredentialDeviceNotFound
+	}
+
+	before, err := s.repo.Get(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	credential := &domain.DeviceCredential{DeviceID: deviceID, SecretHash: secretHash}
+	if err := s.repo.Upsert(ctx, credential); err != nil {
+		return err
+	}
+
+	s.recordAudit(ctx, domain.AuditActionDeviceCredentialEnroll, device, before, credential)
+	return nil
+}
+
+func (s *deviceCredentialService) IsEnrolled(ctx context.Context, deviceID uuid.UUID, secretHash []byte) (bool, error) {
+	credential, err := s.repo.Get(ctx, deviceID)
+	if err != nil {
+		return false, err
+	}
+	return credential != nil && subtle.ConstantTimeCompare(secretHash, credential.SecretHash) == 1, nil
+}
+
+func (s *deviceCredentialService) recordAudit(ctx context.Context, action string, device *domain.Device, before, after *domain.DeviceCredential) {
+	clientID := device.ClientID
+	entry := &domain.AuditEntry{
+		Action:       action,
+		ResourceType: domain.AuditResourceDeviceCredential,
+		ResourceID:   device.ID.String(),
+		ClientID:     &clientID,
+	}
+
+	if err := s.audit.Record(ctx, entry, before, after); err != nil {
+		slog.ErrorContext(ctx, "Failed to record audit entry", "action", action, "device_id", device.ID, "client_id", device.ClientID, "error", err)
+	}
+}
@@ -3,20 +3,27 @@ package service
 import (
 	"context"
 	"github.com/google/uuid"
+	"log/slog"
 	"smat/iot/simulation/iot-inventory-management/internal/domain"
 	"smat/iot/simulation/iot-inventory-management/internal/repository"
 )
 
 type deviceService struct {
-	repo repository.DeviceRepository
+	repo  repository.DeviceRepository
+	audit AuditService
 }
 
-func NewDeviceService(repo repository.DeviceRepository) DeviceService {
-	return &deviceService{repo: repo}
+func NewDeviceService(repo repository.DeviceRepository, audit AuditService) DeviceService {
+	return &deviceService{repo: repo, audit: audit}
 }
 
 func (s *deviceService) RegisterDevice(ctx context.Context, device *domain.Device) error {
-	return s.repo.Create(ctx, device)
+	if err := s.repo.Create(ctx, device); err != nil {
+		return err
+	}
+
+	s.recordAudit(ctx, domain.AuditActionDeviceCreate, device, nil, device)
+	return nil
 }
 
 func (s *deviceService) GetDevice(ctx context.Context, deviceID uuid.UUID) (*domain.Device, error) {
@@ -49,7 +56,7 @@ func (s *deviceService) InitializeDevices(ctx context.Context) error {
 
 			existing, _ := s.repo.GetByDeviceID(ctx, device.ID)
 			if existing == nil {
-				if err := s.repo.Create(ctx, device); err != nil {
+				if err := s.RegisterDevice(ctx, device); err != nil {
 					return err
 				}
 			}
@@ -60,5 +67,29 @@ func (s *deviceService) InitializeDevices(ctx context.Context) error {
 }
 
 func (s *deviceService) Update(ctx context.Context, device *domain.Device) error {
-	return s.repo.Update(ctx, device)
+	before, err := s.repo.GetByDeviceID(ctx, device.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.repo.Update(ctx, device); err != nil {
+		return err
+	}
+
+	s.recordAudit(ctx, domain.AuditActionDeviceUpdate, device, before, device)
+	return nil
+}
+
+func (s *deviceService) recordAudit(ctx context.Context, action string, device *domain.Device, before, after *domain.Device) {
+	clientID := device.ClientID
+	entry := &domain.AuditEntry{
+		Action:       action,
+		ResourceType: domain.AuditResourceDevice,
+		ResourceID:   device.ID.String(),
+		ClientID:     &clientID,
+	}
+
+	if err := s.audit.Record(ctx, entry, before, after); err != nil {
+		slog.ErrorContext(ctx, "Failed to record audit entry", "action", action, "device_id", device.ID, "client_id", device.ClientID, "error", err)
+	}
 }
@@ -0,0 +1,267 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"smat/iot/simulation/iot-inventory-management/internal/spool"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	HealthStatusHealthy   = "healthy"
+	HealthStatusDegraded  = "degraded"
+	HealthStatusUnhealthy = "unhealthy"
+)
+
+// DependencyCheck probes a single dependency. A failing critical check makes
+// the service unhealthy (not ready); a failing non-critical check only
+// degrades it.
+type DependencyCheck struct {
+	Name     string
+	Critical bool
+	Check    func(ctx context.Context) (map[string]interface{}, error)
+}
+
+type CheckResult struct {
+	Status     string                 `json:"status"`
+	Critical   bool                   `json:"critical"`
+	Error      string                 `json:"error,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	DurationMs int64                  `json:"duration_ms"`
+}
+
+type HealthReport struct {
+	Status           string                 `json:"status"`
+	CheckedAt        time.Time              `json:"checked_at"`
+	MigrationVersion *int64                 `json:"migration_version,omitempty"`
+	Checks           map[string]CheckResult `json:"checks"`
+}
+
+type HealthService interface {
+	Uptime() time.Duration
+	Readiness(ctx context.Context) *HealthReport
+}
+
+type healthService struct {
+	checks           []DependencyCheck
+	migrationVersion func(ctx context.Context) (int64, error)
+	checkTimeout     time.Duration
+	cacheTTL         time.Duration
+	startedAt        time.Time
+
+	group  singleflight.Group
+	mu     sync.RWMutex
+	cached *HealthReport
+}
+
+// NewHealthService creates a readiness evaluator. Results are cached for
+// cacheTTL and concurrent callers share a single evaluation, so a burst of
+// probes never fans out into a burst of dependency calls.
+func NewHealthService(checkTimeout, cacheTTL time.Duration, migrationVersion func(ctx context.Context) (int64, error), checks ...DependencyCheck) HealthService {
+	return &healthService{
+		checks:           checks,
+		migrationVersion: migrationVersion,
+		checkTimeout:     checkTimeout,
+		cacheTTL:         cacheTTL,
+		startedAt:        time.Now(),
+	}
+}
+
+func (s *healthService) Uptime() time.Duration {
+	return time.Since(s.startedAt)
+}
+
+func (s *healthService) Readiness(ctx context.Context) *HealthReport {
+	s.mu.RLock()
+	cached := s.cached
+	s.mu.RUnlock()
+
+	if cached != nil && time.Since(cached.CheckedAt) < s.cacheTTL {
+		return cached
+	}
+
+	// The evaluation is detached from the caller's context so that one
+	// impatient client cannot cancel the result shared with everyone else.
+	result, _, _ := s.group.Do("readiness", func() (interface{}, error) {
+		report := s.evaluate(context.WithoutCancel(ctx))
+
+		s.mu.Lock()
+		s.cached = report
+		s.mu.Unlock()
+
+		return report, nil
+	})
+
+	return result.(*HealthReport)
+}
+
+func (s *healthService) evaluate(ctx context.Context) *HealthReport {
+	report := &HealthReport{
+		Status: HealthStatusHealthy,
+		Checks: make(map[string]CheckResult, len(s.checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range s.checks {
+		wg.Add(1)
+		go func(check DependencyCheck) {
+			defer wg.Done()
+			result := s.runCheck(ctx, check)
+
+			mu.Lock()
+			report.Checks[check.Name] = result
+			mu.Unlock()
+		}(check)
+	}
+
+	if s.migrationVersion != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			versionCtx, cancel := context.WithTimeout(ctx, s.checkTimeout)
+			defer cancel()
+
+			if version, err := s.migrationVersion(versionCtx); err == nil {
+				report.MigrationVersion = &version
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		switch {
+		case result.Status == HealthStatusUnhealthy && result.Critical:
+			report.Status = HealthStatusUnhealthy
+		case result.Status != HealthStatusHealthy && report.Status == HealthStatusHealthy:
+			report.Status = HealthStatusDegraded
+		}
+	}
+
+	report.CheckedAt = time.Now()
+	return report
+}
+
+func (s *healthService) runCheck(ctx context.Context, check DependencyCheck) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, s.checkTimeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan CheckResult, 1)
+	go func() {
+		details, err := check.Check(ctx)
+		result := CheckResult{Status: HealthStatusHealthy, Details: details}
+		if err != nil {
+			result.Status = HealthStatusUnhealthy
+			result.Error = err.Error()
+		}
+		done <- result
+	}()
+
+	var result CheckResult
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		result = CheckResult{
+			Status: HealthStatusUnhealthy,
+			Error:  fmt.Sprintf("check timed out after %s", s.checkTimeout),
+		}
+	}
+
+	result.Critical = check.Critical
+	result.DurationMs = time.Since(start).Milliseconds()
+	return result
+}
+
+func NewPostgresCheck(db *sql.DB) DependencyCheck {
+	return DependencyCheck{
+		Name:     "postgres",
+		Critical: true,
+		Check: func(ctx context.Context) (map[string]interface{}, error) {
+			if err := db.PingContext(ctx); err != nil {
+				return nil, err
+			}
+			stats := db.Stats()
+			return map[string]interface{}{
+				"open_connections": stats.OpenConnections,
+				"in_use":           stats.InUse,
+				"idle":             stats.Idle,
+			}, nil
+		},
+	}
+}
+
+func NewRedisCheck(client *redis.Client) DependencyCheck {
+	return DependencyCheck{
+		Name: "redis",
+		Check: func(ctx context.Context) (map[string]interface{}, error) {
+			return nil, client.Ping(ctx).Err()
+		},
+	}
+}
+
+func NewMQTTCheck(mqttService MQTTService) DependencyCheck {
+	return DependencyCheck{
+		Name: "mqtt",
+		Check: func(ctx context.Context) (map[string]interface{}, error) {
+			if !mqttService.IsConnected() {
+				return nil, fmt.Errorf("not connected to MQTT broker")
+			}
+			return nil, nil
+		},
+	}
+}
+
+// NewMessageBusCheck reports the message bus connection, whether the
+// consumer is running and the current queue depth. name is the bus in use,
+// e.g. "rabbitmq".
+func NewMessageBusCheck(name string, bus MessageBus) DependencyCheck {
+	return DependencyCheck{
+		Name: name,
+		Check: func(ctx context.Context) (map[string]interface{}, error) {
+			details := map[string]interface{}{
+				"consumer_running": bus.IsConsuming(),
+			}
+
+			if err := bus.HealthCheck(); err != nil {
+				return details, err
+			}
+
+			if stats, err := bus.QueueStats(); err == nil {
+				details["queue_messages"] = stats.Messages
+				details["queue_consumers"] = stats.Consumers
+			}
+
+			if !bus.IsConsuming() {
+				return details, fmt.Errorf("consumer is not running")
+			}
+
+			return details, nil
+		},
+	}
+}
+
+// NewSpoolCheck degrades the service while messages are buffered on disk
+// because RabbitMQ could not take them.
+func NewSpoolCheck(outbox *spool.Spool) DependencyCheck {
+	return DependencyCheck{
+		Name: "spool",
+		Check: func(ctx context.Context) (map[string]interface{}, error) {
+			pending := outbox.Pending()
+			details := map[string]interface{}{
+				"pending_messages": pending,
+				"size_bytes":       outbox.Size(),
+			}
+			if pending > 0 {
+				return details, fmt.Errorf("buffering %d messages until RabbitMQ is available", pending)
+			}
+			return details, nil
+		},
+	}
+}
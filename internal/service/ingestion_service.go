@@ -0,0 +1,160 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"smat/iot/simulation/iot-inventory-management/internal/repository"
+	"time"
+)
+
+var ErrIngestionStopped = errors.New("ingestion worker stopped")
+
+type ingestionItem struct {
+	reading *domain.DeviceReading
+	message QueueMessage
+}
+
+// ingestionService buffers readings and writes them to the database in
+// bounded batches. A batch is written when it reaches batchSize or when
+// flushInterval has passed since its first reading, whichever comes first.
+// The queue messages behind a batch are acked only after it commits and
+// requeued if it fails, so no reading is lost between the queue and the
+// database.
+type ingestionService struct {
+	repo          repository.ReadingRepository
+	batchSize     int
+	flushInterval time.Duration
+
+	items chan ingestionItem
+	done  chan struct{}
+}
+
+func NewIngestionService(repo repository.ReadingRepository, batchSize int, flushInterval time.Duration) IngestionService {
+	return &ingestionService{
+		repo:          repo,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		items:         make(chan ingestionItem, batchSize),
+		done:          make(chan struct{}),
+	}
+}
+
+// Submit queues a reading for the next batch, blocking while the buffer is
+// full. The worker settles message once the batch has been written.
+func (s *ingestionService) Submit(ctx context.Context, reading *domain.DeviceReading, message QueueMessage) error {
+	select {
+	case s.items <- ingestionItem{reading: reading, message: message}:
+		metrics.IngestionPending.Inc()
+		return nil
+	case <-s.done:
+		return ErrIngestionStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run collects and writes batches until ctx is done, then writes whatever
+// is still buffered.
+func (s *ingestionService) Run(ctx context.Context) {
+	defer close(s.done)
+
+	batch := make([]ingestionItem, 0, s.batchSize)
+	timer := time.NewTimer(s.flushInterval)
+	timer.Stop()
+
+	flush := func(flushCtx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		failed := !s.writeBatch(flushCtx, batch)
+		batch = batch[:0]
+
+		if failed {
+			// Requeued messages come straight back; pause so a database
+			// outage does not turn into a redelivery loop.
+			select {
+			case <-time.After(s.flushInterval):
+			case <-flushCtx.Done():
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			defer cancel()
+
+			// Drain readings already handed over; their messages would
+			// otherwise stay unacked until the connection closes.
+			for drained := false; !drained; {
+				select {
+				case item := <-s.items:
+					batch = append(batch, item)
+					if len(batch) == s.batchSize {
+						flush(flushCtx)
+					}
+				default:
+					drained = true
+				}
+			}
+			flush(flushCtx)
+			return
+
+		case item := <-s.items:
+			if len(batch) == 0 {
+				timer.Reset(s.flushInterval)
+			}
+			batch = append(batch, item)
+			if len(batch) == s.batchSize {
+				timer.Stop()
+				flush(ctx)
+			}
+
+		case <-timer.C:
+			flush(ctx)
+		}
+	}
+}
+
+// writeBatch inserts batch and settles its messages. It reports whether the
+// batch was committed.
+func (s *ingestionService) writeBatch(ctx context.Context, batch []ingestionItem) bool {
+	readings := make([]*domain.DeviceReading, len(batch))
+	for i, item := range batch {
+		readings[i] = item.reading
+	}
+
+	start := time.Now()
+	inserted, err := s.repo.InsertBatch(ctx, readings)
+	metrics.IngestionFlushDuration.Observe(time.Since(start).Seconds())
+	metrics.IngestionBatchSize.Observe(float64(len(batch)))
+	metrics.IngestionPending.Sub(float64(len(batch)))
+
+	if err != nil {
+		metrics.IngestionFailedBatches.Inc()
+		slog.ErrorContext(ctx, "Failed to write reading batch", "readings", len(batch), "error", err)
+		for _, item := range batch {
+			SettleMessage(ctx, item.message, err)
+		}
+		return false
+	}
+
+	committedAt := time.Now()
+	for _, item := range batch {
+		metrics.IngestionLag.Observe(committedAt.Sub(item.reading.ReadingAt).Seconds())
+		// If the ack fails the message is redelivered and the insert
+		// ignores it then.
+		SettleMessage(ctx, item.message, nil)
+	}
+
+	metrics.IngestionReadings.Add(float64(inserted))
+	if duplicates := int64(len(batch)) - inserted; duplicates > 0 {
+		metrics.IngestionDuplicates.Add(float64(duplicates))
+	}
+	return true
+}
@@ -0,0 +1,16 @@
+package service
+
+import (
+	"fmt"
+	"os"
+)
+
+// instanceName identifies this server process among replicas, as
+// <hostname>-<pid>.
+func instanceName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "server"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
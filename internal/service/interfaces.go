@@ -2,9 +2,11 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/google/uuid"
-	amqp "github.com/rabbitmq/amqp091-go"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
 	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"time"
 )
 
 type DeviceService interface {
@@ -19,18 +21,271 @@ type MQTTService interface {
 	Connect() error
 	Subscribe(topic string) error
 	Disconnect()
-	Publish(topic string, payload []byte) error
-	PublishDeviceMessage(message *domain.DeviceMessage) error
+	Publish(ctx context.Context, topic string, payload []byte) error
+	PublishDeviceMessage(ctx context.Context, message *domain.DeviceMessage) error
+	// PublishToDevice publishes payload to a topic devices subscribe to,
+	// such as their commands, without forwarding it to the message bus.
+	PublishToDevice(ctx context.Context, topic string, payload []byte, retain bool) error
+	// PublishRequest publishes payload to a device topic like
+	// PublishToDevice, with the topic and correlation data the device
+	// should answer with. Only MQTT 5 carries them; with MQTT 3.1.1 the
+	// payload must.
+	PublishRequest(ctx context.Context, topic, responseTopic string, correlationData, payload []byte) error
 	IsConnected() bool
 }
 
-type RabbitMQService interface {
+// DeviceCredentialService issues the credentials devices connect to the
+// embedded MQTT broker with, and checks them.
+type DeviceCredentialService interface {
+	// Issue creates a new secret for the device, replacing its previous one.
+	// The secret is only returned here.
+	Issue(ctx context.Context, deviceID uuid.UUID) (*domain.IssuedDeviceCredential, error)
+	Revoke(ctx context.Context, deviceID uuid.UUID) error
+	// Authenticate reports whether secret is the device's current secret.
+	Authenticate(ctx context.Context, deviceID uuid.UUID, secret string) (bool, error)
+	// Enroll stores a secret the device chose itself, of which only the
+	// SHA-256 is known, replacing its previous one.
+	Enroll(ctx context.Context, deviceID uuid.UUID, secretHash []byte) error
+	// IsEnrolled reports whether secretHash is the hash of the device's
+	// current secret.
+	IsEnrolled(ctx context.Context, deviceID uuid.UUID, secretHash []byte) (bool, error)
+}
+
+// CommandService sends commands to devices over MQTT and tracks their
+// acknowledgements. Every command and its outcome is stored, so callers can
+// wait for the outcome or poll for it.
+type CommandService interface {
+	// Send validates and publishes a command. timeout is how long the
+	// device has to acknowledge it; zero uses COMMAND_TIMEOUT.
+	Send(ctx context.Context, deviceID uuid.UUID, command string, params json.RawMessage, timeout time.Duration) (*domain.DeviceCommand, error)
+	Get(ctx context.Context, deviceID, commandID uuid.UUID) (*domain.DeviceCommand, error)
+	// Wait returns the command once it has reached a final status, or as it
+	// is when wait has passed.
+	Wait(ctx context.Context, deviceID, commandID uuid.UUID, wait time.Duration) (*domain.DeviceCommand, error)
+	List(ctx context.Context, deviceID uuid.UUID, limit int) ([]*domain.DeviceCommand, error)
+	// HandleAck applies an acknowledgement the device published.
+	// correlationData is the MQTT 5 correlation data it echoed, if any,
+	// which names the command when the payload has no command_id.
+	HandleAck(ctx context.Context, deviceID uuid.UUID, payload, correlationData []byte) error
+	// Expire marks commands timed out that were not acknowledged in time
+	// and returns how many.
+	Expire(ctx context.Context) (int, error)
+	RunExpirer(ctx context.Context, interval time.Duration)
+	// SetPublisher sets the MQTT client commands are sent with. The client
+	// in turn hands acknowledgements to HandleAck, so it is created after
+	// the command service.
+	SetPublisher(publisher MQTTService)
+}
+
+// TwinService keeps the device twins: the configuration wanted for each
+// device and the configuration it reports. Desired state is published to
+// devices as a retained message, so they receive it whenever they connect.
+type TwinService interface {
+	// Get returns the device's twin with its drift; a device without a twin
+	// has empty sections at version 0.
+	Get(ctx context.Context, deviceID uuid.UUID) (*domain.DeviceTwin, error)
+	// PatchDesired applies a JSON merge patch to the desired section and
+	// publishes it. A version above 0 must match the current desired
+	// version, or ErrTwinVersionConflict is returned.
+	PatchDesired(ctx context.Context, deviceID uuid.UUID, patch map[string]interface{}, version int64) (*domain.DeviceTwin, error)
+	// HandleReported merges a JSON merge patch the device published into
+	// the reported section.
+	HandleReported(ctx context.Context, deviceID uuid.UUID, payload []byte) error
+	// ListDrifted returns the twins whose reported state differs from the
+	// desired state.
+	ListDrifted(ctx context.Context) ([]*domain.DeviceTwin, error)
+	// PublishAll publishes the desired state of every twin again and
+	// returns how many were published.
+	PublishAll(ctx context.Context) (int, error)
+	// SetPublisher sets the MQTT client desired state is published with.
+	SetPublisher(publisher MQTTService)
+}
+
+// ProvisioningService provisions devices without touching them: a device
+// publishes a birth message with its serial number, claim token and the
+// hash of the MQTT secret it chose, and if a client has registered a claim
+// for the serial number with that token the device is created for the
+// client with that secret. Devices without a claim wait as pending devices
+// until they are approved.
+type ProvisioningService interface {
+	// RegisterClaim pre-registers a device for a client. An empty claimToken
+	// generates one; the token is only returned here.
+	RegisterClaim(ctx context.Context, clientID uuid.UUID, serialNumber, claimToken string) (*domain.IssuedDeviceClaim, error)
+	ListClaims(ctx context.Context, clientID uuid.UUID) ([]*domain.DeviceClaim, error)
+	DeleteClaim(ctx context.Context, clientID uuid.UUID, serialNumber string) error
+	// HandleBirth applies a birth message the device published and answers
+	// it on the device's response topic.
+	HandleBirth(ctx context.Context, serialNumber string, payload []byte) error
+	// ListPending returns the pending devices; with a client only those that
+	// named it in their birth message.
+	ListPending(ctx context.Context, clientID *uuid.UUID) ([]*domain.PendingDevice, error)
+	// Approve registers a claim for a pending device that named clientID in
+	// its birth message, with the token it announced itself with, and
+	// provisions it with the credential hash of its birth message. Pending
+	// devices of other clients are reported as not found.
+	Approve(ctx context.Context, serialNumber string, clientID uuid.UUID) (*domain.Device, error)
+	// Assign is Approve for operators: it provisions any pending device for
+	// clientID, whichever client the device named.
+	Assign(ctx context.Context, serialNumber string, clientID uuid.UUID) (*domain.Device, error)
+	// Dismiss removes a pending device; with a client only one that named
+	// it. The device is pending again if it publishes another birth message.
+	Dismiss(ctx context.Context, serialNumber string, clientID *uuid.UUID) error
+	// SetPublisher sets the MQTT client responses are published with.
+	SetPublisher(publisher MQTTService)
+}
+
+// MQTTBroker is the MQTT broker the server can run in process, for
+// development and edge deployments without a separate broker.
+type MQTTBroker interface {
+	Start() error
+	Close() error
+	ConnectedClients() int
+}
+
+// QueueMessage is a message received from the queue together with its
+// string-valued headers (e.g. trace context). The consumer must settle every
+// message with Ack, Retry or DeadLetter once it has been processed.
+type QueueMessage struct {
+	Body    []byte
+	Headers map[string]string
+	// Redelivered is set when the broker has delivered the message before.
+	Redelivered bool
+	// DeliveryCount is how many times the message has been delivered,
+	// counting this delivery and any retries.
+	DeliveryCount int
+
+	acker messageAcker
+}
+
+type messageAcker interface {
+	Ack() error
+	Retry(ctx context.Context, cause error) (requeued bool, err error)
+	DeadLetter(ctx context.Context, reason string, cause error) error
+}
+
+// Ack confirms the message has been fully processed.
+func (m QueueMessage) Ack() error {
+	if m.acker == nil {
+		return nil
+	}
+	return m.acker.Ack()
+}
+
+// Retry returns the message to the queue for another attempt, or
+// dead-letters it once it has reached the maximum number of deliveries. It
+// reports whether the message was requeued.
+func (m QueueMessage) Retry(ctx context.Context, cause error) (bool, error) {
+	if m.acker == nil {
+		return false, nil
+	}
+	return m.acker.Retry(ctx, cause)
+}
+
+// DeadLetter moves the message to the dead-letter queue, recording reason
+// and cause in its headers.
+func (m QueueMessage) DeadLetter(ctx context.Context, reason string, cause error) error {
+	if m.acker == nil {
+		return nil
+	}
+	return m.acker.DeadLetter(ctx, reason, cause)
+}
+
+// MessageBus carries device events from the ingest side to the consumers.
+// Events are published with a topic (see RoutingKey) and delivered to every
+// queue bound to a matching pattern in RABBITMQ_BINDINGS. It is a
+// single-queue abstraction, not general publish/subscribe: the bindings are
+// fixed by the configuration, and Subscribe consumes the one queue this
+// server owns, RABBITMQ_QUEUE. Queue statistics, settings and dead letters
+// belong to that queue, so every implementation keeps them, in process for
+// the in-memory bus. Implementations are selected with MESSAGE_BUS.
+type MessageBus interface {
 	Connect() error
-	PublishMessage(message []byte) error
-	PublishMessageWithContext(ctx context.Context, message []byte) error
-	PublishJSON(v interface{}) error
-	ConsumeMessages() (<-chan []byte, error)
+	// Publish sends message with topic. It fails with ErrPublishReturned
+	// when no queue is bound to the topic.
+	Publish(ctx context.Context, topic string, message []byte) error
+	// Subscribe delivers the messages of the consumer queue, whatever topic
+	// they were published with. The channel is
+	// closed when the subscription ends, e.g. on a reconnect, and Subscribe
+	// must be called again. Every message must be settled with Ack, Retry
+	// or DeadLetter.
+	Subscribe() (<-chan QueueMessage, error)
 	HealthCheck() error
-	GetQueueInfo() (*amqp.Queue, error)
+	IsConsuming() bool
+	QueueStats() (*domain.QueueStats, error)
+	ApplySettings(cfg *config.Config)
 	Close()
+
+	DeadLetterQueue
+}
+
+// DeadLetterQueue holds messages that could not be processed, with the
+// reason recorded in their headers, until they are replayed or purged.
+type DeadLetterQueue interface {
+	// DeadLetter stores a payload that never made it onto the main queue,
+	// such as a malformed MQTT message. source names where it came from.
+	DeadLetter(ctx context.Context, body []byte, source, reason string, cause error) error
+	// ListDeadLetters returns up to limit dead letters, oldest first, and
+	// the total number in the queue. Listing leaves them in the queue.
+	// Implementations may cap limit, and may only find a dead letter by ID
+	// among the oldest ones; RabbitMQ reads at most 500 either way.
+	ListDeadLetters(limit int) ([]*domain.DeadLetter, int, error)
+	GetDeadLetter(id string) (*domain.DeadLetter, error)
+	// ReplayDeadLetter publishes a dead letter back onto the consumer queue
+	// and removes it. It bypasses the exchange, so other queues bound to the
+	// same routing key do not receive it twice. A non-nil payload replaces
+	// the original body.
+	ReplayDeadLetter(ctx context.Context, id string, payload []byte) error
+	// ReplayDeadLetters replays every dead letter and returns how many were
+	// replayed.
+	ReplayDeadLetters(ctx context.Context) (int, error)
+	DeleteDeadLetter(id string) error
+	PurgeDeadLetters() (int, error)
+}
+
+type AuditService interface {
+	Record(ctx context.Context, entry *domain.AuditEntry, before, after interface{}) error
+	List(ctx context.Context, filter domain.AuditFilter) ([]*domain.AuditEntry, error)
+}
+
+// AlertService raises alerts from device updates and pushes them to the
+// dashboard.
+type AlertService interface {
+	Evaluate(ctx context.Context, message *domain.DeviceMessage)
+	// PresenceChanged raises an alert for a device going offline or coming
+	// back online.
+	PresenceChanged(ctx context.Context, presence *domain.DevicePresence)
+	ApplySettings(cfg *config.Config)
+}
+
+// PresenceService tracks whether devices are online. A device comes online
+// when it sends any message or reports itself online, and goes offline when
+// it reports itself offline (typically through its Last Will) or stays
+// silent for the presence timeout. Transitions are pushed to the dashboard
+// and raised as alerts.
+type PresenceService interface {
+	// Seen records a message from the device.
+	Seen(ctx context.Context, deviceID uuid.UUID, clientID string) error
+	// SetStatus applies a status the device published.
+	SetStatus(ctx context.Context, deviceID uuid.UUID, online bool) error
+	// Sweep marks devices offline that have been silent for the timeout and
+	// returns how many.
+	Sweep(ctx context.Context) (int, error)
+	RunSweeper(ctx context.Context, interval time.Duration)
+}
+
+// LiveStateService keeps the latest reading of every device in Redis and
+// periodically writes it back to the database.
+type LiveStateService interface {
+	Record(ctx context.Context, message *domain.DeviceMessage) error
+	Get(ctx context.Context, deviceID uuid.UUID) (*domain.DeviceLiveState, error)
+	Overlay(ctx context.Context, devices []*domain.Device)
+	Flush(ctx context.Context) (int, error)
+	RunFlusher(ctx context.Context, interval time.Duration)
+}
+
+// IngestionService writes device readings to the database in batches and
+// settles their queue messages once the batch commits.
+type IngestionService interface {
+	Submit(ctx context.Context, reading *domain.DeviceReading, message QueueMessage) error
+	Run(ctx context.Context)
 }
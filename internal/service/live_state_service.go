@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"smat/iot/simulation/iot-inventory-management/internal/repository"
+	"time"
+)
+
+var ErrInvalidDeviceMessage = errors.New("invalid device message")
+
+type liveStateService struct {
+	liveRepo   repository.LiveStateRepository
+	deviceRepo repository.DeviceRepository
+	flushBatch int
+}
+
+func NewLiveStateService(liveRepo repository.LiveStateRepository, deviceRepo repository.DeviceRepository, flushBatch int) LiveStateService {
+	return &liveStateService{
+		liveRepo:   liveRepo,
+		deviceRepo: deviceRepo,
+		flushBatch: flushBatch,
+	}
+}
+
+func (s *liveStateService) Record(ctx context.Context, message *domain.DeviceMessage) error {
+	deviceID, err := uuid.Parse(message.DeviceID)
+	if err != nil {
+		return ErrInvalidDeviceMessage
+	}
+
+	now := time.Now()
+	readingAt := message.Timestamp
+	if readingAt.IsZero() {
+		readingAt = now
+	}
+
+	state := &domain.DeviceLiveState{
+		DeviceID:         deviceID,
+		CurrentWeight:    message.CurrentWeight,
+		CurrentItemCount: message.DerivedItemCount(),
+		ItemWeight:       message.ItemWeight,
+		ReadingAt:        readingAt,
+		LastSeenAt:       now,
+	}
+
+	applied, err := s.liveRepo.Save(ctx, state)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		metrics.LiveStateStaleReadings.Inc()
+		slog.DebugContext(ctx, "Ignoring reading older than the stored live state")
+	}
+	return nil
+}
+
+// Get returns the live state of a device, falling back to the last state
+// flushed to the database when Redis has none (or is unavailable). It
+// returns nil if the device does not exist.
+func (s *liveStateService) Get(ctx context.Context, deviceID uuid.UUID) (*domain.DeviceLiveState, error) {
+	state, err := s.liveRepo.Get(ctx, deviceID)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to read live state, falling back to the database", "device_id", deviceID, "error", err)
+	}
+	if state != nil {
+		return state, nil
+	}
+
+	device, err := s.deviceRepo.GetByDeviceID(ctx, deviceID)
+	if err != nil || device == nil {
+		return nil, err
+	}
+	return stateFromDevice(device), nil
+}
+
+func stateFromDevice(device *domain.Device) *domain.DeviceLiveState {
+	state := &domain.DeviceLiveState{
+		DeviceID:         device.ID,
+		CurrentWeight:    device.CurrentWeight,
+		CurrentItemCount: device.CurrentItemCount,
+		ItemWeight:       device.ItemWeight,
+		Source:           domain.LiveStateSourceDatabase,
+	}
+	if device.LastSeenAt != nil {
+		state.ReadingAt = *device.LastSeenAt
+		state.LastSeenAt = *device.LastSeenAt
+	}
+	return state
+}
+
+// Overlay replaces the weight and item count of devices with their live
+// state, where there is one. Errors are logged and leave devices unchanged.
+func (s *liveStateService) Overlay(ctx context.Context, devices []*domain.Device) {
+	if len(devices) == 0 {
+		return
+	}
+
+	deviceIDs := make([]uuid.UUID, len(devices))
+	for i, device := range devices {
+		deviceIDs[i] = device.ID
+	}
+
+	states, err := s.liveRepo.GetMany(ctx, deviceIDs)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to read live state, showing stored values", "error", err)
+		return
+	}
+
+	for _, device := range devices {
+		if state, ok := states[device.ID]; ok {
+			device.CurrentWeight = state.CurrentWeight
+			device.CurrentItemCount = state.CurrentItemCount
+			lastSeenAt := state.LastSeenAt
+			device.LastSeenAt = &lastSeenAt
+		}
+	}
+}
+
+// Flush writes every device changed since the last flush back to the
+// database, in batches of flushBatch, and returns how many were written.
+func (s *liveStateService) Flush(ctx context.Context) (int, error) {
+	start := time.Now()
+	defer func() {
+		metrics.LiveStateFlushDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	flushed := 0
+	for {
+		states, err := s.liveRepo.TakeDirty(ctx, s.flushBatch)
+		if err != nil {
+			return flushed, err
+		}
+		if len(states) == 0 {
+			return flushed, nil
+		}
+
+		if err := s.deviceRepo.UpdateLiveState(ctx, states); err != nil {
+			deviceIDs := make([]uuid.UUID, len(states))
+			for i, state := range states {
+				deviceIDs[i] = state.DeviceID
+			}
+			if markErr := s.liveRepo.MarkDirty(ctx, deviceIDs); markErr != nil {
+				slog.ErrorContext(ctx, "Failed to requeue live state for the next flush", "devices", len(deviceIDs), "error", markErr)
+			}
+			return flushed, err
+		}
+
+		flushed += len(states)
+		metrics.LiveStateFlushedDevices.Add(float64(len(states)))
+
+		if len(states) < s.flushBatch {
+			return flushed, nil
+		}
+	}
+}
+
+// RunFlusher flushes on every interval until ctx is done, then flushes once
+// more so no state is lost on shutdown.
+func (s *liveStateService) RunFlusher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			finalCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			s.flushAndLog(finalCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			s.flushAndLog(ctx)
+		}
+	}
+}
+
+func (s *liveStateService) flushAndLog(ctx context.Context) {
+	flushed, err := s.Flush(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to flush live device state", "flushed", flushed, "error", err)
+		return
+	}
+	if flushed > 0 {
+		slog.DebugContext(ctx, "Flushed live device state", "devices", flushed)
+	}
+}
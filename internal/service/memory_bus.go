@@ -0,0 +1,420 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrBusFull means the in-memory bus already holds MEMORY_BUS_CAPACITY
+	// messages.
+	ErrBusFull = errors.New("message bus is full")
+
+	errBusClosed = errors.New("message bus is closed")
+)
+
+// memoryBus is a MessageBus that keeps the consumer queue in process, for
+// local development, tests and single-binary demos. Nothing survives a
+// restart. Only the consumer queue is held: messages for the other queues in
+// RABBITMQ_BINDINGS are accepted and discarded, since nothing in this process
+// would consume them.
+type memoryBus struct {
+	config   *config.Config
+	patterns []string
+	capacity int
+
+	mu          sync.Mutex
+	pending     []memoryMessage
+	deadLetters []*domain.DeadLetter
+	closed      bool
+	// ready is signalled whenever a message is queued.
+	ready chan struct{}
+
+	maxDeliveries   atomic.Int32
+	activeConsumers atomic.Int32
+	closeChan       chan struct{}
+	closeOnce       sync.Once
+}
+
+type memoryMessage struct {
+	body       []byte
+	messageID  string
+	headers    map[string]string
+	deliveries int
+}
+
+// NewMemoryBus creates an in-process message bus bound to the patterns of
+// RABBITMQ_QUEUE.
+func NewMemoryBus(cfg *config.Config) MessageBus {
+	b := &memoryBus{
+		config:    cfg,
+		capacity:  cfg.MemoryBusCapacity,
+		ready:     make(chan struct{}, 1),
+		closeChan: make(chan struct{}),
+	}
+	for _, binding := range cfg.RabbitMQBindings {
+		if binding.Queue == cfg.RabbitMQQueue {
+			b.patterns = append(b.patterns, binding.Patterns...)
+		}
+	}
+	b.ApplySettings(cfg)
+	return b
+}
+
+// ApplySettings updates the number of deliveries before a failing message
+// is dead-lettered.
+func (b *memoryBus) ApplySettings(cfg *config.Config) {
+	b.maxDeliveries.Store(int32(cfg.RabbitMQMaxDeliveries))
+}
+
+func (b *memoryBus) Connect() error {
+	return b.HealthCheck()
+}
+
+// Publish queues message for the consumer if topic matches one of its
+// bindings. It fails with ErrBusFull rather than blocking when the bus is at
+// capacity.
+func (b *memoryBus) Publish(ctx context.Context, topic string, message []byte) error {
+	if !matchesAnyTopic(b.patterns, topic) {
+		for _, binding := range b.config.RabbitMQBindings {
+			if matchesAnyTopic(binding.Patterns, topic) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: routing key %q", ErrPublishReturned, topic)
+	}
+
+	msg := memoryMessage{
+		body:       bytes.Clone(message),
+		messageID:  messageIDFromPayload(message),
+		headers:    telemetry.Inject(ctx),
+		deliveries: 1,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return errBusClosed
+	}
+	if len(b.pending) >= b.capacity {
+		return fmt.Errorf("%w: %d messages queued", ErrBusFull, len(b.pending))
+	}
+	b.enqueueLocked(msg)
+	return nil
+}
+
+// enqueueLocked appends msg to the queue and wakes the consumer. Retries and
+// replays go through here too and are not limited by the capacity, so
+// settling a message never fails.
+func (b *memoryBus) enqueueLocked(msg memoryMessage) {
+	b.pending = append(b.pending, msg)
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (b *memoryBus) next() (memoryMessage, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.pending) == 0 {
+		return memoryMessage{}, false
+	}
+	msg := b.pending[0]
+	b.pending[0] = memoryMessage{}
+	b.pending = b.pending[1:]
+	return msg, true
+}
+
+func (b *memoryBus) Subscribe() (<-chan QueueMessage, error) {
+	if err := b.HealthCheck(); err != nil {
+		return nil, err
+	}
+
+	output := make(chan QueueMessage, 100)
+	go b.deliver(output)
+	return output, nil
+}
+
+func (b *memoryBus) deliver(output chan<- QueueMessage) {
+	b.activeConsumers.Add(1)
+	defer b.activeConsumers.Add(-1)
+	defer close(output)
+
+	for {
+		msg, ok := b.next()
+		if !ok {
+			select {
+			case <-b.closeChan:
+				return
+			case <-b.ready:
+				continue
+			}
+		}
+
+		queueMessage := QueueMessage{
+			Body:          msg.body,
+			Headers:       msg.headers,
+			Redelivered:   msg.deliveries > 1,
+			DeliveryCount: msg.deliveries,
+			acker:         &memoryDelivery{bus: b, message: msg},
+		}
+		select {
+		case output <- queueMessage:
+		case <-b.closeChan:
+			return
+		}
+	}
+}
+
+// memoryDelivery settles a message taken from the in-memory queue.
+type memoryDelivery struct {
+	bus     *memoryBus
+	message memoryMessage
+}
+
+func (d *memoryDelivery) Ack() error {
+	return nil
+}
+
+func (d *memoryDelivery) Retry(ctx context.Context, cause error) (bool, error) {
+	if d.message.deliveries >= int(d.bus.maxDeliveries.Load()) {
+		return false, d.DeadLetter(ctx, domain.DeadLetterReasonMaxDeliveries, cause)
+	}
+
+	retry := d.message
+	retry.deliveries++
+
+	d.bus.mu.Lock()
+	defer d.bus.mu.Unlock()
+	d.bus.enqueueLocked(retry)
+	return true, nil
+}
+
+func (d *memoryDelivery) DeadLetter(ctx context.Context, reason string, cause error) error {
+	d.bus.addDeadLetter(d.message.body, d.message.messageID, "memory:"+d.bus.config.RabbitMQQueue, reason, cause, d.message.deliveries)
+	return nil
+}
+
+func (b *memoryBus) DeadLetter(ctx context.Context, body []byte, source, reason string, cause error) error {
+	b.addDeadLetter(bytes.Clone(body), messageIDFromPayload(body), source, reason, cause, 1)
+	return nil
+}
+
+// addDeadLetter stores a dead letter. The dead letters are limited to the
+// bus capacity; beyond it the oldest are dropped.
+func (b *memoryBus) addDeadLetter(body []byte, messageID, source, reason string, cause error, deliveries int) {
+	letter := &domain.DeadLetter{
+		ID:            uuid.NewString(),
+		MessageID:     messageID,
+		Reason:        reason,
+		Source:        source,
+		DeliveryCount: deliveries,
+		FailedAt:      time.Now().UTC(),
+	}
+	if cause != nil {
+		letter.Error = cause.Error()
+	}
+	setDeadLetterPayload(letter, body)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.deadLetters) >= b.capacity {
+		slog.Warn("In-memory dead letters are full, dropping the oldest", "dropped_id", b.deadLetters[0].ID)
+		b.deadLetters = b.deadLetters[1:]
+	}
+	b.deadLetters = append(b.deadLetters, letter)
+}
+
+func (b *memoryBus) ListDeadLetters(limit int) ([]*domain.DeadLetter, int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total := len(b.deadLetters)
+	if limit > total {
+		limit = total
+	}
+	letters := make([]*domain.DeadLetter, limit)
+	copy(letters, b.deadLetters[:limit])
+	return letters, total, nil
+}
+
+func (b *memoryBus) GetDeadLetter(id string) (*domain.DeadLetter, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	index := b.deadLetterIndexLocked(id)
+	if index < 0 {
+		return nil, ErrDeadLetterNotFound
+	}
+	return b.deadLetters[index], nil
+}
+
+func (b *memoryBus) ReplayDeadLetter(ctx context.Context, id string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	index := b.deadLetterIndexLocked(id)
+	if index < 0 {
+		return ErrDeadLetterNotFound
+	}
+	body := deadLetterBody(b.deadLetters[index])
+	if payload != nil {
+		body = bytes.Clone(payload)
+	}
+	b.replayLocked(ctx, b.deadLetters[index], body)
+	b.deadLetters = append(b.deadLetters[:index], b.deadLetters[index+1:]...)
+	return nil
+}
+
+func (b *memoryBus) ReplayDeadLetters(ctx context.Context) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	replayed := len(b.deadLetters)
+	for _, letter := range b.deadLetters {
+		b.replayLocked(ctx, letter, deadLetterBody(letter))
+	}
+	b.deadLetters = nil
+	return replayed, nil
+}
+
+// replayLocked puts a dead letter back on the queue as a fresh message.
+func (b *memoryBus) replayLocked(ctx context.Context, letter *domain.DeadLetter, body []byte) {
+	b.enqueueLocked(memoryMessage{
+		body:       body,
+		messageID:  letter.MessageID,
+		headers:    telemetry.Inject(ctx),
+		deliveries: 1,
+	})
+}
+
+func (b *memoryBus) DeleteDeadLetter(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	index := b.deadLetterIndexLocked(id)
+	if index < 0 {
+		return ErrDeadLetterNotFound
+	}
+	b.deadLetters = append(b.deadLetters[:index], b.deadLetters[index+1:]...)
+	return nil
+}
+
+func (b *memoryBus) PurgeDeadLetters() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	purged := len(b.deadLetters)
+	b.deadLetters = nil
+	return purged, nil
+}
+
+func (b *memoryBus) deadLetterIndexLocked(id string) int {
+	for i, letter := range b.deadLetters {
+		if letter.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *memoryBus) HealthCheck() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return errBusClosed
+	}
+	return nil
+}
+
+func (b *memoryBus) IsConsuming() bool {
+	return b.activeConsumers.Load() > 0
+}
+
+func (b *memoryBus) QueueStats() (*domain.QueueStats, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return &domain.QueueStats{
+		Queue:     b.config.RabbitMQQueue,
+		Messages:  len(b.pending),
+		Consumers: int(b.activeConsumers.Load()),
+	}, nil
+}
+
+// Close stops delivery. Messages still queued are lost.
+func (b *memoryBus) Close() {
+	b.closeOnce.Do(func() {
+		b.mu.Lock()
+		b.closed = true
+		dropped := len(b.pending)
+		b.pending = nil
+		b.mu.Unlock()
+
+		close(b.closeChan)
+		if dropped > 0 {
+			slog.Warn("Closed in-memory message bus with undelivered messages", "dropped", dropped)
+		}
+	})
+}
+
+// deadLetterBody returns the original body of a dead letter.
+func deadLetterBody(letter *domain.DeadLetter) []byte {
+	if letter.Payload != nil {
+		return letter.Payload
+	}
+	return []byte(letter.RawPayload)
+}
+
+// matchesAnyTopic reports whether topic matches one of the AMQP topic
+// patterns, where "*" matches exactly one word and "#" zero or more.
+func matchesAnyTopic(patterns []string, topic string) bool {
+	words := strings.Split(topic, ".")
+	for _, pattern := range patterns {
+		if matchTopicWords(strings.Split(pattern, "."), words) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchTopicWords(pattern, topic []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "#":
+			for i := 0; i <= len(topic); i++ {
+				if matchTopicWords(pattern[1:], topic[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(topic) == 0 {
+				return false
+			}
+		default:
+			if len(topic) == 0 || topic[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, topic = pattern[1:], topic[1:]
+	}
+	return len(topic) == 0
+}
@@ -0,0 +1,263 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"testing"
+	"time"
+)
+
+func TestMatchesAnyTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"tenant.a.device.b.sale", "tenant.a.device.b.sale", true},
+		{"tenant.a.device.b.sale", "tenant.a.device.b.restock", false},
+		{"tenant.*.device.*.sale", "tenant.a.device.b.sale", true},
+		{"tenant.*.device.*.sale", "tenant.a.device.sale", false},
+		{"tenant.*.device.*.sale", "tenant.a.device.b.c.sale", false},
+		{"tenant.#", "tenant.a.device.b.sale", true},
+		{"tenant.#", "tenant", true},
+		{"tenant.#", "other.a", false},
+		{"#", "tenant.a.device.b.sale", true},
+		{"#", "", true},
+		{"#.sale", "tenant.a.device.b.sale", true},
+		{"#.sale", "sale", true},
+		{"#.sale", "tenant.a.device.b.restock", false},
+		{"tenant.#.sale", "tenant.a.device.b.sale", true},
+		{"tenant.#.sale", "tenant.sale", true},
+		{"tenant.#.b.#.sale", "tenant.a.device.b.x.sale", true},
+		{"tenant.#.c.#.sale", "tenant.a.device.b.x.sale", false},
+		{"*", "tenant", true},
+		{"*", "tenant.a", false},
+		{"*.#", "tenant", true},
+		{"tenant.*", "tenant", false},
+	}
+	for _, tt := range tests {
+		if got := matchesAnyTopic([]string{tt.pattern}, tt.topic); got != tt.want {
+			t.Errorf("matchesAnyTopic(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+
+	if matchesAnyTopic(nil, "tenant.a") {
+		t.Error("matchesAnyTopic() without patterns = true, want false")
+	}
+	if !matchesAnyTopic([]string{"other.#", "tenant.#"}, "tenant.a") {
+		t.Error("matchesAnyTopic() with a later matching pattern = false, want true")
+	}
+}
+
+func testMemoryBusConfig() *config.Config {
+	return &config.Config{
+		RabbitMQQueue: "inventory_updates",
+		RabbitMQBindings: []config.QueueBinding{
+			{Queue: "inventory_updates", Patterns: []string{"tenant.*.device.*.sale"}},
+			{Queue: "analytics", Patterns: []string{"tenant.#"}},
+		},
+		RabbitMQMaxDeliveries: 2,
+		MemoryBusCapacity:     3,
+	}
+}
+
+func startTestMemoryBus(t *testing.T, cfg *config.Config) (*memoryBus, <-chan QueueMessage) {
+	t.Helper()
+
+	b := NewMemoryBus(cfg).(*memoryBus)
+	t.Cleanup(b.Close)
+	messages, err := b.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	return b, messages
+}
+
+func TestMemoryBusRouting(t *testing.T) {
+	b := NewMemoryBus(testMemoryBusConfig()).(*memoryBus)
+	defer b.Close()
+	ctx := context.Background()
+
+	tests := []struct {
+		topic   string
+		wantErr error
+		queued  bool
+	}{
+		{"tenant.a.device.b.sale", nil, true},
+		// Bound to another queue only: accepted and discarded.
+		{"tenant.a.device.b.restock", nil, false},
+		{"other.topic", ErrPublishReturned, false},
+	}
+	for _, tt := range tests {
+		before := len(b.pending)
+		if err := b.Publish(ctx, tt.topic, []byte(`{}`)); !errors.Is(err, tt.wantErr) {
+			t.Errorf("Publish(%q) error = %v, want %v", tt.topic, err, tt.wantErr)
+		}
+		if queued := len(b.pending) > before; queued != tt.queued {
+			t.Errorf("Publish(%q) queued = %v, want %v", tt.topic, queued, tt.queued)
+		}
+	}
+}
+
+func TestMemoryBusCapacity(t *testing.T) {
+	b := NewMemoryBus(testMemoryBusConfig()).(*memoryBus)
+	defer b.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if err := b.Publish(ctx, "tenant.a.device.b.sale", []byte(`{}`)); err != nil {
+			t.Fatalf("Publish() %d error = %v", i, err)
+		}
+	}
+	if err := b.Publish(ctx, "tenant.a.device.b.sale", []byte(`{}`)); !errors.Is(err, ErrBusFull) {
+		t.Fatalf("Publish() over capacity error = %v, want %v", err, ErrBusFull)
+	}
+	if stats, err := b.QueueStats(); err != nil || stats.Messages != 3 {
+		t.Errorf("QueueStats() = %+v, %v, want 3 messages", stats, err)
+	}
+}
+
+func nextMemoryMessage(t *testing.T, messages <-chan QueueMessage) QueueMessage {
+	t.Helper()
+
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return QueueMessage{}
+}
+
+func expectNoMemoryMessage(t *testing.T, messages <-chan QueueMessage) {
+	t.Helper()
+
+	select {
+	case message := <-messages:
+		t.Fatalf("unexpected delivery of %s", message.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryBusSettlement(t *testing.T) {
+	ctx := context.Background()
+	cause := errors.New("database down")
+
+	tests := []struct {
+		name string
+		// settle settles each delivery; it returns false once the message
+		// should not be delivered again.
+		settle          func(t *testing.T, message QueueMessage) bool
+		wantDeliveries  int
+		wantDeadLetters int
+	}{
+		{
+			name: "ack",
+			settle: func(t *testing.T, message QueueMessage) bool {
+				if err := message.Ack(); err != nil {
+					t.Fatalf("Ack() error = %v", err)
+				}
+				return false
+			},
+			wantDeliveries: 1,
+		},
+		{
+			name: "retry until max deliveries",
+			settle: func(t *testing.T, message QueueMessage) bool {
+				requeued, err := message.Retry(ctx, cause)
+				if err != nil {
+					t.Fatalf("Retry() error = %v", err)
+				}
+				return requeued
+			},
+			wantDeliveries:  2,
+			wantDeadLetters: 1,
+		},
+		{
+			name: "retry then ack",
+			settle: func(t *testing.T, message QueueMessage) bool {
+				if message.Redelivered {
+					return message.Ack() != nil
+				}
+				requeued, err := message.Retry(ctx, cause)
+				if err != nil || !requeued {
+					t.Fatalf("Retry() = %v, %v, want requeued", requeued, err)
+				}
+				return true
+			},
+			wantDeliveries: 2,
+		},
+		{
+			name: "dead letter",
+			settle: func(t *testing.T, message QueueMessage) bool {
+				if err := message.DeadLetter(ctx, domain.DeadLetterReasonInvalid, cause); err != nil {
+					t.Fatalf("DeadLetter() error = %v", err)
+				}
+				return false
+			},
+			wantDeliveries:  1,
+			wantDeadLetters: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, messages := startTestMemoryBus(t, testMemoryBusConfig())
+			if err := b.Publish(ctx, "tenant.a.device.b.sale", []byte(`{"message_id": "m1"}`)); err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+
+			deliveries := 0
+			for {
+				message := nextMemoryMessage(t, messages)
+				deliveries++
+				if message.DeliveryCount != deliveries || message.Redelivered != (deliveries > 1) {
+					t.Errorf("delivery %d: DeliveryCount = %d, Redelivered = %v", deliveries, message.DeliveryCount, message.Redelivered)
+				}
+				if !tt.settle(t, message) {
+					break
+				}
+			}
+			expectNoMemoryMessage(t, messages)
+
+			if deliveries != tt.wantDeliveries {
+				t.Errorf("delivered %d times, want %d", deliveries, tt.wantDeliveries)
+			}
+			letters, total, _ := b.ListDeadLetters(10)
+			if total != tt.wantDeadLetters {
+				t.Fatalf("%d dead letters, want %d", total, tt.wantDeadLetters)
+			}
+			if total > 0 && (letters[0].MessageID != "m1" || letters[0].Error != cause.Error() || letters[0].DeliveryCount != deliveries) {
+				t.Errorf("dead letter = %+v, want message m1 after %d deliveries", letters[0], deliveries)
+			}
+		})
+	}
+}
+
+func TestMemoryBusReplayDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	b, messages := startTestMemoryBus(t, testMemoryBusConfig())
+
+	if err := b.DeadLetter(ctx, []byte(`{"message_id": "m1"}`), "mqtt:devices/x/weight", domain.DeadLetterReasonMalformed, nil); err != nil {
+		t.Fatalf("DeadLetter() error = %v", err)
+	}
+	letters, _, _ := b.ListDeadLetters(10)
+	if len(letters) != 1 {
+		t.Fatalf("%d dead letters, want 1", len(letters))
+	}
+
+	if err := b.ReplayDeadLetter(ctx, letters[0].ID, []byte(`{"message_id": "m1", "fixed": true}`)); err != nil {
+		t.Fatalf("ReplayDeadLetter() error = %v", err)
+	}
+	message := nextMemoryMessage(t, messages)
+	if string(message.Body) != `{"message_id": "m1", "fixed": true}` || message.DeliveryCount != 1 {
+		t.Errorf("replayed message = %s after %d deliveries, want the new payload as a first delivery", message.Body, message.DeliveryCount)
+	}
+	if _, total, _ := b.ListDeadLetters(10); total != 0 {
+		t.Errorf("%d dead letters after replay, want 0", total)
+	}
+	if err := b.ReplayDeadLetter(ctx, letters[0].ID, nil); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("ReplayDeadLetter() twice error = %v, want %v", err, ErrDeadLetterNotFound)
+	}
+}
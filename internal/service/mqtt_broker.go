@@ -0,0 +1,246 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/logger"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+)
+
+// mqttBroker runs a mochi-mqtt broker in process. The server's own MQTT
+// client connects to it like any other broker, and devices on the network
+// can connect to it directly.
+type mqttBroker struct {
+	config      *config.Config
+	credentials DeviceCredentialService
+	server      *mqtt.Server
+}
+
+// NewMQTTBroker creates the embedded broker. Devices log in with their
+// device ID as the client ID and username and an issued device credential
+// as the password, and may only use topics under devices/<device ID>/. Devices
+// without a credential may log in for provisioning with
+// MQTT_BROKER_PROVISIONING_PASSWORD. The server logs in with MQTT_USERNAME
+// and MQTT_PASSWORD and may use every topic.
+func NewMQTTBroker(cfg *config.Config, credentials DeviceCredentialService) MQTTBroker {
+	return &mqttBroker{config: cfg, credentials: credentials}
+}
+
+func (b *mqttBroker) Start() error {
+	// Refused connections and topics are logged by the auth hook; the
+	// broker's own warnings repeat them with the whole packet.
+	server := mqtt.New(&mqtt.Options{
+		Logger: logger.AtLeast(slog.Default().With("component", "mqtt_broker"), slog.LevelError),
+	})
+
+	hook := &deviceAuthHook{config: b.config, credentials: b.credentials}
+	if err := server.AddHook(hook, nil); err != nil {
+		return fmt.Errorf("failed to add auth hook: %w", err)
+	}
+	aliasHook := &topicAliasHook{maximum: server.Options.Capabilities.TopicAliasMaximum}
+	if err := server.AddHook(aliasHook, nil); err != nil {
+		return fmt.Errorf("failed to add topic alias hook: %w", err)
+	}
+
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: b.config.MQTTBrokerListen})); err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", b.config.MQTTBrokerListen, err)
+	}
+	if b.config.MQTTBrokerWSListen != "" {
+		if err := server.AddListener(listeners.NewWebsocket(listeners.Config{ID: "ws", Address: b.config.MQTTBrokerWSListen})); err != nil {
+			server.Close()
+			return fmt.Errorf("failed to listen on %s: %w", b.config.MQTTBrokerWSListen, err)
+		}
+	}
+
+	if err := server.Serve(); err != nil {
+		server.Close()
+		return fmt.Errorf("failed to start MQTT broker: %w", err)
+	}
+	b.server = server
+
+	if b.config.MQTTBrokerAllowAnonymous {
+		slog.Warn("Embedded MQTT broker accepts anonymous clients with full access")
+	}
+	slog.Info("Started embedded MQTT broker", "address", b.config.MQTTBrokerListen, "ws_address", b.config.MQTTBrokerWSListen)
+	return nil
+}
+
+// ConnectedClients returns the number of authenticated clients.
+func (b *mqttBroker) ConnectedClients() int {
+	if b.server == nil {
+		return 0
+	}
+	return int(b.server.Info.Clone().ClientsConnected)
+}
+
+func (b *mqttBroker) Close() error {
+	if b.server == nil {
+		return nil
+	}
+	slog.Info("Stopping embedded MQTT broker")
+	metrics.MQTTBrokerClients.Set(0)
+	return b.server.Close()
+}
+
+// deviceAuthHook authenticates clients of the embedded broker against the
+// device credentials and limits devices to their own topics.
+type deviceAuthHook struct {
+	mqtt.HookBase
+	config      *config.Config
+	credentials DeviceCredentialService
+}
+
+func (h *deviceAuthHook) ID() string {
+	return "device-credentials"
+}
+
+func (h *deviceAuthHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+		mqtt.OnSysInfoTick,
+	}, []byte{b})
+}
+
+func (h *deviceAuthHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	username := string(pk.Connect.Username)
+	if h.isServer(username) {
+		if subtle.ConstantTimeCompare(pk.Connect.Password, []byte(h.config.MQTTPassword)) == 1 {
+			return true
+		}
+		return h.refuse(cl, "bad_credentials")
+	}
+	if h.isProvisioning(username) {
+		if subtle.ConstantTimeCompare(pk.Connect.Password, []byte(h.config.MQTTBrokerProvisioningPassword)) != 1 {
+			return h.refuse(cl, "bad_credentials")
+		}
+		// The client ID is the serial number, which the ACL limits the
+		// client to.
+		if domain.ValidateSerialNumber(cl.ID) != nil {
+			return h.refuse(cl, "invalid_client_id")
+		}
+		return true
+	}
+	if username == "" {
+		if h.config.MQTTBrokerAllowAnonymous {
+			return true
+		}
+		return h.refuse(cl, "anonymous")
+	}
+
+	deviceID, err := uuid.Parse(username)
+	if err != nil {
+		return h.refuse(cl, "unknown_user")
+	}
+	// The client ID must be the device ID too: the broker hands a client ID's
+	// session, with its subscriptions, to whoever connects with it next.
+	if cl.ID != deviceID.String() {
+		return h.refuse(cl, "invalid_client_id")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ok, err := h.credentials.Authenticate(ctx, deviceID, string(pk.Connect.Password))
+	if err != nil {
+		slog.Error("Failed to check device credential", "device_id", deviceID, "error", err)
+		return h.refuse(cl, "error")
+	}
+	if !ok {
+		return h.refuse(cl, "bad_credentials")
+	}
+	slog.Debug("Device connected to embedded MQTT broker", "device_id", deviceID, "client_id", cl.ID)
+	return true
+}
+
+func (h *deviceAuthHook) refuse(cl *mqtt.Client, reason string) bool {
+	slog.Warn("Refused MQTT connection", "client_id", cl.ID, "username", string(cl.Properties.Username), "remote", cl.Net.Remote, "reason", reason)
+	metrics.MQTTBrokerAuthFailures.WithLabelValues(reason).Inc()
+	return false
+}
+
+// OnACLCheck lets the server and anonymous clients use every topic, devices
+// subscribe only to topics under devices/<device ID>/ and publish only the
+// topics devices send, and devices logged in for provisioning only their
+// birth and response topics.
+func (h *deviceAuthHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	username := string(cl.Properties.Username)
+	if h.isServer(username) || username == "" {
+		return true
+	}
+
+	if h.isProvisioning(username) {
+		prefix := "provisioning/" + cl.ID + "/"
+		if (write && topic == prefix+"birth") || (!write && topic == prefix+"response") {
+			return true
+		}
+	} else if deviceID, err := uuid.Parse(username); err == nil {
+		if name, ok := strings.CutPrefix(topic, "devices/"+deviceID.String()+"/"); ok && (!write || isDeviceTopic(name)) {
+			return true
+		}
+	}
+	slog.Warn("Refused MQTT topic access", "client_id", cl.ID, "username", username, "topic", topic, "write", write)
+	metrics.MQTTBrokerAuthFailures.WithLabelValues("acl").Inc()
+	return false
+}
+
+// isDeviceTopic reports whether a device may publish to devices/<device
+// ID>/<name>: its telemetry and status, which are a single word, command
+// acks and reported twin configuration. Commands and the desired twin are
+// the server's.
+func isDeviceTopic(name string) bool {
+	switch name {
+	case "commands/ack", "twin/reported":
+		return true
+	case "", "commands":
+		return false
+	}
+	return !strings.ContainsAny(name, "/+#")
+}
+
+func (h *deviceAuthHook) OnSysInfoTick(info *system.Info) {
+	metrics.MQTTBrokerClients.Set(float64(info.ClientsConnected))
+}
+
+func (h *deviceAuthHook) isServer(username string) bool {
+	return h.config.MQTTUsername != "" && username == h.config.MQTTUsername
+}
+
+func (h *deviceAuthHook) isProvisioning(username string) bool {
+	return h.config.MQTTBrokerProvisioningPassword != "" && username == config.MQTTBrokerProvisioningUsername
+}
+
+// topicAliasHook advertises the topic aliases the broker accepts in the
+// CONNACK. mochi accepts them but leaves the property out, which tells MQTT 5
+// clients not to use any.
+type topicAliasHook struct {
+	mqtt.HookBase
+	maximum uint16
+}
+
+func (h *topicAliasHook) ID() string {
+	return "topic-alias-maximum"
+}
+
+func (h *topicAliasHook) Provides(b byte) bool {
+	return b == mqtt.OnPacketEncode
+}
+
+func (h *topicAliasHook) OnPacketEncode(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	if pk.FixedHeader.Type == packets.Connack && pk.ProtocolVersion == 5 && pk.ReasonCode == packets.CodeSuccess.Code {
+		pk.Properties.TopicAliasMaximum = h.maximum
+	}
+	return pk
+}
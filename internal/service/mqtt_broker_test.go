@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+
+	"github.com/google/uuid"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// acceptingCredentials accepts every device secret.
+type acceptingCredentials struct {
+	DeviceCredentialService
+}
+
+func (acceptingCredentials) Authenticate(context.Context, uuid.UUID, string) (bool, error) {
+	return true, nil
+}
+
+func newTestAuthHook() *deviceAuthHook {
+	return &deviceAuthHook{
+		config:      &config.Config{MQTTUsername: testMQTTUsername, MQTTPassword: testMQTTPassword},
+		credentials: acceptingCredentials{},
+	}
+}
+
+func TestDeviceLoginNeedsDeviceClientID(t *testing.T) {
+	hook := newTestAuthHook()
+	deviceID := uuid.New()
+
+	tests := []struct {
+		name     string
+		clientID string
+		want     bool
+	}{
+		{"device ID", deviceID.String(), true},
+		{"another device", uuid.NewString(), false},
+		{"server", "iot-inventory-server-host-1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := &mqtt.Client{ID: tt.clientID}
+			pk := packets.Packet{Connect: packets.ConnectParams{Username: []byte(deviceID.String()), Password: []byte("secret")}}
+			if got := hook.OnConnectAuthenticate(cl, pk); got != tt.want {
+				t.Errorf("OnConnectAuthenticate() with client ID %q = %v, want %v", tt.clientID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeviceACL(t *testing.T) {
+	hook := newTestAuthHook()
+	deviceID := uuid.New()
+	own := "devices/" + deviceID.String() + "/"
+	other := "devices/" + uuid.NewString() + "/"
+
+	tests := []struct {
+		topic string
+		write bool
+		want  bool
+	}{
+		{own + "weight", true, true},
+		{own + "status", true, true},
+		{own + "commands/ack", true, true},
+		{own + "twin/reported", true, true},
+		{own + "commands", true, false},
+		{own + "twin/desired", true, false},
+		{own + "weight/extra", true, false},
+		{own + "commands", false, true},
+		{own + "twin/desired", false, true},
+		{own + "#", false, true},
+		{other + "weight", true, false},
+		{other + "commands", false, false},
+		{"provisioning/serial/birth", true, false},
+	}
+	cl := &mqtt.Client{ID: deviceID.String(), Properties: mqtt.ClientProperties{Username: []byte(deviceID.String())}}
+	for _, tt := range tests {
+		if got := hook.OnACLCheck(cl, tt.topic, tt.write); got != tt.want {
+			t.Errorf("OnACLCheck(%q, write=%v) = %v, want %v", tt.topic, tt.write, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log/slog"
+	"os"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/logger"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"smat/iot/simulation/iot-inventory-management/internal/repository"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MQTT 5 user properties set on every device message. Trace context uses the
+// W3C header names, so the properties can be handed to the propagator as is.
+const (
+	mqttPropertyMessageID     = "message_id"
+	mqttPropertySchemaVersion = "schema_version"
+	mqttPropertyTraceParent   = "traceparent"
+	mqttPropertyTraceState    = "tracestate"
+)
+
+// mqttForwarder forwards device messages received over MQTT to the message
+// bus, status messages to the presence service, command acknowledgements to
+// the command service, reported configuration to the twin service and birth
+// messages to the provisioning service. It is shared by the MQTT 3.1.1 and
+// MQTT 5 clients.
+type mqttForwarder struct {
+	bus          MessageBus
+	deviceRepo   repository.DeviceRepository
+	presence     PresenceService
+	commands     CommandService
+	twins        TwinService
+	provisioning ProvisioningService
+}
+
+// forward decodes a device message and publishes it to the message bus.
+// properties are the MQTT 5 user properties of the message, nil with MQTT
+// 3.1.1; they fill in the message ID and trace context when the payload
+// does not carry them. correlationData is the MQTT 5 correlation data, which
+// command acknowledgements may echo instead of a command_id.
+func (f *mqttForwarder) forward(topic string, payload []byte, properties map[string]string, correlationData []byte) {
+	slog.Debug("Received MQTT message", "topic", topic, "payload", string(payload))
+	metrics.MQTTMessagesReceived.Inc()
+
+	if deviceID, ok := deviceTopic(topic, "status"); ok {
+		f.updateStatus(topic, deviceID, payload)
+		return
+	}
+	if deviceID, ok := deviceTopic(topic, "commands", "ack"); ok {
+		f.acknowledgeCommand(topic, deviceID, payload, correlationData)
+		return
+	}
+	if deviceID, ok := deviceTopic(topic, "twin", "reported"); ok {
+		f.reportTwin(topic, deviceID, payload)
+		return
+	}
+	if serialNumber, ok := birthTopic(topic); ok {
+		f.provision(topic, serialNumber, payload)
+		return
+	}
+
+	var deviceMsg domain.DeviceMessage
+	if err := json.Unmarshal(payload, &deviceMsg); err != nil {
+		slog.Error("Failed to unmarshal MQTT message, dead-lettering", "topic", topic, "error", err)
+		metrics.MQTTMessagesFailed.WithLabelValues("unmarshal").Inc()
+		f.deadLetter(topic, payload, domain.DeadLetterReasonMalformed, err)
+		return
+	}
+
+	if version := properties[mqttPropertySchemaVersion]; version != "" && version != domain.DeviceMessageSchemaVersion {
+		err := fmt.Errorf("unsupported schema version %q", version)
+		slog.Error("Unsupported MQTT message schema, dead-lettering", "topic", topic, "schema_version", version)
+		metrics.MQTTMessagesFailed.WithLabelValues("schema").Inc()
+		f.deadLetter(topic, payload, domain.DeadLetterReasonInvalid, err)
+		return
+	}
+
+	// The broker only lets a device publish under its own devices/<id>/
+	// topics, so the topic, not the payload, says which device sent it.
+	deviceID, ok := telemetryTopic(topic)
+	if !ok {
+		err := fmt.Errorf("topic %q does not name a device", topic)
+		slog.Error("MQTT message on a topic without a device, dead-lettering", "topic", topic)
+		metrics.MQTTMessagesFailed.WithLabelValues("device").Inc()
+		f.deadLetter(topic, payload, domain.DeadLetterReasonInvalid, err)
+		return
+	}
+	changed := false
+	if deviceMsg.DeviceID == "" {
+		deviceMsg.DeviceID = deviceID.String()
+		changed = true
+	} else if payloadID, err := uuid.Parse(deviceMsg.DeviceID); err != nil || payloadID != deviceID {
+		err := fmt.Errorf("device_id %q does not match the topic", deviceMsg.DeviceID)
+		slog.Error("MQTT message for another device, dead-lettering", "topic", topic, "device_id", deviceMsg.DeviceID)
+		metrics.MQTTMessagesFailed.WithLabelValues("device").Inc()
+		f.deadLetter(topic, payload, domain.DeadLetterReasonInvalid, err)
+		return
+	}
+
+	if deviceMsg.MessageID == "" && properties[mqttPropertyMessageID] != "" {
+		deviceMsg.MessageID = properties[mqttPropertyMessageID]
+		changed = true
+	}
+	if len(deviceMsg.TraceContext) == 0 && properties[mqttPropertyTraceParent] != "" {
+		deviceMsg.TraceContext = map[string]string{mqttPropertyTraceParent: properties[mqttPropertyTraceParent]}
+		if state := properties[mqttPropertyTraceState]; state != "" {
+			deviceMsg.TraceContext[mqttPropertyTraceState] = state
+		}
+		changed = true
+	}
+
+	ctx, cancel := context.WithTimeout(telemetry.Extract(context.Background(), deviceMsg.TraceContext), 5*time.Second)
+	defer cancel()
+
+	if f.normalize(&deviceMsg) {
+		changed = true
+	}
+	clientChanged, err := f.assignClient(ctx, &deviceMsg, deviceID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to find the client of an MQTT message, dead-lettering", "topic", topic, "device_id", deviceID, "error", err)
+		metrics.MQTTMessagesFailed.WithLabelValues("device").Inc()
+		f.deadLetter(topic, payload, domain.DeadLetterReasonInvalid, err)
+		return
+	}
+	if clientChanged {
+		changed = true
+	}
+	if changed {
+		if normalized, err := json.Marshal(&deviceMsg); err == nil {
+			payload = normalized
+		}
+	}
+	ctx = logger.With(ctx, "device_id", deviceMsg.DeviceID, "message_id", deviceMsg.MessageID)
+
+	ctx, span := telemetry.Tracer().Start(ctx, "mqtt.receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "mqtt"),
+			attribute.String("messaging.destination.name", topic),
+			attribute.String("device.id", deviceMsg.DeviceID),
+		),
+	)
+	defer span.End()
+
+	if err := f.bus.Publish(ctx, routingKeyForPayload(payload), payload); err != nil {
+		slog.ErrorContext(ctx, "Failed to publish to the message bus", "error", err)
+		metrics.MQTTMessagesFailed.WithLabelValues("forward").Inc()
+		telemetry.RecordError(span, err)
+
+		if healthErr := f.bus.HealthCheck(); healthErr != nil {
+			slog.WarnContext(ctx, "Message bus health check failed", "error", healthErr)
+		}
+	} else {
+		slog.DebugContext(ctx, "Successfully forwarded message to the message bus")
+	}
+}
+
+// updateStatus applies a status message, which is either "online" or
+// "offline", as plain text or as {"status": "..."}.
+func (f *mqttForwarder) updateStatus(topic string, deviceID uuid.UUID, payload []byte) {
+	status := strings.TrimSpace(string(payload))
+	if strings.HasPrefix(status, "{") {
+		var message struct {
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(payload, &message); err == nil {
+			status = message.Status
+		}
+	}
+	if status != domain.DeviceStatusOnline && status != domain.DeviceStatusOffline {
+		err := fmt.Errorf("invalid device status %q", status)
+		slog.Error("Invalid MQTT status message, dead-lettering", "topic", topic, "error", err)
+		metrics.MQTTMessagesFailed.WithLabelValues("status").Inc()
+		f.deadLetter(topic, payload, domain.DeadLetterReasonMalformed, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = logger.With(ctx, "device_id", deviceID.String())
+
+	if err := f.presence.SetStatus(ctx, deviceID, status == domain.DeviceStatusOnline); err != nil {
+		slog.WarnContext(ctx, "Failed to update device status", "status", status, "error", err)
+		metrics.MQTTMessagesFailed.WithLabelValues("status").Inc()
+	}
+}
+
+func (f *mqttForwarder) acknowledgeCommand(topic string, deviceID uuid.UUID, payload, correlationData []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = logger.With(ctx, "device_id", deviceID.String())
+
+	err := f.commands.HandleAck(ctx, deviceID, payload, correlationData)
+	switch {
+	case errors.Is(err, ErrInvalidCommandAck):
+		slog.ErrorContext(ctx, "Invalid command acknowledgement, dead-lettering", "topic", topic, "error", err)
+		metrics.MQTTMessagesFailed.WithLabelValues("command_ack").Inc()
+		f.deadLetter(topic, payload, domain.DeadLetterReasonMalformed, err)
+	case err != nil:
+		slog.ErrorContext(ctx, "Failed to apply command acknowledgement", "error", err)
+		metrics.MQTTMessagesFailed.WithLabelValues("command_ack").Inc()
+	}
+}
+
+func (f *mqttForwarder) reportTwin(topic string, deviceID uuid.UUID, payload []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = logger.With(ctx, "device_id", deviceID.String())
+
+	err := f.twins.HandleReported(ctx, deviceID, payload)
+	switch {
+	case errors.Is(err, ErrInvalidTwinReport):
+		slog.ErrorContext(ctx, "Invalid reported twin state, dead-lettering", "topic", topic, "error", err)
+		metrics.MQTTMessagesFailed.WithLabelValues("twin").Inc()
+		f.deadLetter(topic, payload, domain.DeadLetterReasonMalformed, err)
+	case err != nil:
+		slog.WarnContext(ctx, "Failed to apply reported twin state", "error", err)
+		metrics.MQTTMessagesFailed.WithLabelValues("twin").Inc()
+	}
+}
+
+func (f *mqttForwarder) provision(topic, serialNumber string, payload []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = logger.With(ctx, "serial_number", serialNumber)
+
+	err := f.provisioning.HandleBirth(ctx, serialNumber, payload)
+	switch {
+	case errors.Is(err, ErrInvalidBirth):
+		slog.ErrorContext(ctx, "Invalid birth message, dead-lettering", "topic", topic, "error", err)
+		metrics.MQTTMessagesFailed.WithLabelValues("birth").Inc()
+		metrics.ProvisioningBirths.WithLabelValues("invalid").Inc()
+		f.deadLetter(topic, payload, domain.DeadLetterReasonMalformed, err)
+	case err != nil:
+		slog.ErrorContext(ctx, "Failed to handle birth message", "error", err)
+		metrics.MQTTMessagesFailed.WithLabelValues("birth").Inc()
+	}
+}
+
+// deviceTopic returns the device of a devices/<id>/<suffix...> topic.
+func deviceTopic(topic string, suffix ...string) (uuid.UUID, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 2+len(suffix) || parts[0] != "devices" {
+		return uuid.Nil, false
+	}
+	for i, part := range suffix {
+		if parts[2+i] != part {
+			return uuid.Nil, false
+		}
+	}
+	deviceID, err := uuid.Parse(parts[1])
+	if err != nil {
+		return uuid.Nil, false
+	}
+	return deviceID, true
+}
+
+// telemetryTopic returns the device of a devices/<id>/<name> topic, which
+// device messages are published on.
+func telemetryTopic(topic string) (uuid.UUID, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 3 || parts[2] == "" {
+		return uuid.Nil, false
+	}
+	return deviceTopic(topic, parts[2])
+}
+
+// birthTopic returns the serial number of a provisioning/<serial>/birth
+// topic.
+func birthTopic(topic string) (string, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 3 || parts[0] != "provisioning" || parts[2] != "birth" || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func (f *mqttForwarder) deadLetter(topic string, payload []byte, reason string, cause error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := f.bus.DeadLetter(ctx, payload, "mqtt:"+topic, reason, cause); err != nil {
+		slog.Error("Failed to dead-letter MQTT message", "topic", topic, "error", err)
+	}
+}
+
+// normalize fills in what devices may leave out: a message ID, so the
+// message can be followed through the queue and into the logs, and the
+// event, which is part of its routing key. It reports whether the message
+// changed.
+func (f *mqttForwarder) normalize(message *domain.DeviceMessage) bool {
+	changed := false
+	if message.MessageID == "" {
+		message.MessageID = uuid.NewString()
+		changed = true
+	}
+	if message.Event == "" {
+		message.Event = domain.DeviceEventTelemetry
+		changed = true
+	}
+	return changed
+}
+
+// assignClient sets the client of the message to the one the device is
+// registered to, whatever the payload says, and reports whether it
+// changed. Messages of unknown devices are rejected.
+func (f *mqttForwarder) assignClient(ctx context.Context, message *domain.DeviceMessage, deviceID uuid.UUID) (bool, error) {
+	device, err := f.deviceRepo.GetByDeviceID(ctx, deviceID)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up device: %w", err)
+	}
+	if device == nil {
+		return false, fmt.Errorf("unknown device %s", deviceID)
+	}
+
+	clientID := device.ClientID.String()
+	if message.ClientID == clientID {
+		return false, nil
+	}
+	if message.ClientID != "" {
+		slog.WarnContext(ctx, "Replacing client_id of MQTT message with the device's", "client_id", message.ClientID, "device_client_id", clientID)
+	}
+	message.ClientID = clientID
+	return true, nil
+}
+
+// prepareDeviceMessage fills in the timestamp, message ID and trace context
+// of a message the server publishes for a device and returns its topic.
+func prepareDeviceMessage(ctx context.Context, message *domain.DeviceMessage) string {
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+	if message.MessageID == "" {
+		message.MessageID = uuid.NewString()
+	}
+	message.TraceContext = telemetry.Inject(ctx)
+	return fmt.Sprintf("devices/%s/weight", message.DeviceID)
+}
+
+// mqttClientID returns MQTT_CLIENT_ID, followed by the instance name with
+// MQTT_UNIQUE_CLIENT_ID. Brokers disconnect a client when another one
+// connects with the same ID, so replicas need IDs of their own.
+func mqttClientID(cfg *config.Config) string {
+	if !cfg.MQTTUniqueClientID {
+		return cfg.MQTTClientID
+	}
+	return cfg.MQTTClientID + "-" + instanceName()
+}
+
+func mqttTLSConfig(caCertPath string) (*tls.Config, error) {
+	caCert, err := os.ReadFile(caCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+
+	caCertPool := x509.NewCertPool()
+	if ok := caCertPool.AppendCertsFromPEM(caCert); !ok {
+		return nil, fmt.Errorf("failed to parse CA certificate")
+	}
+
+	tlsConfig := &tls.Config{
+		RootCAs:            caCertPool,
+		ClientAuth:         tls.NoClientCert,
+		InsecureSkipVerify: false, // Set to true only for testing if having cert issues
+	}
+
+	return tlsConfig, nil
+}
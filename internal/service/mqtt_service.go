@@ -2,77 +2,128 @@ package service
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"log"
-	"os"
+	"log/slog"
 	"smat/iot/simulation/iot-inventory-management/internal/config"
 	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/logger"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"smat/iot/simulation/iot-inventory-management/internal/repository"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	ErrMQTTNotConnected = errors.New("not connected to MQTT broker")
+	ErrMQTTDisabled     = errors.New("MQTT is disabled")
 )
 
 type mqttService struct {
-	client   mqtt.Client
-	config   *config.Config
-	rabbitMQ RabbitMQService
+	mqttForwarder
+	client mqtt.Client
+	config *config.Config
 }
 
-func NewMQTTService(cfg *config.Config, rabbitMQ RabbitMQService) MQTTService {
+// NewMQTTService forwards device messages to the message bus. deviceRepo is
+// used to fill in the client of messages from devices that do not report it,
+// which the routing key needs. With MQTT_ENABLED=false it does not connect
+// to a broker and device messages are published to the bus directly.
+func NewMQTTService(cfg *config.Config, bus MessageBus, deviceRepo repository.DeviceRepository, presence PresenceService, commands CommandService, twins TwinService, provisioning ProvisioningService) MQTTService {
 	return &mqttService{
-		config:   cfg,
-		rabbitMQ: rabbitMQ,
+		mqttForwarder: mqttForwarder{bus: bus, deviceRepo: deviceRepo, presence: presence, commands: commands, twins: twins, provisioning: provisioning},
+		config:        cfg,
 	}
 }
 
-func (s *mqttService) Publish(topic string, payload []byte) error {
-	if !s.IsConnected() {
-		return fmt.Errorf("not connected to MQTT broker")
-	}
+func (s *mqttService) Publish(ctx context.Context, topic string, payload []byte) error {
+	ctx, span := telemetry.Tracer().Start(ctx, "mqtt.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.system", "mqtt"), attribute.String("messaging.destination.name", topic)),
+	)
+	defer span.End()
+
+	if s.config.MQTTEnabled {
+		if !s.IsConnected() {
+			telemetry.RecordError(span, ErrMQTTNotConnected)
+			return ErrMQTTNotConnected
+		}
 
-	// publish to mqtt
-	token := s.client.Publish(topic, 1, false, payload)
-	if token.Wait() && token.Error() != nil {
-		return fmt.Errorf("failed to publish to topic %s: %w", topic, token.Error())
+		// publish to mqtt
+		token := s.client.Publish(topic, 1, false, payload)
+		if token.Wait() && token.Error() != nil {
+			telemetry.RecordError(span, token.Error())
+			return fmt.Errorf("failed to publish to topic %s: %w", topic, token.Error())
+		}
+		slog.DebugContext(ctx, "Successfully published to MQTT", "topic", topic) // now check the message bus
 	}
-	log.Printf("Successfully published to topic %s", topic) // now check the rabbitmq queue
 
-	if err := s.rabbitMQ.PublishMessage(payload); err != nil {
-		log.Printf("Failed to publish to RabbitMQ: %v", err)
+	if err := s.bus.Publish(ctx, routingKeyForPayload(payload), payload); err != nil {
+		slog.ErrorContext(ctx, "Failed to publish to the message bus", "topic", topic, "error", err)
+		telemetry.RecordError(span, err)
 		return err
 	} else {
-		log.Printf("Successfully forwarded message to RabbitMQ for topic: %s", topic)
+		slog.DebugContext(ctx, "Successfully forwarded message to the message bus", "topic", topic)
 	}
 
 	return nil
 }
 
-func (s *mqttService) PublishDeviceMessage(message *domain.DeviceMessage) error {
+func (s *mqttService) PublishToDevice(ctx context.Context, topic string, payload []byte, retain bool) error {
+	ctx, span := telemetry.Tracer().Start(ctx, "mqtt.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.system", "mqtt"), attribute.String("messaging.destination.name", topic)),
+	)
+	defer span.End()
 
-	if message.Timestamp.IsZero() {
-		message.Timestamp = time.Now()
+	if !s.config.MQTTEnabled {
+		return ErrMQTTDisabled
+	}
+	if !s.IsConnected() {
+		telemetry.RecordError(span, ErrMQTTNotConnected)
+		return ErrMQTTNotConnected
 	}
 
+	token := s.client.Publish(topic, 1, retain, payload)
+	if token.Wait() && token.Error() != nil {
+		telemetry.RecordError(span, token.Error())
+		return fmt.Errorf("failed to publish to topic %s: %w", topic, token.Error())
+	}
+	slog.DebugContext(ctx, "Published to device", "topic", topic, "retain", retain)
+	return nil
+}
+
+func (s *mqttService) PublishDeviceMessage(ctx context.Context, message *domain.DeviceMessage) error {
+	topic := prepareDeviceMessage(ctx, message)
+	ctx = logger.With(ctx, "device_id", message.DeviceID, "message_id", message.MessageID)
+
 	payload, err := json.Marshal(message)
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
 
-	topic := fmt.Sprintf("devices/%s/weight", message.DeviceID)
-	return s.Publish(topic, payload)
+	return s.Publish(ctx, topic, payload)
 }
 
 func (s *mqttService) Connect() error {
+	if !s.config.MQTTEnabled {
+		slog.Info("MQTT is disabled, device messages are published to the message bus directly")
+		return nil
+	}
+
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(s.config.MQTTBroker)
-	opts.SetClientID(s.config.MQTTClientID)
+	opts.SetClientID(mqttClientID(s.config))
 	opts.SetUsername(s.config.MQTTUsername)
 	opts.SetPassword(s.config.MQTTPassword)
 
 	if s.config.MQTTUseTLS {
-		tlsConfig, err := s.createTLSConfig()
+		tlsConfig, err := mqttTLSConfig(s.config.MQTTCACertPath)
 		if err != nil {
 			return fmt.Errorf("failed to create TLS config: %w", err)
 		}
@@ -96,89 +147,66 @@ func (s *mqttService) Connect() error {
 		return fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
 	}
 
-	log.Printf("Successfully connected to MQTT broker at %s", s.config.MQTTBroker)
+	slog.Info("Successfully connected to MQTT broker", "broker", s.config.MQTTBroker, "client_id", mqttClientID(s.config))
 	return nil
 }
 
-func (s *mqttService) createTLSConfig() (*tls.Config, error) {
-	caCert, err := os.ReadFile(s.config.MQTTCACertPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
-	}
-
-	caCertPool := x509.NewCertPool()
-	if ok := caCertPool.AppendCertsFromPEM(caCert); !ok {
-		return nil, fmt.Errorf("failed to parse CA certificate")
-	}
-
-	tlsConfig := &tls.Config{
-		RootCAs:            caCertPool,
-		ClientAuth:         tls.NoClientCert,
-		InsecureSkipVerify: false, // Set to true only for testing if having cert issues
-	}
-
-	return tlsConfig, nil
-}
-
 func (s *mqttService) Subscribe(topic string) error {
+	if !s.config.MQTTEnabled {
+		return nil
+	}
 
 	if !s.IsConnected() {
-		return fmt.Errorf("not connected to MQTT broker")
+		return ErrMQTTNotConnected
 	}
 
 	if token := s.client.Subscribe(topic, 1, nil); token.Wait() && token.Error() != nil {
 		return fmt.Errorf("failed to subscribe to topic %s: %w", topic, token.Error())
 	}
-	log.Printf("Successfully subscribed to topic: %s", topic)
+	slog.Info("Successfully subscribed to MQTT topic", "topic", topic)
 
 	return nil
 }
 
 func (s *mqttService) messageHandler(client mqtt.Client, msg mqtt.Message) {
-	log.Printf("Received message from topic %s: %s", msg.Topic(), msg.Payload())
-
-	var deviceMsg domain.DeviceMessage
-	if err := json.Unmarshal(msg.Payload(), &deviceMsg); err != nil {
-		log.Printf("Failed to unmarshal message: %v", err)
-		return
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	if err := s.rabbitMQ.PublishMessageWithContext(ctx, msg.Payload()); err != nil {
-		log.Printf("Failed to publish to RabbitMQ: %v", err)
-
-		if healthErr := s.rabbitMQ.HealthCheck(); healthErr != nil {
-			log.Printf("RabbitMQ health check failed: %v", healthErr)
-		}
-	} else {
-		log.Printf("Successfully forwarded message to RabbitMQ for device: %s", deviceMsg.DeviceID)
-	}
+	s.forward(msg.Topic(), msg.Payload(), nil, nil)
 }
 
 func (s *mqttService) onConnect(client mqtt.Client) {
-	log.Println("Connected to MQTT broker - subscribing to topics")
-	if err := s.Subscribe(s.config.MQTTTopic); err != nil {
-		log.Printf("Failed to re-subscribe on connect: %v", err)
+	slog.Info("Connected to MQTT broker - subscribing to topics")
+	metrics.MQTTConnected.Set(1)
+	for _, topic := range s.config.MQTTSubscriptions() {
+		if err := s.Subscribe(topic); err != nil {
+			slog.Error("Failed to re-subscribe on connect", "topic", topic, "error", err)
+		}
 	}
 }
 
 func (s *mqttService) onConnectionLost(client mqtt.Client, err error) {
-	log.Printf("Connection lost to MQTT broker: %v", err)
+	slog.Warn("Connection lost to MQTT broker", "error", err)
+	metrics.MQTTConnected.Set(0)
 }
 
 func (s *mqttService) onReconnecting(client mqtt.Client, opts *mqtt.ClientOptions) {
-	log.Println("Attempting to reconnect to MQTT broker...")
+	slog.Info("Attempting to reconnect to MQTT broker")
+	metrics.MQTTReconnects.Inc()
 }
 
 func (s *mqttService) Disconnect() {
 	if s.client != nil && s.client.IsConnected() {
 		s.client.Disconnect(250)
-		log.Println("Disconnected from MQTT broker")
+		metrics.MQTTConnected.Set(0)
+		slog.Info("Disconnected from MQTT broker")
 	}
 }
 
+// PublishRequest sends payload like PublishToDevice. MQTT 3.1.1 has no
+// response topic or correlation data, so the payload must carry what the
+// device needs to answer.
+func (s *mqttService) PublishRequest(ctx context.Context, topic, responseTopic string, correlationData, payload []byte) error {
+	return s.PublishToDevice(ctx, topic, payload, false)
+}
+
 func (s *mqttService) IsConnected() bool {
 	return s.client != nil && s.client.IsConnected()
 }
@@ -0,0 +1,443 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/logger"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"smat/iot/simulation/iot-inventory-management/internal/repository"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// mqttConnectWait bounds how long Connect waits for the first connection.
+const mqttConnectWait = 30 * time.Second
+
+// mqttAliasedTopicPrefix selects the high-frequency topics that are sent
+// with a topic alias.
+const mqttAliasedTopicPrefix = "devices/"
+
+type mqttV5Service struct {
+	mqttForwarder
+	config *config.Config
+
+	manager       *autopaho.ConnectionManager
+	cancel        context.CancelFunc
+	connected     atomic.Bool
+	connectErrors chan error
+
+	mu sync.Mutex
+	// subscriptions are the topic filters to subscribe to on every
+	// connection.
+	subscriptions map[string]struct{}
+	aliases       mqttTopicAliases
+}
+
+// NewMQTTV5Service is the MQTT 5 counterpart of NewMQTTService, selected
+// with MQTT_VERSION=5. Device messages carry their message ID, trace context
+// and schema version as user properties and expire after
+// MQTT_MESSAGE_EXPIRY; device topics are sent with topic aliases, and
+// commands carry a response topic and correlation data.
+func NewMQTTV5Service(cfg *config.Config, bus MessageBus, deviceRepo repository.DeviceRepository, presence PresenceService, commands CommandService, twins TwinService, provisioning ProvisioningService) MQTTService {
+	s := &mqttV5Service{
+		mqttForwarder: mqttForwarder{bus: bus, deviceRepo: deviceRepo, presence: presence, commands: commands, twins: twins, provisioning: provisioning},
+		config:        cfg,
+		connectErrors: make(chan error, 1),
+		subscriptions: make(map[string]struct{}),
+	}
+	for _, topic := range cfg.MQTTSubscriptions() {
+		s.subscriptions[topic] = struct{}{}
+	}
+	return s
+}
+
+func (s *mqttV5Service) Connect() error {
+	if !s.config.MQTTEnabled {
+		slog.Info("MQTT is disabled, device messages are published to the message bus directly")
+		return nil
+	}
+
+	serverURL, err := url.Parse(s.config.MQTTBroker)
+	if err != nil {
+		return fmt.Errorf("invalid MQTT broker URL: %w", err)
+	}
+
+	var tlsConfig *tls.Config
+	if s.config.MQTTUseTLS {
+		if tlsConfig, err = mqttTLSConfig(s.config.MQTTCACertPath); err != nil {
+			return fmt.Errorf("failed to create TLS config: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	manager, err := autopaho.NewConnection(ctx, autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{serverURL},
+		TlsCfg:                        tlsConfig,
+		KeepAlive:                     60,
+		CleanStartOnInitialConnection: true,
+		ReconnectBackoff:              autopaho.NewExponentialBackoff(time.Second, 10*time.Second, 2*time.Second, 2),
+		ConnectTimeout:                10 * time.Second,
+		ConnectUsername:               s.config.MQTTUsername,
+		ConnectPassword:               []byte(s.config.MQTTPassword),
+		OnConnectionUp:                s.onConnectionUp,
+		OnConnectError:                s.onConnectError,
+		ClientConfig: paho.ClientConfig{
+			ClientID:           mqttClientID(s.config),
+			OnPublishReceived:  []func(paho.PublishReceived) (bool, error){s.onPublishReceived},
+			OnServerDisconnect: s.onServerDisconnect,
+			OnClientError:      s.onClientError,
+		},
+	})
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+	s.manager = manager
+	s.cancel = cancel
+
+	// autopaho keeps retrying in the background; like the MQTT 3.1.1
+	// client, fail start-up if the first attempt is refused.
+	waitCtx, waitCancel := context.WithTimeout(ctx, mqttConnectWait)
+	defer waitCancel()
+	connected := make(chan error, 1)
+	go func() { connected <- manager.AwaitConnection(waitCtx) }()
+
+	select {
+	case err = <-connected:
+	case err = <-s.connectErrors:
+	}
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+
+	slog.Info("Successfully connected to MQTT broker", "broker", s.config.MQTTBroker, "client_id", mqttClientID(s.config), "version", config.MQTTVersion5)
+	return nil
+}
+
+func (s *mqttV5Service) onConnectionUp(manager *autopaho.ConnectionManager, connack *paho.Connack) {
+	slog.Info("Connected to MQTT broker - subscribing to topics")
+	s.connected.Store(true)
+	metrics.MQTTConnected.Set(1)
+
+	// Aliases only last for one connection, and the broker may allow fewer
+	// than configured.
+	maximum := uint16(s.config.MQTTTopicAliasMaximum)
+	if connack.Properties == nil || connack.Properties.TopicAliasMaximum == nil {
+		maximum = 0
+	} else if *connack.Properties.TopicAliasMaximum < maximum {
+		maximum = *connack.Properties.TopicAliasMaximum
+	}
+
+	s.mu.Lock()
+	s.aliases.reset(maximum)
+	topics := make([]string, 0, len(s.subscriptions))
+	for topic := range s.subscriptions {
+		topics = append(topics, topic)
+	}
+	s.mu.Unlock()
+
+	for _, topic := range topics {
+		if err := s.subscribe(context.Background(), topic); err != nil {
+			slog.Error("Failed to re-subscribe on connect", "topic", topic, "error", err)
+		}
+	}
+}
+
+func (s *mqttV5Service) onConnectError(err error) {
+	slog.Warn("Failed to connect to MQTT broker, retrying", "error", err)
+	metrics.MQTTReconnects.Inc()
+	select {
+	case s.connectErrors <- err:
+	default:
+	}
+}
+
+func (s *mqttV5Service) onServerDisconnect(disconnect *paho.Disconnect) {
+	slog.Warn("MQTT broker closed the connection", "reason_code", disconnect.ReasonCode)
+	s.connectionLost()
+}
+
+func (s *mqttV5Service) onClientError(err error) {
+	slog.Warn("Connection lost to MQTT broker", "error", err)
+	s.connectionLost()
+}
+
+func (s *mqttV5Service) connectionLost() {
+	s.connected.Store(false)
+	metrics.MQTTConnected.Set(0)
+}
+
+func (s *mqttV5Service) Subscribe(topic string) error {
+	if !s.config.MQTTEnabled {
+		return nil
+	}
+
+	if !s.IsConnected() {
+		return ErrMQTTNotConnected
+	}
+
+	s.mu.Lock()
+	s.subscriptions[topic] = struct{}{}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.subscribe(ctx, topic); err != nil {
+		return err
+	}
+	slog.Info("Successfully subscribed to MQTT topic", "topic", topic)
+	return nil
+}
+
+func (s *mqttV5Service) subscribe(ctx context.Context, topic string) error {
+	suback, err := s.manager.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to topic %s: %w", topic, err)
+	}
+	if len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+		return fmt.Errorf("failed to subscribe to topic %s: reason code %d", topic, suback.Reasons[0])
+	}
+	return nil
+}
+
+func (s *mqttV5Service) Publish(ctx context.Context, topic string, payload []byte) error {
+	ctx, span := telemetry.Tracer().Start(ctx, "mqtt.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.system", "mqtt"), attribute.String("messaging.destination.name", topic)),
+	)
+	defer span.End()
+
+	if s.config.MQTTEnabled {
+		if !s.IsConnected() {
+			telemetry.RecordError(span, ErrMQTTNotConnected)
+			return ErrMQTTNotConnected
+		}
+
+		publish := &paho.Publish{
+			Topic:      topic,
+			QoS:        1,
+			Payload:    payload,
+			Properties: s.publishProperties(ctx, messageIDFromPayload(payload)),
+		}
+		if err := s.publishAliased(ctx, publish); err != nil {
+			telemetry.RecordError(span, err)
+			return fmt.Errorf("failed to publish to topic %s: %w", topic, err)
+		}
+		slog.DebugContext(ctx, "Successfully published to MQTT", "topic", topic)
+	}
+
+	if err := s.bus.Publish(ctx, routingKeyForPayload(payload), payload); err != nil {
+		slog.ErrorContext(ctx, "Failed to publish to the message bus", "topic", topic, "error", err)
+		telemetry.RecordError(span, err)
+		return err
+	}
+	slog.DebugContext(ctx, "Successfully forwarded message to the message bus", "topic", topic)
+	return nil
+}
+
+// publishAliased sends device topics with a topic alias. Until the broker
+// has acknowledged a publish that maps the alias to its topic, the topic is
+// sent along with the alias.
+func (s *mqttV5Service) publishAliased(ctx context.Context, publish *paho.Publish) error {
+	if !strings.HasPrefix(publish.Topic, mqttAliasedTopicPrefix) {
+		_, err := s.manager.Publish(ctx, publish)
+		return err
+	}
+
+	s.mu.Lock()
+	alias, registered, generation := s.aliases.lookup(publish.Topic)
+	s.mu.Unlock()
+	if alias == 0 {
+		_, err := s.manager.Publish(ctx, publish)
+		return err
+	}
+
+	topic := publish.Topic
+	publish.Properties.TopicAlias = &alias
+	if registered {
+		publish.Topic = ""
+	}
+	if _, err := s.manager.Publish(ctx, publish); err != nil {
+		return err
+	}
+
+	if !registered {
+		s.mu.Lock()
+		s.aliases.registered(topic, generation)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *mqttV5Service) publishProperties(ctx context.Context, messageID string) *paho.PublishProperties {
+	properties := &paho.PublishProperties{}
+	if s.config.MQTTMessageExpiry > 0 {
+		expiry := uint32(s.config.MQTTMessageExpiry / time.Second)
+		properties.MessageExpiry = &expiry
+	}
+
+	if messageID != "" {
+		properties.User.Add(mqttPropertyMessageID, messageID)
+	}
+	properties.User.Add(mqttPropertySchemaVersion, domain.DeviceMessageSchemaVersion)
+	for key, value := range telemetry.Inject(ctx) {
+		properties.User.Add(key, value)
+	}
+	return properties
+}
+
+// PublishToDevice sends payload without the message bus and without a topic
+// alias: device topics other than telemetry are used too rarely for an
+// alias to pay off. Retained messages get no expiry, so they stay with the
+// broker until replaced.
+func (s *mqttV5Service) PublishToDevice(ctx context.Context, topic string, payload []byte, retain bool) error {
+	return s.publishToDevice(ctx, &paho.Publish{Topic: topic, Retain: retain, Payload: payload, Properties: &paho.PublishProperties{}})
+}
+
+// PublishRequest sends payload like PublishToDevice, with the response topic
+// and correlation data as MQTT 5 properties.
+func (s *mqttV5Service) PublishRequest(ctx context.Context, topic, responseTopic string, correlationData, payload []byte) error {
+	return s.publishToDevice(ctx, &paho.Publish{
+		Topic:   topic,
+		Payload: payload,
+		Properties: &paho.PublishProperties{
+			ResponseTopic:   responseTopic,
+			CorrelationData: correlationData,
+		},
+	})
+}
+
+func (s *mqttV5Service) publishToDevice(ctx context.Context, publish *paho.Publish) error {
+	ctx, span := telemetry.Tracer().Start(ctx, "mqtt.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.system", "mqtt"), attribute.String("messaging.destination.name", publish.Topic)),
+	)
+	defer span.End()
+
+	if !s.config.MQTTEnabled {
+		return ErrMQTTDisabled
+	}
+	if !s.IsConnected() {
+		telemetry.RecordError(span, ErrMQTTNotConnected)
+		return ErrMQTTNotConnected
+	}
+
+	publish.QoS = 1
+	if s.config.MQTTMessageExpiry > 0 && !publish.Retain {
+		expiry := uint32(s.config.MQTTMessageExpiry / time.Second)
+		publish.Properties.MessageExpiry = &expiry
+	}
+	for key, value := range telemetry.Inject(ctx) {
+		publish.Properties.User.Add(key, value)
+	}
+
+	if _, err := s.manager.Publish(ctx, publish); err != nil {
+		telemetry.RecordError(span, err)
+		return fmt.Errorf("failed to publish to topic %s: %w", publish.Topic, err)
+	}
+	slog.DebugContext(ctx, "Published to device", "topic", publish.Topic, "retain", publish.Retain)
+	return nil
+}
+
+func (s *mqttV5Service) PublishDeviceMessage(ctx context.Context, message *domain.DeviceMessage) error {
+	topic := prepareDeviceMessage(ctx, message)
+	ctx = logger.With(ctx, "device_id", message.DeviceID, "message_id", message.MessageID)
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	return s.Publish(ctx, topic, payload)
+}
+
+// onPublishReceived forwards received messages with their user properties
+// and correlation data.
+func (s *mqttV5Service) onPublishReceived(received paho.PublishReceived) (bool, error) {
+	publish := received.Packet
+	properties := publish.Properties
+	if properties == nil {
+		properties = &paho.PublishProperties{}
+	}
+
+	userProperties := make(map[string]string, len(properties.User))
+	for _, property := range properties.User {
+		userProperties[property.Key] = property.Value
+	}
+	s.forward(publish.Topic, publish.Payload, userProperties, properties.CorrelationData)
+	return true, nil
+}
+
+func (s *mqttV5Service) Disconnect() {
+	if s.manager == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	if err := s.manager.Disconnect(ctx); err != nil {
+		slog.Warn("MQTT client did not shut down in time", "error", err)
+	}
+	s.cancel()
+	s.connected.Store(false)
+	metrics.MQTTConnected.Set(0)
+	slog.Info("Disconnected from MQTT broker")
+}
+
+func (s *mqttV5Service) IsConnected() bool {
+	return s.manager != nil && s.connected.Load()
+}
+
+// mqttTopicAliases assigns topic aliases for one connection. An alias is
+// registered once the broker acknowledged a publish carrying both the alias
+// and its topic; after that the topic can be left out.
+type mqttTopicAliases struct {
+	maximum    uint16
+	generation uint64
+	byTopic    map[string]uint16
+	registers  map[string]bool
+}
+
+// reset forgets all aliases; it is called for every new connection.
+func (a *mqttTopicAliases) reset(maximum uint16) {
+	a.maximum = maximum
+	a.generation++
+	a.byTopic = make(map[string]uint16)
+	a.registers = make(map[string]bool)
+}
+
+// lookup returns the alias of topic, assigning the next free one, or 0 when
+// aliases are used up or disabled.
+func (a *mqttTopicAliases) lookup(topic string) (alias uint16, registered bool, generation uint64) {
+	if alias, ok := a.byTopic[topic]; ok {
+		return alias, a.registers[topic], a.generation
+	}
+	if len(a.byTopic) >= int(a.maximum) {
+		return 0, false, a.generation
+	}
+	alias = uint16(len(a.byTopic) + 1)
+	a.byTopic[topic] = alias
+	return alias, false, a.generation
+}
+
+func (a *mqttTopicAliases) registered(topic string, generation uint64) {
+	if generation == a.generation {
+		a.registers[topic] = true
+	}
+}
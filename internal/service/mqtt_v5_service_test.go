@@ -0,0 +1,437 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/repository"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/google/uuid"
+)
+
+const (
+	testMQTTUsername = "server"
+	testMQTTPassword = "server-secret"
+	testMQTTTimeout  = 5 * time.Second
+)
+
+// recordingBus is a MessageBus that records what is published and
+// dead-lettered.
+type recordingBus struct {
+	MessageBus
+
+	published   chan []byte
+	deadLetters chan recordedDeadLetter
+}
+
+type recordedDeadLetter struct {
+	body   []byte
+	reason string
+	cause  error
+}
+
+func newRecordingBus() *recordingBus {
+	return &recordingBus{
+		published:   make(chan []byte, 16),
+		deadLetters: make(chan recordedDeadLetter, 16),
+	}
+}
+
+func (b *recordingBus) Publish(ctx context.Context, topic string, message []byte) error {
+	b.published <- message
+	return nil
+}
+
+func (b *recordingBus) DeadLetter(ctx context.Context, body []byte, source, reason string, cause error) error {
+	b.deadLetters <- recordedDeadLetter{body: body, reason: reason, cause: cause}
+	return nil
+}
+
+func (b *recordingBus) HealthCheck() error {
+	return nil
+}
+
+// staticDeviceRepository knows a fixed set of devices.
+type staticDeviceRepository struct {
+	repository.DeviceRepository
+
+	devices map[uuid.UUID]*domain.Device
+}
+
+func (r *staticDeviceRepository) GetByDeviceID(ctx context.Context, deviceID uuid.UUID) (*domain.Device, error) {
+	return r.devices[deviceID], nil
+}
+
+// testMQTTConfig returns the configuration of a server connecting to the
+// embedded broker on address.
+func testMQTTConfig(address string) *config.Config {
+	return &config.Config{
+		MQTTEnabled:           true,
+		MQTTBroker:            "tcp://" + address,
+		MQTTClientID:          "iot-inventory-test-" + uuid.NewString(),
+		MQTTUsername:          testMQTTUsername,
+		MQTTPassword:          testMQTTPassword,
+		MQTTTopic:             "devices/+/weight",
+		MQTTVersion:           config.MQTTVersion5,
+		MQTTMessageExpiry:     time.Minute,
+		MQTTTopicAliasMaximum: 10,
+		MQTTBrokerEmbedded:    true,
+		MQTTBrokerListen:      address,
+	}
+}
+
+// startTestBroker starts the embedded broker on a free local port and
+// returns its address.
+func startTestBroker(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	address := "127.0.0.1:" + strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	broker := NewMQTTBroker(testMQTTConfig(address), nil)
+	if err := broker.Start(); err != nil {
+		t.Fatalf("failed to start broker: %v", err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return address
+}
+
+// startTestMQTTV5Service connects an MQTT 5 service that knows device.
+func startTestMQTTV5Service(t *testing.T, address string, device *domain.Device) (*mqttV5Service, *recordingBus) {
+	t.Helper()
+
+	bus := newRecordingBus()
+	devices := &staticDeviceRepository{devices: map[uuid.UUID]*domain.Device{device.ID: device}}
+	s := NewMQTTV5Service(testMQTTConfig(address), bus, devices, nil, nil, nil, nil).(*mqttV5Service)
+	if err := s.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(s.Disconnect)
+	return s, bus
+}
+
+// testMQTTClient is a plain MQTT 5 client standing in for a device.
+type testMQTTClient struct {
+	client   *paho.Client
+	received chan *paho.Publish
+}
+
+func connectTestMQTTClient(t *testing.T, address string, onPublish func(*paho.Client, *paho.Publish)) *testMQTTClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to dial broker: %v", err)
+	}
+
+	clientID := "test-device-" + uuid.NewString()
+	c := &testMQTTClient{received: make(chan *paho.Publish, 16)}
+	c.client = paho.NewClient(paho.ClientConfig{
+		ClientID: clientID,
+		Conn:     conn,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+			func(received paho.PublishReceived) (bool, error) {
+				if onPublish != nil {
+					onPublish(c.client, received.Packet)
+				}
+				c.received <- received.Packet
+				return true, nil
+			},
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), testMQTTTimeout)
+	defer cancel()
+	connack, err := c.client.Connect(ctx, &paho.Connect{
+		ClientID:     clientID,
+		KeepAlive:    30,
+		CleanStart:   true,
+		Username:     testMQTTUsername,
+		UsernameFlag: true,
+		Password:     []byte(testMQTTPassword),
+		PasswordFlag: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to connect test client: %v", err)
+	}
+	if connack.ReasonCode != 0 {
+		t.Fatalf("test client refused with reason code %d", connack.ReasonCode)
+	}
+	t.Cleanup(func() { c.client.Disconnect(&paho.Disconnect{}) })
+	return c
+}
+
+func (c *testMQTTClient) subscribe(t *testing.T, topic string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testMQTTTimeout)
+	defer cancel()
+	suback, err := c.client.Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: 1}}})
+	if err != nil {
+		t.Fatalf("failed to subscribe to %s: %v", topic, err)
+	}
+	if len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+		t.Fatalf("subscription to %s refused with reason code %d", topic, suback.Reasons[0])
+	}
+}
+
+func (c *testMQTTClient) publish(t *testing.T, topic string, payload []byte, properties *paho.PublishProperties) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testMQTTTimeout)
+	defer cancel()
+	if _, err := c.client.Publish(ctx, &paho.Publish{Topic: topic, QoS: 1, Payload: payload, Properties: properties}); err != nil {
+		t.Fatalf("failed to publish to %s: %v", topic, err)
+	}
+}
+
+func (c *testMQTTClient) next(t *testing.T) *paho.Publish {
+	t.Helper()
+
+	select {
+	case publish := <-c.received:
+		return publish
+	case <-time.After(testMQTTTimeout):
+		t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+func nextPublished(t *testing.T, bus *recordingBus) domain.DeviceMessage {
+	t.Helper()
+
+	select {
+	case payload := <-bus.published:
+		var message domain.DeviceMessage
+		if err := json.Unmarshal(payload, &message); err != nil {
+			t.Fatalf("forwarded payload is not a device message: %v", err)
+		}
+		return message
+	case letter := <-bus.deadLetters:
+		t.Fatalf("message was dead-lettered with reason %s: %v", letter.reason, letter.cause)
+	case <-time.After(testMQTTTimeout):
+		t.Fatal("timed out waiting for a forwarded message")
+	}
+	return domain.DeviceMessage{}
+}
+
+func nextDeadLetter(t *testing.T, bus *recordingBus) recordedDeadLetter {
+	t.Helper()
+
+	select {
+	case letter := <-bus.deadLetters:
+		return letter
+	case payload := <-bus.published:
+		t.Fatalf("message was forwarded instead of dead-lettered: %s", payload)
+	case <-time.After(testMQTTTimeout):
+		t.Fatal("timed out waiting for a dead letter")
+	}
+	return recordedDeadLetter{}
+}
+
+func testDevice() *domain.Device {
+	return &domain.Device{ID: uuid.New(), ClientID: uuid.New()}
+}
+
+func TestMQTTV5ForwardsUserProperties(t *testing.T) {
+	address := startTestBroker(t)
+	device := testDevice()
+	_, bus := startTestMQTTV5Service(t, address, device)
+	client := connectTestMQTTClient(t, address, nil)
+
+	messageID := uuid.NewString()
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	properties := &paho.PublishProperties{}
+	properties.User.Add(mqttPropertyMessageID, messageID)
+	properties.User.Add(mqttPropertySchemaVersion, domain.DeviceMessageSchemaVersion)
+	properties.User.Add(mqttPropertyTraceParent, traceParent)
+	properties.User.Add(mqttPropertyTraceState, "vendor=value")
+	client.publish(t, "devices/"+device.ID.String()+"/weight", []byte(`{"current_weight": 12.5}`), properties)
+
+	message := nextPublished(t, bus)
+	if message.MessageID != messageID {
+		t.Errorf("message_id = %q, want %q from the user property", message.MessageID, messageID)
+	}
+	if message.TraceContext[mqttPropertyTraceParent] != traceParent {
+		t.Errorf("traceparent = %q, want %q", message.TraceContext[mqttPropertyTraceParent], traceParent)
+	}
+	if message.TraceContext[mqttPropertyTraceState] != "vendor=value" {
+		t.Errorf("tracestate = %q, want %q", message.TraceContext[mqttPropertyTraceState], "vendor=value")
+	}
+	if message.DeviceID != device.ID.String() {
+		t.Errorf("device_id = %q, want %q from the topic", message.DeviceID, device.ID)
+	}
+	if message.ClientID != device.ClientID.String() {
+		t.Errorf("client_id = %q, want %q from the device", message.ClientID, device.ClientID)
+	}
+}
+
+func TestMQTTV5PublishesUserProperties(t *testing.T) {
+	address := startTestBroker(t)
+	device := testDevice()
+	s, _ := startTestMQTTV5Service(t, address, device)
+	client := connectTestMQTTClient(t, address, nil)
+	client.subscribe(t, "devices/+/weight")
+
+	message := &domain.DeviceMessage{DeviceID: device.ID.String(), ClientID: device.ClientID.String(), CurrentWeight: 3}
+	if err := s.PublishDeviceMessage(context.Background(), message); err != nil {
+		t.Fatalf("PublishDeviceMessage() error = %v", err)
+	}
+
+	publish := client.next(t)
+	if got := publish.Properties.User.Get(mqttPropertyMessageID); got != message.MessageID {
+		t.Errorf("message_id property = %q, want %q", got, message.MessageID)
+	}
+	if got := publish.Properties.User.Get(mqttPropertySchemaVersion); got != domain.DeviceMessageSchemaVersion {
+		t.Errorf("schema_version property = %q, want %q", got, domain.DeviceMessageSchemaVersion)
+	}
+	if publish.Properties.MessageExpiry == nil {
+		t.Error("message expiry is not set")
+	}
+}
+
+func TestMQTTV5PublishesWithTopicAlias(t *testing.T) {
+	address := startTestBroker(t)
+	device := testDevice()
+	s, _ := startTestMQTTV5Service(t, address, device)
+	client := connectTestMQTTClient(t, address, nil)
+	client.subscribe(t, "devices/+/weight")
+
+	topic := "devices/" + device.ID.String() + "/weight"
+	for i := 0; i < 3; i++ {
+		message := &domain.DeviceMessage{DeviceID: device.ID.String(), ClientID: device.ClientID.String(), CurrentWeight: float64(i)}
+		if err := s.PublishDeviceMessage(context.Background(), message); err != nil {
+			t.Fatalf("PublishDeviceMessage() #%d error = %v", i, err)
+		}
+		// The broker resolves the alias, so subscribers always see the
+		// topic.
+		if publish := client.next(t); publish.Topic != topic {
+			t.Fatalf("message #%d arrived on %q, want %q", i, publish.Topic, topic)
+		}
+	}
+
+	s.mu.Lock()
+	alias, registered, _ := s.aliases.lookup(topic)
+	s.mu.Unlock()
+	if alias == 0 {
+		t.Fatal("device topic has no alias")
+	}
+	if !registered {
+		t.Error("alias is not registered after an acknowledged publish")
+	}
+}
+
+// recordingCommands is a CommandService that records acknowledgements.
+type recordingCommands struct {
+	CommandService
+
+	acks chan recordedAck
+}
+
+type recordedAck struct {
+	deviceID        uuid.UUID
+	payload         []byte
+	correlationData []byte
+}
+
+func (c *recordingCommands) HandleAck(ctx context.Context, deviceID uuid.UUID, payload, correlationData []byte) error {
+	c.acks <- recordedAck{deviceID: deviceID, payload: payload, correlationData: correlationData}
+	return nil
+}
+
+func TestMQTTV5CommandCarriesResponseTopic(t *testing.T) {
+	address := startTestBroker(t)
+	device := testDevice()
+
+	cfg := testMQTTConfig(address)
+	cfg.MQTTCommandAckTopic = "devices/+/commands/ack"
+	commands := &recordingCommands{acks: make(chan recordedAck, 1)}
+	s := NewMQTTV5Service(cfg, newRecordingBus(), &staticDeviceRepository{}, nil, commands, nil, nil)
+	if err := s.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(s.Disconnect)
+
+	// The device answers on the response topic with the correlation data
+	// and a payload without command_id.
+	client := connectTestMQTTClient(t, address, func(client *paho.Client, command *paho.Publish) {
+		if command.Properties == nil {
+			return
+		}
+		go client.Publish(context.Background(), &paho.Publish{
+			Topic:      command.Properties.ResponseTopic,
+			QoS:        1,
+			Payload:    []byte(`{"status": "delivered"}`),
+			Properties: &paho.PublishProperties{CorrelationData: command.Properties.CorrelationData},
+		})
+	})
+	topic := "devices/" + device.ID.String() + "/commands"
+	client.subscribe(t, topic)
+
+	commandID := uuid.New()
+	ctx, cancel := context.WithTimeout(context.Background(), testMQTTTimeout)
+	defer cancel()
+	if err := s.PublishRequest(ctx, topic, topic+"/ack", []byte(commandID.String()), []byte(`{}`)); err != nil {
+		t.Fatalf("PublishRequest() error = %v", err)
+	}
+
+	command := client.next(t)
+	if command.Properties == nil || command.Properties.ResponseTopic != topic+"/ack" {
+		t.Fatalf("command properties = %+v, want response topic %s", command.Properties, topic+"/ack")
+	}
+	select {
+	case ack := <-commands.acks:
+		if ack.deviceID != device.ID {
+			t.Errorf("ack device = %s, want %s", ack.deviceID, device.ID)
+		}
+		if string(ack.correlationData) != commandID.String() {
+			t.Errorf("ack correlation data = %q, want %q", ack.correlationData, commandID)
+		}
+	case <-time.After(testMQTTTimeout):
+		t.Fatal("timed out waiting for the acknowledgement")
+	}
+}
+
+func TestMQTTV5DeadLettersUnsupportedSchemaVersion(t *testing.T) {
+	address := startTestBroker(t)
+	device := testDevice()
+	_, bus := startTestMQTTV5Service(t, address, device)
+	client := connectTestMQTTClient(t, address, nil)
+
+	properties := &paho.PublishProperties{}
+	properties.User.Add(mqttPropertySchemaVersion, "99")
+	payload := []byte(`{"current_weight": 1}`)
+	client.publish(t, "devices/"+device.ID.String()+"/weight", payload, properties)
+
+	letter := nextDeadLetter(t, bus)
+	if letter.reason != domain.DeadLetterReasonInvalid {
+		t.Errorf("reason = %q, want %q", letter.reason, domain.DeadLetterReasonInvalid)
+	}
+	if string(letter.body) != string(payload) {
+		t.Errorf("dead letter body = %s, want the original payload %s", letter.body, payload)
+	}
+}
+
+func TestMQTTV5DeadLettersMessageForAnotherDevice(t *testing.T) {
+	address := startTestBroker(t)
+	device := testDevice()
+	_, bus := startTestMQTTV5Service(t, address, device)
+	client := connectTestMQTTClient(t, address, nil)
+
+	payload := []byte(`{"device_id": "` + uuid.NewString() + `", "current_weight": 1}`)
+	client.publish(t, "devices/"+device.ID.String()+"/weight", payload, nil)
+
+	if letter := nextDeadLetter(t, bus); letter.reason != domain.DeadLetterReasonInvalid {
+		t.Errorf("reason = %q, want %q", letter.reason, domain.DeadLetterReasonInvalid)
+	}
+}
@@ -0,0 +1,489 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// natsMessageTTL matches the message TTL of the RabbitMQ queues.
+	natsMessageTTL = time.Hour
+	// natsDuplicateWindow is how long JetStream remembers message IDs, so
+	// a publish retried after a lost acknowledgement is stored once.
+	natsDuplicateWindow = 2 * time.Minute
+	// natsRetryDelay is how long a message sent back for a retry waits
+	// before it is redelivered.
+	natsRetryDelay = time.Second
+	// natsAdminTimeout bounds stream and consumer management requests.
+	natsAdminTimeout = 10 * time.Second
+)
+
+var errNATSNotConnected = errors.New("not connected to NATS")
+
+// natsBus is a MessageBus on NATS JetStream, for deployments too small for
+// RabbitMQ. Device events are stored in the NATS_STREAM stream under
+// <NATS_SUBJECT_PREFIX>.<routing key>, and every queue in RABBITMQ_BINDINGS
+// is a durable pull consumer filtered on its patterns. The stream uses
+// interest retention: a message is removed once every consumer it matches
+// has acked it, or after an hour.
+type natsBus struct {
+	config *config.Config
+
+	mu   sync.RWMutex
+	conn *nats.Conn
+	js   jetstream.JetStream
+	// subscriptions are stopped on Close, and consumers waited for, before
+	// the connection closes; a subscription can only unsubscribe cleanly
+	// while the connection is open.
+	subscriptions map[jetstream.MessagesContext]struct{}
+	consumers     sync.WaitGroup
+
+	publishTimeout  atomic.Int64
+	maxDeliveries   atomic.Int32
+	activeConsumers atomic.Int32
+	closeChan       chan struct{}
+	closeOnce       sync.Once
+}
+
+func NewNATSBus(cfg *config.Config) MessageBus {
+	b := &natsBus{
+		config:        cfg,
+		subscriptions: make(map[jetstream.MessagesContext]struct{}),
+		closeChan:     make(chan struct{}),
+	}
+	b.ApplySettings(cfg)
+	return b
+}
+
+// ApplySettings updates the publish timeout and the number of deliveries
+// before a failing message is dead-lettered.
+func (b *natsBus) ApplySettings(cfg *config.Config) {
+	b.publishTimeout.Store(int64(cfg.RabbitMQPublishTimeout))
+	b.maxDeliveries.Store(int32(cfg.RabbitMQMaxDeliveries))
+}
+
+// Connect connects to NATS and declares the streams and consumers. Once
+// connected, the client reconnects by itself and declares them again after
+// every reconnect, in case the server lost them.
+func (b *natsBus) Connect() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn != nil && !b.conn.IsClosed() {
+		return nil
+	}
+
+	conn, err := nats.Connect(b.config.NATSURL,
+		nats.Name("iot-inventory-management"),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(2*time.Second),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				slog.Warn("NATS connection lost", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			slog.Info("Reconnected to NATS", "url", conn.ConnectedUrlRedacted())
+			go b.redeclareTopology()
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), natsAdminTimeout)
+	defer cancel()
+	if err := b.declareTopology(ctx, js); err != nil {
+		conn.Close()
+		return err
+	}
+
+	b.conn = conn
+	b.js = js
+	slog.Info("Successfully connected to NATS", "url", conn.ConnectedUrlRedacted())
+	return nil
+}
+
+func (b *natsBus) redeclareTopology() {
+	js := b.jetStream()
+	if js == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), natsAdminTimeout)
+	defer cancel()
+	if err := b.declareTopology(ctx, js); err != nil {
+		slog.Error("Failed to declare JetStream streams after reconnect", "error", err)
+	}
+}
+
+// declareTopology creates or updates the event stream, the dead-letter
+// stream and a durable consumer per configured queue. Unlike RabbitMQ
+// bindings, consumer filters removed from the configuration are removed from
+// the consumer too.
+func (b *natsBus) declareTopology(ctx context.Context, js jetstream.JetStream) error {
+	_, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:       b.config.NATSStream,
+		Subjects:   []string{b.config.NATSSubjectPrefix + ".>"},
+		Retention:  jetstream.InterestPolicy,
+		Storage:    jetstream.FileStorage,
+		MaxAge:     natsMessageTTL,
+		Duplicates: natsDuplicateWindow,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to declare stream %s: %w", b.config.NATSStream, err)
+	}
+
+	// Dead letters never expire.
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     b.deadLetterStreamName(),
+		Subjects: []string{b.deadLetterSubject()},
+		Storage:  jetstream.FileStorage,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to declare stream %s: %w", b.deadLetterStreamName(), err)
+	}
+
+	for _, binding := range b.config.RabbitMQBindings {
+		var filters []string
+		for _, pattern := range binding.Patterns {
+			filters = append(filters, b.subjectFilter(pattern))
+		}
+		if binding.Queue == b.config.RabbitMQQueue {
+			filters = append(filters, b.replaySubject())
+		}
+
+		consumerConfig := jetstream.ConsumerConfig{
+			Durable:       binding.Queue,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			AckWait:       b.config.NATSAckWait,
+			MaxDeliver:    -1,
+			MaxAckPending: b.config.RabbitMQPrefetch,
+			DeliverPolicy: jetstream.DeliverAllPolicy,
+		}
+		if len(filters) == 1 {
+			consumerConfig.FilterSubject = filters[0]
+		} else {
+			consumerConfig.FilterSubjects = filters
+		}
+
+		if _, err := js.CreateOrUpdateConsumer(ctx, b.config.NATSStream, consumerConfig); err != nil {
+			return fmt.Errorf("failed to declare consumer %s: %w", binding.Queue, err)
+		}
+	}
+	return nil
+}
+
+func (b *natsBus) jetStream() jetstream.JetStream {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.js
+}
+
+func (b *natsBus) subject(topic string) string {
+	return b.config.NATSSubjectPrefix + "." + topic
+}
+
+// subjectFilter turns a routing key pattern into a subject filter. "#" is
+// only allowed as the last word (see config validation) and becomes ">".
+func (b *natsBus) subjectFilter(pattern string) string {
+	words := strings.Split(pattern, ".")
+	if last := len(words) - 1; words[last] == "#" {
+		words[last] = ">"
+	}
+	return b.subject(strings.Join(words, "."))
+}
+
+// replaySubject is only read by the consumer queue, so replayed dead
+// letters are not delivered to the other queues a second time.
+func (b *natsBus) replaySubject() string {
+	return b.config.NATSSubjectPrefix + ".replay." + b.config.RabbitMQQueue
+}
+
+func (b *natsBus) deadLetterStreamName() string {
+	return b.config.NATSStream + "_DLQ"
+}
+
+func (b *natsBus) deadLetterSubject() string {
+	return b.config.NATSSubjectPrefix + "_dlq." + b.config.RabbitMQQueue
+}
+
+// Publish stores message under the subject for topic. Topics no queue is
+// bound to fail with ErrPublishReturned, as they do with RabbitMQ, since
+// JetStream would accept and immediately discard them.
+func (b *natsBus) Publish(ctx context.Context, topic string, message []byte) error {
+	routable := false
+	for _, binding := range b.config.RabbitMQBindings {
+		if matchesAnyTopic(binding.Patterns, topic) {
+			routable = true
+			break
+		}
+	}
+	if !routable {
+		return fmt.Errorf("%w: routing key %q", ErrPublishReturned, topic)
+	}
+
+	msg := nats.NewMsg(b.subject(topic))
+	msg.Data = message
+
+	var opts []jetstream.PublishOpt
+	if messageID := messageIDFromPayload(message); messageID != "" {
+		opts = append(opts, jetstream.WithMsgID(messageID))
+	}
+	return b.publishMsg(ctx, msg, opts...)
+}
+
+func (b *natsBus) publishMsg(ctx context.Context, msg *nats.Msg, opts ...jetstream.PublishOpt) error {
+	ctx, span := telemetry.Tracer().Start(ctx, "nats.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.destination.name", msg.Subject),
+		),
+	)
+	defer span.End()
+
+	js := b.jetStream()
+	if js == nil {
+		telemetry.RecordError(span, errNATSNotConnected)
+		metrics.NATSPublishFailures.Inc()
+		return errNATSNotConnected
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(b.publishTimeout.Load()))
+		defer cancel()
+	}
+
+	for key, value := range telemetry.Inject(ctx) {
+		msg.Header.Set(key, value)
+	}
+
+	start := time.Now()
+	_, err := js.PublishMsg(ctx, msg, opts...)
+	metrics.NATSPublishDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.NATSPublishFailures.Inc()
+		telemetry.RecordError(span, err)
+		return fmt.Errorf("failed to publish to %s: %w", msg.Subject, err)
+	}
+	return nil
+}
+
+func (b *natsBus) Subscribe() (<-chan QueueMessage, error) {
+	js := b.jetStream()
+	if js == nil {
+		return nil, errNATSNotConnected
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), natsAdminTimeout)
+	defer cancel()
+	consumer, err := js.Consumer(ctx, b.config.NATSStream, b.config.RabbitMQQueue)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up consumer %s: %w", b.config.RabbitMQQueue, err)
+	}
+
+	messages, err := consumer.Messages(jetstream.PullMaxMessages(b.config.RabbitMQPrefetch))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start consuming: %w", err)
+	}
+
+	b.mu.Lock()
+	b.subscriptions[messages] = struct{}{}
+	b.consumers.Add(1)
+	b.mu.Unlock()
+
+	output := make(chan QueueMessage, 100)
+	go b.processMessages(messages, output)
+	return output, nil
+}
+
+func (b *natsBus) processMessages(messages jetstream.MessagesContext, output chan<- QueueMessage) {
+	b.activeConsumers.Add(1)
+	defer b.activeConsumers.Add(-1)
+	defer close(output)
+	defer func() {
+		b.mu.Lock()
+		delete(b.subscriptions, messages)
+		b.mu.Unlock()
+		b.consumers.Done()
+	}()
+
+	for {
+		msg, err := messages.Next()
+		if err != nil {
+			if errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+				return
+			}
+			if errors.Is(err, jetstream.ErrConsumerDeleted) || errors.Is(err, jetstream.ErrConsumerNotFound) {
+				// Closing output makes the caller subscribe again.
+				slog.Warn("JetStream consumer is gone", "error", err)
+				messages.Stop()
+				return
+			}
+			slog.Warn("JetStream consumer error", "error", err)
+			continue
+		}
+
+		metrics.NATSMessagesConsumed.Inc()
+
+		deliveries := 1
+		if metadata, err := msg.Metadata(); err == nil {
+			deliveries = int(metadata.NumDelivered)
+		}
+		headers := make(map[string]string, len(msg.Headers()))
+		for key := range msg.Headers() {
+			headers[key] = msg.Headers().Get(key)
+		}
+
+		// The consumer settles the message once it has been processed.
+		delivery := &natsDelivery{bus: b, msg: msg, deliveries: deliveries}
+		queueMessage := QueueMessage{
+			Body:          msg.Data(),
+			Headers:       headers,
+			Redelivered:   deliveries > 1,
+			DeliveryCount: deliveries,
+			acker:         delivery,
+		}
+		select {
+		case output <- queueMessage:
+		case <-b.closeChan:
+			// Redelivered once the ack wait expires.
+			return
+		case <-time.After(5 * time.Second):
+			slog.Warn("Timeout sending message to output channel", "subject", msg.Subject())
+			if _, err := delivery.Retry(context.Background(), errConsumerTimeout); err != nil {
+				slog.Error("Failed to requeue message", "subject", msg.Subject(), "error", err)
+			}
+		}
+	}
+}
+
+// natsDelivery settles a JetStream message. JetStream counts deliveries
+// itself, so a retry is a negative acknowledgement rather than a republish.
+type natsDelivery struct {
+	bus        *natsBus
+	msg        jetstream.Msg
+	deliveries int
+}
+
+func (d *natsDelivery) Ack() error {
+	return d.msg.Ack()
+}
+
+func (d *natsDelivery) Retry(ctx context.Context, cause error) (bool, error) {
+	if d.deliveries >= int(d.bus.maxDeliveries.Load()) {
+		return false, d.DeadLetter(ctx, domain.DeadLetterReasonMaxDeliveries, cause)
+	}
+	return true, d.msg.NakWithDelay(natsRetryDelay)
+}
+
+func (d *natsDelivery) DeadLetter(ctx context.Context, reason string, cause error) error {
+	source := "nats:" + d.bus.config.RabbitMQQueue
+	if err := d.bus.publishDeadLetter(ctx, d.msg.Data(), source, reason, cause, d.deliveries); err != nil {
+		// There is no broker-side dead-lettering to fall back on, so leave
+		// the message to be redelivered.
+		slog.WarnContext(ctx, "Failed to publish dead letter, requeueing message", "subject", d.msg.Subject(), "error", err)
+		return d.msg.NakWithDelay(natsRetryDelay)
+	}
+	return d.msg.Ack()
+}
+
+func (b *natsBus) HealthCheck() error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.conn == nil {
+		return errNATSNotConnected
+	}
+	if !b.conn.IsConnected() {
+		return fmt.Errorf("connection is %s", strings.ToLower(b.conn.Status().String()))
+	}
+	return nil
+}
+
+// IsConsuming reports whether this server is pulling from the consumer.
+func (b *natsBus) IsConsuming() bool {
+	return b.activeConsumers.Load() > 0
+}
+
+// QueueStats reports the messages the consumer has not been delivered yet.
+// Pull consumers have no subscriber count, so Consumers counts this
+// server's subscriptions.
+func (b *natsBus) QueueStats() (*domain.QueueStats, error) {
+	js := b.jetStream()
+	if js == nil {
+		return nil, errNATSNotConnected
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), natsAdminTimeout)
+	defer cancel()
+	consumer, err := js.Consumer(ctx, b.config.NATSStream, b.config.RabbitMQQueue)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up consumer: %w", err)
+	}
+	info, err := consumer.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect consumer: %w", err)
+	}
+
+	return &domain.QueueStats{
+		Queue:     b.config.RabbitMQQueue,
+		Messages:  int(info.NumPending),
+		Consumers: int(b.activeConsumers.Load()),
+	}, nil
+}
+
+func (b *natsBus) Close() {
+	b.closeOnce.Do(func() {
+		slog.Info("Closing NATS connection")
+		close(b.closeChan)
+
+		b.mu.Lock()
+		for messages := range b.subscriptions {
+			messages.Stop()
+		}
+		b.mu.Unlock()
+
+		stopped := make(chan struct{})
+		go func() {
+			b.consumers.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			slog.Warn("Timeout waiting for the JetStream consumer to stop")
+		}
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.conn != nil {
+			b.conn.Close()
+			b.conn = nil
+			b.js = nil
+		}
+	})
+}
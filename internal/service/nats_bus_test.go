@@ -0,0 +1,231 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+const testNATSQueue = "inventory_updates"
+
+// startTestNATS starts a JetStream-enabled NATS server on a free local port
+// and returns its URL.
+func startTestNATS(t *testing.T) string {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create NATS server: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(testMQTTTimeout) {
+		t.Fatal("NATS server did not start")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns.ClientURL()
+}
+
+func testNATSConfig(url string) *config.Config {
+	return &config.Config{
+		NATSURL:                url,
+		NATSStream:             "IOT_EVENTS",
+		NATSSubjectPrefix:      "iot",
+		NATSAckWait:            30 * time.Second,
+		RabbitMQQueue:          testNATSQueue,
+		RabbitMQBindings:       []config.QueueBinding{{Queue: testNATSQueue, Patterns: []string{"tenant.*.device.#"}}},
+		RabbitMQPublishTimeout: testMQTTTimeout,
+		RabbitMQMaxDeliveries:  3,
+		RabbitMQPrefetch:       10,
+	}
+}
+
+func startTestNATSBus(t *testing.T, cfg *config.Config) *natsBus {
+	t.Helper()
+
+	b := NewNATSBus(cfg).(*natsBus)
+	if err := b.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	t.Cleanup(b.Close)
+	return b
+}
+
+func subscribeNATS(t *testing.T, b *natsBus) <-chan QueueMessage {
+	t.Helper()
+
+	messages, err := b.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	return messages
+}
+
+func publishNATS(t *testing.T, b *natsBus, body string) {
+	t.Helper()
+
+	if err := b.Publish(context.Background(), RoutingKey("client", "device", "sale"), []byte(body)); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+}
+
+func nextQueueMessage(t *testing.T, messages <-chan QueueMessage) QueueMessage {
+	t.Helper()
+
+	select {
+	case message, ok := <-messages:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return message
+	case <-time.After(testMQTTTimeout):
+		t.Fatal("timed out waiting for a message")
+	}
+	return QueueMessage{}
+}
+
+func expectQueueStats(t *testing.T, b *natsBus, messages, consumers int) {
+	t.Helper()
+
+	stats, err := b.QueueStats()
+	if err != nil {
+		t.Fatalf("QueueStats() error = %v", err)
+	}
+	if stats.Queue != testNATSQueue || stats.Messages != messages || stats.Consumers != consumers {
+		t.Errorf("QueueStats() = %+v, want %d messages and %d consumers on %s", stats, messages, consumers, testNATSQueue)
+	}
+}
+
+func TestNATSPublishConsumeAck(t *testing.T) {
+	b := startTestNATSBus(t, testNATSConfig(startTestNATS(t)))
+
+	if err := b.Publish(context.Background(), "unbound.topic", []byte(`{}`)); !errors.Is(err, ErrPublishReturned) {
+		t.Fatalf("Publish() to an unbound topic error = %v, want %v", err, ErrPublishReturned)
+	}
+
+	bodies := []string{`{"message_id": "m1"}`, `{"message_id": "m2"}`, `{"message_id": "m3"}`}
+	for _, body := range bodies {
+		publishNATS(t, b, body)
+	}
+	// A retried publish with the same message ID is stored once.
+	publishNATS(t, b, bodies[0])
+	expectQueueStats(t, b, len(bodies), 0)
+
+	messages := subscribeNATS(t, b)
+	for _, want := range bodies {
+		message := nextQueueMessage(t, messages)
+		if string(message.Body) != want {
+			t.Errorf("Body = %s, want %s", message.Body, want)
+		}
+		if message.Redelivered || message.DeliveryCount != 1 {
+			t.Errorf("Redelivered = %v, DeliveryCount = %d on the first delivery", message.Redelivered, message.DeliveryCount)
+		}
+		if err := message.Ack(); err != nil {
+			t.Fatalf("Ack() error = %v", err)
+		}
+	}
+	expectQueueStats(t, b, 0, 1)
+
+	select {
+	case message := <-messages:
+		t.Errorf("acked message delivered again: %s", message.Body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestNATSRedeliversRetriedMessage(t *testing.T) {
+	b := startTestNATSBus(t, testNATSConfig(startTestNATS(t)))
+	messages := subscribeNATS(t, b)
+	publishNATS(t, b, `{"message_id": "m1"}`)
+
+	requeued, err := nextQueueMessage(t, messages).Retry(context.Background(), errors.New("database down"))
+	if err != nil || !requeued {
+		t.Fatalf("Retry() = %v, %v, want requeued", requeued, err)
+	}
+
+	message := nextQueueMessage(t, messages)
+	if !message.Redelivered || message.DeliveryCount != 2 {
+		t.Errorf("Redelivered = %v, DeliveryCount = %d, want a second delivery", message.Redelivered, message.DeliveryCount)
+	}
+	if err := message.Ack(); err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+}
+
+func TestNATSRedeliversAfterAckWait(t *testing.T) {
+	cfg := testNATSConfig(startTestNATS(t))
+	cfg.NATSAckWait = 300 * time.Millisecond
+	b := startTestNATSBus(t, cfg)
+	messages := subscribeNATS(t, b)
+	publishNATS(t, b, `{"message_id": "m1"}`)
+
+	// The first delivery is never settled.
+	nextQueueMessage(t, messages)
+
+	message := nextQueueMessage(t, messages)
+	if !message.Redelivered || message.DeliveryCount != 2 {
+		t.Errorf("Redelivered = %v, DeliveryCount = %d, want a second delivery", message.Redelivered, message.DeliveryCount)
+	}
+	if err := message.Ack(); err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+}
+
+func TestNATSDeadLettersAfterMaxDeliveries(t *testing.T) {
+	cfg := testNATSConfig(startTestNATS(t))
+	cfg.RabbitMQMaxDeliveries = 2
+	b := startTestNATSBus(t, cfg)
+	messages := subscribeNATS(t, b)
+	body := `{"message_id": "m1"}`
+	publishNATS(t, b, body)
+
+	cause := errors.New("database down")
+	if requeued, err := nextQueueMessage(t, messages).Retry(context.Background(), cause); err != nil || !requeued {
+		t.Fatalf("first Retry() = %v, %v, want requeued", requeued, err)
+	}
+	if requeued, err := nextQueueMessage(t, messages).Retry(context.Background(), cause); err != nil || requeued {
+		t.Fatalf("second Retry() = %v, %v, want dead-lettered", requeued, err)
+	}
+
+	letters, total, err := b.ListDeadLetters(10)
+	if err != nil {
+		t.Fatalf("ListDeadLetters() error = %v", err)
+	}
+	if total != 1 || len(letters) != 1 {
+		t.Fatalf("ListDeadLetters() = %d letters of %d, want 1", len(letters), total)
+	}
+	letter := letters[0]
+	if letter.Reason != domain.DeadLetterReasonMaxDeliveries || letter.Error != cause.Error() || letter.DeliveryCount != 2 {
+		t.Errorf("dead letter = %+v, want reason %s, error %q after 2 deliveries", letter, domain.DeadLetterReasonMaxDeliveries, cause)
+	}
+	if letter.Source != "nats:"+testNATSQueue {
+		t.Errorf("Source = %q, want nats:%s", letter.Source, testNATSQueue)
+	}
+
+	// A replayed dead letter is consumed again and leaves the dead-letter
+	// stream.
+	if err := b.ReplayDeadLetter(context.Background(), letter.ID, nil); err != nil {
+		t.Fatalf("ReplayDeadLetter() error = %v", err)
+	}
+	message := nextQueueMessage(t, messages)
+	if string(message.Body) != body {
+		t.Errorf("replayed Body = %s, want %s", message.Body, body)
+	}
+	if err := message.Ack(); err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+	if _, total, err := b.ListDeadLetters(10); err != nil || total != 0 {
+		t.Errorf("ListDeadLetters() after replay = %d, %v, want none", total, err)
+	}
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Dead letters are kept in their own stream with the same headers the
+// RabbitMQ dead-letter queue uses. A dead letter's ID is its sequence number
+// in that stream.
+
+func (b *natsBus) DeadLetter(ctx context.Context, body []byte, source, reason string, cause error) error {
+	return b.publishDeadLetter(ctx, body, source, reason, cause, 1)
+}
+
+func (b *natsBus) publishDeadLetter(ctx context.Context, body []byte, source, reason string, cause error, deliveries int) error {
+	msg := nats.NewMsg(b.deadLetterSubject())
+	msg.Data = body
+	msg.Header.Set(headerDeadLetterReason, reason)
+	msg.Header.Set(headerDeadLetterSource, source)
+	msg.Header.Set(headerDeadLetterAt, time.Now().UTC().Format(time.RFC3339Nano))
+	msg.Header.Set(headerDeliveries, strconv.Itoa(deliveries))
+	if cause != nil {
+		msg.Header.Set(headerDeadLetterError, cause.Error())
+	}
+
+	if err := b.publishMsg(ctx, msg); err != nil {
+		return fmt.Errorf("failed to publish dead letter: %w", err)
+	}
+	metrics.NATSDeadLettered.WithLabelValues(reason).Inc()
+	return nil
+}
+
+func (b *natsBus) deadLetterStream(ctx context.Context) (jetstream.Stream, error) {
+	js := b.jetStream()
+	if js == nil {
+		return nil, errNATSNotConnected
+	}
+	stream, err := js.Stream(ctx, b.deadLetterStreamName())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead-letter stream: %w", err)
+	}
+	return stream, nil
+}
+
+func (b *natsBus) ListDeadLetters(limit int) ([]*domain.DeadLetter, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), natsAdminTimeout)
+	defer cancel()
+
+	stream, err := b.deadLetterStream(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to inspect dead-letter stream: %w", err)
+	}
+
+	var letters []*domain.DeadLetter
+	if info.State.Msgs == 0 {
+		return letters, 0, nil
+	}
+	// Deleted dead letters leave gaps in the sequence, so ask for the next
+	// stored message from each position.
+	for seq := info.State.FirstSeq; len(letters) < limit; {
+		raw, err := stream.GetMsg(ctx, seq, jetstream.WithGetMsgSubject(b.deadLetterSubject()))
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read dead-letter stream: %w", err)
+		}
+		letters = append(letters, deadLetterFromStreamMsg(raw))
+		seq = raw.Sequence + 1
+	}
+	return letters, int(info.State.Msgs), nil
+}
+
+func (b *natsBus) GetDeadLetter(id string) (*domain.DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), natsAdminTimeout)
+	defer cancel()
+
+	_, raw, err := b.getDeadLetter(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return deadLetterFromStreamMsg(raw), nil
+}
+
+func (b *natsBus) getDeadLetter(ctx context.Context, id string) (jetstream.Stream, *jetstream.RawStreamMsg, error) {
+	seq, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, nil, ErrDeadLetterNotFound
+	}
+	stream, err := b.deadLetterStream(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := stream.GetMsg(ctx, seq)
+	if errors.Is(err, jetstream.ErrMsgNotFound) {
+		return nil, nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read dead-letter stream: %w", err)
+	}
+	return stream, raw, nil
+}
+
+func (b *natsBus) ReplayDeadLetter(ctx context.Context, id string, payload []byte) error {
+	stream, raw, err := b.getDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	body := raw.Data
+	if payload != nil {
+		body = payload
+	}
+	return b.replay(ctx, stream, raw.Sequence, body)
+}
+
+// replay publishes body to the consumer queue's replay subject and removes
+// the dead letter. Replays carry no message ID, so JetStream does not drop
+// them as duplicates of the original publish.
+func (b *natsBus) replay(ctx context.Context, stream jetstream.Stream, seq uint64, body []byte) error {
+	msg := nats.NewMsg(b.replaySubject())
+	msg.Data = body
+	if err := b.publishMsg(ctx, msg); err != nil {
+		return err
+	}
+	if err := stream.DeleteMsg(ctx, seq); err != nil {
+		return fmt.Errorf("failed to remove replayed dead letter: %w", err)
+	}
+	metrics.NATSDeadLettersReplayed.Inc()
+	return nil
+}
+
+func (b *natsBus) ReplayDeadLetters(ctx context.Context) (int, error) {
+	stream, err := b.deadLetterStream(ctx)
+	if err != nil {
+		return 0, err
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect dead-letter stream: %w", err)
+	}
+	if info.State.Msgs == 0 {
+		return 0, nil
+	}
+
+	// Only replay what is there now, so messages that fail again straight
+	// away are not picked up a second time.
+	replayed := 0
+	for seq := info.State.FirstSeq; seq <= info.State.LastSeq; {
+		raw, err := stream.GetMsg(ctx, seq, jetstream.WithGetMsgSubject(b.deadLetterSubject()))
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			break
+		}
+		if err != nil {
+			return replayed, fmt.Errorf("failed to read dead-letter stream: %w", err)
+		}
+		if raw.Sequence > info.State.LastSeq {
+			break
+		}
+		if err := b.replay(ctx, stream, raw.Sequence, raw.Data); err != nil {
+			return replayed, err
+		}
+		replayed++
+		seq = raw.Sequence + 1
+	}
+	return replayed, nil
+}
+
+func (b *natsBus) DeleteDeadLetter(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), natsAdminTimeout)
+	defer cancel()
+
+	stream, raw, err := b.getDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := stream.DeleteMsg(ctx, raw.Sequence); err != nil {
+		return fmt.Errorf("failed to delete dead letter: %w", err)
+	}
+	return nil
+}
+
+func (b *natsBus) PurgeDeadLetters() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), natsAdminTimeout)
+	defer cancel()
+
+	stream, err := b.deadLetterStream(ctx)
+	if err != nil {
+		return 0, err
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect dead-letter stream: %w", err)
+	}
+	if err := stream.Purge(ctx); err != nil {
+		return 0, fmt.Errorf("failed to purge dead-letter stream: %w", err)
+	}
+	return int(info.State.Msgs), nil
+}
+
+func deadLetterFromStreamMsg(raw *jetstream.RawStreamMsg) *domain.DeadLetter {
+	letter := &domain.DeadLetter{
+		ID:        strconv.FormatUint(raw.Sequence, 10),
+		MessageID: messageIDFromPayload(raw.Data),
+		Reason:    raw.Header.Get(headerDeadLetterReason),
+		Error:     raw.Header.Get(headerDeadLetterError),
+		Source:    raw.Header.Get(headerDeadLetterSource),
+		FailedAt:  raw.Time,
+	}
+	letter.DeliveryCount, _ = strconv.Atoi(raw.Header.Get(headerDeliveries))
+	if failedAt, err := time.Parse(time.RFC3339Nano, raw.Header.Get(headerDeadLetterAt)); err == nil {
+		letter.FailedAt = failedAt
+	}
+	setDeadLetterPayload(letter, raw.Data)
+	return letter
+}
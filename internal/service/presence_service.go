@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"smat/iot/simulation/iot-inventory-management/internal/repository"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// presenceSweepBatch is how many silent devices one sweep step marks
+// offline; a sweep repeats steps until none are left.
+const presenceSweepBatch = 500
+
+var ErrUnknownDevice = errors.New("unknown device")
+
+type presenceService struct {
+	repo       repository.PresenceRepository
+	deviceRepo repository.DeviceRepository
+	hub        *WebSocketHub
+	alerts     AlertService
+	timeout    time.Duration
+}
+
+func NewPresenceService(repo repository.PresenceRepository, deviceRepo repository.DeviceRepository, hub *WebSocketHub, alerts AlertService, timeout time.Duration) PresenceService {
+	return &presenceService{
+		repo:       repo,
+		deviceRepo: deviceRepo,
+		hub:        hub,
+		alerts:     alerts,
+		timeout:    timeout,
+	}
+}
+
+func (s *presenceService) Seen(ctx context.Context, deviceID uuid.UUID, clientID string) error {
+	now := time.Now()
+	cameOnline, err := s.repo.MarkOnline(ctx, deviceID, now)
+	if err != nil {
+		return err
+	}
+	if cameOnline {
+		s.transition(ctx, &domain.DevicePresence{
+			DeviceID: deviceID.String(),
+			ClientID: clientID,
+			Online:   true,
+			Reason:   domain.PresenceReasonTelemetry,
+		}, now)
+	}
+	return nil
+}
+
+func (s *presenceService) SetStatus(ctx context.Context, deviceID uuid.UUID, online bool) error {
+	// Status topics are not backed by a device's telemetry, so check the
+	// device exists before tracking it.
+	device, err := s.deviceRepo.GetByDeviceID(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if device == nil {
+		return ErrUnknownDevice
+	}
+
+	now := time.Now()
+	var changed bool
+	if online {
+		changed, err = s.repo.MarkOnline(ctx, deviceID, now)
+	} else {
+		changed, err = s.repo.MarkOffline(ctx, deviceID)
+	}
+	if err != nil {
+		return err
+	}
+	if changed {
+		seenAt := now
+		if !online {
+			seenAt = time.Time{}
+		}
+		s.transition(ctx, &domain.DevicePresence{
+			DeviceID: deviceID.String(),
+			ClientID: device.ClientID.String(),
+			Online:   online,
+			Reason:   domain.PresenceReasonStatus,
+		}, seenAt)
+	}
+	return nil
+}
+
+func (s *presenceService) Sweep(ctx context.Context) (int, error) {
+	before := time.Now().Add(-s.timeout)
+	swept := 0
+	for {
+		expired, err := s.repo.Expire(ctx, before, presenceSweepBatch)
+		if err != nil {
+			return swept, err
+		}
+		for deviceID, lastSeen := range expired {
+			lastSeen := lastSeen
+			s.transition(ctx, &domain.DevicePresence{
+				DeviceID:   deviceID.String(),
+				Online:     false,
+				Reason:     domain.PresenceReasonTimeout,
+				LastSeenAt: &lastSeen,
+			}, time.Time{})
+		}
+		swept += len(expired)
+		if len(expired) < presenceSweepBatch {
+			break
+		}
+	}
+
+	if online, err := s.repo.Online(ctx); err == nil {
+		metrics.DevicesOnline.Set(float64(len(online)))
+	}
+	return swept, nil
+}
+
+// RunSweeper sweeps on every interval until ctx is done. It first marks
+// devices offline that the database still has online but that went silent
+// while no server was running.
+func (s *presenceService) RunSweeper(ctx context.Context, interval time.Duration) {
+	s.reconcile(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			swept, err := s.Sweep(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to sweep device presence", "swept", swept, "error", err)
+			} else if swept > 0 {
+				slog.InfoContext(ctx, "Marked silent devices offline", "devices", swept)
+			}
+		}
+	}
+}
+
+func (s *presenceService) reconcile(ctx context.Context) {
+	online, err := s.repo.Online(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read device presence", "error", err)
+		return
+	}
+	stale, err := s.deviceRepo.MarkStaleOffline(ctx, online, time.Now().Add(-s.timeout))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to reconcile device presence", "error", err)
+		return
+	}
+	if len(stale) > 0 {
+		slog.InfoContext(ctx, "Marked devices offline that went silent while the server was down", "devices", len(stale))
+	}
+}
+
+// transition stores a presence change and announces it on the dashboard and
+// as an alert. seenAt moves the device's last_seen_at forward when not zero.
+func (s *presenceService) transition(ctx context.Context, presence *domain.DevicePresence, seenAt time.Time) {
+	presence.Type = domain.PresenceMessageType
+	presence.ChangedAt = time.Now()
+	state := domain.DeviceStatusOffline
+	if presence.Online {
+		state = domain.DeviceStatusOnline
+		presence.LastSeenAt = &seenAt
+	}
+
+	deviceID, _ := uuid.Parse(presence.DeviceID)
+	if err := s.deviceRepo.SetOnline(ctx, deviceID, presence.Online, seenAt); err != nil {
+		slog.ErrorContext(ctx, "Failed to store device presence", "device_id", presence.DeviceID, "error", err)
+	}
+	if presence.ClientID == "" {
+		if device, err := s.deviceRepo.GetByDeviceID(ctx, deviceID); err == nil && device != nil {
+			presence.ClientID = device.ClientID.String()
+		}
+	}
+
+	metrics.PresenceTransitions.WithLabelValues(state, presence.Reason).Inc()
+	slog.InfoContext(ctx, "Device presence changed", "device_id", presence.DeviceID, "status", state, "reason", presence.Reason)
+
+	payload, err := json.Marshal(presence)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to marshal device presence", "error", err)
+		return
+	}
+	s.hub.Broadcast(ctx, payload)
+	s.alerts.PresenceChanged(ctx, presence)
+}
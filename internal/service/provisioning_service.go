@@ -0,0 +1,408 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"smat/iot/simulation/iot-inventory-management/internal/repository"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrClaimExists           = errors.New("serial number is already registered")
+	ErrClaimNotFound         = errors.New("claim not found")
+	ErrPendingDeviceNotFound = errors.New("pending device not found")
+	ErrInvalidBirth          = errors.New("invalid birth message")
+
+	// errClaimUsed and errDeviceSecretRequired reject birth messages for a
+	// serial number whose claim already provisioned its device.
+	errClaimUsed            = errors.New("claim has already been used")
+	errDeviceSecretRequired = errors.New("device is already provisioned: device_secret must be its current secret")
+)
+
+// claimTokenBytes is the entropy of a generated claim token.
+const claimTokenBytes = 24
+
+type provisioningService struct {
+	claims      repository.DeviceClaimRepository
+	pending     repository.PendingDeviceRepository
+	devices     DeviceService
+	deviceRepo  repository.DeviceRepository
+	credentials DeviceCredentialService
+	audit       AuditService
+	publisher   MQTTService
+}
+
+func NewProvisioningService(claims repository.DeviceClaimRepository, pending repository.PendingDeviceRepository, devices DeviceService, deviceRepo repository.DeviceRepository, credentials DeviceCredentialService, audit AuditService) ProvisioningService {
+	return &provisioningService{
+		claims:      claims,
+		pending:     pending,
+		devices:     devices,
+		deviceRepo:  deviceRepo,
+		credentials: credentials,
+		audit:       audit,
+	}
+}
+
+func (s *provisioningService) SetPublisher(publisher MQTTService) {
+	s.publisher = publisher
+}
+
+func (s *provisioningService) RegisterClaim(ctx context.Context, clientID uuid.UUID, serialNumber, claimToken string) (*domain.IssuedDeviceClaim, error) {
+	if err := domain.ValidateSerialNumber(serialNumber); err != nil {
+		return nil, err
+	}
+	if claimToken == "" {
+		raw := make([]byte, claimTokenBytes)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, fmt.Errorf("failed to generate claim token: %w", err)
+		}
+		claimToken = base64.RawURLEncoding.EncodeToString(raw)
+	} else if len(claimToken) < domain.MinClaimTokenLength {
+		return nil, fmt.Errorf("%w: must be at least %d characters", domain.ErrInvalidClaimToken, domain.MinClaimTokenLength)
+	}
+
+	claim := &domain.DeviceClaim{SerialNumber: serialNumber, ClientID: clientID, TokenHash: domain.HashClaimToken(claimToken)}
+	if err := s.createClaim(ctx, claim); err != nil {
+		return nil, err
+	}
+	return &domain.IssuedDeviceClaim{DeviceClaim: *claim, ClaimToken: claimToken}, nil
+}
+
+func (s *provisioningService) ListClaims(ctx context.Context, clientID uuid.UUID) ([]*domain.DeviceClaim, error) {
+	return s.claims.ListByClient(ctx, clientID)
+}
+
+func (s *provisioningService) DeleteClaim(ctx context.Context, clientID uuid.UUID, serialNumber string) error {
+	claim, err := s.claims.Get(ctx, serialNumber)
+	if err != nil {
+		return err
+	}
+	if claim == nil || claim.ClientID != clientID {
+		return ErrClaimNotFound
+	}
+	deleted, err := s.claims.Delete(ctx, clientID, serialNumber)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrClaimNotFound
+	}
+
+	s.recordAudit(ctx, domain.AuditActionDeviceClaimDelete, domain.AuditResourceDeviceClaim, serialNumber, &clientID, claim, nil)
+	return nil
+}
+
+func (s *provisioningService) HandleBirth(ctx context.Context, serialNumber string, payload []byte) error {
+	if err := domain.ValidateSerialNumber(serialNumber); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBirth, err)
+	}
+	var birth domain.BirthMessage
+	if err := json.Unmarshal(payload, &birth); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBirth, err)
+	}
+	if birth.SerialNumber != "" && birth.SerialNumber != serialNumber {
+		return fmt.Errorf("%w: serial number %q does not match the topic", ErrInvalidBirth, birth.SerialNumber)
+	}
+	if birth.ClaimToken == "" {
+		return fmt.Errorf("%w: missing claim_token", ErrInvalidBirth)
+	}
+	credentialHash, err := domain.ParseCredentialHash(birth.CredentialHash)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBirth, err)
+	}
+	tokenHash := domain.HashClaimToken(birth.ClaimToken)
+
+	claim, err := s.claims.Get(ctx, serialNumber)
+	if err != nil {
+		return err
+	}
+
+	if claim == nil {
+		pending := &domain.PendingDevice{
+			SerialNumber:    serialNumber,
+			ClientID:        birth.ClientID,
+			TokenHash:       tokenHash,
+			CredentialHash:  credentialHash,
+			FirmwareVersion: birth.FirmwareVersion,
+			Model:           birth.Model,
+		}
+		accepted, err := s.pending.Upsert(ctx, pending)
+		if err != nil {
+			return err
+		}
+		if !accepted {
+			// Another device announced the serial number first; keep its
+			// token so whoever approves the device gets that one.
+			slog.WarnContext(ctx, "Rejected birth message with a claim token other than the pending device's", "serial_number", serialNumber, "conflicts", pending.ConflictCount)
+			return s.reject(ctx, serialNumber, domain.ErrInvalidClaimToken)
+		}
+		metrics.ProvisioningBirths.WithLabelValues(domain.ProvisioningStatusPending).Inc()
+		if pending.BirthCount == 1 {
+			slog.InfoContext(ctx, "Unclaimed device is waiting for approval", "serial_number", serialNumber, "client_id", pending.ClientID, "token_fingerprint", pending.TokenFingerprint)
+		}
+		return s.respond(ctx, serialNumber, &domain.ProvisioningResponse{Status: domain.ProvisioningStatusPending})
+	}
+
+	if subtle.ConstantTimeCompare(tokenHash, claim.TokenHash) != 1 {
+		slog.WarnContext(ctx, "Rejected birth message with a wrong claim token", "serial_number", serialNumber, "client_id", claim.ClientID)
+		return s.reject(ctx, serialNumber, domain.ErrInvalidClaimToken)
+	}
+
+	device, err := s.provision(ctx, claim, credentialHash)
+	if errors.Is(err, errClaimUsed) {
+		// The claim provisioned a device before, possibly concurrently.
+		if claim, err = s.claims.Get(ctx, serialNumber); err != nil {
+			return err
+		}
+		device, err = s.reprovision(ctx, claim, &birth, credentialHash)
+	}
+	if errors.Is(err, errClaimUsed) || errors.Is(err, errDeviceSecretRequired) {
+		slog.WarnContext(ctx, "Rejected birth message for a provisioned device", "serial_number", serialNumber, "error", err)
+		return s.reject(ctx, serialNumber, err)
+	}
+	if err != nil {
+		return err
+	}
+	metrics.ProvisioningBirths.WithLabelValues(domain.ProvisioningStatusProvisioned).Inc()
+	return s.respond(ctx, serialNumber, provisionedResponse(device))
+}
+
+func (s *provisioningService) ListPending(ctx context.Context, clientID *uuid.UUID) ([]*domain.PendingDevice, error) {
+	return s.pending.List(ctx, clientID)
+}
+
+func (s *provisioningService) Approve(ctx context.Context, serialNumber string, clientID uuid.UUID) (*domain.Device, error) {
+	pending, err := s.pendingDevice(ctx, serialNumber, &clientID)
+	if err != nil {
+		return nil, err
+	}
+	return s.approve(ctx, pending, clientID)
+}
+
+func (s *provisioningService) Assign(ctx context.Context, serialNumber string, clientID uuid.UUID) (*domain.Device, error) {
+	pending, err := s.pendingDevice(ctx, serialNumber, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.approve(ctx, pending, clientID)
+}
+
+func (s *provisioningService) approve(ctx context.Context, pending *domain.PendingDevice, clientID uuid.UUID) (*domain.Device, error) {
+	claim := &domain.DeviceClaim{SerialNumber: pending.SerialNumber, ClientID: clientID, TokenHash: pending.TokenHash}
+	if err := s.createClaim(ctx, claim); err != nil {
+		return nil, err
+	}
+
+	device, err := s.provision(ctx, claim, pending.CredentialHash)
+	if err != nil {
+		return nil, err
+	}
+	// A device that misses the response is answered again on its next
+	// birth message with the same credential hash.
+	if err := s.respond(ctx, pending.SerialNumber, provisionedResponse(device)); err != nil {
+		slog.WarnContext(ctx, "Failed to notify approved device", "serial_number", pending.SerialNumber, "device_id", device.ID, "error", err)
+	}
+	return device, nil
+}
+
+func (s *provisioningService) Dismiss(ctx context.Context, serialNumber string, clientID *uuid.UUID) error {
+	pending, err := s.pendingDevice(ctx, serialNumber, clientID)
+	if err != nil {
+		return err
+	}
+	deleted, err := s.pending.Delete(ctx, serialNumber)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrPendingDeviceNotFound
+	}
+
+	s.recordAudit(ctx, domain.AuditActionPendingDeviceDismiss, domain.AuditResourcePendingDevice, serialNumber, pending.ClientID, pending, nil)
+	return nil
+}
+
+// pendingDevice returns the pending device, or ErrPendingDeviceNotFound if
+// there is none or, with a client, it did not name that client.
+func (s *provisioningService) pendingDevice(ctx context.Context, serialNumber string, clientID *uuid.UUID) (*domain.PendingDevice, error) {
+	pending, err := s.pending.Get(ctx, serialNumber)
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		return nil, ErrPendingDeviceNotFound
+	}
+	if clientID != nil && (pending.ClientID == nil || *pending.ClientID != *clientID) {
+		return nil, ErrPendingDeviceNotFound
+	}
+	return pending, nil
+}
+
+func (s *provisioningService) createClaim(ctx context.Context, claim *domain.DeviceClaim) error {
+	created, err := s.claims.Create(ctx, claim)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return ErrClaimExists
+	}
+
+	clientID := claim.ClientID
+	s.recordAudit(ctx, domain.AuditActionDeviceClaimCreate, domain.AuditResourceDeviceClaim, claim.SerialNumber, &clientID, nil, claim)
+	return nil
+}
+
+// provision creates the device of an unused claim with the credential the
+// device chose, and marks the claim as used. It returns errClaimUsed if the
+// claim was used before.
+func (s *provisioningService) provision(ctx context.Context, claim *domain.DeviceClaim, credentialHash []byte) (*domain.Device, error) {
+	if claim.ClaimedAt != nil {
+		return nil, errClaimUsed
+	}
+
+	device := &domain.Device{ClientID: claim.ClientID}
+	if err := s.devices.RegisterDevice(ctx, device); err != nil {
+		return nil, fmt.Errorf("failed to create device: %w", err)
+	}
+	// Enroll before binding, so that a used claim always has a device that
+	// can connect.
+	if err := s.credentials.Enroll(ctx, device.ID, credentialHash); err != nil {
+		s.discardDevice(ctx, device)
+		return nil, fmt.Errorf("failed to enroll credential: %w", err)
+	}
+
+	bound, err := s.claims.Bind(ctx, claim.SerialNumber, device.ID, time.Now().UTC())
+	if err != nil {
+		s.discardDevice(ctx, device)
+		return nil, err
+	}
+	if !bound {
+		// Another birth message for the same serial number used the claim
+		// first; keep its device.
+		s.discardDevice(ctx, device)
+		return nil, errClaimUsed
+	}
+	slog.InfoContext(ctx, "Provisioned device", "serial_number", claim.SerialNumber, "device_id", device.ID, "client_id", device.ClientID)
+
+	if _, err := s.pending.Delete(ctx, claim.SerialNumber); err != nil {
+		slog.WarnContext(ctx, "Failed to remove provisioned device from pending devices", "serial_number", claim.SerialNumber, "error", err)
+	}
+	return device, nil
+}
+
+// reprovision answers a birth message for a used claim. A repeated birth
+// message with the device's credential hash is answered again, so a device
+// that missed the response can recover; replacing the credential takes the
+// current secret.
+func (s *provisioningService) reprovision(ctx context.Context, claim *domain.DeviceClaim, birth *domain.BirthMessage, credentialHash []byte) (*domain.Device, error) {
+	device, err := s.claimedDevice(ctx, claim)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		// The device was deleted; the claim stays used.
+		return nil, errClaimUsed
+	}
+
+	enrolled, err := s.credentials.IsEnrolled(ctx, device.ID, credentialHash)
+	if err != nil {
+		return nil, err
+	}
+	if enrolled {
+		return device, nil
+	}
+
+	if birth.DeviceSecret == "" {
+		return nil, errDeviceSecretRequired
+	}
+	authenticated, err := s.credentials.Authenticate(ctx, device.ID, birth.DeviceSecret)
+	if err != nil {
+		return nil, err
+	}
+	if !authenticated {
+		return nil, errDeviceSecretRequired
+	}
+	if err := s.credentials.Enroll(ctx, device.ID, credentialHash); err != nil {
+		return nil, fmt.Errorf("failed to enroll credential: %w", err)
+	}
+	slog.InfoContext(ctx, "Replaced credential of provisioned device", "serial_number", claim.SerialNumber, "device_id", device.ID)
+	return device, nil
+}
+
+// discardDevice deletes a device created for a claim that could not be
+// used; its credential goes with it.
+func (s *provisioningService) discardDevice(ctx context.Context, device *domain.Device) {
+	if err := s.deviceRepo.Delete(ctx, device.ID); err != nil {
+		slog.ErrorContext(ctx, "Failed to delete discarded provisioned device", "device_id", device.ID, "error", err)
+		return
+	}
+
+	clientID := device.ClientID
+	entry := &domain.AuditEntry{
+		Action:       domain.AuditActionDeviceDelete,
+		ResourceType: domain.AuditResourceDevice,
+		ResourceID:   device.ID.String(),
+		ClientID:     &clientID,
+	}
+	if err := s.audit.Record(ctx, entry, device, nil); err != nil {
+		slog.ErrorContext(ctx, "Failed to record audit entry", "action", domain.AuditActionDeviceDelete, "device_id", device.ID, "error", err)
+	}
+}
+
+// claimedDevice returns the device created for claim, or nil if there is
+// none.
+func (s *provisioningService) claimedDevice(ctx context.Context, claim *domain.DeviceClaim) (*domain.Device, error) {
+	if claim == nil || claim.DeviceID == nil {
+		return nil, nil
+	}
+	return s.deviceRepo.GetByDeviceID(ctx, *claim.DeviceID)
+}
+
+func (s *provisioningService) respond(ctx context.Context, serialNumber string, response *domain.ProvisioningResponse) error {
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal provisioning response: %w", err)
+	}
+	return s.publisher.PublishToDevice(ctx, fmt.Sprintf("provisioning/%s/response", serialNumber), payload, false)
+}
+
+// reject answers a birth message with the reason it was rejected.
+func (s *provisioningService) reject(ctx context.Context, serialNumber string, reason error) error {
+	metrics.ProvisioningBirths.WithLabelValues(domain.ProvisioningStatusRejected).Inc()
+	return s.respond(ctx, serialNumber, &domain.ProvisioningResponse{
+		Status: domain.ProvisioningStatusRejected,
+		Error:  reason.Error(),
+	})
+}
+
+func provisionedResponse(device *domain.Device) *domain.ProvisioningResponse {
+	deviceID, clientID := device.ID, device.ClientID
+	return &domain.ProvisioningResponse{
+		Status:   domain.ProvisioningStatusProvisioned,
+		DeviceID: &deviceID,
+		ClientID: &clientID,
+	}
+}
+
+func (s *provisioningService) recordAudit(ctx context.Context, action, resourceType, serialNumber string, clientID *uuid.UUID, before, after interface{}) {
+	entry := &domain.AuditEntry{
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   serialNumber,
+		ClientID:     clientID,
+	}
+
+	if err := s.audit.Record(ctx, entry, before, after); err != nil {
+		slog.ErrorContext(ctx, "Failed to record audit entry", "action", action, "serial_number", serialNumber, "error", err)
+	}
+}
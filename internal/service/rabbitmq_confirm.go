@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	// ErrPublishNacked means the broker refused the message, or the channel
+	// closed before it was confirmed.
+	ErrPublishNacked = errors.New("broker did not accept the message")
+	// ErrPublishReturned means no queue is bound for the routing key.
+	ErrPublishReturned = errors.New("message is unroutable")
+	// ErrConfirmTimeout means the broker did not confirm the message in
+	// time; it may still have accepted it.
+	ErrConfirmTimeout = errors.New("timed out waiting for publish confirmation")
+)
+
+// headerPublishSeq ties a basic.return to the publish it belongs to.
+const headerPublishSeq = "x-publish-seq"
+
+// returnHandler hands the unroutable messages returned on one channel back
+// to the publishes waiting on them.
+type returnHandler struct {
+	pending *sync.Map
+	flushes chan chan struct{}
+	done    chan struct{}
+}
+
+// newReturnHandler starts handing over returns. It stops when the channel
+// closes.
+func newReturnHandler(pending *sync.Map, returns <-chan amqp.Return) *returnHandler {
+	h := &returnHandler{
+		pending: pending,
+		flushes: make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go h.run(returns)
+	return h
+}
+
+func (h *returnHandler) run(returns <-chan amqp.Return) {
+	defer close(h.done)
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				return
+			}
+			h.handOver(ret)
+		case flushed := <-h.flushes:
+			close(flushed)
+		}
+	}
+}
+
+func (h *returnHandler) handOver(ret amqp.Return) {
+	seq, ok := ret.Headers[headerPublishSeq].(int64)
+	if !ok {
+		slog.Warn("Unroutable message returned by RabbitMQ", "exchange", ret.Exchange, "routing_key", ret.RoutingKey, "reason", ret.ReplyText)
+		return
+	}
+	if waiter, ok := h.pending.Load(seq); ok {
+		select {
+		case waiter.(chan amqp.Return) <- ret:
+		default:
+		}
+	}
+}
+
+// flush waits until every return the client has received so far is handed
+// over. The client reads returns on an unbuffered channel, so once it has
+// passed one on, the handler has taken it, but may not have handed it over
+// yet.
+func (h *returnHandler) flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case h.flushes <- flushed:
+		<-flushed
+	case <-h.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// publishConfirmed publishes msg as mandatory and waits for the broker to
+// confirm it. It fails if the broker nacks the message, returns it as
+// unroutable or does not confirm it within the confirm timeout.
+func (s *rabbitMQService) publishConfirmed(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	s.mu.RLock()
+	channel := s.channel
+	returns := s.returns
+	s.mu.RUnlock()
+
+	if channel == nil {
+		return fmt.Errorf("channel is not initialized")
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.publishTimeout.Load()))
+		defer cancel()
+	}
+
+	seq := s.publishSeq.Add(1)
+	msg.Headers = copyTable(msg.Headers)
+	msg.Headers[headerPublishSeq] = seq
+
+	returned := make(chan amqp.Return, 1)
+	s.pendingReturns.Store(seq, returned)
+	defer s.pendingReturns.Delete(seq)
+
+	start := time.Now()
+	confirmation, err := channel.PublishWithDeferredConfirmWithContext(ctx, exchange, routingKey, true, false, msg)
+	if err != nil {
+		return err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(s.confirmTimeout.Load()))
+	defer cancel()
+
+	select {
+	case ret := <-returned:
+		return unroutableError(routingKey, ret)
+	case <-confirmation.Done():
+	case <-waitCtx.Done():
+		metrics.RabbitMQPublishUnconfirmed.WithLabelValues("timeout").Inc()
+		return fmt.Errorf("%w: %w", ErrConfirmTimeout, waitCtx.Err())
+	}
+	metrics.RabbitMQConfirmDuration.Observe(time.Since(start).Seconds())
+
+	// The broker sends basic.return before the ack for the same message,
+	// and the client passes it to the return handler before it reads the
+	// ack. The handler may still be handing it over.
+	if err := returns.flush(waitCtx); err != nil {
+		metrics.RabbitMQPublishUnconfirmed.WithLabelValues("timeout").Inc()
+		return fmt.Errorf("%w: %w", ErrConfirmTimeout, err)
+	}
+	select {
+	case ret := <-returned:
+		return unroutableError(routingKey, ret)
+	default:
+	}
+
+	if !confirmation.Acked() {
+		metrics.RabbitMQPublishUnconfirmed.WithLabelValues("nack").Inc()
+		return ErrPublishNacked
+	}
+	return nil
+}
+
+func unroutableError(routingKey string, ret amqp.Return) error {
+	metrics.RabbitMQPublishUnconfirmed.WithLabelValues("returned").Inc()
+	return fmt.Errorf("%w: routing key %q: %s", ErrPublishReturned, routingKey, ret.ReplyText)
+}
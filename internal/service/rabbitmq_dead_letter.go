@@ -0,0 +1,388 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"time"
+
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+	errConsumerTimeout = errors.New("timed out waiting for a consumer worker")
+)
+
+// deadLetterScanLimit bounds how many dead letters a listing or a lookup by
+// ID reads. RabbitMQ queues can only be browsed by fetching messages and
+// holding them unacked until the scan ends, one round trip each, so a
+// lookup only finds dead letters among the oldest deadLetterScanLimit.
+const deadLetterScanLimit = 500
+
+// Headers the application sets on retried and dead-lettered messages. The
+// broker adds its own x-death headers to messages it dead-letters itself.
+const (
+	headerDeliveries       = "x-deliveries"
+	headerDeadLetterID     = "x-dead-letter-id"
+	headerDeadLetterReason = "x-dead-letter-reason"
+	headerDeadLetterError  = "x-dead-letter-error"
+	headerDeadLetterSource = "x-dead-letter-source"
+	headerDeadLetterAt     = "x-dead-letter-at"
+)
+
+func (s *rabbitMQService) deadLetterExchangeName() string {
+	return s.config.RabbitMQQueue + ".dlx"
+}
+
+func (s *rabbitMQService) deadLetterQueueName() string {
+	return s.config.RabbitMQQueue + ".dlq"
+}
+
+// declareDeadLetterQueue declares the dead-letter exchange and the queue
+// bound to it. The queue has no TTL: dead letters stay until they are
+// replayed or purged.
+func (s *rabbitMQService) declareDeadLetterQueue(channel *amqp.Channel) error {
+	if err := channel.ExchangeDeclare(s.deadLetterExchangeName(), amqp.ExchangeDirect, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare dead-letter exchange: %w", err)
+	}
+	if _, err := channel.QueueDeclare(s.deadLetterQueueName(), true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare dead-letter queue: %w", err)
+	}
+	if err := channel.QueueBind(s.deadLetterQueueName(), s.config.RabbitMQQueue, s.deadLetterExchangeName(), false, nil); err != nil {
+		return fmt.Errorf("failed to bind dead-letter queue: %w", err)
+	}
+	return nil
+}
+
+// rabbitDelivery settles a consumed message. Retries are republished to the
+// back of the queue with an incremented delivery count rather than nacked,
+// because the broker does not count redeliveries on classic queues.
+type rabbitDelivery struct {
+	service  *rabbitMQService
+	delivery amqp.Delivery
+}
+
+func (d *rabbitDelivery) Ack() error {
+	return d.delivery.Ack(false)
+}
+
+func (d *rabbitDelivery) Retry(ctx context.Context, cause error) (bool, error) {
+	deliveries := deliveryCount(d.delivery.Headers)
+	if deliveries >= int(d.service.maxDeliveries.Load()) {
+		return false, d.DeadLetter(ctx, domain.DeadLetterReasonMaxDeliveries, cause)
+	}
+
+	headers := copyTable(d.delivery.Headers)
+	headers[headerDeliveries] = int32(deliveries + 1)
+
+	err := d.service.publishConfirmed(ctx, "", d.service.config.RabbitMQQueue, amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		ContentType:  d.delivery.ContentType,
+		MessageId:    d.delivery.MessageId,
+		Timestamp:    d.delivery.Timestamp,
+		Headers:      headers,
+		Body:         d.delivery.Body,
+	})
+	if err != nil {
+		// Fall back to the broker requeueing it; the attempt is not counted.
+		slog.WarnContext(ctx, "Failed to republish message for retry, requeueing", "message_id", d.delivery.MessageId, "error", err)
+		return true, d.delivery.Nack(false, true)
+	}
+	return true, d.delivery.Ack(false)
+}
+
+func (d *rabbitDelivery) DeadLetter(ctx context.Context, reason string, cause error) error {
+	source := "rabbitmq:" + d.service.config.RabbitMQQueue
+	err := d.service.publishDeadLetter(ctx, d.delivery.Body, d.delivery.MessageId, copyTable(d.delivery.Headers), source, reason, cause)
+	if err != nil {
+		// Rejecting without requeue still dead-letters the message through
+		// the queue's dead-letter exchange, only without our reason headers.
+		slog.WarnContext(ctx, "Failed to publish dead letter, rejecting message", "message_id", d.delivery.MessageId, "error", err)
+		return d.delivery.Nack(false, false)
+	}
+	return d.delivery.Ack(false)
+}
+
+func (s *rabbitMQService) DeadLetter(ctx context.Context, body []byte, source, reason string, cause error) error {
+	return s.publishDeadLetter(ctx, body, messageIDFromPayload(body), amqp.Table{}, source, reason, cause)
+}
+
+func (s *rabbitMQService) publishDeadLetter(ctx context.Context, body []byte, messageID string, headers amqp.Table, source, reason string, cause error) error {
+	headers[headerDeadLetterID] = uuid.NewString()
+	headers[headerDeadLetterReason] = reason
+	headers[headerDeadLetterSource] = source
+	headers[headerDeadLetterAt] = time.Now().UTC().Format(time.RFC3339Nano)
+	if cause != nil {
+		headers[headerDeadLetterError] = cause.Error()
+	}
+	if _, ok := headers[headerDeliveries]; !ok {
+		headers[headerDeliveries] = int32(1)
+	}
+
+	err := s.publishConfirmed(ctx, s.deadLetterExchangeName(), s.config.RabbitMQQueue, amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		ContentType:  "application/json",
+		MessageId:    messageID,
+		Timestamp:    time.Now(),
+		Headers:      headers,
+		Body:         body,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish dead letter: %w", err)
+	}
+	metrics.RabbitMQDeadLettered.WithLabelValues(reason).Inc()
+	return nil
+}
+
+// adminChannel opens a channel of its own for browsing the dead-letter
+// queue. Messages fetched on it and not acked return to the queue when it is
+// closed, in their original place, but marked redelivered. Nothing consumes
+// the dead-letter queue, so the flag only shows in the management UI.
+// Browsing is serialized, since a second scan would fetch the messages the
+// first one is not holding and requeue them out of order.
+func (s *rabbitMQService) adminChannel() (*amqp.Channel, error) {
+	s.mu.RLock()
+	conn := s.conn
+	s.mu.RUnlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil, fmt.Errorf("connection is closed")
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel: %w", err)
+	}
+	return channel, nil
+}
+
+// ListDeadLetters reads at most deadLetterScanLimit dead letters, whatever
+// limit asks for.
+func (s *rabbitMQService) ListDeadLetters(limit int) ([]*domain.DeadLetter, int, error) {
+	limit = min(limit, deadLetterScanLimit)
+
+	s.deadLetterScan.Lock()
+	defer s.deadLetterScan.Unlock()
+	channel, err := s.adminChannel()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer channel.Close()
+
+	queue, err := channel.QueueInspect(s.deadLetterQueueName())
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to inspect dead-letter queue: %w", err)
+	}
+
+	letters := make([]*domain.DeadLetter, 0, min(limit, queue.Messages))
+	for len(letters) < limit {
+		delivery, ok, err := channel.Get(s.deadLetterQueueName(), false)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read dead-letter queue: %w", err)
+		}
+		if !ok {
+			break
+		}
+		letters = append(letters, deadLetterFromDelivery(delivery))
+	}
+	return letters, queue.Messages, nil
+}
+
+func (s *rabbitMQService) GetDeadLetter(id string) (*domain.DeadLetter, error) {
+	var letter *domain.DeadLetter
+	err := s.visitDeadLetter(id, func(delivery amqp.Delivery) (bool, error) {
+		letter = deadLetterFromDelivery(delivery)
+		return false, nil
+	})
+	return letter, err
+}
+
+func (s *rabbitMQService) ReplayDeadLetter(ctx context.Context, id string, payload []byte) error {
+	return s.visitDeadLetter(id, func(delivery amqp.Delivery) (bool, error) {
+		body := delivery.Body
+		if payload != nil {
+			body = payload
+		}
+		if err := s.publishTraced(ctx, "", s.config.RabbitMQQueue, body); err != nil {
+			return false, err
+		}
+		metrics.RabbitMQDeadLettersReplayed.Inc()
+		return true, nil
+	})
+}
+
+func (s *rabbitMQService) DeleteDeadLetter(id string) error {
+	return s.visitDeadLetter(id, func(amqp.Delivery) (bool, error) {
+		return true, nil
+	})
+}
+
+// visitDeadLetter scans the oldest deadLetterScanLimit dead letters for id
+// and calls visit with it. The message is removed if visit returns true;
+// every other message fetched during the scan is returned to the queue.
+func (s *rabbitMQService) visitDeadLetter(id string, visit func(amqp.Delivery) (remove bool, err error)) error {
+	s.deadLetterScan.Lock()
+	defer s.deadLetterScan.Unlock()
+	channel, err := s.adminChannel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	for scanned := 0; scanned < deadLetterScanLimit; scanned++ {
+		delivery, ok, err := channel.Get(s.deadLetterQueueName(), false)
+		if err != nil {
+			return fmt.Errorf("failed to read dead-letter queue: %w", err)
+		}
+		if !ok {
+			return ErrDeadLetterNotFound
+		}
+		if deadLetterID(delivery) != id {
+			continue
+		}
+
+		remove, err := visit(delivery)
+		if err != nil || !remove {
+			return err
+		}
+		return delivery.Ack(false)
+	}
+	return fmt.Errorf("%w among the oldest %d", ErrDeadLetterNotFound, deadLetterScanLimit)
+}
+
+func (s *rabbitMQService) ReplayDeadLetters(ctx context.Context) (int, error) {
+	channel, err := s.adminChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer channel.Close()
+
+	// Only replay what is there now, so messages that fail again straight
+	// away are not picked up a second time.
+	queue, err := channel.QueueInspect(s.deadLetterQueueName())
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect dead-letter queue: %w", err)
+	}
+
+	replayed := 0
+	for replayed < queue.Messages {
+		delivery, ok, err := channel.Get(s.deadLetterQueueName(), false)
+		if err != nil {
+			return replayed, fmt.Errorf("failed to read dead-letter queue: %w", err)
+		}
+		if !ok {
+			break
+		}
+		if err := s.publishTraced(ctx, "", s.config.RabbitMQQueue, delivery.Body); err != nil {
+			return replayed, err
+		}
+		if err := delivery.Ack(false); err != nil {
+			return replayed, fmt.Errorf("failed to remove replayed dead letter: %w", err)
+		}
+		replayed++
+		metrics.RabbitMQDeadLettersReplayed.Inc()
+	}
+	return replayed, nil
+}
+
+func (s *rabbitMQService) PurgeDeadLetters() (int, error) {
+	channel, err := s.adminChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer channel.Close()
+
+	purged, err := channel.QueuePurge(s.deadLetterQueueName(), false)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge dead-letter queue: %w", err)
+	}
+	return purged, nil
+}
+
+// deadLetterID identifies a dead letter: the ID assigned when the
+// application dead-lettered it, or the message ID for messages the broker
+// dead-lettered.
+func deadLetterID(delivery amqp.Delivery) string {
+	if id, ok := delivery.Headers[headerDeadLetterID].(string); ok {
+		return id
+	}
+	return delivery.MessageId
+}
+
+func deadLetterFromDelivery(delivery amqp.Delivery) *domain.DeadLetter {
+	headers := delivery.Headers
+	letter := &domain.DeadLetter{
+		ID:            deadLetterID(delivery),
+		MessageID:     delivery.MessageId,
+		DeliveryCount: deliveryCount(headers),
+		FailedAt:      delivery.Timestamp,
+	}
+
+	if reason, ok := headers[headerDeadLetterReason].(string); ok {
+		letter.Reason = reason
+		letter.Error, _ = headers[headerDeadLetterError].(string)
+		letter.Source, _ = headers[headerDeadLetterSource].(string)
+		if at, ok := headers[headerDeadLetterAt].(string); ok {
+			if failedAt, err := time.Parse(time.RFC3339Nano, at); err == nil {
+				letter.FailedAt = failedAt
+			}
+		}
+	} else {
+		// Dead-lettered by the broker: expired or rejected.
+		letter.Reason = domain.DeadLetterReasonRejected
+		if reason, ok := headers["x-first-death-reason"].(string); ok && reason == "expired" {
+			letter.Reason = domain.DeadLetterReasonExpired
+		}
+		if queue, ok := headers["x-first-death-queue"].(string); ok {
+			letter.Source = "rabbitmq:" + queue
+		}
+		if deaths, ok := headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+			if death, ok := deaths[0].(amqp.Table); ok {
+				if at, ok := death["time"].(time.Time); ok {
+					letter.FailedAt = at
+				}
+			}
+		}
+	}
+
+	setDeadLetterPayload(letter, delivery.Body)
+	return letter
+}
+
+// setDeadLetterPayload keeps a JSON body as JSON and anything else as text.
+func setDeadLetterPayload(letter *domain.DeadLetter, body []byte) {
+	if json.Valid(body) {
+		letter.Payload = json.RawMessage(body)
+	} else {
+		letter.RawPayload = string(body)
+	}
+}
+
+// deliveryCount returns how many times a message has been delivered,
+// including the current delivery.
+func deliveryCount(headers amqp.Table) int {
+	switch count := headers[headerDeliveries].(type) {
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	case int:
+		return count
+	default:
+		return 1
+	}
+}
+
+func copyTable(table amqp.Table) amqp.Table {
+	copied := make(amqp.Table, len(table)+1)
+	for key, value := range table {
+		copied[key] = value
+	}
+	return copied
+}
@@ -3,6 +3,7 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"sync"
@@ -10,8 +11,15 @@ import (
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
-	"log"
+	"log/slog"
 	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"smat/iot/simulation/iot-inventory-management/internal/spool"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type rabbitMQService struct {
@@ -21,18 +29,57 @@ type rabbitMQService struct {
 	config          *config.Config
 	mu              sync.RWMutex
 	reconnecting    atomic.Bool
+	activeConsumers atomic.Int32
 	closeChan       chan struct{}
 	closeOnce       sync.Once
 	notifyConnClose chan *amqp.Error
 	consumerTag     string
+
+	// Publish settings can be changed at runtime through ApplySettings.
+	publishTimeout atomic.Int64
+	confirmTimeout atomic.Int64
+	publishRetries atomic.Int32
+	maxDeliveries  atomic.Int32
+
+	// Publishes waiting for their confirmation, by publish sequence number,
+	// so a basic.return can be matched to its publish.
+	publishSeq     atomic.Int64
+	pendingReturns sync.Map
+	returns        *returnHandler
+
+	// deadLetterScan serializes browsing the dead-letter queue.
+	deadLetterScan sync.Mutex
+
+	// spool buffers publishes while the broker is unreachable; nil
+	// disables buffering.
+	spool *spool.Spool
 }
 
-func NewRabbitMQService(cfg *config.Config) RabbitMQService {
-	return &rabbitMQService{
+// NewRabbitMQService creates the RabbitMQ client. When outbox is not nil,
+// events that cannot be published are written to it and replayed in order
+// once the broker is back.
+func NewRabbitMQService(cfg *config.Config, outbox *spool.Spool) MessageBus {
+	s := &rabbitMQService{
 		config:      cfg,
 		closeChan:   make(chan struct{}),
 		consumerTag: fmt.Sprintf("consumer-%d", time.Now().Unix()),
+		spool:       outbox,
+	}
+	s.ApplySettings(cfg)
+	if outbox != nil {
+		go s.runSpoolReplayer()
 	}
+	return s
+}
+
+// ApplySettings updates the publish and confirm timeouts, the retry count
+// and the number of deliveries before a failing message is dead-lettered. Publishes already
+// in flight finish with the values they started with.
+func (s *rabbitMQService) ApplySettings(cfg *config.Config) {
+	s.publishTimeout.Store(int64(cfg.RabbitMQPublishTimeout))
+	s.confirmTimeout.Store(int64(cfg.RabbitMQConfirmTimeout))
+	s.publishRetries.Store(int32(cfg.RabbitMQPublishRetries))
+	s.maxDeliveries.Store(int32(cfg.RabbitMQMaxDeliveries))
 }
 
 func (s *rabbitMQService) Connect() error {
@@ -52,14 +99,14 @@ func (s *rabbitMQService) connectWithRetry() error {
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if err := s.establishConnection(); err == nil {
-			log.Println("Successfully connected to RabbitMQ")
+			slog.Info("Successfully connected to RabbitMQ")
 			return nil
 		} else if attempt == maxRetries-1 {
 			return fmt.Errorf("failed to connect to RabbitMQ after %d attempts: %w", maxRetries, err)
 		} else {
 			delay := s.calculateBackoff(attempt, baseDelay, maxDelay)
-			log.Printf("Failed to connect to RabbitMQ (attempt %d/%d): %v. Retrying in %v...",
-				attempt+1, maxRetries, err, delay)
+			slog.Warn("Failed to connect to RabbitMQ, retrying",
+				"attempt", attempt+1, "max_attempts", maxRetries, "retry_in", delay.String(), "error", err)
 
 			select {
 			case <-time.After(delay):
@@ -112,10 +159,20 @@ func (s *rabbitMQService) establishConnection() error {
 		return fmt.Errorf("failed to open channel: %w", err)
 	}
 
+	// Publishes are only treated as delivered once the broker confirms them.
+	if err := channel.Confirm(false); err != nil {
+		channel.Close()
+		conn.Close()
+		return fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+	returns := newReturnHandler(&s.pendingReturns, channel.NotifyReturn(make(chan amqp.Return)))
+
+	// Messages stay unacked until they are fully processed, so the
+	// prefetch count bounds the messages in flight across all workers.
 	err = channel.Qos(
-		1,     // prefetch count
-		0,     // prefetch size
-		false, // global
+		s.config.RabbitMQPrefetch, // prefetch count
+		0,                         // prefetch size
+		false,                     // global
 	)
 	if err != nil {
 		channel.Close()
@@ -123,24 +180,16 @@ func (s *rabbitMQService) establishConnection() error {
 		return fmt.Errorf("failed to set QoS: %w", err)
 	}
 
-	queue, err := channel.QueueDeclare(
-		s.config.RabbitMQQueue,
-		true,  // durable
-		false, // delete when unused
-		false, // exclusive
-		false, // no-wait
-		amqp.Table{
-			"x-message-ttl": 3600000, // 1 hour TTL for messages
-		},
-	)
+	queue, err := s.declareTopology(conn, channel)
 	if err != nil {
 		channel.Close()
 		conn.Close()
-		return fmt.Errorf("failed to declare queue: %w", err)
+		return err
 	}
 
 	s.conn = conn
 	s.channel = channel
+	s.returns = returns
 	s.queue = queue
 	s.reconnecting.Store(false)
 
@@ -157,7 +206,8 @@ func (s *rabbitMQService) handleReconnect() {
 			return
 		case err := <-s.notifyConnClose:
 			if err != nil {
-				log.Printf("RabbitMQ connection lost: %v", err)
+				slog.Warn("RabbitMQ connection lost", "error", err)
+				metrics.RabbitMQReconnects.Inc()
 				s.reconnect()
 			}
 		}
@@ -173,55 +223,94 @@ func (s *rabbitMQService) reconnect() {
 		case <-s.closeChan:
 			return
 		default:
-			log.Println("Attempting to reconnect to RabbitMQ...")
+			slog.Info("Attempting to reconnect to RabbitMQ")
 
 			if err := s.connectWithRetry(); err != nil {
-				log.Printf("Reconnection failed: %v. Retrying in 5 seconds...", err)
+				slog.Error("Reconnection to RabbitMQ failed, retrying in 5 seconds", "error", err)
 				time.Sleep(5 * time.Second)
 				continue
 			}
 
-			log.Println("Successfully reconnected to RabbitMQ")
+			slog.Info("Successfully reconnected to RabbitMQ")
 			return
 		}
 	}
 }
 
-func (s *rabbitMQService) PublishMessage(message []byte) error {
-	return s.PublishMessageWithContext(context.Background(), message)
+// Publish publishes message to the exchange with routingKey; see
+// RoutingKey. If the broker cannot take it and the spool is enabled, the
+// message is spooled instead and nil is returned.
+func (s *rabbitMQService) Publish(ctx context.Context, routingKey string, message []byte) error {
+	if s.spool == nil {
+		return s.publishTraced(ctx, s.config.RabbitMQExchange, routingKey, message)
+	}
+
+	// While anything is spooled, new messages queue up behind it so they
+	// reach the broker in order.
+	if s.spool.Pending() == 0 && s.HealthCheck() == nil {
+		err := s.publishTraced(ctx, s.config.RabbitMQExchange, routingKey, message)
+		if err == nil || errors.Is(err, ErrPublishReturned) {
+			return err
+		}
+		slog.WarnContext(ctx, "Failed to publish to RabbitMQ, spooling message", "error", err)
+	}
+	return s.spoolMessage(ctx, routingKey, message)
 }
 
-func (s *rabbitMQService) PublishMessageWithContext(ctx context.Context, message []byte) error {
-	if s.reconnecting.Load() {
-		return fmt.Errorf("connection is being reestablished")
+func (s *rabbitMQService) publishTraced(ctx context.Context, exchange, routingKey string, message []byte) error {
+	destination := exchange
+	if destination == "" {
+		destination = routingKey
 	}
+	ctx, span := telemetry.Tracer().Start(ctx, "rabbitmq.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.destination.name", destination),
+			attribute.String("messaging.rabbitmq.destination.routing_key", routingKey),
+		),
+	)
+	defer span.End()
 
-	s.mu.RLock()
-	channel := s.channel
-	queueName := s.queue.Name
-	s.mu.RUnlock()
+	start := time.Now()
+	err := s.publish(ctx, exchange, routingKey, message)
+	metrics.RabbitMQPublishDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.RabbitMQPublishFailures.Inc()
+		telemetry.RecordError(span, err)
+	}
+	return err
+}
 
-	if channel == nil {
-		return fmt.Errorf("channel is not initialized")
+func (s *rabbitMQService) publish(ctx context.Context, exchange, routingKey string, message []byte) error {
+	if s.reconnecting.Load() {
+		return fmt.Errorf("connection is being reestablished")
 	}
 
 	if _, ok := ctx.Deadline(); !ok {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, 5*time.Second)
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.publishTimeout.Load()))
 		defer cancel()
 	}
 
-	maxRetries := 3
+	headers := amqp.Table{}
+	for key, value := range telemetry.Inject(ctx) {
+		headers[key] = value
+	}
+	messageID := messageIDFromPayload(message)
+
+	maxRetries := int(s.publishRetries.Load())
+	var err error
 	for i := 0; i < maxRetries; i++ {
-		err := channel.PublishWithContext(
+		err = s.publishConfirmed(
 			ctx,
-			"",        // exchange
-			queueName, // routing key
-			false,     // mandatory
-			false,     // immediate
+			exchange,
+			routingKey,
 			amqp.Publishing{
 				DeliveryMode: amqp.Persistent, // Make message persistent
 				ContentType:  "application/json",
+				MessageId:    messageID,
+				Headers:      headers,
 				Body:         message,
 				Timestamp:    time.Now(),
 			},
@@ -231,7 +320,13 @@ func (s *rabbitMQService) PublishMessageWithContext(ctx context.Context, message
 			return nil
 		}
 
+		// Retrying cannot make an unroutable message routable.
+		if errors.Is(err, ErrPublishReturned) {
+			return err
+		}
+
 		if i < maxRetries-1 {
+			metrics.RabbitMQPublishRetries.Inc()
 			select {
 			case <-ctx.Done():
 				return fmt.Errorf("publish cancelled: %w", ctx.Err())
@@ -241,10 +336,10 @@ func (s *rabbitMQService) PublishMessageWithContext(ctx context.Context, message
 		}
 	}
 
-	return fmt.Errorf("failed to publish message after %d attempts", maxRetries)
+	return fmt.Errorf("failed to publish message after %d attempts: %w", maxRetries, err)
 }
 
-func (s *rabbitMQService) ConsumeMessages() (<-chan []byte, error) {
+func (s *rabbitMQService) Subscribe() (<-chan QueueMessage, error) {
 	s.mu.RLock()
 	channel := s.channel
 	queueName := s.queue.Name
@@ -267,14 +362,16 @@ func (s *rabbitMQService) ConsumeMessages() (<-chan []byte, error) {
 		return nil, fmt.Errorf("failed to register consumer: %w", err)
 	}
 
-	messageChan := make(chan []byte, 100) // Buffered channel
+	messageChan := make(chan QueueMessage, 100) // Buffered channel
 
 	go s.processMessages(msgs, messageChan)
 
 	return messageChan, nil
 }
 
-func (s *rabbitMQService) processMessages(msgs <-chan amqp.Delivery, output chan<- []byte) {
+func (s *rabbitMQService) processMessages(msgs <-chan amqp.Delivery, output chan<- QueueMessage) {
+	s.activeConsumers.Add(1)
+	defer s.activeConsumers.Add(-1)
 	defer close(output)
 
 	for {
@@ -283,65 +380,58 @@ func (s *rabbitMQService) processMessages(msgs <-chan amqp.Delivery, output chan
 			return
 		case msg, ok := <-msgs:
 			if !ok {
-				log.Println("Consumer channel closed, attempting to re-consume...")
-				s.handleConsumerReconnect(output)
+				// Closing output tells the caller to consume again once
+				// the connection is back.
+				slog.Warn("Consumer channel closed")
 				return
 			}
 
+			metrics.RabbitMQMessagesConsumed.Inc()
+
+			// The consumer settles the message once it has been processed.
+			delivery := &rabbitDelivery{service: s, delivery: msg}
+			queueMessage := QueueMessage{
+				Body:          msg.Body,
+				Headers:       stringHeaders(msg.Headers),
+				Redelivered:   msg.Redelivered,
+				DeliveryCount: deliveryCount(msg.Headers),
+				acker:         delivery,
+			}
 			select {
-			case output <- msg.Body:
-				if err := msg.Ack(false); err != nil {
-					log.Printf("Failed to acknowledge message: %v", err)
-				}
+			case output <- queueMessage:
 			case <-time.After(5 * time.Second):
-				log.Printf("Timeout sending message to output channel")
-				if err := msg.Nack(false, true); err != nil {
-					log.Printf("Failed to nack message: %v", err)
+				// Counts as a failed delivery, so a message that keeps
+				// timing out is dead-lettered instead of cycling forever.
+				slog.Warn("Timeout sending message to output channel", "message_id", msg.MessageId)
+				if _, err := delivery.Retry(context.Background(), errConsumerTimeout); err != nil {
+					slog.Error("Failed to requeue message", "message_id", msg.MessageId, "error", err)
 				}
 			}
 		}
 	}
 }
 
-func (s *rabbitMQService) handleConsumerReconnect(output chan<- []byte) {
-	for {
-		select {
-		case <-s.closeChan:
-			return
-		default:
-			if s.reconnecting.Load() {
-				time.Sleep(1 * time.Second)
-				continue
-			}
-
-			newMsgs, err := s.ConsumeMessages()
-			if err != nil {
-				log.Printf("Failed to re-establish consumer: %v", err)
-				time.Sleep(5 * time.Second)
-				continue
-			}
-
-			go func() {
-				for msg := range newMsgs {
-					select {
-					case output <- msg:
-					case <-s.closeChan:
-						return
-					}
-				}
-			}()
-
-			return
-		}
+// messageIDFromPayload returns the message_id field of a JSON payload, if any.
+func messageIDFromPayload(payload []byte) string {
+	var envelope struct {
+		MessageID string `json:"message_id"`
 	}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return ""
+	}
+	return envelope.MessageID
 }
 
-func (s *rabbitMQService) PublishJSON(v interface{}) error {
-	data, err := json.Marshal(v)
-	if err != nil {
-		return fmt.Errorf("failed to marshal JSON: %w", err)
+// stringHeaders keeps the string-valued AMQP headers, which is all the
+// application sets.
+func stringHeaders(table amqp.Table) map[string]string {
+	headers := make(map[string]string, len(table))
+	for key, value := range table {
+		if str, ok := value.(string); ok {
+			headers[key] = str
+		}
 	}
-	return s.PublishMessage(data)
+	return headers
 }
 
 func (s *rabbitMQService) HealthCheck() error {
@@ -363,7 +453,12 @@ func (s *rabbitMQService) HealthCheck() error {
 	return nil
 }
 
-func (s *rabbitMQService) GetQueueInfo() (*amqp.Queue, error) {
+// IsConsuming reports whether a consumer is currently attached to the queue.
+func (s *rabbitMQService) IsConsuming() bool {
+	return s.activeConsumers.Load() > 0
+}
+
+func (s *rabbitMQService) QueueStats() (*domain.QueueStats, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -376,12 +471,16 @@ func (s *rabbitMQService) GetQueueInfo() (*amqp.Queue, error) {
 		return nil, fmt.Errorf("failed to inspect queue: %w", err)
 	}
 
-	return &queue, nil
+	return &domain.QueueStats{
+		Queue:     queue.Name,
+		Messages:  queue.Messages,
+		Consumers: queue.Consumers,
+	}, nil
 }
 
 func (s *rabbitMQService) Close() {
 	s.closeOnce.Do(func() {
-		log.Println("Closing RabbitMQ connection...")
+		slog.Info("Closing RabbitMQ connection")
 
 		// Signal all goroutines to stop
 		close(s.closeChan)
@@ -406,6 +505,6 @@ func (s *rabbitMQService) Close() {
 			s.conn = nil
 		}
 
-		log.Println("RabbitMQ connection closed")
+		slog.Info("RabbitMQ connection closed")
 	})
 }
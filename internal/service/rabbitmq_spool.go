@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// spoolReplayInterval is how often the spool is checked for messages to
+// replay once RabbitMQ is reachable again.
+const spoolReplayInterval = time.Second
+
+// encodeSpoolRecord stores a message as a 2-byte routing key length, the
+// routing key and the body.
+func encodeSpoolRecord(routingKey string, body []byte) []byte {
+	record := make([]byte, 2+len(routingKey)+len(body))
+	binary.BigEndian.PutUint16(record, uint16(len(routingKey)))
+	copy(record[2:], routingKey)
+	copy(record[2+len(routingKey):], body)
+	return record
+}
+
+func decodeSpoolRecord(record []byte) (string, []byte, error) {
+	if len(record) < 2 {
+		return "", nil, errors.New("record too short")
+	}
+	keyLength := int(binary.BigEndian.Uint16(record))
+	if len(record) < 2+keyLength {
+		return "", nil, errors.New("routing key truncated")
+	}
+	return string(record[2 : 2+keyLength]), record[2+keyLength:], nil
+}
+
+// spoolMessage buffers a message the broker could not take.
+func (s *rabbitMQService) spoolMessage(ctx context.Context, routingKey string, message []byte) error {
+	if err := s.spool.Append(encodeSpoolRecord(routingKey, message)); err != nil {
+		return fmt.Errorf("failed to spool message: %w", err)
+	}
+	slog.DebugContext(ctx, "Spooled message while RabbitMQ is unavailable", "routing_key", routingKey, "pending", s.spool.Pending())
+	return nil
+}
+
+// runSpoolReplayer publishes spooled messages, oldest first, whenever the
+// connection is up, until the service is closed.
+func (s *rabbitMQService) runSpoolReplayer() {
+	ticker := time.NewTicker(spoolReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closeChan:
+			return
+		case <-ticker.C:
+			s.replaySpool()
+		}
+	}
+}
+
+func (s *rabbitMQService) replaySpool() {
+	if s.spool.Pending() == 0 || s.HealthCheck() != nil {
+		return
+	}
+
+	replayed, err := s.spool.Replay(func(record []byte) error {
+		routingKey, body, err := decodeSpoolRecord(record)
+		if err != nil {
+			slog.Error("Discarding unreadable spool record", "error", err)
+			return nil
+		}
+
+		err = s.publishTraced(context.Background(), s.config.RabbitMQExchange, routingKey, body)
+		if errors.Is(err, ErrPublishReturned) {
+			// Nothing is bound to the routing key; a direct publish would
+			// have failed the same way.
+			slog.Warn("Discarding unroutable spooled message", "routing_key", routingKey)
+			return nil
+		}
+		return err
+	})
+
+	if replayed > 0 {
+		slog.Info("Replayed spooled messages", "replayed", replayed, "pending", s.spool.Pending())
+	}
+	if err != nil {
+		slog.Warn("Spool replay interrupted, retrying", "pending", s.spool.Pending(), "error", err)
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// RoutingKey builds the routing key a device event is published with:
+// tenant.<client>.device.<device>.<event>. An unknown client is published
+// as "unknown" so the key keeps its shape.
+func RoutingKey(clientID, deviceID, event string) string {
+	return fmt.Sprintf("tenant.%s.device.%s.%s", routingKeySegment(clientID), routingKeySegment(deviceID), routingKeySegment(event))
+}
+
+// routingKeySegment keeps a value to a single routing key word.
+func routingKeySegment(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return strings.NewReplacer(".", "_", "*", "_", "#", "_").Replace(value)
+}
+
+// routingKeyForPayload derives the routing key of a device message from its
+// client_id, device_id and event fields. Messages without an event are
+// telemetry.
+func routingKeyForPayload(payload []byte) string {
+	var envelope struct {
+		DeviceID string `json:"device_id"`
+		ClientID string `json:"client_id"`
+		Event    string `json:"event"`
+	}
+	_ = json.Unmarshal(payload, &envelope)
+
+	if envelope.Event == "" {
+		envelope.Event = domain.DeviceEventTelemetry
+	}
+	return RoutingKey(envelope.ClientID, envelope.DeviceID, envelope.Event)
+}
+
+// declareTopology declares the topic exchange, the dead-letter queue and
+// every configured queue with its bindings, and returns the queue this
+// server consumes. All declarations are idempotent, so this runs on every
+// (re)connect. Bindings removed from the configuration are not unbound.
+func (s *rabbitMQService) declareTopology(conn *amqp.Connection, channel *amqp.Channel) (amqp.Queue, error) {
+	var consumerQueue amqp.Queue
+
+	if err := channel.ExchangeDeclare(s.config.RabbitMQExchange, amqp.ExchangeTopic, true, false, false, false, nil); err != nil {
+		return consumerQueue, fmt.Errorf("failed to declare exchange %s: %w", s.config.RabbitMQExchange, err)
+	}
+
+	if err := s.declareDeadLetterQueue(channel); err != nil {
+		return consumerQueue, err
+	}
+
+	for _, binding := range s.config.RabbitMQBindings {
+		args := amqp.Table{
+			"x-message-ttl": 3600000, // 1 hour TTL for messages
+		}
+		if binding.Queue == s.config.RabbitMQQueue {
+			// Expired and rejected messages go to the dead-letter queue.
+			args["x-dead-letter-exchange"] = s.deadLetterExchangeName()
+			args["x-dead-letter-routing-key"] = s.config.RabbitMQQueue
+		}
+
+		var queue amqp.Queue
+		var err error
+		if binding.Queue == s.config.RabbitMQQueue {
+			queue, err = s.declareConsumerQueue(conn, channel, args)
+		} else {
+			queue, err = channel.QueueDeclare(
+				binding.Queue,
+				true,  // durable
+				false, // delete when unused
+				false, // exclusive
+				false, // no-wait
+				args,
+			)
+		}
+		if err != nil {
+			return consumerQueue, fmt.Errorf("failed to declare queue %s: %w", binding.Queue, err)
+		}
+		if binding.Queue == s.config.RabbitMQQueue {
+			consumerQueue = queue
+		}
+
+		for _, pattern := range binding.Patterns {
+			if err := channel.QueueBind(binding.Queue, pattern, s.config.RabbitMQExchange, false, nil); err != nil {
+				return consumerQueue, fmt.Errorf("failed to bind queue %s to %s: %w", binding.Queue, pattern, err)
+			}
+		}
+	}
+
+	return consumerQueue, nil
+}
+
+// declareConsumerQueue declares the consumer queue with its dead-letter
+// arguments. RabbitMQ refuses to redeclare a queue with different arguments
+// and closes the channel that tried, so the declaration is tried on a
+// channel of its own. A queue created by an older version without them is
+// kept as it is: the server still dead-letters the messages it cannot
+// process, only expired messages are dropped by the broker unless a policy
+// dead-letters them.
+func (s *rabbitMQService) declareConsumerQueue(conn *amqp.Connection, channel *amqp.Channel, args amqp.Table) (amqp.Queue, error) {
+	name := s.config.RabbitMQQueue
+
+	probe, err := conn.Channel()
+	if err != nil {
+		return amqp.Queue{}, fmt.Errorf("failed to open channel: %w", err)
+	}
+	_, err = probe.QueueDeclare(name, true, false, false, false, args)
+	// The channel is already closed if the declaration was refused.
+	_ = probe.Close()
+
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+		slog.Warn("Consumer queue was created without dead-letter arguments, expired messages are not dead-lettered unless a policy sets them",
+			"queue", name,
+			"error", amqpErr.Reason,
+			"fix", fmt.Sprintf(`rabbitmqctl set_policy %s-dlx '^%s$' '{"dead-letter-exchange":"%s","dead-letter-routing-key":"%s"}' --apply-to queues`,
+				name, regexp.QuoteMeta(name), s.deadLetterExchangeName(), name),
+		)
+	} else if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	// The queue exists now; a passive declaration does not compare
+	// arguments.
+	return channel.QueueDeclarePassive(name, true, false, false, false, nil)
+}
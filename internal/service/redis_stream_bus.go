@@ -0,0 +1,628 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// Stream entry fields. Trace headers are stored as "h:<header>".
+	redisFieldTopic      = "topic"
+	redisFieldBody       = "body"
+	redisFieldMessageID  = "message_id"
+	redisFieldDeliveries = headerDeliveries
+	redisHeaderPrefix    = "h:"
+
+	// redisReadCount and redisReadBlock bound a single XREADGROUP, so the
+	// read loop notices Close and runs the reclaim in between.
+	redisReadCount = 100
+	redisReadBlock = 2 * time.Second
+	// redisAdminTimeout bounds group management and stats requests.
+	redisAdminTimeout = 5 * time.Second
+)
+
+// redisStreamBus is a MessageBus on Redis Streams, for deployments that
+// already run Redis and do not want a broker. Every queue in
+// RABBITMQ_BINDINGS is a stream <REDIS_STREAM_PREFIX>:<queue> with a consumer
+// group of the same name; a publish is added to the stream of every queue
+// whose patterns match. Streams are trimmed to about REDIS_STREAM_MAX_LEN
+// entries.
+//
+// Entries a consumer read but never acked, because it crashed or was
+// stopped, are taken over with XAUTOCLAIM once they have been idle for
+// REDIS_STREAM_CLAIM_IDLE. Before every reclaim a consumer resets the idle
+// time of the entries it is still processing, so neither it nor another
+// server takes them over while they are in progress.
+type redisStreamBus struct {
+	config   *config.Config
+	client   *redis.Client
+	consumer string
+
+	// ctx is cancelled on Close to stop the read loops.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// inflight limits the entries handed to the consumer and not settled
+	// yet to RABBITMQ_PREFETCH.
+	inflight chan struct{}
+	// processing holds the IDs of the entries handed to the consumer and
+	// not settled yet.
+	processing sync.Map
+
+	connected       atomic.Bool
+	publishTimeout  atomic.Int64
+	maxDeliveries   atomic.Int32
+	activeConsumers atomic.Int32
+	closeOnce       sync.Once
+}
+
+func NewRedisStreamBus(cfg *config.Config, client *redis.Client) MessageBus {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	b := &redisStreamBus{
+		config:   cfg,
+		client:   client,
+		consumer: instanceName(),
+		ctx:      ctx,
+		cancel:   cancel,
+		inflight: make(chan struct{}, cfg.RabbitMQPrefetch),
+	}
+	b.ApplySettings(cfg)
+	return b
+}
+
+// ApplySettings updates the publish timeout and the number of deliveries
+// before a failing message is dead-lettered.
+func (b *redisStreamBus) ApplySettings(cfg *config.Config) {
+	b.publishTimeout.Store(int64(cfg.RabbitMQPublishTimeout))
+	b.maxDeliveries.Store(int32(cfg.RabbitMQMaxDeliveries))
+}
+
+// Connect creates the stream and consumer group of every queue. Existing
+// groups keep their position.
+func (b *redisStreamBus) Connect() error {
+	ctx, cancel := context.WithTimeout(b.ctx, redisAdminTimeout)
+	defer cancel()
+
+	for _, binding := range b.config.RabbitMQBindings {
+		if err := b.createGroup(ctx, binding.Queue); err != nil {
+			return err
+		}
+	}
+	b.connected.Store(true)
+	return nil
+}
+
+func (b *redisStreamBus) createGroup(ctx context.Context, queue string) error {
+	err := b.client.XGroupCreateMkStream(ctx, b.streamKey(queue), queue, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create consumer group %s: %w", queue, err)
+	}
+	return nil
+}
+
+func (b *redisStreamBus) streamKey(queue string) string {
+	return b.config.RedisStreamPrefix + ":" + queue
+}
+
+func (b *redisStreamBus) deadLetterKey() string {
+	return b.streamKey(b.config.RabbitMQQueue) + ":dlq"
+}
+
+// Publish adds message to the stream of every queue bound to topic. Topics
+// no queue is bound to fail with ErrPublishReturned, as they do with
+// RabbitMQ.
+func (b *redisStreamBus) Publish(ctx context.Context, topic string, message []byte) error {
+	var queues []string
+	for _, binding := range b.config.RabbitMQBindings {
+		if matchesAnyTopic(binding.Patterns, topic) {
+			queues = append(queues, binding.Queue)
+		}
+	}
+	if len(queues) == 0 {
+		return fmt.Errorf("%w: routing key %q", ErrPublishReturned, topic)
+	}
+
+	ctx, span := telemetry.Tracer().Start(ctx, "redis.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "redis"),
+			attribute.String("messaging.destination.name", topic),
+		),
+	)
+	defer span.End()
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(b.publishTimeout.Load()))
+		defer cancel()
+	}
+
+	values := entryValues(ctx, topic, message, 1)
+	_, err := b.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, queue := range queues {
+			pipe.XAdd(ctx, b.addArgs(b.streamKey(queue), values))
+		}
+		return nil
+	})
+	if err != nil {
+		telemetry.RecordError(span, err)
+		return fmt.Errorf("failed to add to stream: %w", err)
+	}
+	return nil
+}
+
+func (b *redisStreamBus) addArgs(stream string, values map[string]any) *redis.XAddArgs {
+	return &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: int64(b.config.RedisStreamMaxLen),
+		Approx: true,
+		Values: values,
+	}
+}
+
+// entryValues builds the fields of a stream entry, with the trace context of
+// ctx.
+func entryValues(ctx context.Context, topic string, message []byte, deliveries int) map[string]any {
+	values := map[string]any{
+		redisFieldTopic:      topic,
+		redisFieldBody:       message,
+		redisFieldDeliveries: deliveries,
+	}
+	if messageID := messageIDFromPayload(message); messageID != "" {
+		values[redisFieldMessageID] = messageID
+	}
+	for key, value := range telemetry.Inject(ctx) {
+		values[redisHeaderPrefix+key] = value
+	}
+	return values
+}
+
+func (b *redisStreamBus) Subscribe() (<-chan QueueMessage, error) {
+	if !b.connected.Load() {
+		return nil, errors.New("consumer group is not created yet")
+	}
+	if err := b.HealthCheck(); err != nil {
+		return nil, err
+	}
+
+	output := make(chan QueueMessage, 100)
+	go b.processMessages(output)
+	return output, nil
+}
+
+// processMessages reads new entries for this consumer and, every
+// REDIS_STREAM_CLAIM_INTERVAL, takes over the entries other consumers left
+// pending.
+func (b *redisStreamBus) processMessages(output chan<- QueueMessage) {
+	b.activeConsumers.Add(1)
+	defer b.activeConsumers.Add(-1)
+	defer close(output)
+
+	stream := b.streamKey(b.config.RabbitMQQueue)
+	claimTicker := time.NewTicker(b.config.RedisStreamClaimInterval)
+	defer claimTicker.Stop()
+
+	// Entries this consumer left pending before a restart are reclaimed
+	// first.
+	if !b.reclaim(output) {
+		return
+	}
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-claimTicker.C:
+			if !b.reclaim(output) {
+				return
+			}
+		default:
+		}
+
+		streams, err := b.client.XReadGroup(b.ctx, &redis.XReadGroupArgs{
+			Group:    b.config.RabbitMQQueue,
+			Consumer: b.consumer,
+			Streams:  []string{stream, ">"},
+			Count:    redisReadCount,
+			Block:    redisReadBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if b.ctx.Err() != nil {
+				return
+			}
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				// The stream was deleted; closing output makes the caller
+				// subscribe again once Connect has recreated it.
+				slog.Warn("Redis consumer group is gone", "stream", stream, "error", err)
+				b.connected.Store(false)
+				go b.recreateGroup()
+				return
+			}
+			slog.Warn("Failed to read from Redis stream", "stream", stream, "error", err)
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		for _, result := range streams {
+			for _, entry := range result.Messages {
+				if !b.deliver(output, entry, 0) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *redisStreamBus) recreateGroup() {
+	if err := b.Connect(); err != nil {
+		slog.Warn("Failed to recreate Redis consumer group", "error", err)
+	}
+}
+
+// reclaim takes over the consumer queue's entries that have been pending for
+// REDIS_STREAM_CLAIM_IDLE and delivers them again. It returns false once the
+// bus is closed.
+func (b *redisStreamBus) reclaim(output chan<- QueueMessage) bool {
+	defer b.updateStreamMetrics()
+
+	stream := b.streamKey(b.config.RabbitMQQueue)
+	b.touchProcessing(stream)
+	for start := "0-0"; ; {
+		entries, next, err := b.client.XAutoClaim(b.ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    b.config.RabbitMQQueue,
+			Consumer: b.consumer,
+			MinIdle:  b.config.RedisStreamClaimIdle,
+			Start:    start,
+			Count:    redisReadCount,
+		}).Result()
+		if err != nil {
+			if b.ctx.Err() != nil {
+				return false
+			}
+			slog.Warn("Failed to reclaim pending entries", "stream", stream, "error", err)
+			return true
+		}
+
+		entries = b.skipProcessing(entries)
+		if len(entries) > 0 {
+			metrics.RedisStreamReclaimed.Add(float64(len(entries)))
+			slog.Info("Reclaimed pending entries", "stream", stream, "count", len(entries))
+			claims := b.claimCounts(entries)
+			for _, entry := range entries {
+				if !b.deliver(output, entry, claims[entry.ID]) {
+					return false
+				}
+			}
+		}
+
+		if next == "0-0" || next == "" {
+			break
+		}
+		start = next
+	}
+
+	b.removeIdleConsumers(stream)
+	return true
+}
+
+// touchProcessing resets the idle time of the entries this consumer is still
+// processing, so they are not reclaimed as abandoned. JUSTID leaves their
+// delivery counts alone.
+func (b *redisStreamBus) touchProcessing(stream string) {
+	var ids []string
+	b.processing.Range(func(id, _ any) bool {
+		ids = append(ids, id.(string))
+		return true
+	})
+	if len(ids) == 0 {
+		return
+	}
+
+	err := b.client.XClaimJustID(b.ctx, &redis.XClaimArgs{
+		Stream:   stream,
+		Group:    b.config.RabbitMQQueue,
+		Consumer: b.consumer,
+		Messages: ids,
+	}).Err()
+	if err != nil && b.ctx.Err() == nil {
+		slog.Warn("Failed to refresh entries in progress", "stream", stream, "error", err)
+	}
+}
+
+// skipProcessing drops the reclaimed entries this consumer is still
+// processing, in case touchProcessing failed or an entry outlived
+// REDIS_STREAM_CLAIM_IDLE on its own.
+func (b *redisStreamBus) skipProcessing(entries []redis.XMessage) []redis.XMessage {
+	reclaimed := entries[:0]
+	for _, entry := range entries {
+		if _, ok := b.processing.Load(entry.ID); !ok {
+			reclaimed = append(reclaimed, entry)
+		}
+	}
+	return reclaimed
+}
+
+// claimCounts returns how often each reclaimed entry has been delivered by
+// the consumer group before this delivery.
+func (b *redisStreamBus) claimCounts(entries []redis.XMessage) map[string]int {
+	counts := make(map[string]int, len(entries))
+	pending, err := b.client.XPendingExt(b.ctx, &redis.XPendingExtArgs{
+		Stream:   b.streamKey(b.config.RabbitMQQueue),
+		Group:    b.config.RabbitMQQueue,
+		Consumer: b.consumer,
+		Start:    entries[0].ID,
+		End:      entries[len(entries)-1].ID,
+		Count:    int64(len(entries)),
+	}).Result()
+	if err != nil {
+		slog.Warn("Failed to read delivery counts of reclaimed entries", "error", err)
+	}
+	for _, entry := range entries {
+		counts[entry.ID] = 1
+	}
+	for _, p := range pending {
+		counts[p.ID] = int(p.RetryCount) - 1
+	}
+	return counts
+}
+
+// removeIdleConsumers deletes consumers with nothing pending that have not
+// read for REDIS_STREAM_CLAIM_IDLE, so restarted servers do not pile up in
+// the group. A consumer that is still running is recreated by its next read.
+func (b *redisStreamBus) removeIdleConsumers(stream string) {
+	consumers, err := b.client.XInfoConsumers(b.ctx, stream, b.config.RabbitMQQueue).Result()
+	if err != nil {
+		return
+	}
+	for _, consumer := range consumers {
+		if consumer.Name == b.consumer || consumer.Pending > 0 || consumer.Idle < b.config.RedisStreamClaimIdle {
+			continue
+		}
+		if err := b.client.XGroupDelConsumer(b.ctx, stream, b.config.RabbitMQQueue, consumer.Name).Err(); err != nil {
+			slog.Warn("Failed to remove idle Redis consumer", "consumer", consumer.Name, "error", err)
+		}
+	}
+}
+
+// deliver hands entry to the consumer once a prefetch slot is free. claims
+// is how often the consumer group delivered the entry before. It returns
+// false once the bus is closed; the entry then stays pending and is
+// reclaimed later.
+func (b *redisStreamBus) deliver(output chan<- QueueMessage, entry redis.XMessage, claims int) bool {
+	select {
+	case b.inflight <- struct{}{}:
+	case <-b.ctx.Done():
+		return false
+	}
+
+	b.processing.Store(entry.ID, struct{}{})
+	delivery := newRedisStreamDelivery(b, entry, claims)
+	if entry.Values == nil {
+		// Trimmed from the stream while pending.
+		slog.Warn("Dropping pending entry trimmed from the stream", "id", entry.ID)
+		if err := delivery.Ack(); err != nil {
+			slog.Warn("Failed to ack trimmed entry", "id", entry.ID, "error", err)
+		}
+		return true
+	}
+
+	metrics.RedisStreamMessagesConsumed.Inc()
+
+	// An entry that keeps taking its consumer down is never settled;
+	// dead-letter it instead of delivering it again.
+	if claims > 0 && delivery.deliveries > int(b.maxDeliveries.Load()) {
+		if err := delivery.DeadLetter(b.ctx, domain.DeadLetterReasonMaxDeliveries, errors.New("entry was reclaimed too often")); err != nil {
+			slog.Error("Failed to dead-letter reclaimed entry", "id", entry.ID, "error", err)
+		}
+		return true
+	}
+
+	queueMessage := QueueMessage{
+		Body:          delivery.body,
+		Headers:       delivery.headers,
+		Redelivered:   delivery.deliveries > 1,
+		DeliveryCount: delivery.deliveries,
+		acker:         delivery,
+	}
+	select {
+	case output <- queueMessage:
+		return true
+	case <-b.ctx.Done():
+		delivery.release()
+		return false
+	case <-time.After(5 * time.Second):
+		slog.Warn("Timeout sending message to output channel", "id", entry.ID)
+		if _, err := delivery.Retry(b.ctx, errConsumerTimeout); err != nil {
+			slog.Error("Failed to requeue message", "id", entry.ID, "error", err)
+		}
+		return true
+	}
+}
+
+// redisStreamDelivery settles a stream entry. Retries add a new entry with
+// the delivery count raised and ack the old one in a single transaction.
+type redisStreamDelivery struct {
+	bus        *redisStreamBus
+	id         string
+	topic      string
+	body       []byte
+	headers    map[string]string
+	deliveries int
+	released   sync.Once
+}
+
+func newRedisStreamDelivery(b *redisStreamBus, entry redis.XMessage, claims int) *redisStreamDelivery {
+	d := &redisStreamDelivery{
+		bus:        b,
+		id:         entry.ID,
+		headers:    make(map[string]string),
+		deliveries: 1,
+	}
+	for key, value := range entry.Values {
+		text, _ := value.(string)
+		switch {
+		case key == redisFieldTopic:
+			d.topic = text
+		case key == redisFieldBody:
+			d.body = []byte(text)
+		case key == redisFieldDeliveries:
+			if deliveries, err := strconv.Atoi(text); err == nil && deliveries > 0 {
+				d.deliveries = deliveries
+			}
+		case strings.HasPrefix(key, redisHeaderPrefix):
+			d.headers[strings.TrimPrefix(key, redisHeaderPrefix)] = text
+		}
+	}
+	d.deliveries += claims
+	return d
+}
+
+// release frees the prefetch slot of the delivery.
+func (d *redisStreamDelivery) release() {
+	d.released.Do(func() {
+		d.bus.processing.Delete(d.id)
+		<-d.bus.inflight
+	})
+}
+
+func (d *redisStreamDelivery) stream() string {
+	return d.bus.streamKey(d.bus.config.RabbitMQQueue)
+}
+
+func (d *redisStreamDelivery) Ack() error {
+	defer d.release()
+	return d.bus.client.XAck(context.Background(), d.stream(), d.bus.config.RabbitMQQueue, d.id).Err()
+}
+
+func (d *redisStreamDelivery) Retry(ctx context.Context, cause error) (bool, error) {
+	if d.deliveries >= int(d.bus.maxDeliveries.Load()) {
+		return false, d.DeadLetter(ctx, domain.DeadLetterReasonMaxDeliveries, cause)
+	}
+	defer d.release()
+
+	values := entryValues(ctx, d.topic, d.body, d.deliveries+1)
+	return true, d.settle(ctx, d.bus.addArgs(d.stream(), values))
+}
+
+func (d *redisStreamDelivery) DeadLetter(ctx context.Context, reason string, cause error) error {
+	defer d.release()
+
+	source := "redis:" + d.bus.config.RabbitMQQueue
+	values := deadLetterValues(d.body, source, reason, cause, d.deliveries)
+	if err := d.settle(ctx, d.bus.addArgs(d.bus.deadLetterKey(), values)); err != nil {
+		// The entry stays pending and is reclaimed after
+		// REDIS_STREAM_CLAIM_IDLE.
+		return err
+	}
+	metrics.RedisStreamDeadLettered.WithLabelValues(reason).Inc()
+	return nil
+}
+
+// settle adds an entry and acks this delivery in one transaction, so the
+// message is neither lost nor duplicated if either fails.
+func (d *redisStreamDelivery) settle(ctx context.Context, add *redis.XAddArgs) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Duration(d.bus.publishTimeout.Load()))
+	defer cancel()
+
+	_, err := d.bus.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, add)
+		pipe.XAck(ctx, d.stream(), d.bus.config.RabbitMQQueue, d.id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to settle stream entry %s: %w", d.id, err)
+	}
+	return nil
+}
+
+func (b *redisStreamBus) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return b.client.Ping(ctx).Err()
+}
+
+// IsConsuming reports whether this server is reading from the consumer
+// group.
+func (b *redisStreamBus) IsConsuming() bool {
+	return b.activeConsumers.Load() > 0
+}
+
+// QueueStats reports the consumer group's lag as Messages, along with the
+// entries delivered but not acked and the length of the stream.
+func (b *redisStreamBus) QueueStats() (*domain.QueueStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisAdminTimeout)
+	defer cancel()
+
+	stream := b.streamKey(b.config.RabbitMQQueue)
+	groups, err := b.client.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect consumer groups: %w", err)
+	}
+	length, err := b.client.XLen(ctx, stream).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stream length: %w", err)
+	}
+
+	for _, group := range groups {
+		if group.Name != b.config.RabbitMQQueue {
+			continue
+		}
+		lag := group.Lag
+		if lag < 0 {
+			// Redis cannot tell the lag after entries were deleted from the
+			// middle of the stream; the length is an upper bound.
+			lag = length
+		}
+		return &domain.QueueStats{
+			Queue:        b.config.RabbitMQQueue,
+			Messages:     int(lag),
+			Consumers:    int(group.Consumers),
+			Pending:      int(group.Pending),
+			StreamLength: int(length),
+		}, nil
+	}
+	return nil, fmt.Errorf("consumer group %s does not exist", b.config.RabbitMQQueue)
+}
+
+func (b *redisStreamBus) updateStreamMetrics() {
+	stats, err := b.QueueStats()
+	if err != nil {
+		return
+	}
+	metrics.RedisStreamLag.Set(float64(stats.Messages))
+	metrics.RedisStreamPending.Set(float64(stats.Pending))
+	metrics.RedisStreamLength.Set(float64(stats.StreamLength))
+}
+
+// Close stops reading. Entries handed out and not settled yet stay pending
+// and are reclaimed by the next consumer. The Redis client is shared and
+// closed by its owner.
+func (b *redisStreamBus) Close() {
+	b.closeOnce.Do(func() {
+		slog.Info("Closing Redis stream consumer")
+		b.cancel()
+	})
+}
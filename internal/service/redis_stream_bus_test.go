@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"os"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestRedisStreamReclaimSkipsEntriesInProgress needs a Redis server at
+// REDIS_TEST_URL, e.g. redis://localhost:6379/15.
+func TestRedisStreamReclaimSkipsEntriesInProgress(t *testing.T) {
+	url := os.Getenv("REDIS_TEST_URL")
+	if url == "" {
+		t.Skip("REDIS_TEST_URL is not set")
+	}
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatalf("invalid REDIS_TEST_URL: %v", err)
+	}
+	client := redis.NewClient(options)
+
+	const queue = "inventory_updates"
+	claimIdle := 300 * time.Millisecond
+	cfg := &config.Config{
+		RedisStreamPrefix:        "iot-inventory-test-" + uuid.NewString(),
+		RedisStreamMaxLen:        1000,
+		RedisStreamClaimIdle:     claimIdle,
+		RedisStreamClaimInterval: time.Hour,
+		RabbitMQQueue:            queue,
+		RabbitMQBindings:         []config.QueueBinding{{Queue: queue, Patterns: []string{"tenant.#"}}},
+		RabbitMQPublishTimeout:   5 * time.Second,
+		RabbitMQMaxDeliveries:    3,
+		RabbitMQPrefetch:         10,
+	}
+	newBus := func(consumer string) *redisStreamBus {
+		b := NewRedisStreamBus(cfg, client).(*redisStreamBus)
+		b.consumer = consumer
+		if err := b.Connect(); err != nil {
+			t.Fatalf("Connect() error = %v", err)
+		}
+		t.Cleanup(b.Close)
+		return b
+	}
+	t.Cleanup(func() {
+		client.Del(context.Background(), cfg.RedisStreamPrefix+":"+queue, cfg.RedisStreamPrefix+":"+queue+":dlq")
+		client.Close()
+	})
+
+	b := newBus("worker")
+	messages, err := b.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if err := b.Publish(context.Background(), RoutingKey("client", "device", "sale"), []byte(`{"message_id": "m1"}`)); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	message := nextQueueMessage(t, messages)
+
+	// The message is still being processed after the claim idle time; no
+	// reclaim, by this server or another one, may deliver it again.
+	time.Sleep(2 * claimIdle)
+	reclaimed := make(chan QueueMessage, 1)
+	if !b.reclaim(reclaimed) {
+		t.Fatal("reclaim() = false on an open bus")
+	}
+	other := newBus("other")
+	if !other.reclaim(reclaimed) {
+		t.Fatal("reclaim() by another consumer = false on an open bus")
+	}
+	select {
+	case message := <-reclaimed:
+		t.Fatalf("entry in progress reclaimed: %s", message.Body)
+	default:
+	}
+
+	if err := message.Ack(); err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+	pending, err := client.XPending(context.Background(), b.streamKey(queue), queue).Result()
+	if err != nil || pending.Count != 0 {
+		t.Errorf("XPENDING after ack = %+v, %v, want nothing pending", pending, err)
+	}
+}
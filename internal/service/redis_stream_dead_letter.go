@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Dead letters are kept in the stream <consumer stream>:dlq, with the same
+// fields the RabbitMQ dead-letter queue uses as headers. A dead letter's ID
+// is its entry ID.
+
+func (b *redisStreamBus) DeadLetter(ctx context.Context, body []byte, source, reason string, cause error) error {
+	values := deadLetterValues(body, source, reason, cause, 1)
+	if err := b.client.XAdd(ctx, b.addArgs(b.deadLetterKey(), values)).Err(); err != nil {
+		return fmt.Errorf("failed to add dead letter: %w", err)
+	}
+	metrics.RedisStreamDeadLettered.WithLabelValues(reason).Inc()
+	return nil
+}
+
+func deadLetterValues(body []byte, source, reason string, cause error, deliveries int) map[string]any {
+	values := map[string]any{
+		redisFieldBody:         body,
+		redisFieldDeliveries:   deliveries,
+		headerDeadLetterReason: reason,
+		headerDeadLetterSource: source,
+		headerDeadLetterAt:     time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if cause != nil {
+		values[headerDeadLetterError] = cause.Error()
+	}
+	return values
+}
+
+func (b *redisStreamBus) ListDeadLetters(limit int) ([]*domain.DeadLetter, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisAdminTimeout)
+	defer cancel()
+
+	total, err := b.client.XLen(ctx, b.deadLetterKey()).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read dead-letter stream: %w", err)
+	}
+	entries, err := b.client.XRangeN(ctx, b.deadLetterKey(), "-", "+", int64(limit)).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read dead-letter stream: %w", err)
+	}
+
+	letters := make([]*domain.DeadLetter, 0, len(entries))
+	for _, entry := range entries {
+		letters = append(letters, deadLetterFromEntry(entry))
+	}
+	return letters, int(total), nil
+}
+
+func (b *redisStreamBus) GetDeadLetter(id string) (*domain.DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisAdminTimeout)
+	defer cancel()
+
+	entry, err := b.getDeadLetter(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return deadLetterFromEntry(entry), nil
+}
+
+func (b *redisStreamBus) getDeadLetter(ctx context.Context, id string) (redis.XMessage, error) {
+	if !isStreamID(id) {
+		return redis.XMessage{}, ErrDeadLetterNotFound
+	}
+	entries, err := b.client.XRangeN(ctx, b.deadLetterKey(), id, id, 1).Result()
+	if err != nil {
+		return redis.XMessage{}, fmt.Errorf("failed to read dead-letter stream: %w", err)
+	}
+	if len(entries) == 0 {
+		return redis.XMessage{}, ErrDeadLetterNotFound
+	}
+	return entries[0], nil
+}
+
+func (b *redisStreamBus) ReplayDeadLetter(ctx context.Context, id string, payload []byte) error {
+	entry, err := b.getDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	body := []byte(entryString(entry, redisFieldBody))
+	if payload != nil {
+		body = payload
+	}
+	return b.replay(ctx, entry.ID, body)
+}
+
+// replay adds body to the consumer stream only, so the other queues do not
+// get it a second time, and removes the dead letter in the same
+// transaction.
+func (b *redisStreamBus) replay(ctx context.Context, id string, body []byte) error {
+	stream := b.streamKey(b.config.RabbitMQQueue)
+	values := entryValues(ctx, "", body, 1)
+	_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, b.addArgs(stream, values))
+		pipe.XDel(ctx, b.deadLetterKey(), id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replay dead letter %s: %w", id, err)
+	}
+	metrics.RedisStreamDeadLettersReplayed.Inc()
+	return nil
+}
+
+func (b *redisStreamBus) ReplayDeadLetters(ctx context.Context) (int, error) {
+	// Only replay what is there now, so messages that fail again straight
+	// away are not picked up a second time.
+	last, err := b.client.XRevRangeN(ctx, b.deadLetterKey(), "+", "-", 1).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read dead-letter stream: %w", err)
+	}
+	if len(last) == 0 {
+		return 0, nil
+	}
+
+	replayed := 0
+	for start := "-"; ; {
+		entries, err := b.client.XRangeN(ctx, b.deadLetterKey(), start, last[0].ID, redisReadCount).Result()
+		if err != nil {
+			return replayed, fmt.Errorf("failed to read dead-letter stream: %w", err)
+		}
+		if len(entries) == 0 {
+			return replayed, nil
+		}
+		for _, entry := range entries {
+			if err := b.replay(ctx, entry.ID, []byte(entryString(entry, redisFieldBody))); err != nil {
+				return replayed, err
+			}
+			replayed++
+		}
+		start = "(" + entries[len(entries)-1].ID
+	}
+}
+
+func (b *redisStreamBus) DeleteDeadLetter(id string) error {
+	if !isStreamID(id) {
+		return ErrDeadLetterNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisAdminTimeout)
+	defer cancel()
+
+	deleted, err := b.client.XDel(ctx, b.deadLetterKey(), id).Result()
+	if err != nil {
+		return fmt.Errorf("failed to delete dead letter: %w", err)
+	}
+	if deleted == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+func (b *redisStreamBus) PurgeDeadLetters() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisAdminTimeout)
+	defer cancel()
+
+	var length *redis.IntCmd
+	_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		length = pipe.XLen(ctx, b.deadLetterKey())
+		pipe.Del(ctx, b.deadLetterKey())
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge dead-letter stream: %w", err)
+	}
+	return int(length.Val()), nil
+}
+
+func deadLetterFromEntry(entry redis.XMessage) *domain.DeadLetter {
+	body := []byte(entryString(entry, redisFieldBody))
+	letter := &domain.DeadLetter{
+		ID:        entry.ID,
+		MessageID: messageIDFromPayload(body),
+		Reason:    entryString(entry, headerDeadLetterReason),
+		Error:     entryString(entry, headerDeadLetterError),
+		Source:    entryString(entry, headerDeadLetterSource),
+	}
+	letter.DeliveryCount, _ = strconv.Atoi(entryString(entry, redisFieldDeliveries))
+	if failedAt, err := time.Parse(time.RFC3339Nano, entryString(entry, headerDeadLetterAt)); err == nil {
+		letter.FailedAt = failedAt
+	} else if millis, err := strconv.ParseInt(strings.SplitN(entry.ID, "-", 2)[0], 10, 64); err == nil {
+		letter.FailedAt = time.UnixMilli(millis).UTC()
+	}
+	setDeadLetterPayload(letter, body)
+	return letter
+}
+
+func entryString(entry redis.XMessage, field string) string {
+	value, _ := entry.Values[field].(string)
+	return value
+}
+
+// isStreamID reports whether id has the <milliseconds>-<sequence> form of
+// a stream entry ID, so malformed IDs are not found rather than rejected by
+// Redis.
+func isStreamID(id string) bool {
+	millis, seq, ok := strings.Cut(id, "-")
+	if !ok {
+		return false
+	}
+	_, err := strconv.ParseUint(millis, 10, 64)
+	if err != nil {
+		return false
+	}
+	_, err = strconv.ParseUint(seq, 10, 64)
+	return err == nil
+}
@@ -4,56 +4,79 @@ import (
 	"context"
 	"errors"
 	"github.com/google/uuid"
-	"log"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
 	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/logger"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
 	"smat/iot/simulation/iot-inventory-management/internal/repository"
+	"sync/atomic"
 	"time"
 )
 
 type SimulationService interface {
 	SimulateSale(ctx context.Context, deviceID string, itemsSold float64) (*domain.DeviceMessage, error)
+	ApplySettings(cfg *config.Config)
 }
 
 type simulationService struct {
-	deviceRepo repository.DeviceRepository
+	deviceRepo      repository.DeviceRepository
+	audit           AuditService
+	maxItemsPerSale atomic.Int64
 }
 
-func NewSimulationService(deviceRepo repository.DeviceRepository) SimulationService {
+func NewSimulationService(deviceRepo repository.DeviceRepository, audit AuditService) SimulationService {
 	return &simulationService{
 		deviceRepo: deviceRepo,
+		audit:      audit,
 	}
 }
 
+func (s *simulationService) ApplySettings(cfg *config.Config) {
+	s.maxItemsPerSale.Store(int64(cfg.SimulationMaxItemsPerSale))
+}
+
 func (s *simulationService) SimulateSale(ctx context.Context, deviceID string, itemsSold float64) (*domain.DeviceMessage, error) {
+	ctx = logger.With(ctx, "device_id", deviceID)
+
+	if maxItems := s.maxItemsPerSale.Load(); maxItems > 0 && itemsSold > float64(maxItems) {
+		slog.WarnContext(ctx, "SimulateSale: sale exceeds the per-sale limit", "requested", itemsSold, "limit", maxItems)
+		return nil, errors.New("items sold exceeds the maximum per sale")
+	}
+
 	deviceUUID, err := uuid.Parse(deviceID)
 	if err != nil {
-		log.Printf("SimulateSale: ERROR - Failed to parse device UUID: %v", err)
+		slog.WarnContext(ctx, "SimulateSale: failed to parse device UUID", "error", err)
 		return nil, errors.New("invalid device ID format")
 	}
 
 	device, err := s.deviceRepo.GetByDeviceID(ctx, deviceUUID)
 	if err != nil {
-		log.Printf("SimulateSale: ERROR - Failed to retrieve device from repository: %v", err)
+		slog.ErrorContext(ctx, "SimulateSale: failed to retrieve device from repository", "error", err)
 		return nil, err
 	}
 
 	if device == nil {
-		log.Printf("SimulateSale: ERROR - Device with ID %s not found", deviceUUID.String())
+		slog.WarnContext(ctx, "SimulateSale: device not found")
 		return nil, errors.New("device not found")
 	}
 
+	ctx = logger.With(ctx, "client_id", device.ClientID)
+
 	if float64(device.CurrentItemCount) < itemsSold {
-		log.Printf("SimulateSale: ERROR - Insufficient stock. Current items: %d, Requested: %.2f",
-			device.CurrentItemCount, itemsSold)
+		slog.WarnContext(ctx, "SimulateSale: insufficient stock",
+			"current_items", device.CurrentItemCount, "requested", itemsSold)
 		return nil, errors.New("insufficient stock for requested sale")
 	}
 
+	before := *device
+
 	newItemCount := device.CurrentItemCount - int(itemsSold)
 	newWeight := float64(newItemCount) * device.ItemWeight
 
 	if newWeight > device.MaxCapacity {
-		log.Printf("SimulateSale: WARNING - New weight %.2f exceeds max capacity %.2f",
-			newWeight, device.MaxCapacity)
+		slog.WarnContext(ctx, "SimulateSale: new weight exceeds max capacity",
+			"new_weight", newWeight, "max_capacity", device.MaxCapacity)
 		return nil, errors.New("weight exceeds maximum capacity")
 	}
 
@@ -62,21 +85,36 @@ func (s *simulationService) SimulateSale(ctx context.Context, deviceID string, i
 	device.TotalItemSoldCount = device.TotalItemSoldCount + int(itemsSold)
 	device.UpdatedAt = time.Now()
 
-	log.Printf("SimulateSale: Updating device %s - Items: %d -> %d, Weight: %.2f -> %.2f",
-		deviceUUID.String(),
-		device.CurrentItemCount+int(itemsSold),
-		device.CurrentItemCount,
-		device.CurrentWeight+(itemsSold*device.ItemWeight),
-		device.CurrentWeight)
+	slog.InfoContext(ctx, "SimulateSale: updating device",
+		"items_before", before.CurrentItemCount,
+		"items_after", device.CurrentItemCount,
+		"weight_before", before.CurrentWeight,
+		"weight_after", device.CurrentWeight)
 
 	err = s.deviceRepo.Update(ctx, device)
 	if err != nil {
-		log.Printf("SimulateSale: ERROR - Failed to update device in repository: %v", err)
+		slog.ErrorContext(ctx, "SimulateSale: failed to update device in repository", "error", err)
 		return nil, errors.New("failed to update device: " + err.Error())
 	}
 
+	metrics.SalesTotal.WithLabelValues(device.ClientID.String()).Inc()
+	metrics.ItemsSoldTotal.WithLabelValues(device.ClientID.String()).Add(itemsSold)
+
+	clientID := device.ClientID
+	auditEntry := &domain.AuditEntry{
+		Action:       domain.AuditActionSale,
+		ResourceType: domain.AuditResourceDevice,
+		ResourceID:   deviceUUID.String(),
+		ClientID:     &clientID,
+	}
+	if err := s.audit.Record(ctx, auditEntry, &before, device); err != nil {
+		slog.ErrorContext(ctx, "SimulateSale: failed to record audit entry", "error", err)
+	}
+
 	message := &domain.DeviceMessage{
 		DeviceID:         deviceUUID.String(),
+		ClientID:         device.ClientID.String(),
+		Event:            domain.DeviceEventSale,
 		CurrentTotalItem: float64(device.CurrentItemCount),
 		CurrentWeight:    device.CurrentWeight, // Include current weight in response
 		ItemWeight:       device.ItemWeight,
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"smat/iot/simulation/iot-inventory-management/internal/domain"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"smat/iot/simulation/iot-inventory-management/internal/repository"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrTwinDeviceNotFound  = errors.New("device not found")
+	ErrTwinVersionConflict = errors.New("desired state was changed concurrently")
+	ErrTwinNotPublished    = errors.New("desired state could not be published")
+	ErrInvalidTwinReport   = errors.New("invalid reported state")
+)
+
+// twinSaveAttempts bounds the retries of a twin update that lost a race
+// with another update of the same section.
+const twinSaveAttempts = 5
+
+type twinService struct {
+	repo       repository.TwinRepository
+	deviceRepo repository.DeviceRepository
+	audit      AuditService
+	publisher  MQTTService
+}
+
+func NewTwinService(repo repository.TwinRepository, deviceRepo repository.DeviceRepository, audit AuditService) TwinService {
+	return &twinService{repo: repo, deviceRepo: deviceRepo, audit: audit}
+}
+
+func (s *twinService) SetPublisher(publisher MQTTService) {
+	s.publisher = publisher
+}
+
+func (s *twinService) Get(ctx context.Context, deviceID uuid.UUID) (*domain.DeviceTwin, error) {
+	if _, err := s.device(ctx, deviceID); err != nil {
+		return nil, err
+	}
+	return s.load(ctx, deviceID)
+}
+
+func (s *twinService) PatchDesired(ctx context.Context, deviceID uuid.UUID, patch map[string]interface{}, version int64) (*domain.DeviceTwin, error) {
+	device, err := s.device(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < twinSaveAttempts; attempt++ {
+		current, err := s.load(ctx, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		if version > 0 && version != current.DesiredVersion {
+			return nil, ErrTwinVersionConflict
+		}
+
+		desired := domain.MergeTwinPatch(current.Desired, patch)
+		if err := domain.ValidateTwinDesired(desired); err != nil {
+			return nil, err
+		}
+		if reflect.DeepEqual(desired, current.Desired) {
+			return current, nil
+		}
+
+		twin := &domain.DeviceTwin{DeviceID: deviceID, Desired: desired}
+		saved, err := s.repo.SaveDesired(ctx, twin, current.DesiredVersion)
+		if err != nil {
+			return nil, err
+		}
+		if !saved {
+			if version > 0 {
+				return nil, ErrTwinVersionConflict
+			}
+			continue
+		}
+
+		twin.UpdateDrift()
+		metrics.TwinUpdates.WithLabelValues("desired").Inc()
+		s.recordAudit(ctx, device, current.Desired, twin.Desired)
+
+		if err := s.publishDesired(ctx, twin); err != nil {
+			return twin, fmt.Errorf("%w: %w", ErrTwinNotPublished, err)
+		}
+		return twin, nil
+	}
+	return nil, ErrTwinVersionConflict
+}
+
+func (s *twinService) HandleReported(ctx context.Context, deviceID uuid.UUID, payload []byte) error {
+	var patch map[string]interface{}
+	if err := json.Unmarshal(payload, &patch); err != nil || patch == nil {
+		return fmt.Errorf("%w: expected a JSON object", ErrInvalidTwinReport)
+	}
+	if _, err := s.device(ctx, deviceID); err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < twinSaveAttempts; attempt++ {
+		current, err := s.load(ctx, deviceID)
+		if err != nil {
+			return err
+		}
+
+		twin := &domain.DeviceTwin{DeviceID: deviceID, Reported: domain.MergeTwinPatch(current.Reported, patch)}
+		saved, err := s.repo.SaveReported(ctx, twin, current.ReportedVersion)
+		if err != nil {
+			return err
+		}
+		if !saved {
+			continue
+		}
+
+		twin.UpdateDrift()
+		metrics.TwinUpdates.WithLabelValues("reported").Inc()
+		slog.DebugContext(ctx, "Device reported its configuration", "version", twin.ReportedVersion, "drift", len(twin.Drift))
+		return nil
+	}
+	return fmt.Errorf("reported state of device %s kept changing concurrently", deviceID)
+}
+
+func (s *twinService) ListDrifted(ctx context.Context) ([]*domain.DeviceTwin, error) {
+	twins, err := s.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	drifted := make([]*domain.DeviceTwin, 0)
+	for _, twin := range twins {
+		twin.UpdateDrift()
+		if len(twin.Drift) > 0 {
+			drifted = append(drifted, twin)
+		}
+	}
+	metrics.TwinsDrifted.Set(float64(len(drifted)))
+	return drifted, nil
+}
+
+// PublishAll publishes the desired state of every twin again. Retained
+// messages are lost when the broker restarts without persistence, as the
+// embedded broker does, and a publish may have failed after a change.
+func (s *twinService) PublishAll(ctx context.Context) (int, error) {
+	twins, err := s.repo.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for _, twin := range twins {
+		if twin.DesiredVersion == 0 {
+			continue
+		}
+		if err := s.publishDesired(ctx, twin); err != nil {
+			return published, err
+		}
+		published++
+	}
+	return published, nil
+}
+
+func (s *twinService) publishDesired(ctx context.Context, twin *domain.DeviceTwin) error {
+	message := &domain.TwinDesiredMessage{
+		Version: twin.DesiredVersion,
+		Desired: twin.Desired,
+	}
+	if twin.DesiredUpdatedAt != nil {
+		message.UpdatedAt = *twin.DesiredUpdatedAt
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal desired state: %w", err)
+	}
+	return s.publisher.PublishToDevice(ctx, fmt.Sprintf("devices/%s/twin/desired", twin.DeviceID), payload, true)
+}
+
+func (s *twinService) device(ctx context.Context, deviceID uuid.UUID) (*domain.Device, error) {
+	device, err := s.deviceRepo.GetByDeviceID(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, ErrTwinDeviceNotFound
+	}
+	return device, nil
+}
+
+// load returns the device's twin, or an empty one at version 0.
+func (s *twinService) load(ctx context.Context, deviceID uuid.UUID) (*domain.DeviceTwin, error) {
+	twin, err := s.repo.Get(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if twin == nil {
+		twin = &domain.DeviceTwin{DeviceID: deviceID}
+	}
+	if twin.Desired == nil {
+		twin.Desired = map[string]interface{}{}
+	}
+	if twin.Reported == nil {
+		twin.Reported = map[string]interface{}{}
+	}
+	twin.UpdateDrift()
+	return twin, nil
+}
+
+func (s *twinService) recordAudit(ctx context.Context, device *domain.Device, before, after map[string]interface{}) {
+	clientID := device.ClientID
+	entry := &domain.AuditEntry{
+		Action:       domain.AuditActionDeviceTwinUpdate,
+		ResourceType: domain.AuditResourceDeviceTwin,
+		ResourceID:   device.ID.String(),
+		ClientID:     &clientID,
+	}
+
+	if err := s.audit.Record(ctx, entry, before, after); err != nil {
+		slog.ErrorContext(ctx, "Failed to record audit entry", "action", entry.Action, "device_id", device.ID, "client_id", device.ClientID, "error", err)
+	}
+}
@@ -1,16 +1,29 @@
 package service
 
 import (
+	"context"
 	"github.com/gorilla/websocket"
-	"log"
+	"log/slog"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+	"smat/iot/simulation/iot-inventory-management/internal/telemetry"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	defaultWebSocketMaxClients = 1000
+	defaultWebSocketSendBuffer = 256
+)
+
 type WebSocketHub struct {
 	clients    map[*WebSocketClient]bool
 	broadcast  chan []byte
 	Register   chan *WebSocketClient
 	Unregister chan *WebSocketClient
+
+	maxClients atomic.Int64
+	sendBuffer atomic.Int64
 }
 
 type WebSocketClient struct {
@@ -20,29 +33,60 @@ type WebSocketClient struct {
 }
 
 func NewWebSocketHub() *WebSocketHub {
-	return &WebSocketHub{
+	hub := &WebSocketHub{
 		clients:    make(map[*WebSocketClient]bool),
 		broadcast:  make(chan []byte),
 		Register:   make(chan *WebSocketClient),
 		Unregister: make(chan *WebSocketClient),
 	}
+	hub.maxClients.Store(defaultWebSocketMaxClients)
+	hub.sendBuffer.Store(defaultWebSocketSendBuffer)
+	return hub
+}
+
+// ApplySettings updates the client limits. Connected clients are kept even
+// if there are now more of them than the new maximum; the limit only applies
+// to new connections, and the send buffer size only to new clients.
+func (h *WebSocketHub) ApplySettings(cfg *config.Config) {
+	h.maxClients.Store(int64(cfg.WebSocketMaxClients))
+	h.sendBuffer.Store(int64(cfg.WebSocketSendBuffer))
+}
+
+// NewClient creates a client for conn with the currently configured send
+// buffer size.
+func (h *WebSocketHub) NewClient(conn *websocket.Conn) *WebSocketClient {
+	return &WebSocketClient{
+		Hub:  h,
+		Conn: conn,
+		Send: make(chan []byte, h.sendBuffer.Load()),
+	}
 }
 
 func (h *WebSocketHub) Run() {
 	for {
 		select {
 		case client := <-h.Register:
+			if int64(len(h.clients)) >= h.maxClients.Load() {
+				// Closing Send makes WritePump send a close frame.
+				close(client.Send)
+				metrics.WebSocketRejected.Inc()
+				slog.Warn("WebSocket client rejected, too many clients", "clients", len(h.clients))
+				continue
+			}
 			h.clients[client] = true
-			log.Println("WebSocket client connected")
+			metrics.WebSocketClients.Set(float64(len(h.clients)))
+			slog.Info("WebSocket client connected", "clients", len(h.clients))
 
 		case client := <-h.Unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.Send)
-				log.Println("WebSocket client disconnected")
+				metrics.WebSocketClients.Set(float64(len(h.clients)))
+				slog.Info("WebSocket client disconnected", "clients", len(h.clients))
 			}
 
 		case message := <-h.broadcast:
+			metrics.WebSocketBroadcasts.Inc()
 			for client := range h.clients {
 				select {
 				case client.Send <- message: // Queue message for sending
@@ -51,13 +95,19 @@ func (h *WebSocketHub) Run() {
 					// Client's send channel is full, close it
 					close(client.Send)
 					delete(h.clients, client)
+					metrics.WebSocketDroppedSends.Inc()
+					slog.Warn("WebSocket client send buffer full, disconnecting client")
+					metrics.WebSocketClients.Set(float64(len(h.clients)))
 				}
 			}
 		}
 	}
 }
 
-func (h *WebSocketHub) Broadcast(message []byte) {
+func (h *WebSocketHub) Broadcast(ctx context.Context, message []byte) {
+	_, span := telemetry.Tracer().Start(ctx, "websocket.broadcast")
+	defer span.End()
+
 	h.broadcast <- message
 }
 
@@ -73,7 +123,7 @@ func (c *WebSocketClient) ReadPump() {
 		_, _, err := c.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+				slog.Warn("WebSocket error", "error", err)
 			}
 			break
 		}
@@ -94,7 +144,7 @@ func (c *WebSocketClient) WritePump() {
 			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 
 			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				log.Printf("Error writing to WebSocket: %v", err)
+				slog.Warn("Error writing to WebSocket", "error", err)
 				return
 			}
 		}
@@ -0,0 +1,172 @@
+package settings
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+)
+
+// Subscriber is notified with the effective configuration when it first
+// subscribes and again after every reload that changes a reloadable setting.
+type Subscriber interface {
+	ApplySettings(cfg *config.Config)
+}
+
+// SubscriberFunc adapts a plain function to a Subscriber.
+type SubscriberFunc func(cfg *config.Config)
+
+func (f SubscriberFunc) ApplySettings(cfg *config.Config) {
+	f(cfg)
+}
+
+// Store holds the effective runtime configuration and reloads it on SIGHUP or
+// when the config file changes.
+type Store struct {
+	load func() (*config.Config, error)
+
+	mu          sync.RWMutex
+	current     *config.Config
+	loadedAt    time.Time
+	subscribers []Subscriber
+
+	// reloadMu serializes reloads so subscribers see changes in order.
+	reloadMu sync.Mutex
+}
+
+// NewStore creates a store seeded with cfg. load re-reads the configuration
+// from all of its sources and is normally config.Load.
+func NewStore(cfg *config.Config, load func() (*config.Config, error)) *Store {
+	return &Store{
+		load:     load,
+		current:  cfg,
+		loadedAt: time.Now(),
+	}
+}
+
+func (s *Store) Current() *config.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// LoadedAt returns when the effective configuration was last loaded.
+func (s *Store) LoadedAt() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.loadedAt
+}
+
+// Subscribe registers sub and immediately applies the current configuration
+// to it.
+func (s *Store) Subscribe(sub Subscriber) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.mu.Lock()
+	s.subscribers = append(s.subscribers, sub)
+	current := s.current
+	s.mu.Unlock()
+
+	sub.ApplySettings(current)
+}
+
+// Reload re-reads the configuration and applies any changed reloadable
+// settings. An invalid configuration is rejected as a whole and the running
+// settings are left untouched. Changes to settings that need a restart are
+// logged and ignored.
+func (s *Store) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	next, err := s.load()
+	if err != nil {
+		return fmt.Errorf("failed to reload configuration: %w", err)
+	}
+
+	s.mu.RLock()
+	current := s.current
+	s.mu.RUnlock()
+
+	changed, static := current.ChangedKeys(next)
+	if len(static) > 0 {
+		slog.Warn("Configuration changes require a restart and were not applied", "settings", static)
+	}
+
+	merged := current.WithReloadable(next)
+
+	s.mu.Lock()
+	s.current = merged
+	s.loadedAt = time.Now()
+	subscribers := append([]Subscriber(nil), s.subscribers...)
+	s.mu.Unlock()
+
+	if len(changed) == 0 {
+		slog.Info("Configuration reloaded, no runtime settings changed")
+		return nil
+	}
+
+	for _, sub := range subscribers {
+		sub.ApplySettings(merged)
+	}
+
+	slog.Info("Configuration reloaded", "changed", changed)
+	return nil
+}
+
+// Watch reloads the configuration on SIGHUP and, when a config file is in
+// use, whenever its modification time changes. It returns when ctx is done.
+func (s *Store) Watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	cfg := s.Current()
+
+	var poll <-chan time.Time
+	var lastModified time.Time
+	if cfg.ConfigFile != "" && cfg.ConfigWatchInterval > 0 {
+		lastModified = modTime(cfg.ConfigFile)
+		ticker := time.NewTicker(cfg.ConfigWatchInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading configuration")
+			s.reloadAndLog()
+		case <-poll:
+			modified := modTime(cfg.ConfigFile)
+			if modified.IsZero() || modified.Equal(lastModified) {
+				continue
+			}
+			lastModified = modified
+			slog.Info("Config file changed, reloading configuration", "path", cfg.ConfigFile)
+			s.reloadAndLog()
+		}
+	}
+}
+
+func (s *Store) reloadAndLog() {
+	if err := s.Reload(); err != nil {
+		slog.Error("Keeping previous configuration", "error", err)
+	}
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
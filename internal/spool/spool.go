@@ -0,0 +1,524 @@
+// Package spool is an on-disk, append-only queue of opaque records. Records
+// are written to numbered segment files in a directory and read back in the
+// order they were appended; a segment is deleted once every record in it has
+// been read. The read position survives restarts, so records are replayed at
+// least once.
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"smat/iot/simulation/iot-inventory-management/internal/metrics"
+)
+
+var (
+	ErrFull     = errors.New("spool is full")
+	ErrClosed   = errors.New("spool is closed")
+	ErrTooLarge = errors.New("record is too large for the spool")
+)
+
+// Fsync policies: sync after every append, on an interval, or leave it to
+// the operating system.
+const (
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+)
+
+const (
+	// Each record is stored as a 4-byte length, a 4-byte CRC-32 of the
+	// data, and the data.
+	headerSize = 8
+	// maxRecordSize bounds a single record, so a corrupt length field is
+	// caught before it is used to allocate.
+	maxRecordSize = 64 << 20
+
+	segmentSuffix = ".seg"
+	cursorFile    = "cursor"
+
+	// cursorEvery is how many replayed records may go by between cursor
+	// writes; a crash replays at most this many records twice.
+	cursorEvery = 256
+)
+
+type Options struct {
+	Dir           string
+	SegmentBytes  int64
+	MaxBytes      int64
+	Fsync         string
+	FsyncInterval time.Duration
+}
+
+type Spool struct {
+	opts Options
+
+	mu       sync.Mutex
+	closed   bool
+	segments []uint64 // oldest first; the last one is written to
+	// lastSegment is the highest segment ID used. IDs are never reused, so
+	// a saved cursor cannot point into a newer segment with the same ID.
+	lastSegment uint64
+	active      *os.File
+	// sizes holds the bytes of complete records in each segment.
+	sizes   map[uint64]int64
+	total   int64
+	pending int
+	dirty   bool
+
+	// Read position: the segment being read and the offset of the next
+	// record in it.
+	readSegment uint64
+	readOffset  int64
+	reader      *os.File
+	unsaved     int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens the spool in opts.Dir, creating it if needed, and recovers any
+// records left by a previous run. A record torn by a crash at the end of the
+// last segment is discarded.
+func Open(opts Options) (*Spool, error) {
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	s := &Spool{
+		opts:  opts,
+		sizes: make(map[uint64]int64),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	s.updateMetrics()
+
+	if opts.Fsync == FsyncInterval {
+		go s.syncLoop()
+	} else {
+		close(s.done)
+	}
+	return s, nil
+}
+
+func (s *Spool) recover() error {
+	entries, err := os.ReadDir(s.opts.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read spool directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, id)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	s.readSegment, s.readOffset = s.loadCursor()
+	s.lastSegment = s.readSegment
+	if len(s.segments) > 0 {
+		s.lastSegment = max(s.lastSegment, s.segments[len(s.segments)-1])
+	}
+
+	// Segments before the cursor have been replayed completely.
+	for len(s.segments) > 0 && s.segments[0] < s.readSegment {
+		_ = os.Remove(s.segmentPath(s.segments[0]))
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) == 0 || s.segments[0] != s.readSegment {
+		s.readOffset = 0
+	}
+
+	for i, id := range s.segments {
+		start := int64(0)
+		if id == s.readSegment {
+			start = s.readOffset
+		}
+		size, records, err := scanSegment(s.segmentPath(id), start)
+		if err != nil {
+			return err
+		}
+		if i == len(s.segments)-1 {
+			// Drop a torn record at the end so appends continue after
+			// the last complete one.
+			if err := os.Truncate(s.segmentPath(id), size); err != nil {
+				return fmt.Errorf("failed to truncate spool segment: %w", err)
+			}
+		}
+		s.sizes[id] = size
+		s.total += size
+		s.pending += records
+	}
+
+	if len(s.segments) > 0 {
+		s.readSegment = s.segments[0]
+		last := s.segments[len(s.segments)-1]
+		active, err := os.OpenFile(s.segmentPath(last), os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open spool segment: %w", err)
+		}
+		s.active = active
+	}
+	return nil
+}
+
+// scanSegment validates the records of a segment from offset start and
+// returns the size up to the end of the last valid record and the number of
+// records after start.
+func scanSegment(path string, start int64) (int64, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	defer f.Close()
+
+	offset, records := int64(0), 0
+	for {
+		_, next, err := readRecord(f, offset)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Warn("Discarding corrupt spool records", "segment", path, "offset", offset, "error", err)
+			}
+			return offset, records, nil
+		}
+		if offset >= start {
+			records++
+		}
+		offset = next
+	}
+}
+
+// readRecord reads the record at offset and returns it with the offset of
+// the next one. It returns io.EOF at the end of the data, including a record
+// cut short by a crash.
+func readRecord(f *os.File, offset int64) ([]byte, int64, error) {
+	var header [headerSize]byte
+	if _, err := f.ReadAt(header[:], offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > maxRecordSize {
+		return nil, 0, fmt.Errorf("invalid record length %d", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, offset+headerSize); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != checksum {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+	return data, offset + headerSize + int64(length), nil
+}
+
+// Append writes record to the end of the spool. It returns ErrFull when the
+// record would take the spool over its size limit.
+func (s *Spool) Append(record []byte) error {
+	if len(record) > maxRecordSize {
+		return ErrTooLarge
+	}
+	size := int64(headerSize + len(record))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if s.total+size > s.opts.MaxBytes {
+		metrics.SpoolDropped.Inc()
+		return ErrFull
+	}
+
+	if s.active == nil || (s.sizes[s.activeSegment()] > 0 && s.sizes[s.activeSegment()]+size > s.opts.SegmentBytes) {
+		if err := s.rollLocked(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(record))
+	copy(buf[headerSize:], record)
+
+	id := s.activeSegment()
+	if _, err := s.active.Write(buf); err != nil {
+		// Cut off a partial write so the next record starts cleanly.
+		_ = s.active.Truncate(s.sizes[id])
+		return fmt.Errorf("failed to write to spool: %w", err)
+	}
+	if s.opts.Fsync == FsyncAlways {
+		if err := s.active.Sync(); err != nil {
+			return fmt.Errorf("failed to sync spool: %w", err)
+		}
+	} else {
+		s.dirty = true
+	}
+
+	s.sizes[id] += size
+	s.total += size
+	s.pending++
+	metrics.SpoolAppended.Inc()
+	s.updateMetrics()
+	return nil
+}
+
+func (s *Spool) activeSegment() uint64 {
+	return s.segments[len(s.segments)-1]
+}
+
+// rollLocked starts a new segment.
+func (s *Spool) rollLocked() error {
+	id := s.lastSegment + 1
+
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %w", err)
+	}
+	if s.active != nil {
+		if s.opts.Fsync != FsyncNever {
+			_ = s.active.Sync()
+		}
+		_ = s.active.Close()
+	}
+
+	if len(s.segments) == 0 {
+		s.readSegment, s.readOffset = id, 0
+	}
+	s.lastSegment = id
+	s.active = f
+	s.segments = append(s.segments, id)
+	s.sizes[id] = 0
+	return nil
+}
+
+// Replay passes every record to fn in the order they were appended,
+// removing each one fn accepts. It stops at the first error from fn, leaving
+// that record to be replayed next time, and returns the number of records
+// replayed. Records appended while Replay runs are replayed too.
+func (s *Spool) Replay(fn func(record []byte) error) (int, error) {
+	replayed := 0
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return replayed, ErrClosed
+		}
+		record, next, err := s.nextLocked()
+		s.mu.Unlock()
+		if err != nil || record == nil {
+			s.mu.Lock()
+			s.saveCursorLocked()
+			s.mu.Unlock()
+			return replayed, err
+		}
+
+		if err := fn(record); err != nil {
+			s.mu.Lock()
+			s.saveCursorLocked()
+			s.mu.Unlock()
+			return replayed, err
+		}
+
+		s.mu.Lock()
+		s.readOffset = next
+		s.pending--
+		s.unsaved++
+		if s.unsaved >= cursorEvery {
+			s.saveCursorLocked()
+		}
+		s.updateMetrics()
+		s.mu.Unlock()
+
+		replayed++
+		metrics.SpoolReplayed.Inc()
+	}
+}
+
+// nextLocked returns the next unread record and the offset after it, or nil
+// when everything has been read. Segments that have been read completely
+// are deleted, except the one being written to, which is reset instead.
+func (s *Spool) nextLocked() ([]byte, int64, error) {
+	for len(s.segments) > 0 {
+		id := s.segments[0]
+		if s.readSegment != id {
+			s.readSegment, s.readOffset = id, 0
+		}
+
+		if s.readOffset < s.sizes[id] {
+			if s.reader == nil {
+				f, err := os.Open(s.segmentPath(id))
+				if err != nil {
+					return nil, 0, fmt.Errorf("failed to open spool segment: %w", err)
+				}
+				s.reader = f
+			}
+			record, next, err := readRecord(s.reader, s.readOffset)
+			if err == nil {
+				return record, next, nil
+			}
+			// Records past a corrupt one in this segment cannot be
+			// framed; skip to the next segment.
+			slog.Warn("Skipping corrupt spool records", "segment", id, "offset", s.readOffset, "error", err)
+			s.readOffset = s.sizes[id]
+		}
+
+		s.closeReaderLocked()
+		if len(s.segments) == 1 {
+			// Everything has been read: start the next append in a
+			// fresh segment.
+			s.pending = 0
+			if s.active != nil {
+				_ = s.active.Close()
+				s.active = nil
+			}
+		}
+		_ = os.Remove(s.segmentPath(id))
+		s.total -= s.sizes[id]
+		delete(s.sizes, id)
+		s.segments = s.segments[1:]
+		s.readOffset = 0
+		s.unsaved++
+		s.updateMetrics()
+	}
+	return nil, 0, nil
+}
+
+func (s *Spool) closeReaderLocked() {
+	if s.reader != nil {
+		_ = s.reader.Close()
+		s.reader = nil
+	}
+}
+
+// Pending returns the number of records not yet replayed.
+func (s *Spool) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// Size returns the bytes on disk taken by records not yet deleted.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
+
+// Close syncs and closes the spool. Unreplayed records stay on disk for the
+// next Open.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	s.mu.Unlock()
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.saveCursorLocked()
+	s.closeReaderLocked()
+	if s.active != nil {
+		if s.opts.Fsync != FsyncNever {
+			_ = s.active.Sync()
+		}
+		return s.active.Close()
+	}
+	return nil
+}
+
+func (s *Spool) syncLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.opts.FsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.dirty && s.active != nil {
+				if err := s.active.Sync(); err != nil {
+					slog.Error("Failed to sync spool", "error", err)
+				}
+				s.dirty = false
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.opts.Dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// loadCursor returns the saved read position, or the start of the spool.
+func (s *Spool) loadCursor() (uint64, int64) {
+	data, err := os.ReadFile(filepath.Join(s.opts.Dir, cursorFile))
+	if err != nil {
+		return 0, 0
+	}
+	var segment uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &segment, &offset); err != nil {
+		return 0, 0
+	}
+	return segment, offset
+}
+
+// saveCursorLocked records the read position. It is written to a temporary
+// file and renamed so a crash never leaves a half-written cursor.
+func (s *Spool) saveCursorLocked() {
+	if s.unsaved == 0 {
+		return
+	}
+	path := filepath.Join(s.opts.Dir, cursorFile)
+	data := fmt.Sprintf("%d %d\n", s.readSegment, s.readOffset)
+	if err := os.WriteFile(path+".tmp", []byte(data), 0o644); err != nil {
+		slog.Error("Failed to save spool cursor", "error", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		slog.Error("Failed to save spool cursor", "error", err)
+		return
+	}
+	s.unsaved = 0
+}
+
+func (s *Spool) updateMetrics() {
+	metrics.SpoolPending.Set(float64(s.pending))
+	metrics.SpoolBytes.Set(float64(s.total))
+}
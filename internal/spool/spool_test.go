@@ -0,0 +1,205 @@
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// recordSize is the size on disk of the records appendRecords writes.
+const recordSize = headerSize + len("record-00")
+
+func openSpool(t *testing.T, opts Options) *Spool {
+	t.Helper()
+
+	s, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func testOptions(dir string) Options {
+	return Options{
+		Dir:          dir,
+		SegmentBytes: 1 << 20,
+		MaxBytes:     1 << 20,
+		Fsync:        FsyncAlways,
+	}
+}
+
+// appendRecords appends record-<from> up to record-<to - 1>.
+func appendRecords(t *testing.T, s *Spool, from, to int) {
+	t.Helper()
+
+	for i := from; i < to; i++ {
+		if err := s.Append([]byte(fmt.Sprintf("record-%02d", i))); err != nil {
+			t.Fatalf("Append(record-%02d) error = %v", i, err)
+		}
+	}
+}
+
+// replayAll replays every record and returns them as strings.
+func replayAll(t *testing.T, s *Spool) []string {
+	t.Helper()
+
+	var records []string
+	if _, err := s.Replay(func(record []byte) error {
+		records = append(records, string(record))
+		return nil
+	}); err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	return records
+}
+
+func expectRecords(t *testing.T, got []string, from, to int) {
+	t.Helper()
+
+	if len(got) != to-from {
+		t.Fatalf("replayed %d records %v, want record-%02d to record-%02d", len(got), got, from, to-1)
+	}
+	for i, record := range got {
+		if want := fmt.Sprintf("record-%02d", from+i); record != want {
+			t.Fatalf("record %d = %q, want %q", i, record, want)
+		}
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatalf("failed to list segments: %v", err)
+	}
+	return files
+}
+
+func TestSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions(dir)
+	opts.SegmentBytes = 2 * int64(recordSize)
+	s := openSpool(t, opts)
+
+	appendRecords(t, s, 0, 10)
+	if got := len(segmentFiles(t, dir)); got != 5 {
+		t.Fatalf("%d segments after 10 records, want 5 of 2 records each", got)
+	}
+	if got := s.Size(); got != 10*int64(recordSize) {
+		t.Errorf("Size() = %d, want %d", got, 10*recordSize)
+	}
+
+	expectRecords(t, replayAll(t, s), 0, 10)
+	if got := segmentFiles(t, dir); len(got) != 0 {
+		t.Errorf("segments left after replaying everything: %v", got)
+	}
+	if s.Pending() != 0 || s.Size() != 0 {
+		t.Errorf("Pending() = %d, Size() = %d after replay, want 0", s.Pending(), s.Size())
+	}
+
+	// Appending after a full replay starts a new segment.
+	appendRecords(t, s, 10, 11)
+	expectRecords(t, replayAll(t, s), 10, 11)
+}
+
+func TestCursorPersistsAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions(dir)
+	opts.SegmentBytes = 3 * int64(recordSize)
+	s, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	appendRecords(t, s, 0, 8)
+
+	// Accept four records, then fail: the fifth is replayed after the
+	// restart.
+	stop := errors.New("stop")
+	replayed, err := s.Replay(func(record []byte) error {
+		if string(record) == "record-04" {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || replayed != 4 {
+		t.Fatalf("Replay() = %d, %v, want 4, %v", replayed, err, stop)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	s = openSpool(t, opts)
+	if got := s.Pending(); got != 4 {
+		t.Fatalf("Pending() after restart = %d, want 4", got)
+	}
+	expectRecords(t, replayAll(t, s), 4, 8)
+}
+
+func TestReplayAfterPartialWrite(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(testOptions(dir))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	appendRecords(t, s, 0, 3)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// A crash in the middle of an append leaves a header announcing more
+	// data than was written.
+	segments := segmentFiles(t, dir)
+	if len(segments) != 1 {
+		t.Fatalf("%d segments, want 1", len(segments))
+	}
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	torn := make([]byte, headerSize+4)
+	binary.BigEndian.PutUint32(torn[0:4], 100)
+	copy(torn[headerSize:], "torn")
+	if _, err := f.Write(torn); err != nil {
+		t.Fatalf("failed to write torn record: %v", err)
+	}
+	f.Close()
+
+	s = openSpool(t, testOptions(dir))
+	if got := s.Pending(); got != 3 {
+		t.Fatalf("Pending() after recovery = %d, want 3", got)
+	}
+	if got := s.Size(); got != 3*int64(recordSize) {
+		t.Errorf("Size() after recovery = %d, want %d without the torn record", got, 3*recordSize)
+	}
+
+	// The torn record is cut off, so new records follow the last complete
+	// one.
+	appendRecords(t, s, 3, 5)
+	expectRecords(t, replayAll(t, s), 0, 5)
+}
+
+func TestSizeLimit(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions(dir)
+	opts.SegmentBytes = 2 * int64(recordSize)
+	opts.MaxBytes = 4 * int64(recordSize)
+	s := openSpool(t, opts)
+
+	appendRecords(t, s, 0, 4)
+	if err := s.Append([]byte("record-04")); !errors.Is(err, ErrFull) {
+		t.Fatalf("Append() over the limit error = %v, want %v", err, ErrFull)
+	}
+	if got := s.Pending(); got != 4 {
+		t.Errorf("Pending() = %d, want 4: a full spool keeps its records and drops the new one", got)
+	}
+
+	// Replaying frees the space of the segments read.
+	expectRecords(t, replayAll(t, s), 0, 4)
+	appendRecords(t, s, 4, 8)
+	expectRecords(t, replayAll(t, s), 4, 8)
+}
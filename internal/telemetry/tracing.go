@@ -0,0 +1,117 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"smat/iot/simulation/iot-inventory-management/internal/config"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "smat/iot/simulation/iot-inventory-management"
+
+// InitTracing installs the global tracer provider and W3C propagator. The
+// exporters are selected by cfg.TracingExporters, a comma-separated list of
+// "otlp", "stdout" or "none". The returned function flushes and stops the
+// provider.
+func InitTracing(ctx context.Context, cfg *config.Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var opts []sdktrace.TracerProviderOption
+	for _, name := range strings.Split(cfg.TracingExporters, ",") {
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "", "none":
+		case "otlp":
+			clientOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.TracingOTLPEndpoint)}
+			if cfg.TracingOTLPInsecure {
+				clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+			}
+			exporter, err := otlptracehttp.New(ctx, clientOpts...)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+			}
+			opts = append(opts, sdktrace.WithBatcher(exporter))
+			slog.Info("Exporting traces via OTLP", "endpoint", cfg.TracingOTLPEndpoint)
+		case "stdout":
+			exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+			if err != nil {
+				return nil, fmt.Errorf("failed to create stdout exporter: %w", err)
+			}
+			opts = append(opts, sdktrace.WithSyncer(exporter))
+			slog.Info("Exporting traces to stdout")
+		default:
+			return nil, fmt.Errorf("unknown trace exporter %q", name)
+		}
+	}
+
+	if len(opts) == 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.TracingServiceName),
+	))
+	if err != nil && !errors.Is(err, resource.ErrSchemaURLConflict) {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	opts = append(opts,
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TracingSampleRatio))),
+	)
+
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the application tracer. It is a no-op until InitTracing has
+// installed a provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Inject writes the span context of ctx into a string map suitable for
+// message headers or payload fields.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns ctx enriched with the span context found in carrier.
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// RecordError marks span as failed with err.
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Reading history written in batches by the ingestion worker. There is no
+-- foreign key to devices so a reading from an unknown device cannot fail the
+-- whole batch.
+CREATE TABLE IF NOT EXISTS device_readings (
+    id BIGSERIAL PRIMARY KEY,
+    device_id UUID NOT NULL,
+    message_id VARCHAR(64),
+    current_weight DECIMAL(10, 2) NOT NULL,
+    current_item_count INT NOT NULL,
+    item_weight DECIMAL NOT NULL DEFAULT 0.0,
+    reading_at TIMESTAMPTZ NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Redelivered messages are ignored on insert.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_device_readings_message_id ON device_readings(message_id);
+CREATE INDEX IF NOT EXISTS idx_device_readings_device_reading_at ON device_readings(device_id, reading_at DESC);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS device_readings;
+-- +goose StatementEnd
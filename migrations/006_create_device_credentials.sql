@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Secrets devices authenticate to the embedded MQTT broker with. Only the
+-- SHA-256 of the secret is stored; the secret itself is shown once when it
+-- is issued.
+CREATE TABLE IF NOT EXISTS device_credentials (
+    device_id UUID PRIMARY KEY REFERENCES devices(id) ON DELETE CASCADE,
+    secret_hash BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMPTZ
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS device_credentials;
+-- +goose StatementEnd
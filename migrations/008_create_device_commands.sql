@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Commands sent to devices over MQTT and their outcome. The ID is the
+-- correlation ID devices echo in their acknowledgements.
+CREATE TABLE IF NOT EXISTS device_commands (
+    id UUID PRIMARY KEY,
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    client_id UUID NOT NULL,
+    command VARCHAR(50) NOT NULL,
+    params JSONB,
+    status VARCHAR(20) NOT NULL,
+    error TEXT,
+    result JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL,
+    delivered_at TIMESTAMPTZ,
+    completed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_commands_device_created ON device_commands (device_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_device_commands_open ON device_commands (expires_at) WHERE status IN ('pending', 'delivered');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS device_commands;
+-- +goose StatementEnd
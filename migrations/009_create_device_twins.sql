@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Desired and reported configuration per device. Each section carries a
+-- version that is incremented on every change and used for optimistic
+-- concurrency.
+CREATE TABLE IF NOT EXISTS device_twins (
+    device_id UUID PRIMARY KEY REFERENCES devices(id) ON DELETE CASCADE,
+    desired JSONB NOT NULL DEFAULT '{}',
+    desired_version BIGINT NOT NULL DEFAULT 0,
+    desired_updated_at TIMESTAMPTZ,
+    reported JSONB NOT NULL DEFAULT '{}',
+    reported_version BIGINT NOT NULL DEFAULT 0,
+    reported_updated_at TIMESTAMPTZ
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS device_twins;
+-- +goose StatementEnd
@@ -0,0 +1,40 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Devices pre-registered for a client by serial number. A device that
+-- presents the claim token in its birth message is created for the client;
+-- only the SHA-256 of the token is stored. claimed_at marks the claim as
+-- used, and stays set if the device is deleted.
+CREATE TABLE IF NOT EXISTS device_claims (
+    serial_number VARCHAR(64) PRIMARY KEY,
+    client_id UUID NOT NULL,
+    token_hash BYTEA NOT NULL,
+    device_id UUID REFERENCES devices(id) ON DELETE SET NULL,
+    claimed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_claims_client_id ON device_claims (client_id);
+
+-- Devices that announced themselves without a claim, waiting for approval.
+-- The token and client of the first birth message are kept; later birth
+-- messages with another token are only counted as conflicts.
+CREATE TABLE IF NOT EXISTS pending_devices (
+    serial_number VARCHAR(64) PRIMARY KEY,
+    client_id UUID,
+    token_hash BYTEA NOT NULL,
+    credential_hash BYTEA NOT NULL,
+    firmware_version VARCHAR(64),
+    model VARCHAR(64),
+    birth_count INTEGER NOT NULL DEFAULT 1,
+    conflict_count INTEGER NOT NULL DEFAULT 0,
+    first_seen_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_conflict_at TIMESTAMPTZ
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS pending_devices;
+DROP TABLE IF EXISTS device_claims;
+-- +goose StatementEnd
@@ -0,0 +1,111 @@
+#!/bin/bash
+
+# Runs two server instances in one MQTT shared subscription group and checks
+# that every device message is received by exactly one of them.
+#
+# Needs Docker (for PostgreSQL, Redis and, when mosquitto_pub is not
+# installed, the MQTT client) and Go. The first instance runs the embedded
+# MQTT broker on localhost:1883; ports 8081 and 8082 must be free.
+
+set -u
+
+MESSAGES=${MESSAGES:-200}
+DEVICES=${DEVICES:-10}
+GROUP=iot-backend
+BINARY=$(mktemp -d)/server
+
+echo "Testing MQTT shared subscriptions"
+echo "---------------------------------"
+
+echo "Starting PostgreSQL and Redis..."
+docker compose -f docker-local.compose.yml up -d --wait postgres redis || exit 1
+
+echo "Building the server..."
+go build -o "$BINARY" ./cmd/server || exit 1
+
+export DB_PASSWORD=postgres
+export DB_NAME=iot_inventory_local_new_1
+export MESSAGE_BUS=memory
+export MQTT_BROKER=tcp://localhost:1883
+export MQTT_SHARED_GROUP=$GROUP
+export MQTT_UNIQUE_CLIENT_ID=true
+export LOG_LEVEL=warn
+
+PIDS=()
+cleanup() {
+  kill "${PIDS[@]}" 2>/dev/null
+  wait "${PIDS[@]}" 2>/dev/null
+}
+trap cleanup EXIT
+
+wait_ready() {
+  for _ in $(seq 1 30); do
+    if curl -sf "http://localhost:$1/health/live" >/dev/null; then
+      return 0
+    fi
+    sleep 1
+  done
+  echo "❌ Instance on port $1 did not start"
+  exit 1
+}
+
+# The instance with the embedded broker starts first, so the other one has
+# a broker to connect to.
+echo "Starting instance 1 (with the embedded broker) on port 8081..."
+SERVER_PORT=8081 MQTT_BROKER_EMBEDDED=true MQTT_BROKER_ALLOW_ANONYMOUS=true "$BINARY" &
+PIDS+=($!)
+wait_ready 8081
+
+echo "Starting instance 2 on port 8082..."
+SERVER_PORT=8082 "$BINARY" &
+PIDS+=($!)
+wait_ready 8082
+
+received() {
+  curl -s "http://localhost:$1/metrics" | awk '/^iot_inventory_mqtt_messages_received_total/ { print $2 }'
+}
+
+before1=$(received 8081)
+before2=$(received 8082)
+
+echo "Publishing $MESSAGES device messages from $DEVICES devices..."
+per_device=$((MESSAGES / DEVICES))
+MESSAGES=$((per_device * DEVICES))
+for _ in $(seq 1 "$DEVICES"); do
+  device_id=$(cat /proc/sys/kernel/random/uuid)
+  lines=$(for i in $(seq 1 "$per_device"); do
+    echo "{\"device_id\":\"$device_id\",\"event\":\"telemetry\",\"current_total_item\":$i,\"current_weight\":$i,\"item_weight\":1}"
+  done)
+  if command -v mosquitto_pub >/dev/null; then
+    echo "$lines" | mosquitto_pub -h localhost -p 1883 -q 1 -t "devices/$device_id/weight" -l
+  else
+    echo "$lines" | docker run --rm -i --network host eclipse-mosquitto:2 \
+      mosquitto_pub -h localhost -p 1883 -q 1 -t "devices/$device_id/weight" -l
+  fi
+done
+
+sleep 2
+
+count1=$(awk "BEGIN { print $(received 8081) - $before1 }")
+count2=$(awk "BEGIN { print $(received 8082) - $before2 }")
+total=$((count1 + count2))
+
+echo "Instance 1 received $count1, instance 2 received $count2, $total of $MESSAGES in total"
+
+status=0
+if [ "$total" -eq "$MESSAGES" ]; then
+  echo "✅ Every message was received exactly once"
+else
+  echo "❌ Expected $MESSAGES messages in total, got $total"
+  status=1
+fi
+
+if [ "$count1" -gt 0 ] && [ "$count2" -gt 0 ]; then
+  echo "✅ Both instances received messages"
+else
+  echo "❌ One instance received no messages"
+  status=1
+fi
+
+echo "Test completed."
+exit $status